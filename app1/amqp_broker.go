@@ -0,0 +1,54 @@
+package app
+
+import (
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-amqp/v3/pkg/amqp"
+	"github.com/ThreeDotsLabs/watermill/message"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpQueueExpiration is how long queues without consumers are kept, like offsets of Kafka consumer groups.
+// Without it, queues of per-request consumer groups (e.g. synchronous bookings) would never be removed.
+const amqpQueueExpiration = 7 * 24 * time.Hour
+
+// amqpBroker uses RabbitMQ.
+//
+// Every topic is a durable fanout exchange with the same name (the event or command name).
+// Every consumer group gets its own durable queue bound to the exchange, named <topic>_<consumer group>,
+// so each group receives a copy of every message and members of the same group share the queue.
+//
+// Queues only receive messages published after they are declared, so offsetReset is ignored.
+type amqpBroker struct {
+	url       string
+	publisher *amqp.Publisher
+	logger    watermill.LoggerAdapter
+}
+
+func newAMQPBroker(url string, logger watermill.LoggerAdapter) (*amqpBroker, error) {
+	config := amqp.NewDurablePubSubConfig(url, nil)
+	config.Publish.ConfirmDelivery = true
+
+	publisher, err := amqp.NewPublisher(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &amqpBroker{
+		url:       url,
+		publisher: publisher,
+		logger:    logger,
+	}, nil
+}
+
+func (b *amqpBroker) Publisher() message.Publisher {
+	return b.publisher
+}
+
+func (b *amqpBroker) NewSubscriber(consumerGroup string, offsetReset OffsetReset) (message.Subscriber, error) {
+	config := amqp.NewDurablePubSubConfig(b.url, amqp.GenerateQueueNameTopicNameWithSuffix(consumerGroup))
+	config.Queue.Arguments = amqp091.Table{"x-expires": amqpQueueExpiration.Milliseconds()}
+
+	return amqp.NewSubscriber(config, b.logger)
+}
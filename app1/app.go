@@ -0,0 +1,29 @@
+package app
+
+import (
+	"context"
+	"net/http"
+)
+
+// App is the service wired by NewApp. Run runs its components and Close releases resources they used.
+type App struct {
+	lifecycle   Lifecycle
+	container   *Container
+	httpHandler http.Handler
+}
+
+// Run starts the app's components and runs them until ctx is cancelled or any of them stops.
+// Components are stopped before Run returns.
+func (a *App) Run(ctx context.Context) error {
+	return a.lifecycle.Run(ctx)
+}
+
+// HTTPHandler returns the handler of the app's HTTP API, e.g. to call it in tests without the HTTP server.
+func (a *App) HTTPHandler() http.Handler {
+	return a.httpHandler
+}
+
+// Close releases resources opened by the app's container, it must be called after Run returns.
+func (a *App) Close() error {
+	return a.container.Close()
+}
@@ -0,0 +1,119 @@
+package apptest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roblaszczak/watermill-livecoding/apptest"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/clock"
+)
+
+// bookRoom returns the command booking a stay a week after now, so it's always in the future of the test's clock.
+func bookRoom(now time.Time) contracts.BookRoom {
+	return contracts.BookRoom{
+		BookingID:   uuid.NewString(),
+		RoomID:      uuid.NewString(),
+		GuestsCount: 2,
+		CheckIn:     now.AddDate(0, 0, 7).Format(time.DateOnly),
+		CheckOut:    now.AddDate(0, 0, 9).Format(time.DateOnly),
+		Currency:    "USD",
+	}
+}
+
+func TestBookRoom_payment_taken(t *testing.T) {
+	h := apptest.New(t, nil)
+
+	cmd := bookRoom(time.Now())
+	roomBooked := apptest.Listen(h, func(e *contracts.RoomBooked) bool {
+		return e.BookingID == cmd.BookingID
+	})
+
+	paymentTaken := apptest.SendAndWaitFor(h, cmd, func(e *contracts.PaymentTaken) bool {
+		return e.BookingID == cmd.BookingID
+	})
+
+	booked := roomBooked.Wait()
+	if booked.RoomID != cmd.RoomID {
+		t.Errorf("RoomBooked.RoomID = %s, want %s", booked.RoomID, cmd.RoomID)
+	}
+	if paymentTaken.Price != booked.Price {
+		t.Errorf("PaymentTaken.Price = %v, want %v", paymentTaken.Price, booked.Price)
+	}
+}
+
+func TestBookRoom_payment_failed(t *testing.T) {
+	provider := &apptest.PaymentsProvider{
+		TakePaymentFunc: func(ctx context.Context, bookingID string, paymentID string, amount contracts.Money) error {
+			return errors.New("card declined")
+		},
+	}
+	clk := clock.NewFake(time.Now())
+	h := apptest.New(t, nil, apptest.WithPaymentsProvider(provider), apptest.WithClock(clk))
+
+	cmd := bookRoom(clk.Now())
+	paymentFailed := apptest.Listen(h, func(e *contracts.PaymentFailed) bool {
+		return e.BookingID == cmd.BookingID
+	})
+	h.Send(cmd)
+
+	// The payment is retried 4 times, with the interval doubled after every attempt.
+	// The stuck bookings watchdog waits for its next check on the clock too.
+	for range 4 {
+		if !clk.WaitForTimers(2, apptest.WaitTimeout) {
+			t.Fatal("payment is not retried")
+		}
+		clk.Advance(time.Minute)
+	}
+
+	if e := paymentFailed.Wait(); e.Reason != "card declined" {
+		t.Errorf("PaymentFailed.Reason = %q, want %q", e.Reason, "card declined")
+	}
+	if payments := provider.Payments(); len(payments) != 0 {
+		t.Errorf("payments taken: %v", payments)
+	}
+}
+
+func TestBookRoom_slow_payment(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	provider := &apptest.PaymentsProvider{
+		TakePaymentFunc: func(ctx context.Context, bookingID string, paymentID string, amount contracts.Money) error {
+			close(started)
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+	h := apptest.New(t, nil, apptest.WithPaymentsProvider(provider))
+
+	cmd := bookRoom(time.Now())
+	paymentTaken := apptest.Listen(h, func(e *contracts.PaymentTaken) bool {
+		return e.BookingID == cmd.BookingID
+	})
+	h.Send(cmd)
+
+	select {
+	case <-started:
+	case <-time.After(apptest.WaitTimeout):
+		t.Fatal("payment not started")
+	}
+
+	if payments := provider.Payments(); len(payments) != 0 {
+		t.Fatalf("payment taken before the provider answered: %v", payments)
+	}
+
+	close(release)
+	paymentTaken.Wait()
+
+	payments := provider.Payments()
+	if len(payments) != 1 || payments[0].ID != cmd.BookingID {
+		t.Errorf("payments = %v, want one payment of booking %s", payments, cmd.BookingID)
+	}
+}
@@ -0,0 +1,229 @@
+//go:build integration
+
+package apptest_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	app "github.com/roblaszczak/watermill-livecoding"
+	"github.com/roblaszczak/watermill-livecoding/apptest"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/testcontainers/testcontainers-go/modules/kafka"
+)
+
+// runKafka starts Kafka in a container for the test and returns the settings running the app on it.
+// Topics and consumer groups are new, so handlers read them from the earliest offset
+// and don't miss messages published before they were assigned partitions.
+func runKafka(t *testing.T) map[string]string {
+	t.Helper()
+
+	ctx := context.Background()
+
+	container, err := kafka.Run(ctx, "confluentinc/confluent-local:7.5.0", kafka.WithClusterID("apptest"))
+	if err != nil {
+		t.Fatalf("could not start Kafka: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := container.Terminate(ctx); err != nil {
+			t.Errorf("could not stop Kafka: %v", err)
+		}
+	})
+
+	brokers, err := container.Brokers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Joining consumer groups takes a few seconds on Kafka.
+	waitTimeout := apptest.WaitTimeout
+	apptest.WaitTimeout = time.Minute
+	t.Cleanup(func() {
+		apptest.WaitTimeout = waitTimeout
+	})
+
+	return map[string]string{
+		"BROKER":                "kafka",
+		"KAFKA_BROKERS":         strings.Join(brokers, ","),
+		"CONSUMER_OFFSET_RESET": "earliest",
+	}
+}
+
+func TestKafka_booking_flow(t *testing.T) {
+	h := apptest.New(t, runKafka(t))
+
+	cmd := bookRoom(time.Now())
+	roomBooked := apptest.Listen(h, func(e *contracts.RoomBooked) bool {
+		return e.BookingID == cmd.BookingID
+	})
+
+	paymentTaken := apptest.SendAndWaitFor(h, cmd, func(e *contracts.PaymentTaken) bool {
+		return e.BookingID == cmd.BookingID
+	})
+
+	booked := roomBooked.Wait()
+	if paymentTaken.Price != booked.Price {
+		t.Errorf("PaymentTaken.Price = %v, want %v", paymentTaken.Price, booked.Price)
+	}
+}
+
+func TestKafka_consumer_groups(t *testing.T) {
+	settings := runKafka(t)
+	settings["TOPIC_PARTITIONS"] = "4"
+	h := apptest.New(t, settings)
+	broker, err := h.Container().Broker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := "apptest_" + uuid.NewString()
+	groupA := "apptest_a_" + uuid.NewString()
+	groupB := "apptest_b_" + uuid.NewString()
+
+	// The topic has partitions for both instances of group A before they join it,
+	// otherwise it's auto-created with a single partition and one of them gets nothing.
+	provisioner, ok := broker.(app.TopicProvisioner)
+	if !ok {
+		t.Fatalf("%T doesn't provision topics", broker)
+	}
+	if err := provisioner.ProvisionTopics([]string{topic}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both instances of group A share messages, group B receives all of them too.
+	// Messages may be delivered again when partitions are rebalanced, so only at-least-once delivery is checked.
+	receivedA1 := subscribe(t, broker, groupA, topic)
+	receivedA2 := subscribe(t, broker, groupA, topic)
+	receivedB := subscribe(t, broker, groupB, topic)
+
+	published := publish(t, broker, topic, 10)
+
+	receivedByA := map[string]bool{}
+	for !receivedAll(receivedByA, published) {
+		select {
+		case id := <-receivedA1:
+			receivedByA[id] = true
+		case id := <-receivedA2:
+			receivedByA[id] = true
+		case <-time.After(apptest.WaitTimeout):
+			t.Fatalf("group A received %d of %d messages", len(receivedByA), len(published))
+		}
+	}
+
+	receivedByB := map[string]bool{}
+	for !receivedAll(receivedByB, published) {
+		select {
+		case id := <-receivedB:
+			receivedByB[id] = true
+		case <-time.After(apptest.WaitTimeout):
+			t.Fatalf("group B received %d of %d messages", len(receivedByB), len(published))
+		}
+	}
+}
+
+func TestKafka_offsets_committed(t *testing.T) {
+	h := apptest.New(t, runKafka(t))
+	broker, err := h.Container().Broker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := "apptest_" + uuid.NewString()
+	group := "apptest_" + uuid.NewString()
+
+	first := publish(t, broker, topic, 1)[0]
+
+	subscriber, err := broker.NewSubscriber(group, app.OffsetResetEarliest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-messages:
+		if msg.UUID != first {
+			t.Fatalf("received %s, want %s", msg.UUID, first)
+		}
+		msg.Ack()
+	case <-time.After(apptest.WaitTimeout):
+		t.Fatal("message not received")
+	}
+	// Offsets of acked messages are committed when the subscriber is closed.
+	if err := subscriber.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := publish(t, broker, topic, 1)[0]
+
+	// The next instance of the group continues after the committed offset, even though it resets to the earliest one.
+	select {
+	case id := <-subscribe(t, broker, group, topic):
+		if id != second {
+			t.Errorf("received %s, want %s: acked message was received again", id, second)
+		}
+	case <-time.After(apptest.WaitTimeout):
+		t.Fatal("message not received")
+	}
+}
+
+// subscribe acks messages of the topic received by the consumer group and sends their UUIDs to the returned channel.
+func subscribe(t *testing.T, broker app.Broker, consumerGroup string, topic string) chan string {
+	t.Helper()
+
+	subscriber, err := broker.NewSubscriber(consumerGroup, app.OffsetResetEarliest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		_ = subscriber.Close()
+	})
+
+	messages, err := subscriber.Subscribe(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 100)
+	go func() {
+		for msg := range messages {
+			received <- msg.UUID
+			msg.Ack()
+		}
+	}()
+
+	return received
+}
+
+func publish(t *testing.T, broker app.Broker, topic string, count int) []string {
+	t.Helper()
+
+	var uuids []string
+	for range count {
+		msg := message.NewMessage(watermill.NewUUID(), []byte("{}"))
+		if err := broker.Publisher().Publish(topic, msg); err != nil {
+			t.Fatalf("could not publish to %s: %v", topic, err)
+		}
+		uuids = append(uuids, msg.UUID)
+	}
+
+	return uuids
+}
+
+func receivedAll(received map[string]bool, published []string) bool {
+	for _, id := range published {
+		if !received[id] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package apptest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+// PaymentsProvider is a payments provider controlled by the test, passed to New with WithPaymentsProvider.
+// Payments are taken right away, unless TakePaymentFunc makes them slow or failing.
+type PaymentsProvider struct {
+	// TakePaymentFunc is called for every payment, it can block until the test releases it,
+	// wait for ctx to be done to simulate timeouts or return an error to fail the payment.
+	TakePaymentFunc func(ctx context.Context, bookingID string, paymentID string, amount contracts.Money) error
+
+	mu       sync.Mutex
+	payments []Payment
+	refunds  []Payment
+}
+
+// Payment is a payment or a refund made with PaymentsProvider.
+type Payment struct {
+	BookingID string
+	ID        string
+	Amount    contracts.Money
+}
+
+func (p *PaymentsProvider) TakePayment(ctx context.Context, bookingID string, paymentID string, amount contracts.Money) error {
+	if p.TakePaymentFunc != nil {
+		if err := p.TakePaymentFunc(ctx, bookingID, paymentID, amount); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.payments = append(p.payments, Payment{BookingID: bookingID, ID: paymentID, Amount: amount})
+
+	return nil
+}
+
+func (p *PaymentsProvider) Refund(ctx context.Context, bookingID string, refundID string, amount contracts.Money) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.refunds = append(p.refunds, Payment{BookingID: bookingID, ID: refundID, Amount: amount})
+
+	return nil
+}
+
+// Payments returns payments taken so far.
+func (p *PaymentsProvider) Payments() []Payment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]Payment(nil), p.payments...)
+}
+
+// Refunds returns refunds made so far.
+func (p *PaymentsProvider) Refunds() []Payment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]Payment(nil), p.refunds...)
+}
@@ -0,0 +1,209 @@
+package app
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+// AsyncAPIDocument is an AsyncAPI 3.0 document describing the app's commands and events.
+type AsyncAPIDocument struct {
+	AsyncAPI           string                       `json:"asyncapi"`
+	Info               AsyncAPIInfo                 `json:"info"`
+	DefaultContentType string                       `json:"defaultContentType"`
+	Channels           map[string]AsyncAPIChannel   `json:"channels"`
+	Operations         map[string]AsyncAPIOperation `json:"operations"`
+	Components         AsyncAPIComponents           `json:"components"`
+}
+
+type AsyncAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type AsyncAPIChannel struct {
+	Address  string                 `json:"address"`
+	Messages map[string]AsyncAPIRef `json:"messages"`
+}
+
+type AsyncAPIOperation struct {
+	Action      string        `json:"action"`
+	Channel     AsyncAPIRef   `json:"channel"`
+	Messages    []AsyncAPIRef `json:"messages"`
+	Description string        `json:"description,omitempty"`
+}
+
+type AsyncAPIRef struct {
+	Ref string `json:"$ref"`
+}
+
+type AsyncAPIComponents struct {
+	Messages map[string]AsyncAPIMessage `json:"messages"`
+}
+
+type AsyncAPIMessage struct {
+	Name    string     `json:"name"`
+	Title   string     `json:"title"`
+	Payload JSONSchema `json:"payload"`
+}
+
+// JSONSchema is the subset of JSON Schema used to describe commands and events.
+type JSONSchema struct {
+	Type                 string                `json:"type,omitempty"`
+	Format               string                `json:"format,omitempty"`
+	Properties           map[string]JSONSchema `json:"properties,omitempty"`
+	Required             []string              `json:"required,omitempty"`
+	Items                *JSONSchema           `json:"items,omitempty"`
+	AdditionalProperties *JSONSchema           `json:"additionalProperties,omitempty"`
+}
+
+// NewAsyncAPIDocument describes commands and events of the handlers, commands sent by the app and streamed events.
+// Every command and event has its own channel named after it, like the topics of the buses and processors.
+//
+// All described messages are published by the app, so every channel has a send operation,
+// and a receive operation for every handler subscribed to it.
+func NewAsyncAPIDocument(commandHandlers []cqrs.CommandHandler, eventHandlers []cqrs.EventHandler) AsyncAPIDocument {
+	doc := AsyncAPIDocument{
+		AsyncAPI: "3.0.0",
+		Info: AsyncAPIInfo{
+			Title:       "Room bookings",
+			Version:     "1.0.0",
+			Description: "Commands and events of room bookings. Payloads are described in their JSON form, which is used with MARSHALER=json.",
+		},
+		DefaultContentType: "application/json",
+		Channels:           map[string]AsyncAPIChannel{},
+		Operations:         map[string]AsyncAPIOperation{},
+		Components: AsyncAPIComponents{
+			Messages: map[string]AsyncAPIMessage{},
+		},
+	}
+
+	for _, v := range slices.Concat(commands, streamedEvents) {
+		doc.addMessage(v)
+	}
+
+	for _, handler := range commandHandlers {
+		doc.addHandler(handler.HandlerName(), handler.NewCommand())
+	}
+	for _, handler := range eventHandlers {
+		doc.addHandler(handler.HandlerName(), handler.NewEvent())
+	}
+
+	return doc
+}
+
+// addMessage adds the message's channel and the operation of publishing it.
+func (d AsyncAPIDocument) addMessage(v any) string {
+	name := cqrs.StructName(v)
+	if _, ok := d.Channels[name]; ok {
+		return name
+	}
+
+	d.Components.Messages[name] = AsyncAPIMessage{
+		Name:    name,
+		Title:   name,
+		Payload: jsonSchemaOf(reflect.TypeOf(v)),
+	}
+	d.Channels[name] = AsyncAPIChannel{
+		Address: name,
+		Messages: map[string]AsyncAPIRef{
+			name: {Ref: "#/components/messages/" + name},
+		},
+	}
+	d.Operations["send"+name] = d.operation("send", name)
+
+	return name
+}
+
+func (d AsyncAPIDocument) addHandler(handlerName string, v any) {
+	name := d.addMessage(v)
+
+	operation := d.operation("receive", name)
+	operation.Description = "Handled by " + handlerName + "."
+	d.Operations[handlerName] = operation
+}
+
+func (d AsyncAPIDocument) operation(action string, name string) AsyncAPIOperation {
+	return AsyncAPIOperation{
+		Action:   action,
+		Channel:  AsyncAPIRef{Ref: "#/channels/" + name},
+		Messages: []AsyncAPIRef{{Ref: "#/channels/" + name + "/messages/" + name}},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchemaOf describes how the type is encoded by encoding/json.
+// Fields without omitempty are required, because they are always encoded.
+func jsonSchemaOf(t reflect.Type) JSONSchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return JSONSchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return JSONSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return JSONSchema{Type: "number"}
+	case reflect.String:
+		return JSONSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return JSONSchema{Type: "string", Format: "byte"}
+		}
+		items := jsonSchemaOf(t.Elem())
+		return JSONSchema{Type: "array", Items: &items}
+	case reflect.Map:
+		values := jsonSchemaOf(t.Elem())
+		return JSONSchema{Type: "object", AdditionalProperties: &values}
+	case reflect.Struct:
+		return jsonSchemaOfStruct(t)
+	default:
+		return JSONSchema{}
+	}
+}
+
+func jsonSchemaOfStruct(t reflect.Type) JSONSchema {
+	schema := JSONSchema{
+		Type:       "object",
+		Properties: map[string]JSONSchema{},
+	}
+
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && options == "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema.Properties[name] = jsonSchemaOf(field.Type)
+		if !slices.Contains(strings.Split(options, ","), "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+
+	return schema
+}
+
+func (d AsyncAPIDocument) Handler(writer http.ResponseWriter, request *http.Request) {
+	server.WriteJSON(request.Context(), writer, http.StatusOK, d)
+}
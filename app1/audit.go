@@ -0,0 +1,185 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	stdSQL "database/sql"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+const (
+	auditDirectionPublished = "published"
+	auditDirectionHandled   = "handled"
+
+	auditOutcomeSuccess      = "success"
+	auditOutcomeFailed       = "failed"
+	auditOutcomeDeadLettered = "dead_lettered"
+)
+
+// AuditEntry is a single published or handled event.
+type AuditEntry struct {
+	ID            int64     `json:"id"`
+	Direction     string    `json:"direction"`
+	EventName     string    `json:"event_name"`
+	EventID       string    `json:"event_id"`
+	CorrelationID string    `json:"correlation_id"`
+	BookingID     string    `json:"booking_id"`
+	Topic         string    `json:"topic"`
+	Handler       string    `json:"handler,omitempty"`
+	PayloadHash   string    `json:"payload_hash"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Audit appends every published and handled event to the audit_log table.
+//
+// Only messages with the event envelope are audited, so commands and outbox messages are skipped.
+// Failing to write the audit log doesn't fail publishing nor handling.
+type Audit struct {
+	db *stdSQL.DB
+}
+
+// Publisher returns publisher which audits published events.
+func (a Audit) Publisher(publisher message.Publisher) message.Publisher {
+	return auditingPublisher{Publisher: publisher, audit: a}
+}
+
+type auditingPublisher struct {
+	message.Publisher
+	audit Audit
+}
+
+func (p auditingPublisher) Publish(topic string, messages ...*message.Message) error {
+	err := p.Publisher.Publish(topic, messages...)
+
+	for _, msg := range messages {
+		entry := newAuditEntry(auditDirectionPublished, topic, msg, err)
+		p.audit.append(msg.Context(), entry)
+	}
+
+	return err
+}
+
+// Middleware audits handled events. It should be added before the dead letter queue to see the final outcome.
+func (a Audit) Middleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		events, err := h(msg)
+
+		entry := newAuditEntry(auditDirectionHandled, message.SubscribeTopicFromCtx(msg.Context()), msg, err)
+		entry.Handler = message.HandlerNameFromCtx(msg.Context())
+		if err == nil && msg.Metadata.Get(deadLetterReasonKey) != "" {
+			entry.Outcome = auditOutcomeDeadLettered
+			entry.Error = msg.Metadata.Get(deadLetterReasonKey)
+		}
+
+		a.append(msg.Context(), entry)
+
+		return events, err
+	}
+}
+
+func newAuditEntry(direction string, topic string, msg *message.Message, err error) AuditEntry {
+	payloadHash := sha256.Sum256(msg.Payload)
+
+	entry := AuditEntry{
+		Direction:     direction,
+		EventName:     msg.Metadata.Get("name"),
+		EventID:       msg.Metadata.Get(contracts.EventIDMetadataKey),
+		CorrelationID: middleware.MessageCorrelationID(msg),
+		BookingID:     msg.Metadata.Get(bookingIDMetadataKey),
+		Topic:         topic,
+		PayloadHash:   hex.EncodeToString(payloadHash[:]),
+		Outcome:       auditOutcomeSuccess,
+	}
+	if err != nil {
+		entry.Outcome = auditOutcomeFailed
+		entry.Error = err.Error()
+	}
+
+	return entry
+}
+
+func (a Audit) append(ctx context.Context, entry AuditEntry) {
+	if entry.EventID == "" {
+		return
+	}
+
+	_, err := a.db.ExecContext(
+		// the entry is appended even if the handler's context was cancelled
+		context.WithoutCancel(ctx),
+		`INSERT INTO audit_log
+			(direction, event_name, event_id, correlation_id, booking_id, topic, handler, payload_hash, outcome, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		entry.Direction,
+		entry.EventName,
+		entry.EventID,
+		entry.CorrelationID,
+		entry.BookingID,
+		entry.Topic,
+		entry.Handler,
+		entry.PayloadHash,
+		entry.Outcome,
+		entry.Error,
+	)
+	if err != nil {
+		slog.With("err", err, "event_id", entry.EventID).ErrorContext(ctx, "Failed to append audit log entry")
+	}
+}
+
+// BookingHandler returns the audit trail of the booking.
+func (a Audit) BookingHandler(writer http.ResponseWriter, request *http.Request) {
+	rows, err := a.db.QueryContext(
+		request.Context(),
+		`SELECT id, direction, event_name, event_id, correlation_id, booking_id, topic, handler, payload_hash, outcome, error, created_at
+		FROM audit_log WHERE booking_id = $1 ORDER BY id`,
+		request.PathValue("id"),
+	)
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to get audit log")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err := rows.Scan(
+			&entry.ID,
+			&entry.Direction,
+			&entry.EventName,
+			&entry.EventID,
+			&entry.CorrelationID,
+			&entry.BookingID,
+			&entry.Topic,
+			&entry.Handler,
+			&entry.PayloadHash,
+			&entry.Outcome,
+			&entry.Error,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			slog.With("err", err).ErrorContext(request.Context(), "Failed to read audit log entry")
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to get audit log")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, entries)
+}
@@ -0,0 +1,189 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+)
+
+// streamedEvents are events which can be streamed to HTTP clients.
+var streamedEvents = []any{
+	RoomBooked{},
+	DiscountApplied{},
+	RoomUnavailable{},
+	PaymentTaken{},
+	PaymentFailed{},
+	PaymentRefunded{},
+	RefundRejected{},
+	BookingConfirmed{},
+	BookingFailed{},
+	BookingExpired{},
+	BookingCancelled{},
+	InvoiceIssued{},
+	PaymentsDegraded{},
+	LoyaltyPointsEarned{},
+	BookingAmended{},
+	AmendmentRejected{},
+	AmendmentPaymentTaken{},
+	AmendmentPaymentFailed{},
+	AmendmentReverted{},
+	GuestRegistered{},
+	GuestForgotten{},
+}
+
+// StreamedEvent is an event decoded with the app's marshaler and encoded as JSON.
+type StreamedEvent struct {
+	Name    string          `json:"name"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// EventsStream subscribes to events for HTTP clients.
+//
+// Every client uses its own consumer group, so it receives all events. The group is deleted
+// when the client disconnects, with brokers which keep consumer groups.
+type EventsStream struct {
+	broker              Broker
+	marshaler           cqrs.CommandEventMarshaler
+	consumerGroupPrefix string
+}
+
+// Subscribe returns events published to all topics of streamedEvents until ctx is cancelled.
+func (s EventsStream) Subscribe(ctx context.Context) (<-chan StreamedEvent, error) {
+	consumerGroup := s.consumerGroupPrefix + "events_stream_" + uuid.NewString()
+
+	subscriber, err := s.broker.NewSubscriber(consumerGroup, OffsetResetLatest)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan StreamedEvent)
+	wg := sync.WaitGroup{}
+	var topics []string
+
+	for _, event := range streamedEvents {
+		name := s.marshaler.Name(event)
+		eventType := reflect.TypeOf(event)
+
+		messages, err := subscriber.Subscribe(ctx, name)
+		if err != nil {
+			s.close(ctx, subscriber, consumerGroup, topics)
+			return nil, fmt.Errorf("could not subscribe to %s: %w", name, err)
+		}
+		topics = append(topics, name)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for msg := range messages {
+				if msg.Metadata.Get(replayHandlerMetadataKey) != "" {
+					// Replayed to the topic by older versions, clients already received the event
+					// when it was published for the first time.
+					msg.Ack()
+					continue
+				}
+
+				streamedEvent, err := s.decode(msg, name, eventType)
+				msg.Ack()
+				if err != nil {
+					slog.With("err", err, "message_uuid", msg.UUID).ErrorContext(ctx, "Failed to decode streamed event")
+					continue
+				}
+
+				select {
+				case out <- streamedEvent:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.close(ctx, subscriber, consumerGroup, topics)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// close closes the client's subscriber and deletes its consumer group, so groups of disconnected clients don't pile up.
+func (s EventsStream) close(ctx context.Context, subscriber message.Subscriber, consumerGroup string, topics []string) {
+	ctx = context.WithoutCancel(ctx)
+	logger := slog.With("consumer_group", consumerGroup)
+
+	if err := subscriber.Close(); err != nil {
+		logger.With("err", err).WarnContext(ctx, "Failed to close events stream subscriber")
+	}
+
+	if deleter, ok := unwrapBroker(s.broker).(ConsumerGroupDeleter); ok {
+		if err := deleter.DeleteConsumerGroup(ctx, consumerGroup, topics); err != nil {
+			logger.With("err", err).WarnContext(ctx, "Failed to delete events stream consumer group")
+		}
+	}
+}
+
+func (s EventsStream) decode(msg *message.Message, name string, eventType reflect.Type) (StreamedEvent, error) {
+	event := reflect.New(eventType).Interface()
+	if err := s.marshaler.Unmarshal(msg, event); err != nil {
+		return StreamedEvent{}, err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return StreamedEvent{}, err
+	}
+
+	return StreamedEvent{Name: name, Payload: payload}, nil
+}
+
+// BookingEventsHandler streams events of the booking as Server-Sent Events.
+func (s EventsStream) BookingEventsHandler(writer http.ResponseWriter, request *http.Request) {
+	bookingID := request.PathValue("id")
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	events, err := s.Subscribe(request.Context())
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to subscribe to booking events")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for event := range events {
+		var booking struct {
+			BookingID string `json:"booking_id"`
+		}
+		if err := json.Unmarshal(event.Payload, &booking); err != nil || booking.BookingID != bookingID {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.Name, event.Payload); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
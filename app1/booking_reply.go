@@ -0,0 +1,71 @@
+package app
+
+import (
+	"context"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/requestreply"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/roblaszczak/watermill-livecoding/internal/booking"
+)
+
+const bookingRepliesTopic = "booking_replies"
+
+type operationIDKey struct{}
+
+func contextWithOperationID(ctx context.Context, operationID string) context.Context {
+	return context.WithValue(ctx, operationIDKey{}, operationID)
+}
+
+func operationIDFromContext(ctx context.Context) string {
+	operationID, _ := ctx.Value(operationIDKey{}).(string)
+	return operationID
+}
+
+// operationIDRouterMiddleware passes the request/reply operation ID from the message metadata
+// to the handler's context, so it reaches the events published further in the booking flow.
+func operationIDRouterMiddleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		if operationID := msg.Metadata.Get(requestreply.OperationIDMetadataKey); operationID != "" {
+			msg.SetContext(contextWithOperationID(msg.Context(), operationID))
+		}
+
+		return h(msg)
+	}
+}
+
+func setOperationIDMetadata(ctx context.Context, msg *message.Message) {
+	if operationID := operationIDFromContext(ctx); operationID != "" && msg.Metadata.Get(requestreply.OperationIDMetadataKey) == "" {
+		msg.Metadata.Set(requestreply.OperationIDMetadataKey, operationID)
+	}
+}
+
+func newBookingRepliesBackend(
+	broker Broker,
+	publisher message.Publisher,
+	config Config,
+	logger watermill.LoggerAdapter,
+) (*requestreply.PubSubBackend[booking.Status], error) {
+	return requestreply.NewPubSubBackend[booking.Status](
+		requestreply.PubSubBackendConfig{
+			Publisher: publisher,
+			SubscriberConstructor: func(params requestreply.PubSubBackendSubscribeParams) (message.Subscriber, error) {
+				// Every waiting request needs to receive all replies.
+				return broker.NewSubscriber(
+					config.ConsumerGroupPrefix+bookingRepliesTopic+"_"+string(params.OperationID),
+					OffsetResetLatest,
+				)
+			},
+			GeneratePublishTopic: func(params requestreply.PubSubBackendPublishParams) (string, error) {
+				return bookingRepliesTopic, nil
+			},
+			GenerateSubscribeTopic: func(params requestreply.PubSubBackendSubscribeParams) (string, error) {
+				return bookingRepliesTopic, nil
+			},
+			Logger:                logger,
+			ListenForReplyTimeout: &config.BookingSyncTimeout,
+			AckCommandErrors:      true,
+		},
+		requestreply.BackendPubsubJSONMarshaler[booking.Status]{},
+	)
+}
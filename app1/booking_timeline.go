@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	stdSQL "database/sql"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+// TimelineEvent is a domain event which happened to the booking.
+type TimelineEvent struct {
+	EventName     string    `json:"event_name"`
+	EventID       string    `json:"event_id"`
+	CorrelationID string    `json:"correlation_id"`
+	PublishedAt   time.Time `json:"published_at"`
+}
+
+// BookingTimeline lists domain events of a booking, built from the audit log.
+type BookingTimeline struct {
+	db *stdSQL.DB
+}
+
+// Timeline returns successfully published events of the booking in the order they were published.
+//
+// Events published more than once (e.g. moved to the dead letter queue or replayed) are returned once.
+func (t BookingTimeline) Timeline(ctx context.Context, bookingID string) ([]TimelineEvent, error) {
+	rows, err := t.db.QueryContext(
+		ctx,
+		`SELECT event_name, event_id, correlation_id, created_at FROM (
+			SELECT DISTINCT ON (event_id) id, event_name, event_id, correlation_id, created_at
+			FROM audit_log
+			WHERE booking_id = $1 AND direction = $2 AND outcome = $3
+			ORDER BY event_id, id
+		) AS events ORDER BY id`,
+		bookingID,
+		auditDirectionPublished,
+		auditOutcomeSuccess,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []TimelineEvent{}
+	for rows.Next() {
+		var event TimelineEvent
+		if err := rows.Scan(&event.EventName, &event.EventID, &event.CorrelationID, &event.PublishedAt); err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+func (t BookingTimeline) Handler(writer http.ResponseWriter, request *http.Request) {
+	events, err := t.Timeline(request.Context(), request.PathValue("id"))
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to get booking timeline")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(events) == 0 {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, events)
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+)
+
+// Broker creates publishers and subscribers for the configured Pub/Sub.
+//
+// Domain code only uses message.Publisher and message.Subscriber, so the broker can be changed with BROKER.
+type Broker interface {
+	Publisher() message.Publisher
+	NewSubscriber(consumerGroup string, offsetReset OffsetReset) (message.Subscriber, error)
+}
+
+// ConsumerGroupDeleter is implemented by brokers which keep consumer groups after their subscribers are closed,
+// so short-lived consumer groups can be deleted.
+type ConsumerGroupDeleter interface {
+	DeleteConsumerGroup(ctx context.Context, consumerGroup string, topics []string) error
+}
+
+// BrokerPinger is implemented by brokers which can check their connection with an already open client,
+// so readiness probes don't connect to the broker every time.
+type BrokerPinger interface {
+	Ping(ctx context.Context) error
+}
+
+func newBroker(config Config, db *sql.DB, logger watermill.LoggerAdapter) (Broker, error) {
+	switch config.Broker {
+	case "kafka":
+		return newKafkaBroker(config.KafkaBrokers, config.KafkaAuth, config.KafkaProducer, config.TopicSettings, logger)
+	case "nats":
+		return newNATSBroker(config.NATSURL, logger)
+	case "amqp":
+		return newAMQPBroker(config.AMQPURL, logger)
+	case "googlecloud":
+		return newGoogleCloudBroker(config.GoogleCloudProject, logger)
+	case "postgres":
+		return newPostgresBroker(db, logger)
+	case "redis":
+		return newRedisBroker(config.RedisAddr, logger)
+	case "inmemory":
+		return newGoChannelBroker(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown broker: %s", config.Broker)
+	}
+}
+
+// unwrapBroker returns the broker decorated by decorators like ClaimCheck.
+func unwrapBroker(broker Broker) Broker {
+	for {
+		wrapper, ok := broker.(interface{ Unwrap() Broker })
+		if !ok {
+			return broker
+		}
+		broker = wrapper.Unwrap()
+	}
+}
+
+type kafkaBroker struct {
+	brokers       []string
+	auth          KafkaAuth
+	topicSettings TopicSettings
+	publisher     *kafka.Publisher
+	// pingClient is shared by readiness probes.
+	pingClient sarama.Client
+	logger     watermill.LoggerAdapter
+}
+
+func newKafkaBroker(
+	brokers []string,
+	auth KafkaAuth,
+	producerSettings KafkaProducerSettings,
+	topicSettings TopicSettings,
+	logger watermill.LoggerAdapter,
+) (*kafkaBroker, error) {
+	saramaConfig := kafka.DefaultSaramaSyncPublisherConfig()
+	producerSettings.Apply(saramaConfig)
+	if err := auth.Apply(saramaConfig); err != nil {
+		return nil, err
+	}
+
+	publisher, err := kafka.NewPublisher(
+		kafka.PublisherConfig{
+			Brokers:               brokers,
+			Marshaler:             kafka.NewWithPartitioningMarshaler(generatePartitionKey),
+			OverwriteSaramaConfig: saramaConfig,
+		},
+		logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	pingConfig := newProbeSaramaConfig(5 * time.Second)
+	if err := auth.Apply(pingConfig); err != nil {
+		return nil, errors.Join(err, publisher.Close())
+	}
+	pingClient, err := sarama.NewClient(brokers, pingConfig)
+	if err != nil {
+		return nil, errors.Join(err, publisher.Close())
+	}
+
+	return &kafkaBroker{
+		brokers:       brokers,
+		auth:          auth,
+		topicSettings: topicSettings,
+		publisher:     publisher,
+		pingClient:    pingClient,
+		logger:        logger,
+	}, nil
+}
+
+// Ping refreshes the cluster metadata with the connections kept open by the shared client.
+func (b *kafkaBroker) Ping(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- b.pingClient.RefreshMetadata()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *kafkaBroker) Close() error {
+	return b.pingClient.Close()
+}
+
+func (b *kafkaBroker) Publisher() message.Publisher {
+	return b.publisher
+}
+
+func (b *kafkaBroker) NewSubscriber(consumerGroup string, offsetReset OffsetReset) (message.Subscriber, error) {
+	saramaConfig := kafka.DefaultSaramaSubscriberConfig()
+	if offsetReset == OffsetResetEarliest {
+		saramaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	} else {
+		saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+	}
+	if err := b.auth.Apply(saramaConfig); err != nil {
+		return nil, err
+	}
+
+	return kafka.NewSubscriber(
+		kafka.SubscriberConfig{
+			Brokers:               b.brokers,
+			ConsumerGroup:         consumerGroup,
+			Unmarshaler:           kafka.DefaultMarshaler{},
+			OverwriteSaramaConfig: saramaConfig,
+		},
+		b.logger,
+	)
+}
+
+// DeleteConsumerGroup deletes the group's committed offsets, its subscribers have to be closed first.
+func (b *kafkaBroker) DeleteConsumerGroup(ctx context.Context, consumerGroup string, topics []string) error {
+	client, err := b.newClient()
+	if err != nil {
+		return err
+	}
+
+	// Closing the admin closes the client as well.
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return err
+	}
+	defer admin.Close()
+
+	return admin.DeleteConsumerGroup(consumerGroup)
+}
+
+// goChannelBroker keeps all messages in memory, so the app can run without Kafka.
+//
+// Every subscriber receives all messages from the topic, which works like a consumer group per handler.
+type goChannelBroker struct {
+	pubSub *gochannel.GoChannel
+}
+
+func newGoChannelBroker(logger watermill.LoggerAdapter) *goChannelBroker {
+	return &goChannelBroker{
+		pubSub: gochannel.NewGoChannel(gochannel.Config{}, logger),
+	}
+}
+
+func (b *goChannelBroker) Publisher() message.Publisher {
+	return b.pubSub
+}
+
+// NewSubscriber ignores offsetReset, because GoChannel doesn't keep already delivered messages.
+func (b *goChannelBroker) NewSubscriber(consumerGroup string, offsetReset OffsetReset) (message.Subscriber, error) {
+	return goChannelSubscriber{Subscriber: b.pubSub}, nil
+}
+
+// goChannelSubscriber doesn't close the GoChannel on Close, because it's shared by all subscribers and the publisher.
+// Subscriptions end when their context is done.
+type goChannelSubscriber struct {
+	message.Subscriber
+}
+
+func (s goChannelSubscriber) Close() error {
+	return nil
+}
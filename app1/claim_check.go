@@ -0,0 +1,202 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// claimCheckKeyMetadataKey is the key of the payload offloaded to the blob store, the message's payload is empty then.
+const claimCheckKeyMetadataKey = "claim_check_key"
+
+// BlobStore stores offloaded payloads as objects, like an S3 bucket.
+type BlobStore interface {
+	PutObject(ctx context.Context, key string, data []byte) error
+	// GetObject returns os.ErrNotExist if there is no object with the key.
+	GetObject(ctx context.Context, key string) ([]byte, error)
+}
+
+// FilesystemBlobStore stores objects as files in dir, it works for a single instance or with a shared volume.
+type FilesystemBlobStore struct {
+	dir string
+}
+
+func (s FilesystemBlobStore) PutObject(ctx context.Context, key string, data []byte) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Written to a temporary file first, so consumers never read a partially written object.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s FilesystemBlobStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+// ClaimCheck offloads payloads larger than threshold to the blob store before they are published
+// and replaces them with the object's key in claimCheckKeyMetadataKey. Subscribers load the payload back
+// before the message is handled, so handlers and marshalers don't know about it.
+//
+// Objects are not deleted after the message is handled, because it can be consumed by many consumer groups.
+// They should be expired by the blob store, e.g. with S3 lifecycle rules.
+type ClaimCheck struct {
+	store     BlobStore
+	threshold int
+}
+
+// Broker returns broker which publishers and subscribers use the claim check.
+func (c ClaimCheck) Broker(broker Broker) Broker {
+	return claimCheckBroker{Broker: broker, claimCheck: c}
+}
+
+type claimCheckBroker struct {
+	Broker
+	claimCheck ClaimCheck
+}
+
+func (b claimCheckBroker) Publisher() message.Publisher {
+	return claimCheckPublisher{Publisher: b.Broker.Publisher(), claimCheck: b.claimCheck}
+}
+
+func (b claimCheckBroker) NewSubscriber(consumerGroup string, offsetReset OffsetReset) (message.Subscriber, error) {
+	subscriber, err := b.Broker.NewSubscriber(consumerGroup, offsetReset)
+	if err != nil {
+		return nil, err
+	}
+
+	return claimCheckSubscriber{Subscriber: subscriber, claimCheck: b.claimCheck}, nil
+}
+
+// Unwrap returns the decorated broker, so its optional interfaces like TopicProvisioner can be used.
+func (b claimCheckBroker) Unwrap() Broker {
+	return b.Broker
+}
+
+func (b claimCheckBroker) PartitionRanges(topic string, from ReadPosition) ([]PartitionRange, error) {
+	reader, ok := b.Broker.(TopicReader)
+	if !ok {
+		return nil, errors.New("decorated broker is not a TopicReader")
+	}
+
+	return reader.PartitionRanges(topic, from)
+}
+
+// ReadPartitions loads offloaded payloads of read messages.
+func (b claimCheckBroker) ReadPartitions(
+	ctx context.Context,
+	topic string,
+	ranges []PartitionRange,
+	handle func(msg *message.Message) error,
+) error {
+	reader, ok := b.Broker.(TopicReader)
+	if !ok {
+		return errors.New("decorated broker is not a TopicReader")
+	}
+
+	return reader.ReadPartitions(ctx, topic, ranges, func(msg *message.Message) error {
+		if err := b.claimCheck.load(ctx, msg); err != nil {
+			return err
+		}
+		return handle(msg)
+	})
+}
+
+type claimCheckPublisher struct {
+	message.Publisher
+	claimCheck ClaimCheck
+}
+
+func (p claimCheckPublisher) Publish(topic string, messages ...*message.Message) error {
+	toPublish := make([]*message.Message, 0, len(messages))
+
+	for _, msg := range messages {
+		if len(msg.Payload) <= p.claimCheck.threshold {
+			toPublish = append(toPublish, msg)
+			continue
+		}
+
+		key := topic + "/" + msg.UUID
+		if err := p.claimCheck.store.PutObject(msg.Context(), key, msg.Payload); err != nil {
+			return fmt.Errorf("could not offload payload of message %s: %w", msg.UUID, err)
+		}
+
+		// The original message is not modified, so it can be published again if publishing fails.
+		offloaded := msg.Copy()
+		offloaded.SetContext(msg.Context())
+		offloaded.Payload = nil
+		offloaded.Metadata.Set(claimCheckKeyMetadataKey, key)
+
+		slog.With("message_uuid", msg.UUID, "key", key, "size", len(msg.Payload)).DebugContext(msg.Context(), "Payload offloaded")
+
+		toPublish = append(toPublish, offloaded)
+	}
+
+	return p.Publisher.Publish(topic, toPublish...)
+}
+
+type claimCheckSubscriber struct {
+	message.Subscriber
+	claimCheck ClaimCheck
+}
+
+// Subscribe loads offloaded payloads of received messages. Messages which payloads can't be loaded are nacked,
+// so they are redelivered.
+func (s claimCheckSubscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	messages, err := s.Subscriber.Subscribe(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *message.Message)
+	go func() {
+		defer close(out)
+
+		for msg := range messages {
+			if err := s.claimCheck.load(ctx, msg); err != nil {
+				slog.With("err", err, "message_uuid", msg.UUID).ErrorContext(ctx, "Failed to load offloaded payload")
+				msg.Nack()
+				continue
+			}
+
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				msg.Nack()
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (c ClaimCheck) load(ctx context.Context, msg *message.Message) error {
+	key := msg.Metadata.Get(claimCheckKeyMetadataKey)
+	if key == "" {
+		return nil
+	}
+
+	payload, err := c.store.GetObject(ctx, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("offloaded payload %s not found: %w", key, err)
+	}
+	if err != nil {
+		return fmt.Errorf("could not get offloaded payload %s: %w", key, err)
+	}
+
+	msg.Payload = payload
+	delete(msg.Metadata, claimCheckKeyMetadataKey)
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const tickInterval = 10 * time.Millisecond
+
+type loadGenerator struct {
+	book           bookFunc
+	rate           rateProfile
+	duration       time.Duration
+	concurrency    int
+	reportInterval time.Duration
+	lagURL         string
+}
+
+// Run makes bookings at the profile's rate until duration passes or ctx is cancelled,
+// then waits for bookings in flight and prints the summary.
+func (g loadGenerator) Run(ctx context.Context) {
+	interval := &stats{}
+	total := &stats{}
+	inFlight := make(chan struct{}, g.concurrency)
+
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	reports := time.NewTicker(g.reportInterval)
+	defer reports.Stop()
+
+	// due accumulates fractions of bookings, so low rates are kept between ticks.
+	var due float64
+	lastTick := start
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case now := <-reports.C:
+			g.report(ctx, now.Sub(start), interval.Reset())
+		case now := <-ticker.C:
+			elapsed := now.Sub(start)
+			if elapsed >= g.duration {
+				break loop
+			}
+
+			due += g.rate(elapsed) * now.Sub(lastTick).Seconds()
+			lastTick = now
+
+			for ; due >= 1; due-- {
+				select {
+				case inFlight <- struct{}{}:
+				default:
+					// The app doesn't keep up, waiting would lower the rate instead of showing it.
+					interval.Skip()
+					total.Skip()
+					continue
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() { <-inFlight }()
+
+					bookingStart := time.Now()
+					err := g.book(ctx)
+					latency := time.Since(bookingStart)
+
+					if err != nil && ctx.Err() == nil {
+						slog.With("err", err).Debug("Booking failed")
+					}
+					interval.Record(latency, err)
+					total.Record(latency, err)
+				}()
+			}
+		}
+	}
+
+	wg.Wait()
+
+	fmt.Println()
+	fmt.Println("Summary:")
+	fmt.Println(total.Summary(time.Since(start)))
+}
+
+func (g loadGenerator) report(ctx context.Context, elapsed time.Duration, s *stats) {
+	line := fmt.Sprintf("[%s] target %.1f rps, %s", elapsed.Truncate(time.Second), g.rate(elapsed), s.Summary(g.reportInterval))
+
+	if g.lagURL != "" {
+		lag, err := totalLag(ctx, g.lagURL)
+		if err != nil {
+			line += ", lag unknown: " + err.Error()
+		} else {
+			line += fmt.Sprintf(", consumer lag %d", lag)
+		}
+	}
+
+	fmt.Println(line)
+}
+
+// totalLag sums the lag of all handlers returned by the app's GET /debug/lag.
+func totalLag(ctx context.Context, url string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var handlers []struct {
+		Lag int64 `json:"lag"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&handlers); err != nil {
+		return 0, err
+	}
+
+	var lag int64
+	for _, handler := range handlers {
+		lag += handler.Lag
+	}
+
+	return lag, nil
+}
+
+// stats are latencies of bookings made in a period.
+type stats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+	skipped   int
+}
+
+func (s *stats) Record(latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, latency)
+}
+
+func (s *stats) Skip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.skipped++
+}
+
+// Reset returns the stats collected so far and starts collecting them from scratch.
+func (s *stats) Reset() *stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	collected := &stats{latencies: s.latencies, errors: s.errors, skipped: s.skipped}
+	s.latencies, s.errors, s.skipped = nil, 0, 0
+
+	return collected
+}
+
+// Summary formats the rate of successful bookings made within period and their latency percentiles.
+func (s *stats) Summary(period time.Duration) string {
+	s.mu.Lock()
+	latencies := slices.Clone(s.latencies)
+	errors, skipped := s.errors, s.skipped
+	s.mu.Unlock()
+
+	slices.Sort(latencies)
+
+	summary := fmt.Sprintf("%d ok (%.1f rps), %d errors, %d skipped", len(latencies), float64(len(latencies))/period.Seconds(), errors, skipped)
+	if len(latencies) == 0 {
+		return summary
+	}
+
+	return summary + fmt.Sprintf(
+		", latency p50 %s p90 %s p99 %s max %s",
+		percentile(latencies, 50),
+		percentile(latencies, 90),
+		percentile(latencies, 99),
+		latencies[len(latencies)-1].Round(time.Millisecond),
+	)
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank-1, 0)].Round(time.Millisecond)
+}
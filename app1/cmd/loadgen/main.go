@@ -0,0 +1,158 @@
+// Command loadgen books rooms at the configured rate, to show how the app behaves under load.
+//
+// Bookings are made with POST /book, or with BookRoom commands sent straight to the broker
+// configured like the app with environment variables (-target=command).
+// Latency percentiles are printed every -report-interval and at the end.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/google/uuid"
+	app "github.com/roblaszczak/watermill-livecoding"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+func main() {
+	target := flag.String("target", "http", "http sends POST /book requests, command sends BookRoom commands to the broker")
+	url := flag.String("url", "http://localhost:8080", "URL of the bookings API, used with -target=http")
+	sync := flag.Bool("sync", false, "book with POST /book?sync=true, so latency includes the payment")
+	rps := flag.Float64("rps", 10, "bookings per second after the ramp-up")
+	duration := flag.Duration("duration", time.Minute, "how long to generate load, including the ramp-up")
+	profile := flag.String("profile", profileConstant, "ramp-up profile: constant, linear or step")
+	rampUp := flag.Duration("ramp-up", 30*time.Second, "how long it takes to reach -rps with linear and step profiles")
+	steps := flag.Int("steps", 5, "number of steps of the step profile")
+	concurrency := flag.Int("concurrency", 100, "maximum number of bookings in flight, bookings above it are skipped")
+	reportInterval := flag.Duration("report-interval", 5*time.Second, "how often latency percentiles are printed")
+	lagURL := flag.String("lag-url", "", "GET /debug/lag URL of the app, the total consumer lag is printed with reports when set")
+	flag.Parse()
+
+	rate, err := newRateProfile(*profile, *rps, *rampUp, *steps)
+	if err != nil {
+		exit(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var book bookFunc
+	switch *target {
+	case "http":
+		book = httpBooking(*url, *sync)
+	case "command":
+		var closeContainer func() error
+		book, closeContainer, err = commandBooking(ctx)
+		if err != nil {
+			exit(err)
+		}
+		defer func() {
+			if err := closeContainer(); err != nil {
+				slog.With("err", err).Warn("Failed to close container")
+			}
+		}()
+	default:
+		exit(fmt.Errorf("unknown target %s, must be http or command", *target))
+	}
+
+	generator := loadGenerator{
+		book:           book,
+		rate:           rate,
+		duration:       *duration,
+		concurrency:    *concurrency,
+		reportInterval: *reportInterval,
+		lagURL:         *lagURL,
+	}
+	generator.Run(ctx)
+}
+
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// bookFunc makes one booking, it returns an error when the booking was not accepted.
+type bookFunc func(ctx context.Context) error
+
+func newBookRoomRequest() map[string]any {
+	// Every booking is for a different room, so they are not rejected as unavailable.
+	return map[string]any{
+		"room_id":      uuid.NewString(),
+		"guests_count": 2,
+	}
+}
+
+func httpBooking(url string, sync bool) bookFunc {
+	client := &http.Client{Timeout: time.Minute}
+	bookURL := url + "/book"
+	if sync {
+		bookURL += "?sync=true"
+	}
+
+	return func(ctx context.Context) error {
+		body, err := json.Marshal(newBookRoomRequest())
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, bookURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+
+		return nil
+	}
+}
+
+// commandBooking sends BookRoom with the command bus built by the app's container,
+// so the load skips the HTTP API and reaches handlers through the broker.
+func commandBooking(ctx context.Context) (bookFunc, func() error, error) {
+	config, err := app.LoadConfig(app.Service{Name: "loadgen"})
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	container := app.NewContainer(ctx, config, watermill.NopLogger{})
+
+	commandBus, err := container.CommandBus()
+	if err != nil {
+		_ = container.Close()
+		return nil, nil, err
+	}
+
+	book := func(ctx context.Context) error {
+		today := time.Now().UTC()
+
+		return commandBus.Send(ctx, contracts.BookRoom{
+			BookingID:   uuid.NewString(),
+			RoomID:      uuid.NewString(),
+			GuestsCount: 2,
+			CheckIn:     today.Format(time.DateOnly),
+			CheckOut:    today.AddDate(0, 0, 1).Format(time.DateOnly),
+			Currency:    contracts.BaseCurrency,
+		})
+	}
+
+	return book, container.Close, nil
+}
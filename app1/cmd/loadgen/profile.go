@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	profileConstant = "constant"
+	profileLinear   = "linear"
+	profileStep     = "step"
+)
+
+// rateProfile returns bookings per second at elapsed time since the load started.
+type rateProfile func(elapsed time.Duration) float64
+
+func newRateProfile(profile string, rps float64, rampUp time.Duration, steps int) (rateProfile, error) {
+	if rps <= 0 {
+		return nil, fmt.Errorf("rps must be positive")
+	}
+
+	switch profile {
+	case profileConstant:
+		return func(time.Duration) float64 {
+			return rps
+		}, nil
+	case profileLinear:
+		return func(elapsed time.Duration) float64 {
+			if elapsed >= rampUp {
+				return rps
+			}
+			return rps * float64(elapsed) / float64(rampUp)
+		}, nil
+	case profileStep:
+		if steps <= 0 {
+			return nil, fmt.Errorf("steps must be positive")
+		}
+
+		stepDuration := rampUp / time.Duration(steps)
+		return func(elapsed time.Duration) float64 {
+			if elapsed >= rampUp || stepDuration == 0 {
+				return rps
+			}
+			// The first step starts at the rate of one step, not at zero.
+			step := int(elapsed/stepDuration) + 1
+			return rps * float64(step) / float64(steps)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown profile %s, must be constant, linear or step", profile)
+	}
+}
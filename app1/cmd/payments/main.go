@@ -0,0 +1,7 @@
+package main
+
+import app "github.com/roblaszczak/watermill-livecoding"
+
+func main() {
+	app.Run(app.PaymentsService)
+}
@@ -0,0 +1,127 @@
+// Command publish publishes a command or event with the JSON payload read from a file or stdin,
+// e.g. to reproduce bugs or backfill events.
+//
+// The payload is validated against the message's type and published with the app's buses,
+// so it gets the same metadata as messages published by the app. It's configured like the app
+// with environment variables.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/ThreeDotsLabs/watermill"
+	app "github.com/roblaszczak/watermill-livecoding"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: publish [flags] <command or event name>\n\nFlags:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nCommands and events: %s\n", strings.Join(app.MessageNames(), ", "))
+	}
+	file := flag.String("file", "-", "file with the JSON payload, - reads it from stdin")
+	dryRun := flag.Bool("dry-run", false, "only validate the payload and print it as it would be published")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), *file, *dryRun); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(name string, file string, dryRun bool) error {
+	v, ok := app.NewMessage(name)
+	if !ok {
+		return fmt.Errorf("unknown command or event %s, available ones: %s", name, strings.Join(app.MessageNames(), ", "))
+	}
+
+	payload, err := readPayload(file)
+	if err != nil {
+		return err
+	}
+	if err := decodePayload(payload, v); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", name, err)
+	}
+
+	if dryRun {
+		validated, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(validated))
+		return nil
+	}
+
+	config, err := app.LoadConfig(app.Service{Name: "publish"})
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	container := app.NewContainer(ctx, config, watermill.NopLogger{})
+	defer container.Close()
+
+	if err := publish(ctx, container, name, v); err != nil {
+		return fmt.Errorf("could not publish %s: %w", name, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Published %s\n", name)
+
+	return nil
+}
+
+// publish sends commands with the command bus and publishes events with the event bus.
+func publish(ctx context.Context, container *app.Container, name string, v any) error {
+	if app.IsCommand(name) {
+		commandBus, err := container.CommandBus()
+		if err != nil {
+			return err
+		}
+		return commandBus.Send(ctx, v)
+	}
+
+	eventBus, err := container.EventBus()
+	if err != nil {
+		return err
+	}
+	return eventBus.Publish(ctx, v)
+}
+
+func readPayload(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
+
+// decodePayload rejects fields the message doesn't have, so typos don't publish messages with missing data.
+func decodePayload(payload []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("payload has more than one JSON value")
+	}
+
+	return nil
+}
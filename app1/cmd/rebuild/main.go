@@ -0,0 +1,78 @@
+// Command rebuild rebuilds a projection's table from scratch with events kept by Kafka,
+// e.g. after a bug in the projection was fixed or a column was added.
+//
+// The running app keeps serving the current table until the rebuilt one replaces it.
+// It's configured like the app with environment variables.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	app "github.com/roblaszczak/watermill-livecoding"
+)
+
+func main() {
+	projection := flag.String("projection", "", "projection to rebuild, e.g. bookings_projection")
+	rateLimit := flag.Int("rate-limit", 0, "maximum number of events replayed per second, 0 disables the limit")
+	flag.Parse()
+
+	if *projection == "" {
+		fmt.Fprintln(os.Stderr, "-projection is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*projection, *rateLimit); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(projection string, rateLimit int) error {
+	config, err := app.LoadConfig(app.Service{Name: "rebuild"})
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	container := app.NewContainer(ctx, config, watermill.NopLogger{})
+	defer container.Close()
+
+	rebuild, err := container.ProjectionRebuild(projection)
+	if err != nil {
+		return err
+	}
+	rebuild.RateLimit = rateLimit
+	rebuild.OnProgress = printProgress
+
+	start := time.Now()
+	if err := rebuild.Run(ctx); err != nil {
+		return fmt.Errorf("rebuild of %s failed, the current table is kept: %w", projection, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Rebuilt %s in %s\n", projection, time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
+
+func printProgress(progress app.RebuildProgress) {
+	percent := 100.0
+	if progress.Total > 0 {
+		percent = float64(progress.Replayed) / float64(progress.Total) * 100
+	}
+
+	fmt.Fprintf(
+		os.Stderr,
+		"%s %s %d/%d events (%.0f%%)\n",
+		progress.Projection, progress.Phase, progress.Replayed, progress.Total, percent,
+	)
+}
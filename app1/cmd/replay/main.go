@@ -0,0 +1,157 @@
+// Command replay replays events kept by Kafka from an offset or time, e.g. after fixing a bug in a handler
+// or to repair a projection.
+//
+// Events are replayed to one handler's replay topic, other handlers don't receive them, or into a projection,
+// which handlers are called in this process. It's configured like the app with environment variables.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	app "github.com/roblaszczak/watermill-livecoding"
+)
+
+type options struct {
+	topic      string
+	from       app.ReadPosition
+	handler    string
+	projection string
+	rateLimit  int
+	dryRun     bool
+}
+
+func main() {
+	var opts options
+	var fromTime string
+
+	flag.StringVar(&opts.topic, "topic", "", "topic to replay, e.g. RoomBooked")
+	flag.Int64Var(&opts.from.Offset, "from-offset", 0, "offset in every partition from which events are replayed")
+	flag.StringVar(&fromTime, "from-time", "", "replay events published at or after the time (RFC 3339), overrides -from-offset")
+	flag.StringVar(&opts.handler, "handler", "", "handler which gets the replayed events on its replay topic")
+	flag.StringVar(&opts.projection, "projection", "", "projection which handlers are called with the replayed events, e.g. bookings_projection")
+	flag.IntVar(&opts.rateLimit, "rate-limit", 0, "maximum number of events replayed per second, 0 disables the limit")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "only print offsets of events which would be replayed")
+	flag.Parse()
+
+	if fromTime != "" {
+		t, err := time.Parse(time.RFC3339, fromTime)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -from-time: %v\n", err)
+			os.Exit(2)
+		}
+		opts.from.Time = t
+	}
+
+	if opts.topic == "" || (opts.handler == "") == (opts.projection == "") {
+		fmt.Fprintln(os.Stderr, "-topic and one of -handler or -projection are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(opts options) error {
+	config, err := app.LoadConfig(app.Service{Name: "replay"})
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	container := app.NewContainer(ctx, config, watermill.NopLogger{})
+	defer container.Close()
+
+	reader, err := container.TopicReader()
+	if err != nil {
+		return err
+	}
+
+	replay := app.Replay{
+		Reader:    reader,
+		Topic:     opts.topic,
+		From:      opts.from,
+		RateLimit: opts.rateLimit,
+	}
+
+	if opts.dryRun {
+		ranges, err := replay.Plan()
+		if err != nil {
+			return err
+		}
+		printPlan(ranges)
+		return nil
+	}
+
+	replay.Target, err = replayTarget(container, opts)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	replayed, err := replay.Run(ctx)
+	fmt.Fprintf(os.Stderr, "Replayed %d events of %s in %s\n", replayed, opts.topic, time.Since(start).Round(time.Millisecond))
+	if errors.Is(err, context.Canceled) {
+		return errors.New("replay interrupted, replay the rest from the next offset")
+	}
+
+	return err
+}
+
+func replayTarget(container *app.Container, opts options) (app.ReplayTarget, error) {
+	if opts.handler != "" {
+		publisher, err := container.Publisher()
+		if err != nil {
+			return nil, err
+		}
+		return app.ReplayToHandler(publisher, opts.handler), nil
+	}
+
+	marshaler, err := container.Marshaler()
+	if err != nil {
+		return nil, err
+	}
+	handlers, err := container.ProjectionHandlers(opts.projection)
+	if err != nil {
+		return nil, err
+	}
+
+	handlesTopic := slices.ContainsFunc(handlers, func(handler cqrs.EventHandler) bool {
+		return marshaler.Name(handler.NewEvent()) == opts.topic
+	})
+	if !handlesTopic {
+		return nil, fmt.Errorf("projection %s doesn't handle %s", opts.projection, opts.topic)
+	}
+
+	return app.ReplayToEventHandlers(marshaler, handlers), nil
+}
+
+func printPlan(ranges []app.PartitionRange) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer writer.Flush()
+
+	fmt.Fprintln(writer, "PARTITION\tFROM\tTO\tEVENTS")
+
+	var total int64
+	for _, partitionRange := range ranges {
+		fmt.Fprintf(writer, "%d\t%d\t%d\t%d\n", partitionRange.Partition, partitionRange.From, partitionRange.To, partitionRange.Count())
+		total += partitionRange.Count()
+	}
+
+	fmt.Fprintf(writer, "total\t\t\t%d\n", total)
+}
@@ -0,0 +1,112 @@
+// Command tail prints commands and events published to the app's topics, so they can be watched
+// without exec-ing into the broker's container.
+//
+// It's configured like the app with environment variables, and reads topics with a new consumer group,
+// so it doesn't take messages from the app's handlers.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/google/uuid"
+	app "github.com/roblaszczak/watermill-livecoding"
+)
+
+func main() {
+	topics := flag.String("topics", "", "comma-separated topics to print, all commands and events by default")
+	bookingID := flag.String("booking-id", "", "print only messages of the booking")
+	fromBeginning := flag.Bool("from-beginning", false, "print messages published before tail was started, if the broker keeps them")
+	metadata := flag.Bool("metadata", true, "print messages' metadata")
+	color := flag.Bool("color", os.Getenv("NO_COLOR") == "", "color the output, disabled by default when NO_COLOR is set")
+	flag.Parse()
+
+	if err := run(*topics, *bookingID, *fromBeginning, printer{metadata: *metadata, color: *color}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(topicsFlag string, bookingID string, fromBeginning bool, p printer) error {
+	topics := app.MessageNames()
+	if topicsFlag != "" {
+		topics = strings.Split(topicsFlag, ",")
+		for _, topic := range topics {
+			if !slices.Contains(app.MessageNames(), topic) {
+				return fmt.Errorf("unknown topic %s, available topics: %s", topic, strings.Join(app.MessageNames(), ", "))
+			}
+		}
+	}
+
+	config, err := app.LoadConfig(app.Service{Name: "tail"})
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	container := app.NewContainer(ctx, config, watermill.NopLogger{})
+	defer container.Close()
+
+	broker, err := container.Broker()
+	if err != nil {
+		return err
+	}
+	marshaler, err := container.Marshaler()
+	if err != nil {
+		return err
+	}
+
+	offsetReset := app.OffsetResetLatest
+	if fromBeginning {
+		offsetReset = app.OffsetResetEarliest
+	}
+
+	// The consumer group is thrown away, so tail doesn't continue where the previous one stopped.
+	subscriber, err := broker.NewSubscriber("tail_"+uuid.NewString(), offsetReset)
+	if err != nil {
+		return err
+	}
+	defer subscriber.Close()
+
+	// Messages from all topics are printed one at a time, so they are not interleaved.
+	var printLock sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, topic := range topics {
+		messages, err := subscriber.Subscribe(ctx, topic)
+		if err != nil {
+			return fmt.Errorf("could not subscribe to %s: %w", topic, err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for msg := range messages {
+				m := decode(marshaler, topic, msg)
+				if bookingID == "" || m.BookingID == bookingID {
+					printLock.Lock()
+					p.Print(os.Stdout, m)
+					printLock.Unlock()
+				}
+				msg.Ack()
+			}
+		}()
+	}
+
+	fmt.Fprintf(os.Stderr, "Tailing %s\n", strings.Join(topics, ", "))
+
+	wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	app "github.com/roblaszczak/watermill-livecoding"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+const (
+	colorReset = "\033[0m"
+	colorGray  = "\033[90m"
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+	colorCyan  = "\033[36m"
+)
+
+// decodedMessage is the message with its payload decoded to JSON.
+type decodedMessage struct {
+	Topic      string
+	UUID       string
+	OccurredAt time.Time
+	BookingID  string
+	Metadata   message.Metadata
+	Payload    []byte
+	// Err is set if the payload couldn't be unmarshaled, then Payload is the raw payload.
+	Err error
+}
+
+// decode unmarshals the message like the app's handlers do, so compressed, encrypted
+// and older versions of payloads are printed as the handlers see them.
+func decode(marshaler cqrs.CommandEventMarshaler, topic string, msg *message.Message) decodedMessage {
+	m := decodedMessage{
+		Topic:     topic,
+		UUID:      msg.UUID,
+		BookingID: msg.Metadata.Get("booking_id"),
+		Metadata:  msg.Metadata,
+		Payload:   msg.Payload,
+	}
+	m.OccurredAt, _ = time.Parse(time.RFC3339Nano, msg.Metadata.Get(contracts.OccurredAtMetadataKey))
+
+	v, ok := app.NewMessage(topic)
+	if !ok {
+		m.Err = fmt.Errorf("unknown message %s", topic)
+		return m
+	}
+	if err := marshaler.Unmarshal(msg, v); err != nil {
+		m.Err = err
+		return m
+	}
+
+	payload, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		m.Err = err
+		return m
+	}
+	m.Payload = payload
+
+	// Messages published before the booking ID was added to metadata have it only in the payload.
+	if m.BookingID == "" {
+		var fields struct {
+			BookingID string `json:"booking_id"`
+		}
+		_ = json.Unmarshal(payload, &fields)
+		m.BookingID = fields.BookingID
+	}
+
+	return m
+}
+
+type printer struct {
+	metadata bool
+	color    bool
+}
+
+func (p printer) Print(w io.Writer, m decodedMessage) {
+	at := m.OccurredAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	fmt.Fprintf(w, "%s %s", p.colored(colorGray, at.Local().Format("15:04:05.000")), p.colored(topicColor(m.Topic), m.Topic))
+	if m.BookingID != "" {
+		fmt.Fprintf(w, " %s", p.colored(colorGray, "booking_id="+m.BookingID))
+	}
+	fmt.Fprintln(w)
+
+	if p.metadata {
+		fmt.Fprintf(w, "  %s\n", p.colored(colorGray, "uuid="+m.UUID))
+		for _, key := range slices.Sorted(maps.Keys(m.Metadata)) {
+			fmt.Fprintf(w, "  %s\n", p.colored(colorGray, key+"="+m.Metadata[key]))
+		}
+	}
+
+	if m.Err != nil {
+		fmt.Fprintf(w, "  %s\n", p.colored(colorRed, "could not decode: "+m.Err.Error()))
+	}
+	fmt.Fprintf(w, "  %s\n\n", strings.ReplaceAll(string(m.Payload), "\n", "\n  "))
+}
+
+func (p printer) colored(color string, s string) string {
+	if !p.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// topicColor highlights failures in red and successful outcomes in green.
+func topicColor(topic string) string {
+	switch {
+	case strings.HasSuffix(topic, "Failed"), strings.HasSuffix(topic, "Rejected"), strings.HasSuffix(topic, "Unavailable"),
+		strings.HasSuffix(topic, "Expired"), strings.HasSuffix(topic, "Degraded"):
+		return colorRed
+	case strings.HasSuffix(topic, "Taken"), strings.HasSuffix(topic, "Confirmed"), strings.HasSuffix(topic, "Booked"):
+		return colorGreen
+	default:
+		return colorCyan
+	}
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/klauspost/compress/zstd"
+)
+
+// contentEncodingMetadataKey is the compression of the payload, it's not set for uncompressed payloads.
+const contentEncodingMetadataKey = "content_encoding"
+
+const (
+	contentEncodingGzip = "gzip"
+	contentEncodingZstd = "zstd"
+)
+
+// compressingMarshaler compresses payloads of commands and events larger than minSize with the encoding.
+// Payloads are decompressed according to contentEncodingMetadataKey, so messages are unmarshaled with any encoding,
+// or without one, regardless of the configured encoding.
+type compressingMarshaler struct {
+	cqrs.CommandEventMarshaler
+
+	// encoding is gzip or zstd, payloads are not compressed when it's empty.
+	encoding string
+	minSize  int
+}
+
+func (m compressingMarshaler) Marshal(v any) (*message.Message, error) {
+	msg, err := m.CommandEventMarshaler.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.encoding == "" || len(msg.Payload) < m.minSize {
+		return msg, nil
+	}
+
+	msg.Payload, err = compress(m.encoding, msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("could not compress payload: %w", err)
+	}
+	msg.Metadata.Set(contentEncodingMetadataKey, m.encoding)
+
+	return msg, nil
+}
+
+func (m compressingMarshaler) Unmarshal(msg *message.Message, v any) error {
+	encoding := msg.Metadata.Get(contentEncodingMetadataKey)
+	if encoding == "" {
+		return m.CommandEventMarshaler.Unmarshal(msg, v)
+	}
+
+	payload, err := decompress(encoding, msg.Payload)
+	if err != nil {
+		return fmt.Errorf("could not decompress %s payload: %w", encoding, err)
+	}
+
+	// The original message is not modified, so it's retried or dead-lettered as it was received.
+	decompressed := msg.Copy()
+	decompressed.Payload = payload
+	delete(decompressed.Metadata, contentEncodingMetadataKey)
+
+	return m.CommandEventMarshaler.Unmarshal(decompressed, v)
+}
+
+func compress(encoding string, payload []byte) ([]byte, error) {
+	switch encoding {
+	case contentEncodingGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case contentEncodingZstd:
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll(payload, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown content encoding %q", encoding)
+	}
+}
+
+func decompress(encoding string, payload []byte) ([]byte, error) {
+	switch encoding {
+	case contentEncodingGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	case contentEncodingZstd:
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(payload, nil)
+	default:
+		return nil, fmt.Errorf("unknown content encoding %q", encoding)
+	}
+}
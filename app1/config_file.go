@@ -0,0 +1,206 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configKeys are environment variables read by LoadConfig, settings of the config file are validated against them.
+var configKeys = map[string]struct{}{}
+
+// externalConfigKeyPrefixes are environment variables read by libraries, they can be set in the config file as well.
+var externalConfigKeyPrefixes = []string{"OTEL_", "PUBSUB_EMULATOR_HOST"}
+
+// ConfigFile is a YAML or TOML file with settings named after environment variables:
+//
+//	defaults:
+//	  HTTP_ADDR: ":8080"
+//	profiles:
+//	  dev:
+//	    BROKER: inmemory
+//	  prod:
+//	    BROKER: kafka
+//	    KAFKA_BROKERS: [kafka-1:9092, kafka-2:9092]
+//	    HANDLER_TIMEOUTS: {payments: 1m}
+//
+// Settings of the CONFIG_PROFILE profile override defaults and environment variables override both.
+// Lists are joined with commas and maps are joined as key=value pairs, like in environment variables.
+type ConfigFile struct {
+	Defaults map[string]any            `yaml:"defaults" toml:"defaults"`
+	Profiles map[string]map[string]any `yaml:"profiles" toml:"profiles"`
+}
+
+func loadConfigFile(path string) (ConfigFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ConfigFile{}, err
+	}
+
+	var file ConfigFile
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	case ".toml":
+		err = toml.Unmarshal(data, &file)
+	default:
+		return ConfigFile{}, fmt.Errorf("unknown config file extension %q, expected .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return ConfigFile{}, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	return file, nil
+}
+
+// Settings returns settings of the profile merged with defaults.
+func (f ConfigFile) Settings(profile string) (map[string]string, error) {
+	profileSettings, ok := f.Profiles[profile]
+	if !ok && profile != "" {
+		return nil, fmt.Errorf("unknown profile %q, available profiles: %s", profile, strings.Join(slices.Sorted(maps.Keys(f.Profiles)), ", "))
+	}
+
+	settings := map[string]string{}
+	var errs []error
+	for _, values := range []map[string]any{f.Defaults, profileSettings} {
+		for key, value := range values {
+			formatted, err := formatConfigValue(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+				continue
+			}
+			settings[key] = formatted
+		}
+	}
+
+	return settings, errors.Join(errs...)
+}
+
+// formatConfigValue formats the value like it would be set in the environment variable.
+func formatConfigValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			formatted, err := formatConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, formatted)
+		}
+		return strings.Join(values, ","), nil
+	case map[string]any:
+		pairs := make([]string, 0, len(v))
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			formatted, err := formatConfigValue(v[key])
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+"="+formatted)
+		}
+		return strings.Join(pairs, ","), nil
+	case time.Time:
+		if v.Equal(v.Truncate(24 * time.Hour)) {
+			return v.Format(time.DateOnly), nil
+		}
+		return v.Format(time.RFC3339), nil
+	case string, bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v of type %T", value, value)
+	}
+}
+
+// applyConfigFile sets settings of the profile from the config file as environment variables which are not set.
+func applyConfigFile(path string, profile string) (map[string]string, error) {
+	file, err := loadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := file.Settings(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range settings {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return settings, nil
+}
+
+// validateConfigFileKeys returns errors for settings which are not read by LoadConfig, e.g. misspelled ones.
+func validateConfigFileKeys(settings map[string]string) error {
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(settings)) {
+		if _, ok := configKeys[key]; ok {
+			continue
+		}
+		if slices.ContainsFunc(externalConfigKeyPrefixes, func(prefix string) bool {
+			return strings.HasPrefix(key, prefix)
+		}) {
+			continue
+		}
+
+		err := fmt.Errorf("unknown setting %s", key)
+		if suggestion := closestConfigKey(key); suggestion != "" {
+			err = fmt.Errorf("unknown setting %s, did you mean %s?", key, suggestion)
+		}
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// closestConfigKey returns the known setting which is at most 3 edits away from the key.
+func closestConfigKey(key string) string {
+	closest := ""
+	closestDistance := 4
+	for _, known := range slices.Sorted(maps.Keys(configKeys)) {
+		if distance := editDistance(key, known); distance < closestDistance {
+			closest = known
+			closestDistance = distance
+		}
+	}
+
+	return closest
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
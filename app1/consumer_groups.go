@@ -0,0 +1,62 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// OffsetReset decides where a consumer group without committed offsets starts reading.
+type OffsetReset string
+
+const (
+	OffsetResetEarliest OffsetReset = "earliest"
+	OffsetResetLatest   OffsetReset = "latest"
+)
+
+func parseOffsetReset(s string) (OffsetReset, error) {
+	switch OffsetReset(s) {
+	case OffsetResetEarliest, OffsetResetLatest:
+		return OffsetReset(s), nil
+	default:
+		return "", fmt.Errorf("unknown offset reset %q, expected earliest or latest", s)
+	}
+}
+
+// Consumer group strategies:
+//   - handler: every handler has its own consumer group named after the handler,
+//   - service_handler: like handler, but prefixed with the service name, so multiple services can share the broker,
+//   - service: all handlers of the service share one consumer group,
+//     which works only when every handler subscribes to different topics.
+const (
+	ConsumerGroupStrategyHandler        = "handler"
+	ConsumerGroupStrategyServiceHandler = "service_handler"
+	ConsumerGroupStrategyService        = "service"
+)
+
+func consumerGroupName(config Config, handlerName string) string {
+	switch config.ConsumerGroupStrategy {
+	case ConsumerGroupStrategyServiceHandler:
+		return config.ConsumerGroupPrefix + config.ServiceName + "_" + handlerName
+	case ConsumerGroupStrategyService:
+		return config.ConsumerGroupPrefix + config.ServiceName
+	default:
+		return config.ConsumerGroupPrefix + handlerName
+	}
+}
+
+func handlerOffsetReset(config Config, handlerName string) OffsetReset {
+	if offsetReset, ok := config.HandlerOffsetResets[handlerName]; ok {
+		return offsetReset
+	}
+
+	return config.OffsetReset
+}
+
+// newHandlerSubscriber returns the subscriber of the handler's consumer group.
+//
+// Kafka subscribers process partitions of the topic in parallel, while messages with the same partition key
+// are processed in order, so handlers' parallelism is set with TOPIC_PARTITIONS.
+func newHandlerSubscriber(broker Broker, config Config, handlerName string) (message.Subscriber, error) {
+	return broker.NewSubscriber(consumerGroupName(config, handlerName), handlerOffsetReset(config, handlerName))
+}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+// HandlerLag is the number of messages in the handler's topic which were not processed by its consumer group yet.
+type HandlerLag struct {
+	Handler       string    `json:"handler"`
+	Topic         string    `json:"topic"`
+	ConsumerGroup string    `json:"consumer_group"`
+	Lag           int64     `json:"lag"`
+	CheckedAt     time.Time `json:"checked_at"`
+}
+
+// ConsumerLagExporter polls lag of handlers' consumer groups from Kafka
+// and exposes it as the consumer_group_lag gauge and on /debug/lag.
+type ConsumerLagExporter struct {
+	brokers  []string
+	auth     KafkaAuth
+	interval time.Duration
+	gauge    *prometheus.GaugeVec
+
+	lock     sync.RWMutex
+	handlers []HandlerLag
+}
+
+func NewConsumerLagExporter(
+	brokers []string,
+	auth KafkaAuth,
+	interval time.Duration,
+	registry *prometheus.Registry,
+) (*ConsumerLagExporter, error) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_group_lag",
+		Help: "Number of messages in the topic not processed by the handler's consumer group yet.",
+	}, []string{"handler", "topic", "consumer_group"})
+	if err := registry.Register(gauge); err != nil {
+		return nil, err
+	}
+
+	return &ConsumerLagExporter{
+		brokers:  brokers,
+		auth:     auth,
+		interval: interval,
+		gauge:    gauge,
+	}, nil
+}
+
+// Watch adds the handler's consumer group to the polled ones.
+func (e *ConsumerLagExporter) Watch(handler, topic, consumerGroup string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.handlers = append(e.handlers, HandlerLag{
+		Handler:       handler,
+		Topic:         topic,
+		ConsumerGroup: consumerGroup,
+	})
+}
+
+// Run polls the lag every interval until ctx is cancelled.
+func (e *ConsumerLagExporter) Run(ctx context.Context) error {
+	saramaConfig := sarama.NewConfig()
+	if err := e.auth.Apply(saramaConfig); err != nil {
+		return err
+	}
+
+	client, err := sarama.NewClient(e.brokers, saramaConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		e.poll(ctx, client, admin)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *ConsumerLagExporter) poll(ctx context.Context, client sarama.Client, admin sarama.ClusterAdmin) {
+	e.lock.RLock()
+	handlers := slices.Clone(e.handlers)
+	e.lock.RUnlock()
+
+	for i, handler := range handlers {
+		lag, err := topicLag(client, admin, handler.Topic, handler.ConsumerGroup)
+		if err != nil {
+			slog.With("err", err, "handler", handler.Handler).WarnContext(ctx, "Failed to get consumer group lag")
+			continue
+		}
+
+		handlers[i].Lag = lag
+		handlers[i].CheckedAt = time.Now()
+		e.gauge.WithLabelValues(handler.Handler, handler.Topic, handler.ConsumerGroup).Set(float64(lag))
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.handlers = handlers
+}
+
+// topicLag sums the lag of all partitions of topic.
+// Partitions without committed offset are skipped, because the consumer group didn't start reading them yet.
+func topicLag(client sarama.Client, admin sarama.ClusterAdmin, topic, consumerGroup string) (int64, error) {
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	offsets, err := admin.ListConsumerGroupOffsets(consumerGroup, map[string][]int32{topic: partitions})
+	if err != nil {
+		return 0, err
+	}
+
+	var lag int64
+	for _, partition := range partitions {
+		block := offsets.GetBlock(topic, partition)
+		if block == nil || block.Offset < 0 {
+			continue
+		}
+
+		newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return 0, err
+		}
+
+		lag += max(newest-block.Offset, 0)
+	}
+
+	return lag, nil
+}
+
+func (e *ConsumerLagExporter) Handler(writer http.ResponseWriter, request *http.Request) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, e.handlers)
+}
@@ -0,0 +1,1130 @@
+package app
+
+import (
+	"context"
+	stdSQL "database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/components/metrics"
+	"github.com/ThreeDotsLabs/watermill/components/requestreply"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/booking"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/clock"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/messages"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+	"github.com/roblaszczak/watermill-livecoding/internal/loyalty"
+	"github.com/roblaszczak/watermill-livecoding/internal/monitoring"
+	"github.com/roblaszczak/watermill-livecoding/internal/notifications"
+	"github.com/roblaszczak/watermill-livecoding/internal/payments"
+	"github.com/roblaszczak/watermill-livecoding/internal/reporting"
+	"github.com/roblaszczak/watermill-livecoding/internal/webhooks"
+	"github.com/sony/gobreaker"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Container is the composition root of the app. It builds the app's dependencies from the config
+// the first time they are needed, so binaries and tests can assemble only the parts of the app they use.
+//
+// Dependencies holding state or connections are built once and shared, resources they opened are released with Close.
+type Container struct {
+	// ctx is used to wait until the app's dependencies accept connections.
+	ctx             context.Context
+	config          Config
+	watermillLogger watermill.LoggerAdapter
+	clock           clock.Clock
+
+	closers []containerCloser
+
+	db                    provided[*stdSQL.DB]
+	broker                provided[Broker]
+	deduplicationStore    provided[DeduplicationStore]
+	tracerProvider        provided[*sdktrace.TracerProvider]
+	delayedDelivery       provided[DelayedDelivery]
+	publisher             provided[message.Publisher]
+	router                provided[*message.Router]
+	marshaler             provided[cqrs.CommandEventMarshaler]
+	eventBus              provided[*cqrs.EventBus]
+	commandBus            provided[*cqrs.CommandBus]
+	commandProcessor      provided[*cqrs.CommandProcessor]
+	eventProcessor        provided[*cqrs.EventProcessor]
+	bookingRepliesBackend provided[*requestreply.PubSubBackend[booking.Status]]
+	paymentsBreaker       provided[*gobreaker.CircuitBreaker]
+	paymentsProvider      provided[payments.Provider]
+	paymentRecords        provided[payments.Records]
+	projectionCheckpoints provided[*ProjectionCheckpoints]
+	stuckBookings         provided[*monitoring.StuckBookings]
+	consumerLagExporter   provided[*ConsumerLagExporter]
+
+	prometheusRegistry *prometheus.Registry
+	topology           *Topology
+	handlerPauses      *HandlerPauses
+	paymentsChaos      *payments.Chaos
+}
+
+type containerCloser struct {
+	name  string
+	close func() error
+}
+
+// provided is a dependency built by the container, it's built once even if building it failed.
+type provided[T any] struct {
+	value T
+	err   error
+	built bool
+}
+
+func (p *provided[T]) get(build func() (T, error)) (T, error) {
+	if !p.built {
+		p.value, p.err = build()
+		p.built = true
+	}
+	return p.value, p.err
+}
+
+func NewContainer(ctx context.Context, config Config, watermillLogger watermill.LoggerAdapter) *Container {
+	return &Container{
+		ctx:             ctx,
+		config:          config,
+		watermillLogger: watermillLogger,
+		clock:           clock.Real{},
+	}
+}
+
+// SetClock replaces the clock of components waiting for time to pass, like payment retries.
+// It must be called before they are built.
+func (c *Container) SetClock(clock clock.Clock) {
+	c.clock = clock
+}
+
+// SetPaymentsProvider replaces the provider configured with PAYMENTS_PROVIDER, e.g. with one controlled by a test.
+// It must be called before the payments handler is built.
+func (c *Container) SetPaymentsProvider(provider payments.Provider) {
+	c.paymentsProvider = provided[payments.Provider]{value: provider, built: true}
+}
+
+func (c *Container) addCloser(name string, close func() error) {
+	c.closers = append(c.closers, containerCloser{name: name, close: close})
+}
+
+// Close releases resources in the reverse order in which they were opened,
+// so they are released after everything using them.
+func (c *Container) Close() error {
+	var errs []error
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		closer := c.closers[i]
+		if err := closer.close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", closer.name, err))
+		}
+	}
+	c.closers = nil
+
+	return errors.Join(errs...)
+}
+
+func (c *Container) Config() Config {
+	return c.config
+}
+
+func (c *Container) DB() (*stdSQL.DB, error) {
+	return c.db.get(func() (*stdSQL.DB, error) {
+		// Dependencies started together with the app (e.g. by docker-compose) may not accept connections yet.
+		err := waitUntilReady(c.ctx, "postgres", c.config.StartupTimeout, func(ctx context.Context) error {
+			return probePostgres(ctx, c.config.PostgresDSN)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		db, err := newPostgresDB(c.config.PostgresDSN)
+		if err != nil {
+			return nil, err
+		}
+		c.addCloser("postgres", db.Close)
+
+		return db, nil
+	})
+}
+
+func (c *Container) Broker() (Broker, error) {
+	return c.broker.get(func() (Broker, error) {
+		db, err := c.DB()
+		if err != nil {
+			return nil, err
+		}
+
+		err = waitUntilReady(c.ctx, c.config.Broker, c.config.StartupTimeout, func(ctx context.Context) error {
+			return probeBroker(ctx, c.config)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		broker, err := newBroker(c.config, db, c.watermillLogger)
+		if err != nil {
+			return nil, err
+		}
+		// Closed after the router, so messages published by handlers are flushed.
+		c.addCloser("publisher", broker.Publisher().Close)
+		if closer, ok := broker.(interface{ Close() error }); ok {
+			c.addCloser("broker", closer.Close)
+		}
+
+		if c.config.ClaimCheckThreshold > 0 {
+			broker = ClaimCheck{
+				store:     FilesystemBlobStore{dir: c.config.ClaimCheckDir},
+				threshold: c.config.ClaimCheckThreshold,
+			}.Broker(broker)
+		}
+
+		return broker, nil
+	})
+}
+
+// Subscriber returns the subscriber of the handler, which can be paused with the admin API.
+func (c *Container) Subscriber(handlerName string) (message.Subscriber, error) {
+	broker, err := c.Broker()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.HandlerPauses().Subscriber(handlerName, func() (message.Subscriber, error) {
+		return newHandlerSubscriber(broker, c.config, handlerName)
+	})
+}
+
+func (c *Container) DeduplicationStore() (DeduplicationStore, error) {
+	return c.deduplicationStore.get(func() (DeduplicationStore, error) {
+		if c.config.DeduplicationStore == "redis" {
+			err := waitUntilReady(c.ctx, "redis", c.config.StartupTimeout, func(ctx context.Context) error {
+				return probeRedis(ctx, c.config.RedisAddr)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return newDeduplicationStore(c.config)
+	})
+}
+
+func (c *Container) TracerProvider() (*sdktrace.TracerProvider, error) {
+	return c.tracerProvider.get(func() (*sdktrace.TracerProvider, error) {
+		tracerProvider, err := newTracerProvider(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		c.addCloser("tracer_provider", func() error {
+			return tracerProvider.Shutdown(context.Background())
+		})
+
+		return tracerProvider, nil
+	})
+}
+
+// PrometheusRegistry returns the registry of metrics served on METRICS_ADDR.
+func (c *Container) PrometheusRegistry() *prometheus.Registry {
+	if c.prometheusRegistry == nil {
+		registry, closeMetricsServer := metrics.CreateRegistryAndServeHTTP(c.config.MetricsAddr)
+		c.addCloser("metrics_server", func() error {
+			closeMetricsServer()
+			return nil
+		})
+		c.prometheusRegistry = registry
+	}
+	return c.prometheusRegistry
+}
+
+func (c *Container) Audit() (Audit, error) {
+	db, err := c.DB()
+	if err != nil {
+		return Audit{}, err
+	}
+
+	return Audit{
+		db: db,
+	}, nil
+}
+
+func (c *Container) DelayedDelivery() (DelayedDelivery, error) {
+	return c.delayedDelivery.get(func() (DelayedDelivery, error) {
+		db, err := c.DB()
+		if err != nil {
+			return DelayedDelivery{}, err
+		}
+		broker, err := c.Broker()
+		if err != nil {
+			return DelayedDelivery{}, err
+		}
+		audit, err := c.Audit()
+		if err != nil {
+			return DelayedDelivery{}, err
+		}
+
+		metricsBuilder := metrics.NewPrometheusMetricsBuilder(c.PrometheusRegistry(), "", "")
+		publisher, err := metricsBuilder.DecoratePublisher(broker.Publisher())
+		if err != nil {
+			return DelayedDelivery{}, err
+		}
+
+		return DelayedDelivery{
+			db:           db,
+			publisher:    audit.Publisher(publisher),
+			pollInterval: time.Second,
+			batchSize:    100,
+		}, nil
+	})
+}
+
+// Publisher returns the publisher with metrics, audit and delayed delivery.
+func (c *Container) Publisher() (message.Publisher, error) {
+	return c.publisher.get(func() (message.Publisher, error) {
+		delayedDelivery, err := c.DelayedDelivery()
+		if err != nil {
+			return nil, err
+		}
+
+		return delayedDelivery.Publisher()
+	})
+}
+
+func (c *Container) DeadLetterStore() (DeadLetterStore, error) {
+	db, err := c.DB()
+	if err != nil {
+		return DeadLetterStore{}, err
+	}
+
+	return DeadLetterStore{
+		db: db,
+	}, nil
+}
+
+func (c *Container) Quarantine() (Quarantine, error) {
+	db, err := c.DB()
+	if err != nil {
+		return Quarantine{}, err
+	}
+
+	return Quarantine{
+		db: db,
+	}, nil
+}
+
+// Router returns the router with all middlewares added.
+func (c *Container) Router() (*message.Router, error) {
+	return c.router.get(func() (*message.Router, error) {
+		publisher, err := c.Publisher()
+		if err != nil {
+			return nil, err
+		}
+		audit, err := c.Audit()
+		if err != nil {
+			return nil, err
+		}
+		deadLetterStore, err := c.DeadLetterStore()
+		if err != nil {
+			return nil, err
+		}
+		quarantine, err := c.Quarantine()
+		if err != nil {
+			return nil, err
+		}
+		deduplicationStore, err := c.DeduplicationStore()
+		if err != nil {
+			return nil, err
+		}
+		projectionCheckpoints, err := c.ProjectionCheckpoints()
+		if err != nil {
+			return nil, err
+		}
+
+		router, err := message.NewRouter(message.RouterConfig{
+			// Handlers have this much time to finish processing messages after the router is closed.
+			CloseTimeout: c.config.RouterCloseTimeout,
+		}, c.watermillLogger)
+		if err != nil {
+			return nil, err
+		}
+
+		metricsBuilder := metrics.NewPrometheusMetricsBuilder(c.PrometheusRegistry(), "", "")
+		metricsBuilder.AddPrometheusRouterMetrics(router)
+
+		// Added first, so messages replayed to other handlers by older versions are skipped before they are logged or audited.
+		router.AddMiddleware(replayRouterMiddleware)
+
+		router.AddMiddleware(
+			correlationIDRouterMiddleware,
+			operationIDRouterMiddleware,
+			tracingRouterMiddleware,
+			loggingRouterMiddleware,
+		)
+
+		// Added before the dead letter queue, so the final outcome of handling is audited.
+		router.AddMiddleware(audit.Middleware)
+
+		router.AddMiddleware(DeadLetterQueue{
+			Retry: c.config.HandlerRetry.Middleware(c.watermillLogger),
+			// Payments are retried with backoff by payments.Handler, before PaymentFailed is published.
+			NoRetry: []string{"payments", "charge_amendment"},
+			// Invalid bookings from producers other than the HTTP API fail the same way on every attempt.
+			PermanentErrors: []error{booking.ErrInvalidBooking, booking.ErrUnsupportedCurrency},
+			Publisher:       publisher,
+			Store:           deadLetterStore,
+			Logger:          c.watermillLogger,
+		}.Middleware)
+
+		// Added after the dead letter queue, so messages which can't be unmarshaled are not retried.
+		router.AddMiddleware(quarantine.Middleware)
+
+		// Claims don't expire before the handler times out, so a message is not processed by two consumers at once.
+		claimTTL := c.config.HandlerTimeout
+		for _, timeout := range c.config.HandlerTimeouts {
+			claimTTL = max(claimTTL, timeout)
+		}
+
+		router.AddMiddleware(Deduplicator{
+			Store:    deduplicationStore,
+			ClaimTTL: claimTTL,
+			Logger:   c.watermillLogger,
+		}.Middleware)
+
+		// Added after the dead letter queue, so checkpoints are saved only for events processed successfully.
+		router.AddMiddleware(projectionCheckpoints.Middleware)
+
+		if c.config.PaymentsRateLimit > 0 {
+			// Handlers calling the payments provider share its rate limit.
+			router.AddMiddleware(NewHandlerThrottle(
+				[]string{"payments", "payments_booking_cancelled", "refund_payment"},
+				c.config.PaymentsRateLimit,
+			).Middleware)
+		}
+
+		// Every retry gets its own deadline.
+		router.AddMiddleware(HandlerTimeouts{
+			Default:    c.config.HandlerTimeout,
+			PerHandler: c.config.HandlerTimeouts,
+		}.Middleware)
+
+		// Added as the last one, so panics are retried and moved to the dead letter queue like errors.
+		router.AddMiddleware(recoveryRouterMiddleware)
+
+		return router, nil
+	})
+}
+
+func (c *Container) PersonalData() (PersonalDataEncryption, error) {
+	db, err := c.DB()
+	if err != nil {
+		return PersonalDataEncryption{}, err
+	}
+
+	return PersonalDataEncryption{
+		keys: GuestKeys{db: db},
+	}, nil
+}
+
+// Marshaler returns the marshaler of the configured format, which encrypts personal data and compresses
+// and encrypts payloads.
+func (c *Container) Marshaler() (cqrs.CommandEventMarshaler, error) {
+	return c.marshaler.get(func() (cqrs.CommandEventMarshaler, error) {
+		personalData, err := c.PersonalData()
+		if err != nil {
+			return nil, err
+		}
+
+		marshaler := contracts.NewMarshaler(c.config.Marshaler, c.config.SchemaRegistryURL)
+
+		marshaler = personalDataMarshaler{
+			CommandEventMarshaler: marshaler,
+			encryption:            personalData,
+		}
+		// Compressed before encryption, because encrypted payloads don't compress.
+		// It's always added, so compressed messages are consumed before compression is enabled on publishers.
+		marshaler = compressingMarshaler{
+			CommandEventMarshaler: marshaler,
+			encoding:              c.config.PayloadCompression,
+			minSize:               c.config.PayloadCompressionMinSize,
+		}
+		if len(c.config.PayloadEncryptionKeys) > 0 {
+			// Keys are kept without the current key ID as well, so messages encrypted before are still decrypted.
+			marshaler = encryptingMarshaler{
+				CommandEventMarshaler: marshaler,
+				keys: StaticPayloadKeys{
+					currentKeyID: c.config.PayloadEncryptionKeyID,
+					keys:         c.config.PayloadEncryptionKeys,
+				},
+			}
+		}
+
+		return marshaler, nil
+	})
+}
+
+func (c *Container) Topology() *Topology {
+	if c.topology == nil {
+		c.topology = NewTopology(c.config)
+	}
+	return c.topology
+}
+
+func (c *Container) HandlerPauses() *HandlerPauses {
+	if c.handlerPauses == nil {
+		c.handlerPauses = NewHandlerPauses()
+	}
+	return c.handlerPauses
+}
+
+func (c *Container) eventBusConfig() (cqrs.EventBusConfig, error) {
+	marshaler, err := c.Marshaler()
+	if err != nil {
+		return cqrs.EventBusConfig{}, err
+	}
+	topology := c.Topology()
+
+	return cqrs.EventBusConfig{
+		GeneratePublishTopic: func(params cqrs.GenerateEventPublishTopicParams) (string, error) {
+			return params.EventName, nil
+		},
+		OnPublish: func(params cqrs.OnEventSendParams) error {
+			messages.SetUUIDFromContext(params.Message.Context(), params.Message)
+			setCorrelationIDMetadata(params.Message.Context(), params.Message)
+			setOperationIDMetadata(params.Message.Context(), params.Message)
+			setPartitionKeyMetadata(params.Event, params.Message)
+			setEventEnvelopeMetadata(params, c.config.ServiceName)
+			topology.RecordPublished(params.Message.Context(), params.EventName)
+			return nil
+		},
+		Marshaler: marshaler,
+		Logger:    c.watermillLogger,
+	}, nil
+}
+
+func (c *Container) commandBusConfig() (cqrs.CommandBusConfig, error) {
+	marshaler, err := c.Marshaler()
+	if err != nil {
+		return cqrs.CommandBusConfig{}, err
+	}
+	topology := c.Topology()
+
+	return cqrs.CommandBusConfig{
+		GeneratePublishTopic: func(params cqrs.CommandBusGeneratePublishTopicParams) (string, error) {
+			return params.CommandName, nil
+		},
+		OnSend: func(params cqrs.CommandBusOnSendParams) error {
+			setCorrelationIDMetadata(params.Message.Context(), params.Message)
+			setOperationIDMetadata(params.Message.Context(), params.Message)
+			setPartitionKeyMetadata(params.Command, params.Message)
+			topology.RecordPublished(params.Message.Context(), params.CommandName)
+			return nil
+		},
+		Marshaler: marshaler,
+		Logger:    c.watermillLogger,
+	}, nil
+}
+
+func (c *Container) EventBus() (*cqrs.EventBus, error) {
+	return c.eventBus.get(func() (*cqrs.EventBus, error) {
+		publisher, err := c.Publisher()
+		if err != nil {
+			return nil, err
+		}
+		config, err := c.eventBusConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		return cqrs.NewEventBusWithConfig(tracingPublisher{publisher}, config)
+	})
+}
+
+func (c *Container) CommandBus() (*cqrs.CommandBus, error) {
+	return c.commandBus.get(func() (*cqrs.CommandBus, error) {
+		publisher, err := c.Publisher()
+		if err != nil {
+			return nil, err
+		}
+		config, err := c.commandBusConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		return cqrs.NewCommandBusWithConfig(tracingPublisher{publisher}, config)
+	})
+}
+
+// Outbox returns the outbox storing messages in the database, they are published by the forwarder
+// added to the router with outbox.AddForwarder.
+func (c *Container) Outbox() (outbox.Outbox, error) {
+	db, err := c.DB()
+	if err != nil {
+		return outbox.Outbox{}, err
+	}
+	eventBusConfig, err := c.eventBusConfig()
+	if err != nil {
+		return outbox.Outbox{}, err
+	}
+	commandBusConfig, err := c.commandBusConfig()
+	if err != nil {
+		return outbox.Outbox{}, err
+	}
+
+	return outbox.New(db, eventBusConfig, commandBusConfig, c.watermillLogger, func(publisher message.Publisher) message.Publisher {
+		return tracingPublisher{publisher}
+	}), nil
+}
+
+func (c *Container) CommandProcessor() (*cqrs.CommandProcessor, error) {
+	return c.commandProcessor.get(func() (*cqrs.CommandProcessor, error) {
+		router, err := c.Router()
+		if err != nil {
+			return nil, err
+		}
+		marshaler, err := c.Marshaler()
+		if err != nil {
+			return nil, err
+		}
+
+		return cqrs.NewCommandProcessorWithConfig(router, cqrs.CommandProcessorConfig{
+			GenerateSubscribeTopic: func(params cqrs.CommandProcessorGenerateSubscribeTopicParams) (string, error) {
+				return params.CommandName, nil
+			},
+			SubscriberConstructor: func(params cqrs.CommandProcessorSubscriberConstructorParams) (message.Subscriber, error) {
+				return c.Subscriber(params.HandlerName)
+			},
+			Marshaler: quarantiningMarshaler{marshaler},
+			Logger:    c.watermillLogger,
+		})
+	})
+}
+
+func (c *Container) EventProcessor() (*cqrs.EventProcessor, error) {
+	return c.eventProcessor.get(func() (*cqrs.EventProcessor, error) {
+		router, err := c.Router()
+		if err != nil {
+			return nil, err
+		}
+		marshaler, err := c.Marshaler()
+		if err != nil {
+			return nil, err
+		}
+
+		return cqrs.NewEventProcessorWithConfig(router, cqrs.EventProcessorConfig{
+			GenerateSubscribeTopic: func(params cqrs.EventProcessorGenerateSubscribeTopicParams) (string, error) {
+				return params.EventName, nil
+			},
+			SubscriberConstructor: func(params cqrs.EventProcessorSubscriberConstructorParams) (message.Subscriber, error) {
+				return c.Subscriber(params.HandlerName)
+			},
+			Marshaler: quarantiningMarshaler{marshaler},
+			Logger:    c.watermillLogger,
+		})
+	})
+}
+
+func (c *Container) BookingRepliesBackend() (*requestreply.PubSubBackend[booking.Status], error) {
+	return c.bookingRepliesBackend.get(func() (*requestreply.PubSubBackend[booking.Status], error) {
+		broker, err := c.Broker()
+		if err != nil {
+			return nil, err
+		}
+		publisher, err := c.Publisher()
+		if err != nil {
+			return nil, err
+		}
+
+		return newBookingRepliesBackend(broker, publisher, c.config, c.watermillLogger)
+	})
+}
+
+func (c *Container) Currencies() booking.FixedRatesCurrencyConverter {
+	return booking.NewFixedRatesCurrencyConverter(c.config.CurrencyRates)
+}
+
+func (c *Container) GuestContacts() (notifications.GuestContacts, error) {
+	db, err := c.DB()
+	if err != nil {
+		return notifications.GuestContacts{}, err
+	}
+
+	return notifications.NewGuestContacts(db), nil
+}
+
+func (c *Container) PromoCodes() (booking.PromoCodes, error) {
+	db, err := c.DB()
+	if err != nil {
+		return booking.PromoCodes{}, err
+	}
+
+	return booking.NewPromoCodes(db), nil
+}
+
+func (c *Container) RoomBookingHandler() (booking.RoomBookingHandler, error) {
+	db, err := c.DB()
+	if err != nil {
+		return booking.RoomBookingHandler{}, err
+	}
+	commandBus, err := c.CommandBus()
+	if err != nil {
+		return booking.RoomBookingHandler{}, err
+	}
+	contacts, err := c.GuestContacts()
+	if err != nil {
+		return booking.RoomBookingHandler{}, err
+	}
+	promoCodes, err := c.PromoCodes()
+	if err != nil {
+		return booking.RoomBookingHandler{}, err
+	}
+	replies, err := c.BookingRepliesBackend()
+	if err != nil {
+		return booking.RoomBookingHandler{}, err
+	}
+
+	return booking.NewRoomBookingHandler(
+		commandBus,
+		booking.NewIdempotencyKeys(db, time.Hour*24),
+		contacts,
+		c.Currencies(),
+		promoCodes,
+		c.config.BookingResponseStatus,
+		replies,
+	), nil
+}
+
+func (c *Container) Guests() (booking.Guests, error) {
+	db, err := c.DB()
+	if err != nil {
+		return booking.Guests{}, err
+	}
+	transactionalOutbox, err := c.Outbox()
+	if err != nil {
+		return booking.Guests{}, err
+	}
+
+	return booking.NewGuests(transactionalOutbox, db), nil
+}
+
+func (c *Container) BookRoomHandler() (booking.BookRoomHandler, error) {
+	transactionalOutbox, err := c.Outbox()
+	if err != nil {
+		return booking.BookRoomHandler{}, err
+	}
+	personalData, err := c.PersonalData()
+	if err != nil {
+		return booking.BookRoomHandler{}, err
+	}
+	promoCodes, err := c.PromoCodes()
+	if err != nil {
+		return booking.BookRoomHandler{}, err
+	}
+	guests, err := c.Guests()
+	if err != nil {
+		return booking.BookRoomHandler{}, err
+	}
+
+	return booking.NewBookRoomHandler(
+		booking.NewRepository(transactionalOutbox, c.config.BookingUpdateMaxAttempts, c.config.BookingSnapshotInterval, personalData),
+		booking.NewPricing(c.config.PricingRules, c.Currencies()),
+		promoCodes,
+		guests,
+	), nil
+}
+
+func (c *Container) BookingProcessManager() (booking.ProcessManager, error) {
+	transactionalOutbox, err := c.Outbox()
+	if err != nil {
+		return booking.ProcessManager{}, err
+	}
+
+	return booking.NewProcessManager(transactionalOutbox, c.config.BookingExpiration), nil
+}
+
+func (c *Container) BookingsProjection() (booking.Projection, error) {
+	db, err := c.DB()
+	if err != nil {
+		return booking.Projection{}, err
+	}
+
+	return booking.NewProjection(db), nil
+}
+
+// projectionTables are tables of projections which can be replayed and rebuilt, by projections' names.
+var projectionTables = map[string]string{
+	"bookings_projection": booking.ReadModelTable,
+}
+
+// ProjectionHandlers returns event handlers of the projection, e.g. to replay events into it.
+func (c *Container) ProjectionHandlers(projection string) ([]cqrs.EventHandler, error) {
+	return c.projectionHandlers(projection, projectionTables[projection])
+}
+
+// projectionHandlers returns event handlers of the projection building the table.
+func (c *Container) projectionHandlers(projection string, table string) ([]cqrs.EventHandler, error) {
+	db, err := c.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	switch projection {
+	case "bookings_projection":
+		return bookingsProjectionHandlers(booking.NewProjection(db).WithTable(table)), nil
+	default:
+		return nil, fmt.Errorf("unknown projection %s", projection)
+	}
+}
+
+// ProjectionRebuild returns the rebuild of the projection's table from events kept by the broker.
+func (c *Container) ProjectionRebuild(projection string) (ProjectionRebuild, error) {
+	table, ok := projectionTables[projection]
+	if !ok {
+		return ProjectionRebuild{}, fmt.Errorf("unknown projection %s", projection)
+	}
+	shadowTable := table + "_rebuild"
+
+	db, err := c.DB()
+	if err != nil {
+		return ProjectionRebuild{}, err
+	}
+	broker, err := c.Broker()
+	if err != nil {
+		return ProjectionRebuild{}, err
+	}
+	reader, err := c.TopicReader()
+	if err != nil {
+		return ProjectionRebuild{}, err
+	}
+	marshaler, err := c.Marshaler()
+	if err != nil {
+		return ProjectionRebuild{}, err
+	}
+	handlers, err := c.projectionHandlers(projection, shadowTable)
+	if err != nil {
+		return ProjectionRebuild{}, err
+	}
+
+	return ProjectionRebuild{
+		db:          db,
+		broker:      broker,
+		reader:      reader,
+		marshaler:   marshaler,
+		config:      c.config,
+		logger:      c.watermillLogger,
+		projection:  projection,
+		table:       table,
+		shadowTable: shadowTable,
+		handlers:    handlers,
+	}, nil
+}
+
+// bookingsProjectionHandlers are handlers of the bookings read model, which can be also replayed with cmd/replay.
+func bookingsProjectionHandlers(bookingsProjection booking.Projection) []cqrs.EventHandler {
+	return []cqrs.EventHandler{
+		cqrs.NewEventHandler("bookings_projection_room_booked", bookingsProjection.OnRoomBooked),
+		cqrs.NewEventHandler("bookings_projection_room_unavailable", bookingsProjection.OnRoomUnavailable),
+		cqrs.NewEventHandler("bookings_projection_payment_taken", bookingsProjection.OnPaymentTaken),
+		cqrs.NewEventHandler("bookings_projection_booking_cancelled", bookingsProjection.OnBookingCancelled),
+		cqrs.NewEventHandler("bookings_projection_payment_failed", bookingsProjection.OnPaymentFailed),
+		cqrs.NewEventHandler("bookings_projection_booking_expired", bookingsProjection.OnBookingExpired),
+		cqrs.NewEventHandler("bookings_projection_booking_amended", bookingsProjection.OnBookingAmended),
+		cqrs.NewEventHandler("bookings_projection_amendment_reverted", bookingsProjection.OnAmendmentReverted),
+	}
+}
+
+func (c *Container) BookingReplies() (booking.Replies, error) {
+	backend, err := c.BookingRepliesBackend()
+	if err != nil {
+		return booking.Replies{}, err
+	}
+
+	return booking.NewReplies(backend), nil
+}
+
+func (c *Container) Loyalty() (loyalty.Loyalty, error) {
+	db, err := c.DB()
+	if err != nil {
+		return loyalty.Loyalty{}, err
+	}
+	transactionalOutbox, err := c.Outbox()
+	if err != nil {
+		return loyalty.Loyalty{}, err
+	}
+
+	return loyalty.NewLoyalty(transactionalOutbox, db, c.Currencies(), c.config.LoyaltyPointsPerUSD), nil
+}
+
+func (c *Container) StuckBookings() (*monitoring.StuckBookings, error) {
+	return c.stuckBookings.get(func() (*monitoring.StuckBookings, error) {
+		db, err := c.DB()
+		if err != nil {
+			return nil, err
+		}
+		transactionalOutbox, err := c.Outbox()
+		if err != nil {
+			return nil, err
+		}
+
+		return monitoring.NewStuckBookings(
+			transactionalOutbox,
+			db,
+			c.clock,
+			c.config.StuckBookingSLA,
+			c.config.StuckBookingCheckInterval,
+			c.config.StuckBookingRetention,
+			c.PrometheusRegistry(),
+		)
+	})
+}
+
+// PaymentsChaos returns the chaos settings of the fake payments provider, which can be changed with the admin API.
+func (c *Container) PaymentsChaos() *payments.Chaos {
+	if c.paymentsChaos == nil {
+		c.paymentsChaos = payments.NewChaos(c.config.PaymentsChaos, c.clock)
+	}
+	return c.paymentsChaos
+}
+
+func (c *Container) PaymentRecords() (payments.Records, error) {
+	return c.paymentRecords.get(func() (payments.Records, error) {
+		db, err := c.DB()
+		if err != nil {
+			return nil, err
+		}
+
+		return newPaymentRecords(c.config, db)
+	})
+}
+
+func (c *Container) PaymentsBreaker() (*gobreaker.CircuitBreaker, error) {
+	return c.paymentsBreaker.get(func() (*gobreaker.CircuitBreaker, error) {
+		eventBus, err := c.EventBus()
+		if err != nil {
+			return nil, err
+		}
+
+		return payments.NewCircuitBreaker(
+			c.config.PaymentsBreakerThreshold,
+			c.config.PaymentsBreakerOpenFor,
+			eventBus,
+			c.PrometheusRegistry(),
+			c.clock,
+		)
+	})
+}
+
+func (c *Container) PaymentsProvider() (payments.Provider, error) {
+	return c.paymentsProvider.get(func() (payments.Provider, error) {
+		return newPaymentsProvider(c.config, c.PaymentsChaos(), c.clock), nil
+	})
+}
+
+func (c *Container) PaymentsHandler() (payments.Handler, error) {
+	records, err := c.PaymentRecords()
+	if err != nil {
+		return payments.Handler{}, err
+	}
+	breaker, err := c.PaymentsBreaker()
+	if err != nil {
+		return payments.Handler{}, err
+	}
+	eventBus, err := c.EventBus()
+	if err != nil {
+		return payments.Handler{}, err
+	}
+	provider, err := c.PaymentsProvider()
+	if err != nil {
+		return payments.Handler{}, err
+	}
+
+	return payments.NewHandler(
+		provider,
+		records,
+		breaker,
+		eventBus,
+		c.config.PaymentsRetryMaxAttempts,
+		c.config.PaymentsRetryInterval,
+		c.clock,
+		c.config.PaymentsMode == "webhook",
+	), nil
+}
+
+func (c *Container) PaymentsWebhookHandler() (payments.WebhookHandler, error) {
+	records, err := c.PaymentRecords()
+	if err != nil {
+		return payments.WebhookHandler{}, err
+	}
+	eventBus, err := c.EventBus()
+	if err != nil {
+		return payments.WebhookHandler{}, err
+	}
+
+	return payments.NewWebhookHandler(eventBus, records, c.config.PaymentsWebhookSecret, time.Minute*5), nil
+}
+
+func (c *Container) RevenueReport() (reporting.RevenueReport, error) {
+	db, err := c.DB()
+	if err != nil {
+		return reporting.RevenueReport{}, err
+	}
+
+	return reporting.NewRevenueReport(db), nil
+}
+
+func (c *Container) Invoicing() (reporting.Invoicing, error) {
+	db, err := c.DB()
+	if err != nil {
+		return reporting.Invoicing{}, err
+	}
+	transactionalOutbox, err := c.Outbox()
+	if err != nil {
+		return reporting.Invoicing{}, err
+	}
+	bookingsProjection, err := c.BookingsProjection()
+	if err != nil {
+		return reporting.Invoicing{}, err
+	}
+
+	return reporting.NewInvoicing(transactionalOutbox, db, bookingsProjection, c.config.InvoiceTaxRate), nil
+}
+
+// TopicReader returns the reader of messages kept by the broker, so they can be replayed.
+func (c *Container) TopicReader() (TopicReader, error) {
+	broker, err := c.Broker()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := unwrapBroker(broker).(TopicReader); !ok {
+		return nil, fmt.Errorf("broker %s doesn't keep consumed messages, they can't be replayed", c.config.Broker)
+	}
+
+	return broker.(TopicReader), nil
+}
+
+func (c *Container) ProjectionCheckpoints() (*ProjectionCheckpoints, error) {
+	return c.projectionCheckpoints.get(func() (*ProjectionCheckpoints, error) {
+		db, err := c.DB()
+		if err != nil {
+			return nil, err
+		}
+
+		var reader TopicReader
+		if c.config.Broker == "kafka" {
+			reader, err = c.TopicReader()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return NewProjectionCheckpoints(
+			db,
+			reader,
+			c.clock,
+			c.config.ProjectionCheckpointInterval,
+			c.config.ProjectionMaxStaleness,
+			c.PrometheusRegistry(),
+		)
+	})
+}
+
+func (c *Container) EventsStream() (EventsStream, error) {
+	broker, err := c.Broker()
+	if err != nil {
+		return EventsStream{}, err
+	}
+	marshaler, err := c.Marshaler()
+	if err != nil {
+		return EventsStream{}, err
+	}
+
+	return EventsStream{
+		broker:              broker,
+		marshaler:           marshaler,
+		consumerGroupPrefix: c.config.ConsumerGroupPrefix,
+	}, nil
+}
+
+func (c *Container) NotificationsHandler() (notifications.Handler, error) {
+	bookingsProjection, err := c.BookingsProjection()
+	if err != nil {
+		return notifications.Handler{}, err
+	}
+	contacts, err := c.GuestContacts()
+	if err != nil {
+		return notifications.Handler{}, err
+	}
+
+	return notifications.NewHandler(bookingsProjection, contacts, c.EmailSender()), nil
+}
+
+func (c *Container) EmailSender() notifications.EmailSender {
+	switch c.config.EmailSender {
+	case "smtp":
+		return notifications.NewSMTPEmailSender(c.config.SMTPAddr, c.config.EmailFrom, c.config.SMTPUsername, c.config.SMTPPassword)
+	default:
+		return notifications.LogEmailSender{}
+	}
+}
+
+func (c *Container) SlackAlerts() SlackAlerts {
+	return NewSlackAlerts(c.config.SlackWebhookURL)
+}
+
+func (c *Container) WebhookSubscriptions() (webhooks.Subscriptions, error) {
+	db, err := c.DB()
+	if err != nil {
+		return webhooks.Subscriptions{}, err
+	}
+	marshaler, err := c.Marshaler()
+	if err != nil {
+		return webhooks.Subscriptions{}, err
+	}
+
+	var eventNames []string
+	for _, event := range streamedEvents {
+		eventNames = append(eventNames, marshaler.Name(event))
+	}
+
+	return webhooks.NewSubscriptions(db, eventNames), nil
+}
+
+func (c *Container) WebhookDispatcher() (webhooks.Dispatcher, error) {
+	subscriptions, err := c.WebhookSubscriptions()
+	if err != nil {
+		return webhooks.Dispatcher{}, err
+	}
+	marshaler, err := c.Marshaler()
+	if err != nil {
+		return webhooks.Dispatcher{}, err
+	}
+
+	return webhooks.NewDispatcher(
+		subscriptions,
+		marshaler,
+		&http.Client{Timeout: 10 * time.Second},
+		c.config.WebhookMaxAttempts,
+		c.config.WebhookRetryInterval,
+		c.config.WebhookDisableAfter,
+	), nil
+}
+
+// ConsumerLagExporter returns the exporter of consumer lag, it's available only with Kafka.
+func (c *Container) ConsumerLagExporter() (*ConsumerLagExporter, error) {
+	return c.consumerLagExporter.get(func() (*ConsumerLagExporter, error) {
+		if c.config.Broker != "kafka" {
+			return nil, fmt.Errorf("consumer lag is exported only with Kafka, the broker is %s", c.config.Broker)
+		}
+
+		return NewConsumerLagExporter(
+			c.config.KafkaBrokers,
+			c.config.KafkaAuth,
+			c.config.ConsumerLagInterval,
+			c.PrometheusRegistry(),
+		)
+	})
+}
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+// Commands and events are defined in the contracts package, so they are shared by all services.
+// They are aliased here, so handlers don't have to prefix them.
+
+type Money = contracts.Money
+
+// Commands.
+type (
+	BookRoom        = contracts.BookRoom
+	CancelBooking   = contracts.CancelBooking
+	RefundPayment   = contracts.RefundPayment
+	ExpireBooking   = contracts.ExpireBooking
+	AmendBooking    = contracts.AmendBooking
+	ChargeAmendment = contracts.ChargeAmendment
+	RevertAmendment = contracts.RevertAmendment
+	ForgetGuest     = contracts.ForgetGuest
+)
+
+// Events.
+type (
+	AmendmentPaymentFailed = contracts.AmendmentPaymentFailed
+	AmendmentPaymentTaken  = contracts.AmendmentPaymentTaken
+	AmendmentRejected      = contracts.AmendmentRejected
+	AmendmentReverted      = contracts.AmendmentReverted
+	BookingAmended         = contracts.BookingAmended
+	BookingCancelled       = contracts.BookingCancelled
+	BookingConfirmed       = contracts.BookingConfirmed
+	BookingExpired         = contracts.BookingExpired
+	BookingFailed          = contracts.BookingFailed
+	BookingStuck           = contracts.BookingStuck
+	CheckInReminder        = contracts.CheckInReminder
+	DailyReportRequested   = contracts.DailyReportRequested
+	DiscountApplied        = contracts.DiscountApplied
+	GuestForgotten         = contracts.GuestForgotten
+	GuestRegistered        = contracts.GuestRegistered
+	InvoiceIssued          = contracts.InvoiceIssued
+	LoyaltyPointsEarned    = contracts.LoyaltyPointsEarned
+	PaymentFailed          = contracts.PaymentFailed
+	PaymentRefunded        = contracts.PaymentRefunded
+	PaymentTaken           = contracts.PaymentTaken
+	PaymentsDegraded       = contracts.PaymentsDegraded
+	RefundRejected         = contracts.RefundRejected
+	RoomBooked             = contracts.RoomBooked
+	RoomUnavailable        = contracts.RoomUnavailable
+)
@@ -0,0 +1,61 @@
+// Package contracts contains commands and events exchanged by the services and their marshalers.
+package contracts
+
+type BookRoom struct {
+	BookingID   string `json:"booking_id"`
+	RoomID      string `json:"room_id"`
+	GuestsCount int    `json:"guests_count"`
+	CheckIn     string `json:"check_in"`
+	CheckOut    string `json:"check_out"`
+	GuestID     string `json:"guest_id,omitempty"`
+
+	// Currency of the price, calculated by BookRoomHandler.
+	Currency  string `json:"currency"`
+	PromoCode string `json:"promo_code,omitempty"`
+}
+
+type CancelBooking struct {
+	BookingID string `json:"booking_id"`
+}
+
+// RefundPayment refunds Amount of the booking's payment, or everything which wasn't refunded yet if Amount is zero.
+type RefundPayment struct {
+	BookingID string `json:"booking_id"`
+	// RefundID identifies partial refunds, refunds without it refund the whole payment once.
+	RefundID string `json:"refund_id,omitempty"`
+	Amount   Money  `json:"amount"`
+}
+
+// ExpireBooking is sent with a delay when the booking is made, to expire it if it's still not paid.
+type ExpireBooking struct {
+	BookingID string `json:"booking_id"`
+}
+
+// AmendBooking changes the guests count or dates of a paid booking before the check-in.
+type AmendBooking struct {
+	BookingID   string `json:"booking_id"`
+	AmendmentID string `json:"amendment_id"`
+	// GuestsCount, CheckIn and CheckOut are not changed when they are empty.
+	GuestsCount int    `json:"guests_count,omitempty"`
+	CheckIn     string `json:"check_in,omitempty"`
+	CheckOut    string `json:"check_out,omitempty"`
+}
+
+// ChargeAmendment charges the guest for the amendment which made the booking more expensive.
+type ChargeAmendment struct {
+	BookingID   string `json:"booking_id"`
+	AmendmentID string `json:"amendment_id"`
+	Amount      Money  `json:"amount"`
+}
+
+// RevertAmendment is sent when the amendment's charge fails, to restore the stay from before it.
+type RevertAmendment struct {
+	BookingID   string `json:"booking_id"`
+	AmendmentID string `json:"amendment_id"`
+	Reason      string `json:"reason"`
+}
+
+// ForgetGuest erases personal data of the guest, including data carried by already published events.
+type ForgetGuest struct {
+	GuestID string `json:"guest_id"`
+}
@@ -0,0 +1,15 @@
+package contracts
+
+// Metadata keys of the event envelope, set on every published event.
+const (
+	EventIDMetadataKey       = "event_id"
+	OccurredAtMetadataKey    = "occurred_at"
+	ProducerMetadataKey      = "producer"
+	SchemaVersionMetadataKey = "schema_version"
+)
+
+// VersionedEvent is implemented by events with a schema version other than 1.
+// Bump the version when an event changes in a way which consumers need to know about.
+type VersionedEvent interface {
+	SchemaVersion() int
+}
@@ -0,0 +1,203 @@
+package contracts
+
+import "time"
+
+type AmendmentPaymentFailed struct {
+	BookingID   string `json:"booking_id"`
+	AmendmentID string `json:"amendment_id"`
+	Reason      string `json:"reason"`
+}
+
+type AmendmentPaymentTaken struct {
+	BookingID   string `json:"booking_id"`
+	AmendmentID string `json:"amendment_id"`
+	Amount      Money  `json:"amount"`
+}
+
+type AmendmentRejected struct {
+	BookingID   string `json:"booking_id"`
+	AmendmentID string `json:"amendment_id"`
+	Reason      string `json:"reason"`
+}
+
+// AmendmentReverted is published with the restored stay when the amendment couldn't be paid.
+type AmendmentReverted struct {
+	BookingID   string `json:"booking_id"`
+	AmendmentID string `json:"amendment_id"`
+	RoomID      string `json:"room_id"`
+	GuestsCount int    `json:"guests_count"`
+	CheckIn     string `json:"check_in"`
+	CheckOut    string `json:"check_out"`
+	Price       Money  `json:"price"`
+	Reason      string `json:"reason"`
+}
+
+// BookingAmended is published when the stay is changed. The price Difference is charged,
+// or refunded if it's negative, by booking.ProcessManager.
+type BookingAmended struct {
+	BookingID   string `json:"booking_id"`
+	AmendmentID string `json:"amendment_id"`
+	RoomID      string `json:"room_id"`
+	GuestsCount int    `json:"guests_count"`
+	CheckIn     string `json:"check_in"`
+	CheckOut    string `json:"check_out"`
+	Price       Money  `json:"price"`
+	Difference  Money  `json:"difference"`
+}
+
+type BookingCancelled struct {
+	BookingID string `json:"booking_id"`
+	RoomID    string `json:"room_id"`
+	Price     Money  `json:"price"`
+}
+
+// SchemaVersion of BookingCancelled is 2 since Price is Money.
+func (BookingCancelled) SchemaVersion() int {
+	return 2
+}
+
+type BookingConfirmed struct {
+	BookingID string `json:"booking_id"`
+}
+
+type BookingExpired struct {
+	BookingID string `json:"booking_id"`
+}
+
+type BookingFailed struct {
+	BookingID string `json:"booking_id"`
+	Reason    string `json:"reason"`
+}
+
+// BookingStuck is published when the booking's payment had no outcome within the SLA after the room was booked.
+type BookingStuck struct {
+	BookingID  string    `json:"booking_id"`
+	RoomID     string    `json:"room_id"`
+	BookedAt   time.Time `json:"booked_at"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// CheckInReminder is published a day before the guest checks in.
+type CheckInReminder struct {
+	BookingID string `json:"booking_id"`
+	CheckIn   string `json:"check_in"`
+}
+
+// DailyReportRequested is published by the scheduler when the revenue of Day should be reported.
+type DailyReportRequested struct {
+	// Day is the last full day (YYYY-MM-DD, UTC) before the report was requested.
+	Day         string    `json:"day"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// DiscountApplied is raised together with RoomBooked when the booking was made with a promo code.
+// RoomBooked's price is already discounted.
+type DiscountApplied struct {
+	BookingID     string `json:"booking_id"`
+	PromoCode     string `json:"promo_code"`
+	PercentOff    int    `json:"percent_off"`
+	OriginalPrice Money  `json:"original_price"`
+	Discount      Money  `json:"discount"`
+}
+
+type GuestForgotten struct {
+	GuestID string `json:"guest_id"`
+}
+
+// GuestRegistered is published when the guest registers.
+type GuestRegistered struct {
+	GuestID string `json:"guest_id"`
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+}
+
+// InvoiceIssued is published when the invoice of a paid booking is issued.
+type InvoiceIssued struct {
+	Number    string    `json:"number"`
+	BookingID string    `json:"booking_id"`
+	Total     Money     `json:"total"`
+	Tax       Money     `json:"tax"`
+	IssuedAt  time.Time `json:"issued_at"`
+}
+
+// LoyaltyPointsEarned is published when the guest earns points for a paid booking.
+type LoyaltyPointsEarned struct {
+	GuestID   string `json:"guest_id"`
+	BookingID string `json:"booking_id"`
+	Points    int    `json:"points"`
+	// Balance is the guest's points including the earned ones.
+	Balance int `json:"balance"`
+}
+
+type PaymentFailed struct {
+	BookingID string `json:"booking_id"`
+	Reason    string `json:"reason"`
+}
+
+type PaymentRefunded struct {
+	BookingID string `json:"booking_id"`
+	RefundID  string `json:"refund_id"`
+	Amount    Money  `json:"amount"`
+	// Remaining is what is left of the payment after the refund, zero when it's fully refunded.
+	// Refunds published before partial refunds were supported don't have it, they were full refunds.
+	Remaining Money `json:"remaining"`
+}
+
+// SchemaVersion of PaymentRefunded is 2 since Amount is Money.
+func (PaymentRefunded) SchemaVersion() int {
+	return 2
+}
+
+type PaymentTaken struct {
+	BookingID string `json:"booking_id"`
+	RoomID    string `json:"room_id"`
+	Price     Money  `json:"price"`
+}
+
+// SchemaVersion of PaymentTaken is 2 since Price is Money.
+func (PaymentTaken) SchemaVersion() int {
+	return 2
+}
+
+// PaymentsDegraded is published when the payments circuit breaker opens
+// and payments are failed without calling the provider.
+type PaymentsDegraded struct {
+	Reason    string    `json:"reason"`
+	OpenUntil time.Time `json:"open_until"`
+}
+
+// RefundRejected is published instead of PaymentRefunded when the refund doesn't match what was paid.
+type RefundRejected struct {
+	BookingID string `json:"booking_id"`
+	RefundID  string `json:"refund_id"`
+	Amount    Money  `json:"amount"`
+	Reason    string `json:"reason"`
+}
+
+type RoomBooked struct {
+	BookingID   string `json:"booking_id"`
+	RoomID      string `json:"room_id"`
+	GuestsCount int    `json:"guests_count"`
+	Price       Money  `json:"price"`
+	CheckIn     string `json:"check_in"`
+	CheckOut    string `json:"check_out"`
+	// GuestID is empty for bookings made without it.
+	GuestID string `json:"guest_id"`
+	// GuestName and GuestEmail are copied from the registered guest, so consumers don't need to look them up.
+	// They are empty for guests who didn't register.
+	GuestName  string `json:"guest_name"`
+	GuestEmail string `json:"guest_email"`
+}
+
+// SchemaVersion of RoomBooked is 2 since CheckIn and CheckOut were added, and 3 since Price is Money.
+// Older messages are upcasted when unmarshaled.
+func (RoomBooked) SchemaVersion() int {
+	return 3
+}
+
+type RoomUnavailable struct {
+	BookingID string `json:"booking_id"`
+	RoomID    string `json:"room_id"`
+	CheckIn   string `json:"check_in"`
+	CheckOut  string `json:"check_out"`
+}
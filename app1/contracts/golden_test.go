@@ -0,0 +1,301 @@
+package contracts
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"google.golang.org/protobuf/proto"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+const updateHint = "if the change is intended, bump SchemaVersion, add an upcaster of the previous version to eventUpcasters " +
+	"and run go test ./contracts -update, golden files of previous versions are kept"
+
+// samples are commands and events with all fields set, their payloads are compared to golden files
+// in testdata named <name>.v<schema version>.json (and .pb for events defined in proto/events.proto).
+var samples = []any{
+	BookRoom{
+		BookingID:   "booking-1",
+		RoomID:      "room-1",
+		GuestsCount: 2,
+		CheckIn:     "2026-10-12",
+		CheckOut:    "2026-10-14",
+		GuestID:     "guest-1",
+		Currency:    "EUR",
+		PromoCode:   "AUTUMN10",
+	},
+	CancelBooking{BookingID: "booking-1"},
+	RefundPayment{BookingID: "booking-1", RefundID: "refund-1", Amount: eur(4200)},
+	ExpireBooking{BookingID: "booking-1"},
+	AmendBooking{
+		BookingID:   "booking-1",
+		AmendmentID: "amendment-1",
+		GuestsCount: 3,
+		CheckIn:     "2026-10-13",
+		CheckOut:    "2026-10-16",
+	},
+	ChargeAmendment{BookingID: "booking-1", AmendmentID: "amendment-1", Amount: eur(4200)},
+	RevertAmendment{BookingID: "booking-1", AmendmentID: "amendment-1", Reason: "card declined"},
+	ForgetGuest{GuestID: "guest-1"},
+
+	AmendmentPaymentFailed{BookingID: "booking-1", AmendmentID: "amendment-1", Reason: "card declined"},
+	AmendmentPaymentTaken{BookingID: "booking-1", AmendmentID: "amendment-1", Amount: eur(4200)},
+	AmendmentRejected{BookingID: "booking-1", AmendmentID: "amendment-1", Reason: "room unavailable"},
+	AmendmentReverted{
+		BookingID:   "booking-1",
+		AmendmentID: "amendment-1",
+		RoomID:      "room-1",
+		GuestsCount: 2,
+		CheckIn:     "2026-10-12",
+		CheckOut:    "2026-10-14",
+		Price:       eur(8400),
+		Reason:      "card declined",
+	},
+	BookingAmended{
+		BookingID:   "booking-1",
+		AmendmentID: "amendment-1",
+		RoomID:      "room-1",
+		GuestsCount: 3,
+		CheckIn:     "2026-10-13",
+		CheckOut:    "2026-10-16",
+		Price:       eur(12600),
+		Difference:  eur(4200),
+	},
+	BookingCancelled{BookingID: "booking-1", RoomID: "room-1", Price: eur(8400)},
+	BookingConfirmed{BookingID: "booking-1"},
+	BookingExpired{BookingID: "booking-1"},
+	BookingFailed{BookingID: "booking-1", Reason: "payment failed"},
+	BookingStuck{BookingID: "booking-1", RoomID: "room-1", BookedAt: sampleTime, DetectedAt: sampleTime.Add(10 * time.Minute)},
+	CheckInReminder{BookingID: "booking-1", CheckIn: "2026-10-12"},
+	DailyReportRequested{Day: "2026-10-11", RequestedAt: sampleTime},
+	DiscountApplied{
+		BookingID:     "booking-1",
+		PromoCode:     "AUTUMN10",
+		PercentOff:    10,
+		OriginalPrice: eur(9333),
+		Discount:      eur(933),
+	},
+	GuestForgotten{GuestID: "guest-1"},
+	GuestRegistered{GuestID: "guest-1", Name: "Jane Doe", Email: "jane@example.com"},
+	InvoiceIssued{
+		Number:    "INV-2026-000001",
+		BookingID: "booking-1",
+		Total:     eur(8400),
+		Tax:       eur(1571),
+		IssuedAt:  sampleTime,
+	},
+	LoyaltyPointsEarned{GuestID: "guest-1", BookingID: "booking-1", Points: 84, Balance: 120},
+	PaymentFailed{BookingID: "booking-1", Reason: "card declined"},
+	PaymentRefunded{BookingID: "booking-1", RefundID: "refund-1", Amount: eur(4200), Remaining: eur(4200)},
+	PaymentTaken{BookingID: "booking-1", RoomID: "room-1", Price: eur(8400)},
+	PaymentsDegraded{Reason: "provider unavailable", OpenUntil: sampleTime},
+	RefundRejected{BookingID: "booking-1", RefundID: "refund-1", Amount: eur(9000), Reason: "exceeds payment"},
+	RoomBooked{
+		BookingID:   "booking-1",
+		RoomID:      "room-1",
+		GuestsCount: 2,
+		Price:       eur(8400),
+		CheckIn:     "2026-10-12",
+		CheckOut:    "2026-10-14",
+		GuestID:     "guest-1",
+		GuestName:   "Jane Doe",
+		GuestEmail:  "jane@example.com",
+	},
+	RoomUnavailable{BookingID: "booking-1", RoomID: "room-1", CheckIn: "2026-10-12", CheckOut: "2026-10-14"},
+}
+
+var sampleTime = time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)
+
+func eur(amount int) Money {
+	return Money{Amount: amount, Currency: "EUR"}
+}
+
+func schemaVersion(v any) int {
+	if versioned, ok := v.(VersionedEvent); ok {
+		return versioned.SchemaVersion()
+	}
+	return 1
+}
+
+func TestGolden(t *testing.T) {
+	marshaler := NewMarshaler("json", "")
+
+	for _, sample := range samples {
+		name := marshaler.Name(sample)
+		file := fmt.Sprintf("%s.v%d", name, schemaVersion(sample))
+
+		t.Run(name, func(t *testing.T) {
+			msg, err := marshaler.Marshal(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var payload bytes.Buffer
+			if err := json.Indent(&payload, msg.Payload, "", "  "); err != nil {
+				t.Fatal(err)
+			}
+			payload.WriteString("\n")
+
+			assertGolden(t, file+".json", payload.Bytes())
+
+			if pb, ok := toProto(sample); ok {
+				pbPayload, err := proto.MarshalOptions{Deterministic: true}.Marshal(pb)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				assertGolden(t, file+".pb", pbPayload)
+			}
+		})
+	}
+}
+
+func assertGolden(t *testing.T, file string, payload []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", file)
+	if *update {
+		if err := os.WriteFile(path, payload, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	golden, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		t.Fatalf("%s doesn't exist, run go test ./contracts -update to create it", path)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(payload, golden) {
+		t.Errorf("payload differs from %s, %s\n\ngot:\n%s\nwant:\n%s", path, updateHint, payload, golden)
+	}
+}
+
+var goldenFileRegexp = regexp.MustCompile(`^(\w+)\.v(\d+)\.(json|pb)$`)
+
+// TestGolden_previous_versions checks that payloads of previous versions, kept in golden files,
+// can be still unmarshaled into the current version.
+func TestGolden_previous_versions(t *testing.T) {
+	marshaler := NewMarshaler("protobuf", "")
+
+	samplesByName := map[string]any{}
+	for _, sample := range samples {
+		samplesByName[marshaler.Name(sample)] = sample
+	}
+
+	files, err := os.ReadDir("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goldenVersions := map[string]map[int]bool{}
+
+	for _, file := range files {
+		match := goldenFileRegexp.FindStringSubmatch(file.Name())
+		if match == nil {
+			t.Errorf("unexpected file testdata/%s", file.Name())
+			continue
+		}
+		name, format := match[1], match[3]
+		version, _ := strconv.Atoi(match[2])
+
+		sample, ok := samplesByName[name]
+		if !ok {
+			t.Errorf("testdata/%s has no sample, %s was removed or renamed", file.Name(), name)
+			continue
+		}
+
+		if goldenVersions[name] == nil {
+			goldenVersions[name] = map[int]bool{}
+		}
+		goldenVersions[name][version] = true
+
+		currentVersion := schemaVersion(sample)
+		if version > currentVersion {
+			t.Errorf("testdata/%s is newer than the current version %d of %s", file.Name(), currentVersion, name)
+			continue
+		}
+		if version == currentVersion {
+			continue
+		}
+
+		t.Run(file.Name(), func(t *testing.T) {
+			// Protocol Buffers payloads are not upcasted, previous versions are readable thanks to deprecated fields.
+			if _, ok := eventUpcasters[name][version]; !ok && format == "json" {
+				t.Errorf("%s has no upcaster from version %d", name, version)
+			}
+
+			payload, err := os.ReadFile(filepath.Join("testdata", file.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg := message.NewMessage("1", payload)
+			msg.Metadata.Set("name", name)
+			msg.Metadata.Set(SchemaVersionMetadataKey, strconv.Itoa(version))
+			msg.Metadata.Set(OccurredAtMetadataKey, sampleTime.Format(time.RFC3339Nano))
+			if format == "pb" {
+				msg.Metadata.Set(contentTypeMetadataKey, contentTypeProtobuf)
+			}
+
+			v := reflect.New(reflect.TypeOf(sample)).Interface()
+			if err := marshaler.Unmarshal(msg, v); err != nil {
+				t.Fatalf("could not unmarshal version %d of %s: %v", version, name, err)
+			}
+		})
+	}
+
+	// Upcasters are tested with real payloads of versions they upcast from.
+	for name, upcasters := range eventUpcasters {
+		for version := range upcasters {
+			if !goldenVersions[name][version] {
+				t.Errorf("%s has an upcaster from version %d, but no testdata/%s.v%d.json", name, version, name, version)
+			}
+		}
+	}
+}
+
+// TestGolden_all_contracts checks that every command and event has a sample, so its payload is in golden files.
+func TestGolden_all_contracts(t *testing.T) {
+	sampled := map[string]bool{}
+	for _, sample := range samples {
+		sampled[reflect.TypeOf(sample).Name()] = true
+	}
+
+	for _, file := range []string{"commands.go", "events.go"} {
+		f, err := parser.ParseFile(token.NewFileSet(), file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, decl := range f.Decls {
+			decl, ok := decl.(*ast.GenDecl)
+			if !ok || decl.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				name := spec.(*ast.TypeSpec).Name.Name
+				if !sampled[name] {
+					t.Errorf("%s from %s has no sample in golden_test.go", name, file)
+				}
+			}
+		}
+	}
+}
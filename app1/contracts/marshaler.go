@@ -0,0 +1,33 @@
+package contracts
+
+import (
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+)
+
+// NewMarshaler returns the marshaler of commands and events in the format, json, protobuf or avro.
+// Services have to use the same format, but old versions of JSON events are upcasted by all of them.
+func NewMarshaler(format string, schemaRegistryURL string) cqrs.CommandEventMarshaler {
+	var marshaler cqrs.CommandEventMarshaler = cqrs.JSONMarshaler{
+		GenerateName: cqrs.StructName,
+	}
+	switch format {
+	case "protobuf":
+		marshaler = ProtobufMarshaler{
+			JSONMarshaler: cqrs.JSONMarshaler{
+				GenerateName: cqrs.StructName,
+			},
+		}
+	case "avro":
+		marshaler = AvroMarshaler{
+			JSONMarshaler: cqrs.JSONMarshaler{
+				GenerateName: cqrs.StructName,
+			},
+			Registry: NewSchemaRegistryClient(schemaRegistryURL),
+		}
+	}
+
+	return upcastingMarshaler{
+		CommandEventMarshaler: marshaler,
+		upcasters:             eventUpcasters,
+	}
+}
@@ -0,0 +1,224 @@
+package contracts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro/v2"
+)
+
+const contentTypeAvro = "application/vnd.confluent.avro"
+
+// avroSchemas are Avro schemas of events, the other commands and events are marshaled with JSON.
+//
+// Changing price from an int to Money is not backward compatible in Avro,
+// so subjects registered with the old schemas need to be deleted before deploying.
+var avroSchemas = map[string]string{
+	"RoomBooked": `{
+		"type": "record",
+		"name": "RoomBooked",
+		"namespace": "events",
+		"fields": [
+			{"name": "booking_id", "type": "string"},
+			{"name": "room_id", "type": "string"},
+			{"name": "guests_count", "type": "int"},
+			{"name": "price", "type": {"type": "record", "name": "Money", "fields": [{"name": "amount", "type": "long"}, {"name": "currency", "type": "string"}]}},
+			{"name": "check_in", "type": "string", "default": ""},
+			{"name": "check_out", "type": "string", "default": ""},
+			{"name": "guest_id", "type": "string", "default": ""},
+			{"name": "guest_name", "type": "string", "default": ""},
+			{"name": "guest_email", "type": "string", "default": ""}
+		]
+	}`,
+	"PaymentTaken": `{
+		"type": "record",
+		"name": "PaymentTaken",
+		"namespace": "events",
+		"fields": [
+			{"name": "booking_id", "type": "string"},
+			{"name": "room_id", "type": "string"},
+			{"name": "price", "type": {"type": "record", "name": "Money", "fields": [{"name": "amount", "type": "long"}, {"name": "currency", "type": "string"}]}}
+		]
+	}`,
+}
+
+// avroAPI uses json tags, so the same structs work with JSON and Avro.
+var avroAPI = avro.Config{TagKey: "json"}.Freeze()
+
+// AvroMarshaler marshals events with Avro schemas registered in the Schema Registry.
+//
+// Payloads use the Confluent wire format: a zero magic byte, 4-byte schema ID and Avro binary data.
+// Producers can't publish events which are incompatible with the schema registered in the Schema Registry,
+// because registering the schema fails.
+type AvroMarshaler struct {
+	JSONMarshaler cqrs.JSONMarshaler
+	Registry      *SchemaRegistryClient
+}
+
+func (m AvroMarshaler) Marshal(v any) (*message.Message, error) {
+	name := m.Name(v)
+
+	schemaJSON, ok := avroSchemas[name]
+	if !ok {
+		return m.JSONMarshaler.Marshal(v)
+	}
+
+	schemaID, schema, err := m.Registry.Register(name, schemaJSON)
+	if err != nil {
+		return nil, fmt.Errorf("could not register schema of %s: %w", name, err)
+	}
+
+	data, err := avroAPI.Marshal(schema, v)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(payload[1:], uint32(schemaID))
+	payload = append(payload, data...)
+
+	msg := message.NewMessage(watermill.NewUUID(), payload)
+	msg.Metadata.Set("name", name)
+	msg.Metadata.Set(contentTypeMetadataKey, contentTypeAvro)
+
+	return msg, nil
+}
+
+func (m AvroMarshaler) Unmarshal(msg *message.Message, v any) error {
+	if msg.Metadata.Get(contentTypeMetadataKey) != contentTypeAvro {
+		return m.JSONMarshaler.Unmarshal(msg, v)
+	}
+
+	if len(msg.Payload) < 5 || msg.Payload[0] != 0 {
+		return errors.New("invalid Avro payload")
+	}
+
+	schema, err := m.Registry.Schema(int(binary.BigEndian.Uint32(msg.Payload[1:5])))
+	if err != nil {
+		return err
+	}
+
+	return avroAPI.Unmarshal(schema, msg.Payload[5:], v)
+}
+
+func (m AvroMarshaler) Name(v any) string {
+	return m.JSONMarshaler.Name(v)
+}
+
+func (m AvroMarshaler) NameFromMessage(msg *message.Message) string {
+	return m.JSONMarshaler.NameFromMessage(msg)
+}
+
+// SchemaRegistryClient is a client of the Confluent-compatible Schema Registry API.
+// Schemas are cached, so the registry is called only once per schema.
+type SchemaRegistryClient struct {
+	url        string
+	httpClient *http.Client
+
+	mu         sync.Mutex
+	registered map[string]int
+	schemas    map[int]avro.Schema
+}
+
+func NewSchemaRegistryClient(url string) *SchemaRegistryClient {
+	return &SchemaRegistryClient{
+		url:        url,
+		httpClient: http.DefaultClient,
+		registered: map[string]int{},
+		schemas:    map[int]avro.Schema{},
+	}
+}
+
+// Register registers the schema under the <name>-value subject.
+// Registration fails if the schema is not compatible with the already registered versions.
+func (c *SchemaRegistryClient) Register(name string, schemaJSON string) (int, avro.Schema, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := c.registered[name]; ok {
+		return id, c.schemas[id], nil
+	}
+
+	schema, err := avro.Parse(schemaJSON)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var resp struct {
+		ID int `json:"id"`
+	}
+	err = c.call(http.MethodPost, "/subjects/"+name+"-value/versions", map[string]string{"schema": schema.String()}, &resp)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c.registered[name] = resp.ID
+	c.schemas[resp.ID] = schema
+
+	return resp.ID, schema, nil
+}
+
+func (c *SchemaRegistryClient) Schema(id int) (avro.Schema, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if schema, ok := c.schemas[id]; ok {
+		return schema, nil
+	}
+
+	var resp struct {
+		Schema string `json:"schema"`
+	}
+	if err := c.call(http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+
+	schema, err := avro.Parse(resp.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	c.schemas[id] = schema
+
+	return schema, nil
+}
+
+func (c *SchemaRegistryClient) call(method string, path string, body any, resp any) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.url+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+
+	httpResp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(httpResp.Body).Decode(&errResp)
+
+		return fmt.Errorf("schema registry returned %d: %s", httpResp.StatusCode, errResp.Message)
+	}
+
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
@@ -0,0 +1,143 @@
+package contracts
+
+import (
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/roblaszczak/watermill-livecoding/eventspb"
+)
+
+//go:generate protoc --proto_path=../proto --go_out=../eventspb --go_opt=paths=source_relative events.proto
+
+const (
+	contentTypeMetadataKey = "content_type"
+	contentTypeProtobuf    = "application/x-protobuf"
+)
+
+// ProtobufMarshaler marshals events defined in proto/events.proto with Protocol Buffers.
+// Other commands and events are marshaled with JSONMarshaler.
+//
+// Messages are unmarshaled based on their content type, so consumers can read messages
+// published before the producer switched to Protocol Buffers.
+type ProtobufMarshaler struct {
+	JSONMarshaler cqrs.JSONMarshaler
+}
+
+func (m ProtobufMarshaler) Marshal(v any) (*message.Message, error) {
+	pb, ok := toProto(v)
+	if !ok {
+		return m.JSONMarshaler.Marshal(v)
+	}
+
+	payload, err := proto.Marshal(pb)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := message.NewMessage(watermill.NewUUID(), payload)
+	msg.Metadata.Set("name", m.Name(v))
+	msg.Metadata.Set(contentTypeMetadataKey, contentTypeProtobuf)
+
+	return msg, nil
+}
+
+func (m ProtobufMarshaler) Unmarshal(msg *message.Message, v any) error {
+	if msg.Metadata.Get(contentTypeMetadataKey) != contentTypeProtobuf {
+		return m.JSONMarshaler.Unmarshal(msg, v)
+	}
+
+	switch v := v.(type) {
+	case *RoomBooked:
+		pb := &eventspb.RoomBooked{}
+		if err := proto.Unmarshal(msg.Payload, pb); err != nil {
+			return err
+		}
+
+		*v = RoomBooked{
+			BookingID:   pb.BookingId,
+			RoomID:      pb.RoomId,
+			GuestsCount: int(pb.GuestsCount),
+			Price:       moneyFromProto(pb.Price, pb.LegacyPrice),
+			CheckIn:     pb.CheckIn,
+			CheckOut:    pb.CheckOut,
+			GuestID:     pb.GuestId,
+			GuestName:   pb.GuestName,
+			GuestEmail:  pb.GuestEmail,
+		}
+	case *PaymentTaken:
+		pb := &eventspb.PaymentTaken{}
+		if err := proto.Unmarshal(msg.Payload, pb); err != nil {
+			return err
+		}
+
+		*v = PaymentTaken{
+			BookingID: pb.BookingId,
+			RoomID:    pb.RoomId,
+			Price:     moneyFromProto(pb.Price, pb.LegacyPrice),
+		}
+	default:
+		return fmt.Errorf("%T has no protobuf definition", v)
+	}
+
+	return nil
+}
+
+func (m ProtobufMarshaler) Name(v any) string {
+	return m.JSONMarshaler.Name(v)
+}
+
+func (m ProtobufMarshaler) NameFromMessage(msg *message.Message) string {
+	return m.JSONMarshaler.NameFromMessage(msg)
+}
+
+func toProto(v any) (proto.Message, bool) {
+	switch v := v.(type) {
+	case *RoomBooked:
+		return toProto(*v)
+	case *PaymentTaken:
+		return toProto(*v)
+	case RoomBooked:
+		return &eventspb.RoomBooked{
+			BookingId:   v.BookingID,
+			RoomId:      v.RoomID,
+			GuestsCount: int64(v.GuestsCount),
+			Price:       moneyToProto(v.Price),
+			CheckIn:     v.CheckIn,
+			CheckOut:    v.CheckOut,
+			GuestId:     v.GuestID,
+			GuestName:   v.GuestName,
+			GuestEmail:  v.GuestEmail,
+		}, true
+	case PaymentTaken:
+		return &eventspb.PaymentTaken{
+			BookingId: v.BookingID,
+			RoomId:    v.RoomID,
+			Price:     moneyToProto(v.Price),
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+func moneyToProto(m Money) *eventspb.Money {
+	return &eventspb.Money{
+		Amount:   int64(m.Amount),
+		Currency: m.Currency,
+	}
+}
+
+// moneyFromProto falls back to legacyPrice for messages published before price was Money.
+func moneyFromProto(pb *eventspb.Money, legacyPrice int64) Money {
+	if pb == nil {
+		return legacyMoney(int(legacyPrice))
+	}
+
+	return Money{
+		Amount:   int(pb.Amount),
+		Currency: pb.Currency,
+	}
+}
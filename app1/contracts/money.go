@@ -0,0 +1,79 @@
+package contracts
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// Money is an amount in minor units (e.g. cents) of the ISO 4217 currency.
+type Money struct {
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// BaseCurrency is the currency of room prices, bookings in other currencies are converted from it.
+const BaseCurrency = "USD"
+
+var currencyCodeRegexp = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// IsCurrencyCode reports whether code looks like an ISO 4217 currency code.
+func IsCurrencyCode(code string) bool {
+	return currencyCodeRegexp.MatchString(code)
+}
+
+// currencyExponents are numbers of minor units' digits of currencies which don't have cents.
+var currencyExponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"HUF": 0,
+}
+
+// CurrencyExponent returns the number of minor units' digits of the currency.
+func CurrencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+	return 2
+}
+
+// legacyMoney converts prices of events published before Money was introduced.
+// They were whole US dollars.
+func legacyMoney(price int) Money {
+	return Money{Amount: price * 100, Currency: BaseCurrency}
+}
+
+func (m Money) Times(n int) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// Percent returns the percent of m, rounded to minor units.
+func (m Money) Percent(percent int) Money {
+	return Money{Amount: int(math.Round(float64(m.Amount) * float64(percent) / 100)), Currency: m.Currency}
+}
+
+func (m Money) Sub(other Money) Money {
+	return Money{Amount: m.Amount - other.Amount, Currency: m.Currency}
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// Decimal returns the amount in major units, e.g. "84.00" for 8400 USD cents.
+func (m Money) Decimal() string {
+	exponent := CurrencyExponent(m.Currency)
+	if exponent == 0 {
+		return fmt.Sprintf("%d", m.Amount)
+	}
+
+	unit := int(math.Pow10(exponent))
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/unit, exponent, amount%unit)
+}
@@ -0,0 +1,11 @@
+package contracts
+
+// PersonalData returns the guest whose personal data the event carries and the fields with it.
+// They are encrypted with the guest's key before the event is published.
+func (e *RoomBooked) PersonalData() (string, []*string) {
+	return e.GuestID, []*string{&e.GuestName, &e.GuestEmail}
+}
+
+func (e *GuestRegistered) PersonalData() (string, []*string) {
+	return e.GuestID, []*string{&e.Name, &e.Email}
+}
@@ -0,0 +1,2 @@
+
+	booking-1room-1T
\ No newline at end of file
@@ -0,0 +1,2 @@
+
+	booking-1room-1"AEUR
\ No newline at end of file
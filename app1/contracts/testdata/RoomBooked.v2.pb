@@ -0,0 +1,4 @@
+
+	booking-1room-1 T*
+2026-10-122
+2026-10-14
\ No newline at end of file
@@ -0,0 +1,4 @@
+
+	booking-1room-1*
+2026-10-122
+2026-10-14:AEURBguest-1JJane DoeRjane@example.com
\ No newline at end of file
@@ -0,0 +1,122 @@
+package contracts
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Upcaster transforms the JSON payload of an event from one version to the next one.
+type Upcaster func(msg *message.Message, payload map[string]any) error
+
+// eventUpcasters are upcasters by event name and the version they upcast from.
+//
+// Commands have no schema version, so their upcasters always run and have to skip current payloads.
+var eventUpcasters = map[string]map[int]Upcaster{
+	"RoomBooked": {
+		1: upcastRoomBookedV1,
+		2: upcastLegacyPrice("price"),
+	},
+	"PaymentTaken": {
+		1: upcastLegacyPrice("price"),
+	},
+	"BookingCancelled": {
+		1: upcastLegacyPrice("price"),
+	},
+	"PaymentRefunded": {
+		1: upcastLegacyPrice("amount"),
+	},
+	"RefundPayment": {
+		1: upcastLegacyPrice("amount"),
+	},
+}
+
+// upcastRoomBookedV1 adds check_in and check_out to RoomBooked.
+// Version 1 bookings were for one night starting on the day they were made.
+func upcastRoomBookedV1(msg *message.Message, payload map[string]any) error {
+	occurredAt := time.Now()
+	if value := msg.Metadata.Get(OccurredAtMetadataKey); value != "" {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", OccurredAtMetadataKey, err)
+		}
+		occurredAt = t
+	}
+
+	payload["check_in"] = occurredAt.Format(time.DateOnly)
+	payload["check_out"] = occurredAt.AddDate(0, 0, 1).Format(time.DateOnly)
+
+	return nil
+}
+
+// upcastLegacyPrice replaces the price in whole US dollars in the field with Money.
+func upcastLegacyPrice(field string) Upcaster {
+	return func(msg *message.Message, payload map[string]any) error {
+		UpcastLegacyPrice(payload, field)
+		return nil
+	}
+}
+
+// UpcastLegacyPrice replaces the price in whole US dollars in the field of the JSON payload with Money.
+func UpcastLegacyPrice(payload map[string]any, field string) {
+	if price, ok := payload[field].(float64); ok {
+		payload[field] = legacyMoney(int(price))
+	}
+}
+
+// upcastingMarshaler upcasts old versions of JSON events to the current version before unmarshaling.
+// Protocol Buffers and Avro payloads are not upcasted, as these formats handle new fields on their own.
+type upcastingMarshaler struct {
+	cqrs.CommandEventMarshaler
+
+	upcasters map[string]map[int]Upcaster
+}
+
+func (m upcastingMarshaler) Unmarshal(msg *message.Message, v any) error {
+	upcasters := m.upcasters[m.NameFromMessage(msg)]
+	if len(upcasters) == 0 || msg.Metadata.Get(contentTypeMetadataKey) != "" {
+		return m.CommandEventMarshaler.Unmarshal(msg, v)
+	}
+
+	// Messages published before the event envelope was added have no version.
+	version := 1
+	if value := msg.Metadata.Get(SchemaVersionMetadataKey); value != "" {
+		var err error
+		version, err = strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", SchemaVersionMetadataKey, err)
+		}
+	}
+
+	if _, ok := upcasters[version]; !ok {
+		return m.CommandEventMarshaler.Unmarshal(msg, v)
+	}
+
+	var payload map[string]any
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return err
+	}
+
+	for upcaster, ok := upcasters[version]; ok; upcaster, ok = upcasters[version] {
+		if err := upcaster(msg, payload); err != nil {
+			return fmt.Errorf("could not upcast from version %d: %w", version, err)
+		}
+		version++
+	}
+
+	upcastedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	// The original message is not modified, so it's retried or dead-lettered as it was received.
+	upcasted := msg.Copy()
+	upcasted.Payload = upcastedPayload
+	upcasted.Metadata.Set(SchemaVersionMetadataKey, strconv.Itoa(version))
+
+	return m.CommandEventMarshaler.Unmarshal(upcasted, v)
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/google/uuid"
+)
+
+const (
+	correlationIDHeader = "X-Request-ID"
+	correlationIDLogKey = "correlation_id"
+)
+
+type correlationIDKey struct{}
+
+func contextWithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, correlationID)
+}
+
+func correlationIDFromContext(ctx context.Context) string {
+	correlationID, _ := ctx.Value(correlationIDKey{}).(string)
+	return correlationID
+}
+
+// correlationIDHTTPMiddleware takes the correlation ID from the X-Request-ID header
+// or generates a new one when the request doesn't have it.
+func correlationIDHTTPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		correlationID := request.Header.Get(correlationIDHeader)
+		if correlationID == "" {
+			correlationID = uuid.NewString()
+		}
+
+		writer.Header().Set(correlationIDHeader, correlationID)
+
+		ctx := contextWithCorrelationID(request.Context(), correlationID)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// correlationIDRouterMiddleware passes the correlation ID from the message metadata to the handler's context,
+// so messages published by the handler keep it.
+func correlationIDRouterMiddleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		if correlationID := middleware.MessageCorrelationID(msg); correlationID != "" {
+			msg.SetContext(contextWithCorrelationID(msg.Context(), correlationID))
+		}
+
+		return h(msg)
+	}
+}
+
+func setCorrelationIDMetadata(ctx context.Context, msg *message.Message) {
+	if correlationID := correlationIDFromContext(ctx); correlationID != "" {
+		middleware.SetCorrelationID(correlationID, msg)
+	}
+}
+
+// correlationIDLogHandler adds the correlation ID to all records logged with a context,
+// unless the logger already has it (e.g. the logger of a handler).
+type correlationIDLogHandler struct {
+	slog.Handler
+	hasCorrelationID bool
+}
+
+func (h correlationIDLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if correlationID := correlationIDFromContext(ctx); correlationID != "" && !h.hasCorrelationID {
+		record.AddAttrs(slog.String(correlationIDLogKey, correlationID))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h correlationIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	hasCorrelationID := h.hasCorrelationID
+	for _, attr := range attrs {
+		if attr.Key == correlationIDLogKey {
+			hasCorrelationID = true
+		}
+	}
+
+	return correlationIDLogHandler{
+		Handler:          h.Handler.WithAttrs(attrs),
+		hasCorrelationID: hasCorrelationID,
+	}
+}
+
+func (h correlationIDLogHandler) WithGroup(name string) slog.Handler {
+	return correlationIDLogHandler{
+		Handler:          h.Handler.WithGroup(name),
+		hasCorrelationID: h.hasCorrelationID,
+	}
+}
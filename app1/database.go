@@ -0,0 +1,286 @@
+package app
+
+import (
+	stdSQL "database/sql"
+	"fmt"
+
+	_ "github.com/lib/pq"
+)
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS bookings (
+		booking_id UUID PRIMARY KEY,
+		room_id VARCHAR(255) NOT NULL,
+		guests_count INT NOT NULL,
+		price INT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`ALTER TABLE bookings ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMP`,
+	`CREATE TABLE IF NOT EXISTS booking_events (
+		booking_id VARCHAR(255) NOT NULL,
+		version INT NOT NULL,
+		event_name VARCHAR(255) NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (booking_id, version)
+	)`,
+	`CREATE TABLE IF NOT EXISTS room_nights (
+		room_id VARCHAR(255) NOT NULL,
+		night DATE NOT NULL,
+		booking_id VARCHAR(255) NOT NULL,
+		PRIMARY KEY (room_id, night)
+	)`,
+	`CREATE INDEX IF NOT EXISTS room_nights_booking_id_idx ON room_nights (booking_id)`,
+	`CREATE TABLE IF NOT EXISTS booking_snapshots (
+		booking_id VARCHAR(255) PRIMARY KEY,
+		version INT NOT NULL,
+		state JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	// snapshots with prices in whole US dollars are rebuilt from events
+	`DELETE FROM booking_snapshots WHERE jsonb_typeof(state->'price') = 'number'`,
+	// snapshots from before amendments don't have the stay, bookings are rebuilt from events
+	`DELETE FROM booking_snapshots WHERE state->'schema_version' IS NULL`,
+	// bookings is not written anymore, bookings made before the event store are migrated to it
+	`INSERT INTO booking_events (booking_id, version, event_name, payload, created_at)
+	SELECT booking_id::text, 1, 'RoomBooked', json_build_object(
+		'booking_id', booking_id, 'room_id', room_id, 'guests_count', guests_count, 'price', price,
+		'check_in', '', 'check_out', ''
+	), created_at FROM bookings
+	ON CONFLICT DO NOTHING`,
+	`INSERT INTO booking_events (booking_id, version, event_name, payload, created_at)
+	SELECT booking_id::text, 2, 'BookingCancelled', json_build_object(
+		'booking_id', booking_id, 'room_id', room_id, 'price', price
+	), cancelled_at FROM bookings WHERE cancelled_at IS NOT NULL
+	ON CONFLICT DO NOTHING`,
+	`CREATE TABLE IF NOT EXISTS booking_processes (
+		booking_id UUID PRIMARY KEY,
+		status VARCHAR(32) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`ALTER TABLE booking_processes ADD COLUMN IF NOT EXISTS check_in DATE`,
+	`CREATE TABLE IF NOT EXISTS bookings_read_model (
+		booking_id VARCHAR(255) PRIMARY KEY,
+		room_id VARCHAR(255) NOT NULL,
+		guests_count INT NOT NULL DEFAULT 0,
+		price INT NOT NULL,
+		status VARCHAR(32) NOT NULL
+	)`,
+	`ALTER TABLE bookings_read_model ADD COLUMN IF NOT EXISTS check_in VARCHAR(10) NOT NULL DEFAULT ''`,
+	`ALTER TABLE bookings_read_model ADD COLUMN IF NOT EXISTS check_out VARCHAR(10) NOT NULL DEFAULT ''`,
+	// prices without a currency were whole US dollars, now they are in minor units
+	`ALTER TABLE bookings_read_model ADD COLUMN IF NOT EXISTS currency VARCHAR(3)`,
+	`UPDATE bookings_read_model SET price = price * 100, currency = 'USD' WHERE currency IS NULL`,
+	`ALTER TABLE bookings_read_model ADD COLUMN IF NOT EXISTS guest_id VARCHAR(255) NOT NULL DEFAULT ''`,
+	// when the last applied events changing the stay and the status occurred, so older events don't overwrite them
+	`ALTER TABLE bookings_read_model ADD COLUMN IF NOT EXISTS stay_updated_at TIMESTAMPTZ NOT NULL DEFAULT '-infinity'`,
+	`ALTER TABLE bookings_read_model ADD COLUMN IF NOT EXISTS status_updated_at TIMESTAMPTZ NOT NULL DEFAULT '-infinity'`,
+	`CREATE TABLE IF NOT EXISTS booking_contacts (
+		booking_id VARCHAR(255) PRIMARY KEY,
+		email VARCHAR(255) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS guests (
+		guest_id VARCHAR(255) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		email VARCHAR(255) NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS guest_keys (
+		guest_id VARCHAR(255) PRIMARY KEY,
+		key BYTEA,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		forgotten_at TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS dead_letters (
+		id BIGSERIAL PRIMARY KEY,
+		message_uuid VARCHAR(255) NOT NULL,
+		handler VARCHAR(255) NOT NULL,
+		topic VARCHAR(255) NOT NULL,
+		booking_id VARCHAR(255) NOT NULL,
+		reason TEXT NOT NULL,
+		metadata JSONB NOT NULL,
+		payload BYTEA NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS dead_letters_handler_idx ON dead_letters (handler, created_at)`,
+	`CREATE TABLE IF NOT EXISTS quarantined_messages (
+		id BIGSERIAL PRIMARY KEY,
+		message_uuid VARCHAR(255) NOT NULL,
+		handler VARCHAR(255) NOT NULL,
+		topic VARCHAR(255) NOT NULL,
+		error TEXT NOT NULL,
+		metadata JSONB NOT NULL,
+		payload BYTEA NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		direction VARCHAR(16) NOT NULL,
+		event_name VARCHAR(255) NOT NULL,
+		event_id VARCHAR(255) NOT NULL,
+		correlation_id VARCHAR(255) NOT NULL,
+		booking_id VARCHAR(255) NOT NULL,
+		topic VARCHAR(255) NOT NULL,
+		handler VARCHAR(255) NOT NULL,
+		payload_hash VARCHAR(64) NOT NULL,
+		outcome VARCHAR(32) NOT NULL,
+		error TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_booking_id_idx ON audit_log (booking_id, id)`,
+	// the audit log is append-only
+	`CREATE OR REPLACE RULE audit_log_no_update AS ON UPDATE TO audit_log DO INSTEAD NOTHING`,
+	`CREATE OR REPLACE RULE audit_log_no_delete AS ON DELETE TO audit_log DO INSTEAD NOTHING`,
+	`CREATE TABLE IF NOT EXISTS scheduled_messages (
+		id BIGSERIAL PRIMARY KEY,
+		topic VARCHAR(255) NOT NULL,
+		message_uuid VARCHAR(255) NOT NULL,
+		metadata JSONB NOT NULL,
+		payload BYTEA NOT NULL,
+		deliver_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS scheduled_messages_deliver_at_idx ON scheduled_messages (deliver_at)`,
+	`CREATE TABLE IF NOT EXISTS invoice_numbers (
+		year INT PRIMARY KEY,
+		last_number INT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS invoices (
+		booking_id VARCHAR(255) PRIMARY KEY,
+		number VARCHAR(32) NOT NULL UNIQUE,
+		invoice JSONB NOT NULL,
+		html TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS loyalty_bookings (
+		booking_id VARCHAR(255) PRIMARY KEY,
+		guest_id VARCHAR(255) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS loyalty_points (
+		booking_id VARCHAR(255) PRIMARY KEY,
+		guest_id VARCHAR(255) NOT NULL,
+		points INT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS loyalty_balances (
+		guest_id VARCHAR(255) PRIMARY KEY,
+		points INT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS scheduled_runs (
+		job VARCHAR(255) NOT NULL,
+		scheduled_at TIMESTAMPTZ NOT NULL,
+		published_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (job, scheduled_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+		id VARCHAR(255) PRIMARY KEY,
+		url TEXT NOT NULL,
+		event_name VARCHAR(255) NOT NULL,
+		secret VARCHAR(255) NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		consecutive_failures INT NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		last_failure_at TIMESTAMPTZ,
+		last_success_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_subscriptions_event_name_idx ON webhook_subscriptions (event_name)`,
+	`CREATE TABLE IF NOT EXISTS payment_records (
+		booking_id VARCHAR(255) PRIMARY KEY,
+		amount INT NOT NULL,
+		status VARCHAR(32) NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`ALTER TABLE payment_records ADD COLUMN IF NOT EXISTS currency VARCHAR(3)`,
+	`UPDATE payment_records SET amount = amount * 100, currency = 'USD' WHERE currency IS NULL`,
+	`CREATE TABLE IF NOT EXISTS payment_refunds (
+		refund_id VARCHAR(255) PRIMARY KEY,
+		booking_id VARCHAR(255) NOT NULL,
+		amount INT NOT NULL,
+		currency VARCHAR(3) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS payment_refunds_booking_id_idx ON payment_refunds (booking_id)`,
+	`CREATE TABLE IF NOT EXISTS payment_charges (
+		charge_id VARCHAR(255) PRIMARY KEY,
+		booking_id VARCHAR(255) NOT NULL,
+		amount INT NOT NULL,
+		currency VARCHAR(3) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	// charges used to be recorded only once taken, now they are recorded before calling the provider
+	`ALTER TABLE payment_charges ADD COLUMN IF NOT EXISTS status VARCHAR(32) NOT NULL DEFAULT 'taken'`,
+	`ALTER TABLE payment_charges ADD COLUMN IF NOT EXISTS reason TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE payment_charges ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()`,
+	`CREATE TABLE IF NOT EXISTS promo_codes (
+		code VARCHAR(255) PRIMARY KEY,
+		percent_off INT NOT NULL,
+		max_uses INT NOT NULL DEFAULT 0,
+		uses INT NOT NULL DEFAULT 0,
+		expires_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS promo_code_redemptions (
+		booking_id VARCHAR(255) PRIMARY KEY,
+		code VARCHAR(255) NOT NULL REFERENCES promo_codes (code),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS revenue_payments (
+		booking_id VARCHAR(255) PRIMARY KEY,
+		day DATE NOT NULL,
+		room_id VARCHAR(255) NOT NULL,
+		currency CHAR(3) NOT NULL,
+		amount BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS daily_revenue (
+		day DATE NOT NULL,
+		room_id VARCHAR(255) NOT NULL,
+		currency CHAR(3) NOT NULL,
+		revenue BIGINT NOT NULL,
+		payments INT NOT NULL,
+		PRIMARY KEY (day, room_id, currency)
+	)`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		idempotency_key VARCHAR(255) PRIMARY KEY,
+		booking_id UUID NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS projection_checkpoints (
+		handler VARCHAR(255) NOT NULL,
+		topic VARCHAR(255) NOT NULL,
+		partition INT NOT NULL,
+		projection VARCHAR(255) NOT NULL,
+		message_offset BIGINT NOT NULL,
+		event_time TIMESTAMPTZ NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (handler, topic, partition)
+	)`,
+	`CREATE TABLE IF NOT EXISTS booking_payment_watch (
+		booking_id VARCHAR(255) PRIMARY KEY,
+		room_id VARCHAR(255) NOT NULL,
+		booked_at TIMESTAMPTZ NOT NULL,
+		resolved_at TIMESTAMPTZ,
+		detected_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS booking_payment_watch_unresolved ON booking_payment_watch (booked_at) WHERE resolved_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS booking_payment_watch_resolved ON booking_payment_watch (resolved_at) WHERE resolved_at IS NOT NULL`,
+}
+
+func newPostgresDB(dsn string) (*stdSQL.DB, error) {
+	db, err := stdSQL.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, query := range schema {
+		if _, err := db.Exec(query); err != nil {
+			return nil, fmt.Errorf("could not initialize schema: %w", err)
+		}
+	}
+
+	return db, nil
+}
@@ -0,0 +1,132 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+)
+
+const (
+	deadLetterReasonKey   = "dead_letter_reason"
+	deadLetterHandlerKey  = "dead_letter_handler"
+	deadLetterTopicKey    = "dead_letter_topic"
+	deadLetterAttemptsKey = "dead_letter_attempts"
+)
+
+// RetrySettings are the exponential backoff of handlers retried before their messages are moved
+// to the dead letter queue.
+type RetrySettings struct {
+	MaxRetries      int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter randomizes intervals by up to this fraction of them, 0.5 is ±50%.
+	Jitter float64
+}
+
+func (s RetrySettings) Middleware(logger watermill.LoggerAdapter) middleware.Retry {
+	return middleware.Retry{
+		MaxRetries:          s.MaxRetries,
+		InitialInterval:     s.InitialInterval,
+		MaxInterval:         s.MaxInterval,
+		Multiplier:          s.Multiplier,
+		RandomizationFactor: s.Jitter,
+		Logger:              logger,
+	}
+}
+
+func deadLetterTopic(handlerName string) string {
+	return "dead_letter_" + handlerName
+}
+
+// DeadLetterQueue retries the handler according to Retry and moves messages which still fail
+// to the handler's dead letter topic, so they don't block the consumer group.
+// Dead letters are also saved in Store, so they can be inspected and replayed.
+type DeadLetterQueue struct {
+	Retry middleware.Retry
+	// NoRetry are handlers which retry on their own, their messages are moved to the dead letter topic
+	// after the first failure, so their calls are not retried again by Retry.
+	NoRetry []string
+	// PermanentErrors fail the handler however many times it's called, messages failing with them
+	// are moved to the dead letter topic without further retries.
+	PermanentErrors []error
+	Publisher       message.Publisher
+	Store           deadLetterSaver
+	Logger          watermill.LoggerAdapter
+}
+
+// deadLetterSaver saves dead letters, it's implemented by DeadLetterStore.
+type deadLetterSaver interface {
+	Store(ctx context.Context, msg *message.Message) error
+}
+
+func (d DeadLetterQueue) Middleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		handlerName := message.HandlerNameFromCtx(msg.Context())
+
+		var attempts int
+		var permanentErr error
+		// Retry stops only after a successful call, so permanent errors are hidden from it and returned afterwards.
+		attempt := func(msg *message.Message) ([]*message.Message, error) {
+			attempts++
+
+			events, err := h(msg)
+			if d.isPermanent(err) {
+				permanentErr = err
+				return nil, nil
+			}
+
+			return events, err
+		}
+
+		handle := d.Retry.Middleware(attempt)
+		if slices.Contains(d.NoRetry, configuredHandlerName(msg.Context())) {
+			handle = attempt
+		}
+
+		events, err := handle(msg)
+		if permanentErr != nil {
+			events, err = nil, permanentErr
+		}
+		if err == nil {
+			return events, nil
+		}
+
+		msg.Metadata.Set(deadLetterReasonKey, err.Error())
+		msg.Metadata.Set(deadLetterHandlerKey, handlerName)
+		msg.Metadata.Set(deadLetterTopicKey, message.SubscribeTopicFromCtx(msg.Context()))
+		msg.Metadata.Set(deadLetterAttemptsKey, strconv.Itoa(attempts))
+
+		if publishErr := d.Publisher.Publish(deadLetterTopic(handlerName), msg); publishErr != nil {
+			return nil, errors.Join(err, fmt.Errorf("cannot publish message to dead letter queue: %w", publishErr))
+		}
+
+		if storeErr := d.Store.Store(msg.Context(), msg); storeErr != nil {
+			return nil, errors.Join(err, fmt.Errorf("cannot store dead letter: %w", storeErr))
+		}
+
+		d.Logger.Error("Message moved to dead letter queue", err, watermill.LogFields{
+			"message_uuid": msg.UUID,
+			"handler":      handlerName,
+		})
+
+		return nil, nil
+	}
+}
+
+func (d DeadLetterQueue) isPermanent(err error) bool {
+	for _, permanent := range d.PermanentErrors {
+		if errors.Is(err, permanent) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,258 @@
+package app
+
+import (
+	"context"
+	stdSQL "database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+// DeadLetter is a message moved to the dead letter queue.
+type DeadLetter struct {
+	ID          int64             `json:"id"`
+	MessageUUID string            `json:"message_uuid"`
+	Handler     string            `json:"handler"`
+	Topic       string            `json:"topic"`
+	BookingID   string            `json:"booking_id,omitempty"`
+	Reason      string            `json:"reason"`
+	Metadata    map[string]string `json:"metadata"`
+	Payload     []byte            `json:"payload"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+type DeadLettersFilter struct {
+	BookingID string
+	From      time.Time
+	To        time.Time
+}
+
+// DeadLetterStore keeps dead-lettered messages in Postgres, so they can be inspected and replayed
+// without consuming the dead letter topics.
+type DeadLetterStore struct {
+	db *stdSQL.DB
+}
+
+func (s DeadLetterStore) Store(ctx context.Context, msg *message.Message) error {
+	metadata, err := json.Marshal(msg.Metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(
+		ctx,
+		`INSERT INTO dead_letters (message_uuid, handler, topic, booking_id, reason, metadata, payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		msg.UUID,
+		msg.Metadata.Get(deadLetterHandlerKey),
+		msg.Metadata.Get(deadLetterTopicKey),
+		msg.Metadata.Get(bookingIDMetadataKey),
+		msg.Metadata.Get(deadLetterReasonKey),
+		metadata,
+		[]byte(msg.Payload),
+	)
+
+	return err
+}
+
+func (s DeadLetterStore) List(ctx context.Context, handler string, filter DeadLettersFilter) ([]DeadLetter, error) {
+	return s.list(ctx, s.db, handler, filter, "")
+}
+
+// Replay publishes dead letters of the handler back to their original topics and removes them from the store.
+//
+// Messages keep their UUIDs, so handlers which already processed them skip them thanks to the Deduplicator.
+func (s DeadLetterStore) Replay(
+	ctx context.Context,
+	handler string,
+	filter DeadLettersFilter,
+	publisher message.Publisher,
+) (replayed int, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	deadLetters, err := s.list(ctx, tx, handler, filter, "FOR UPDATE SKIP LOCKED")
+	if err != nil {
+		return 0, err
+	}
+
+	for _, deadLetter := range deadLetters {
+		msg := message.NewMessage(deadLetter.MessageUUID, deadLetter.Payload)
+		for key, value := range deadLetter.Metadata {
+			if !strings.HasPrefix(key, "dead_letter_") {
+				msg.Metadata.Set(key, value)
+			}
+		}
+
+		if err := publisher.Publish(deadLetter.Topic, msg); err != nil {
+			return 0, fmt.Errorf("could not replay message %s: %w", deadLetter.MessageUUID, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM dead_letters WHERE id = $1`, deadLetter.ID); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(deadLetters), nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*stdSQL.Rows, error)
+}
+
+func (s DeadLetterStore) list(
+	ctx context.Context,
+	q queryer,
+	handler string,
+	filter DeadLettersFilter,
+	lock string,
+) ([]DeadLetter, error) {
+	query := `SELECT id, message_uuid, handler, topic, booking_id, reason, metadata, payload, created_at
+		FROM dead_letters WHERE handler = $1`
+	args := []any{handler}
+
+	if filter.BookingID != "" {
+		args = append(args, filter.BookingID)
+		query += fmt.Sprintf(" AND booking_id = $%d", len(args))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		query += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+
+	query += " ORDER BY id " + lock
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := []DeadLetter{}
+	for rows.Next() {
+		var deadLetter DeadLetter
+		var metadata []byte
+
+		err := rows.Scan(
+			&deadLetter.ID,
+			&deadLetter.MessageUUID,
+			&deadLetter.Handler,
+			&deadLetter.Topic,
+			&deadLetter.BookingID,
+			&deadLetter.Reason,
+			&metadata,
+			&deadLetter.Payload,
+			&deadLetter.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(metadata, &deadLetter.Metadata); err != nil {
+			return nil, err
+		}
+
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	return deadLetters, rows.Err()
+}
+
+// DeadLettersAdmin exposes the dead letter queue to operators.
+type DeadLettersAdmin struct {
+	store     DeadLetterStore
+	publisher message.Publisher
+}
+
+func (a DeadLettersAdmin) ListHandler(writer http.ResponseWriter, request *http.Request) {
+	filter, err := deadLettersFilterFromRequest(request)
+	if err != nil {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid filter",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	deadLetters, err := a.store.List(request.Context(), request.PathValue("handler"), filter)
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to list dead letters")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, deadLetters)
+}
+
+func (a DeadLettersAdmin) ReplayHandler(writer http.ResponseWriter, request *http.Request) {
+	filter, err := deadLettersFilterFromRequest(request)
+	if err != nil {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid filter",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	handler := request.PathValue("handler")
+
+	replayed, err := a.store.Replay(request.Context(), handler, filter, a.publisher)
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to replay dead letters")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	slog.With("handler", handler, "replayed", replayed).InfoContext(request.Context(), "Dead letters replayed")
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, map[string]int{"replayed": replayed})
+}
+
+// deadLettersFilterFromRequest reads the booking_id, from and to (RFC 3339) query parameters.
+func deadLettersFilterFromRequest(request *http.Request) (DeadLettersFilter, error) {
+	query := request.URL.Query()
+
+	filter := DeadLettersFilter{
+		BookingID: query.Get("booking_id"),
+	}
+
+	if from := query.Get("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return DeadLettersFilter{}, fmt.Errorf("invalid from: %w", err)
+		}
+		filter.From = t
+	}
+	if to := query.Get("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return DeadLettersFilter{}, fmt.Errorf("invalid to: %w", err)
+		}
+		filter.To = t
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,24 @@
+package app
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/roblaszczak/watermill-livecoding/internal/booking"
+)
+
+func TestDeadLetterQueue_permanent_error_is_not_retried(t *testing.T) {
+	attempts := runTestRouter(
+		t,
+		"BookRoomHandler",
+		DeadLetterQueue{PermanentErrors: []error{booking.ErrInvalidBooking}},
+		fmt.Errorf("could not book room: %w", booking.ErrInvalidBooking),
+		message.NewMessage(watermill.NewUUID(), nil),
+	)
+
+	if attempts != 1 {
+		t.Errorf("handler was called %d times, want 1", attempts)
+	}
+}
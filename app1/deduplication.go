@@ -0,0 +1,251 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/redis/go-redis/v9"
+)
+
+const deduplicationTTL = time.Hour * 24
+
+// deduplicationClaimPollInterval is how often a message claimed by another consumer is checked.
+const deduplicationClaimPollInterval = time.Millisecond * 100
+
+// ClaimResult is the outcome of claiming a message's key for processing.
+type ClaimResult int
+
+const (
+	// ClaimAcquired means that the message can be processed, no other consumer processes it.
+	ClaimAcquired ClaimResult = iota
+	// ClaimInProgress means that the message is being processed by another consumer.
+	ClaimInProgress
+	// ClaimProcessed means that the message was already processed.
+	ClaimProcessed
+)
+
+// DeduplicationStore remembers keys of processed messages for the TTL.
+//
+// Keys are claimed atomically, so a message redelivered to another consumer while it's processed
+// is not processed twice.
+type DeduplicationStore interface {
+	// Claim claims the key for processing, the claim expires after claimTTL if it's not released
+	// or marked as processed, e.g. when the consumer crashed.
+	Claim(ctx context.Context, key string, claimTTL time.Duration) (ClaimResult, error)
+	MarkProcessed(ctx context.Context, key string) error
+	// Release releases the claim after processing failed, so the message can be processed again.
+	Release(ctx context.Context, key string) error
+}
+
+func newDeduplicationStore(config Config) (DeduplicationStore, error) {
+	switch config.DeduplicationStore {
+	case "memory":
+		return NewMemoryDeduplicationStore(deduplicationTTL), nil
+	case "redis":
+		return NewRedisDeduplicationStore(redis.NewClient(&redis.Options{Addr: config.RedisAddr}), deduplicationTTL), nil
+	default:
+		return nil, fmt.Errorf("unknown deduplication store: %s", config.DeduplicationStore)
+	}
+}
+
+// Deduplicator skips messages which were already processed by the handler.
+//
+// Kafka delivers messages at least once, so without it payments.Handler could take the payment twice
+// when the offset was not committed before a restart or rebalance.
+// Messages are claimed before the handler is called and marked as processed only after it succeeds,
+// so failed messages are still retried. When a message is redelivered to another consumer while it's
+// processed, e.g. after a rebalance, that consumer waits until the claim is released or marked as processed.
+type Deduplicator struct {
+	Store DeduplicationStore
+	// ClaimTTL is how long a message can be processed, claims of crashed consumers expire after it.
+	ClaimTTL time.Duration
+	Logger   watermill.LoggerAdapter
+}
+
+func (d Deduplicator) Middleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		ctx := msg.Context()
+		// The same message is delivered to all handlers subscribed to the topic.
+		key := configuredHandlerName(ctx) + ":" + msg.UUID
+
+		processed, err := d.claim(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if processed {
+			d.Logger.Info("Skipping already processed message", watermill.LogFields{
+				"message_uuid": msg.UUID,
+				"handler":      message.HandlerNameFromCtx(ctx),
+			})
+			return nil, nil
+		}
+
+		events, err := h(msg)
+		if err != nil {
+			if releaseErr := d.Store.Release(context.WithoutCancel(ctx), key); releaseErr != nil {
+				return nil, errors.Join(err, fmt.Errorf("cannot release message: %w", releaseErr))
+			}
+			return nil, err
+		}
+
+		if err := d.Store.MarkProcessed(ctx, key); err != nil {
+			return nil, fmt.Errorf("cannot mark message as processed: %w", err)
+		}
+
+		return events, nil
+	}
+}
+
+// claim claims the key, waiting while it's claimed by another consumer. It returns true if the key was processed.
+func (d Deduplicator) claim(ctx context.Context, key string) (bool, error) {
+	for {
+		result, err := d.Store.Claim(ctx, key, d.ClaimTTL)
+		if err != nil {
+			return false, fmt.Errorf("cannot claim message: %w", err)
+		}
+
+		switch result {
+		case ClaimAcquired:
+			return false, nil
+		case ClaimProcessed:
+			return true, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(deduplicationClaimPollInterval):
+		}
+	}
+}
+
+// MemoryDeduplicationStore keeps processed keys in memory, so it works only with a single instance.
+type MemoryDeduplicationStore struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]memoryDeduplicationKey
+	lastPrune time.Time
+}
+
+type memoryDeduplicationKey struct {
+	processed bool
+	expiresAt time.Time
+}
+
+func NewMemoryDeduplicationStore(ttl time.Duration) *MemoryDeduplicationStore {
+	return &MemoryDeduplicationStore{
+		ttl:       ttl,
+		keys:      map[string]memoryDeduplicationKey{},
+		lastPrune: time.Now(),
+	}
+}
+
+func (s *MemoryDeduplicationStore) Claim(ctx context.Context, key string, claimTTL time.Duration) (ClaimResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := s.keys[key]; ok && now.Before(existing.expiresAt) {
+		if existing.processed {
+			return ClaimProcessed, nil
+		}
+		return ClaimInProgress, nil
+	}
+
+	s.keys[key] = memoryDeduplicationKey{expiresAt: now.Add(claimTTL)}
+	s.prune(now)
+
+	return ClaimAcquired, nil
+}
+
+func (s *MemoryDeduplicationStore) MarkProcessed(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key] = memoryDeduplicationKey{processed: true, expiresAt: time.Now().Add(s.ttl)}
+
+	return nil
+}
+
+func (s *MemoryDeduplicationStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, key)
+
+	return nil
+}
+
+func (s *MemoryDeduplicationStore) prune(now time.Time) {
+	if now.Sub(s.lastPrune) <= time.Minute {
+		return
+	}
+
+	for k, existing := range s.keys {
+		if now.After(existing.expiresAt) {
+			delete(s.keys, k)
+		}
+	}
+	s.lastPrune = now
+}
+
+const (
+	redisDeduplicationProcessing = "processing"
+	redisDeduplicationProcessed  = "processed"
+)
+
+// RedisDeduplicationStore keeps processed keys in Redis, so they are shared by all instances.
+// Keys are claimed with SET NX, so only one instance processes the message.
+type RedisDeduplicationStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewRedisDeduplicationStore(client *redis.Client, ttl time.Duration) *RedisDeduplicationStore {
+	return &RedisDeduplicationStore{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+func (s *RedisDeduplicationStore) Claim(ctx context.Context, key string, claimTTL time.Duration) (ClaimResult, error) {
+	claimed, err := s.client.SetNX(ctx, s.redisKey(key), redisDeduplicationProcessing, claimTTL).Result()
+	if err != nil {
+		return 0, err
+	}
+	if claimed {
+		return ClaimAcquired, nil
+	}
+
+	value, err := s.client.Get(ctx, s.redisKey(key)).Result()
+	if errors.Is(err, redis.Nil) {
+		// The claim was released or expired in the meantime.
+		return s.Claim(ctx, key, claimTTL)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if value == redisDeduplicationProcessed {
+		return ClaimProcessed, nil
+	}
+	return ClaimInProgress, nil
+}
+
+func (s *RedisDeduplicationStore) MarkProcessed(ctx context.Context, key string) error {
+	return s.client.Set(ctx, s.redisKey(key), redisDeduplicationProcessed, s.ttl).Err()
+}
+
+func (s *RedisDeduplicationStore) Release(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.redisKey(key)).Err()
+}
+
+func (s *RedisDeduplicationStore) redisKey(key string) string {
+	return "processed_messages:" + key
+}
@@ -0,0 +1,184 @@
+package app
+
+import (
+	"context"
+	stdSQL "database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/delay"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// DelayedDelivery stores delayed messages in the scheduled_messages table
+// and publishes them to the broker when they are due.
+//
+// None of the app's brokers supports delayed delivery, so it's done before messages are published.
+type DelayedDelivery struct {
+	db        *stdSQL.DB
+	publisher message.Publisher
+
+	pollInterval time.Duration
+	batchSize    int
+}
+
+// Publisher returns publisher which stores messages with a delay set with delay.WithContext or delay.Message
+// until they are due. Other messages are published right away.
+func (d DelayedDelivery) Publisher() (message.Publisher, error) {
+	return delay.NewPublisher(schedulingPublisher{delivery: d}, delay.PublisherConfig{
+		AllowNoDelay: true,
+	})
+}
+
+type schedulingPublisher struct {
+	delivery DelayedDelivery
+}
+
+func (p schedulingPublisher) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		deliverAt, delayed, err := messageDeliverAt(msg)
+		if err != nil {
+			return err
+		}
+
+		if !delayed || !deliverAt.After(time.Now()) {
+			if err := p.delivery.publisher.Publish(topic, msg); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := p.delivery.schedule(msg.Context(), topic, msg, deliverAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p schedulingPublisher) Close() error {
+	return nil
+}
+
+func messageDeliverAt(msg *message.Message) (time.Time, bool, error) {
+	delayedUntil := msg.Metadata.Get(delay.DelayedUntilKey)
+	if delayedUntil == "" {
+		return time.Time{}, false, nil
+	}
+
+	deliverAt, err := time.Parse(time.RFC3339, delayedUntil)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid %s metadata: %w", delay.DelayedUntilKey, err)
+	}
+
+	return deliverAt, true, nil
+}
+
+func (d DelayedDelivery) schedule(ctx context.Context, topic string, msg *message.Message, deliverAt time.Time) error {
+	metadata, err := json.Marshal(msg.Metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.ExecContext(
+		ctx,
+		`INSERT INTO scheduled_messages (topic, message_uuid, metadata, payload, deliver_at) VALUES ($1, $2, $3, $4, $5)`,
+		topic, msg.UUID, metadata, []byte(msg.Payload), deliverAt,
+	)
+	if err != nil {
+		return fmt.Errorf("could not schedule message: %w", err)
+	}
+
+	return nil
+}
+
+// Run publishes due messages until ctx is cancelled. It can run on many instances at once.
+func (d DelayedDelivery) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		for {
+			published, err := d.publishDue(ctx)
+			if err != nil {
+				slog.With("err", err).ErrorContext(ctx, "Failed to publish scheduled messages")
+				break
+			}
+			if published < d.batchSize {
+				break
+			}
+		}
+	}
+}
+
+// publishDue publishes one batch of due messages and removes them, returning how many were published.
+// Messages are published at least once, as the batch may be published again if removing it fails.
+func (d DelayedDelivery) publishDue(ctx context.Context) (published int, err error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT id, topic, message_uuid, metadata, payload FROM scheduled_messages
+		WHERE deliver_at <= NOW() ORDER BY deliver_at LIMIT $1 FOR UPDATE SKIP LOCKED`,
+		d.batchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	type scheduledMessage struct {
+		id    int64
+		topic string
+		msg   *message.Message
+	}
+
+	var scheduled []scheduledMessage
+	for rows.Next() {
+		var s scheduledMessage
+		var uuid string
+		var metadata, payload []byte
+		if err := rows.Scan(&s.id, &s.topic, &uuid, &metadata, &payload); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+
+		s.msg = message.NewMessage(uuid, payload)
+		if err := json.Unmarshal(metadata, &s.msg.Metadata); err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("could not unmarshal metadata of scheduled message %d: %w", s.id, err)
+		}
+
+		scheduled = append(scheduled, s)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+
+	for _, s := range scheduled {
+		if err := d.publisher.Publish(s.topic, s.msg); err != nil {
+			return 0, fmt.Errorf("could not publish scheduled message %d: %w", s.id, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM scheduled_messages WHERE id = $1`, s.id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(scheduled), tx.Commit()
+}
@@ -0,0 +1,22 @@
+package app
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+// setEventEnvelopeMetadata adds the event envelope to the published message metadata.
+func setEventEnvelopeMetadata(params cqrs.OnEventSendParams, producer string) {
+	schemaVersion := 1
+	if event, ok := params.Event.(contracts.VersionedEvent); ok {
+		schemaVersion = event.SchemaVersion()
+	}
+
+	params.Message.Metadata.Set(contracts.EventIDMetadataKey, params.Message.UUID)
+	params.Message.Metadata.Set(contracts.OccurredAtMetadataKey, time.Now().UTC().Format(time.RFC3339Nano))
+	params.Message.Metadata.Set(contracts.ProducerMetadataKey, producer)
+	params.Message.Metadata.Set(contracts.SchemaVersionMetadataKey, strconv.Itoa(schemaVersion))
+}
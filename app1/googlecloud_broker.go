@@ -0,0 +1,60 @@
+package app
+
+import (
+	"cloud.google.com/go/pubsub"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-googlecloud/pkg/googlecloud"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// googleCloudBroker uses Google Cloud Pub/Sub.
+//
+// Every topic is a Pub/Sub topic with the same name and every consumer group gets its own subscription,
+// named <topic>_<consumer group>. Topics and subscriptions are created on the first use.
+// When PUBSUB_EMULATOR_HOST is set, the client connects to the emulator instead.
+//
+// The partition key is used as the ordering key, so messages of the same booking are delivered in order.
+// Subscriptions only receive messages published after they were created, so offsetReset is ignored.
+type googleCloudBroker struct {
+	projectID string
+	publisher *googlecloud.Publisher
+	logger    watermill.LoggerAdapter
+}
+
+func newGoogleCloudBroker(projectID string, logger watermill.LoggerAdapter) (*googleCloudBroker, error) {
+	publisher, err := googlecloud.NewPublisher(
+		googlecloud.PublisherConfig{
+			ProjectID:             projectID,
+			EnableMessageOrdering: true,
+			EnableMessageOrderingAutoResumePublishOnError: true,
+			Marshaler: googlecloud.NewOrderingMarshaler(generatePartitionKey),
+		},
+		logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &googleCloudBroker{
+		projectID: projectID,
+		publisher: publisher,
+		logger:    logger,
+	}, nil
+}
+
+func (b *googleCloudBroker) Publisher() message.Publisher {
+	return b.publisher
+}
+
+func (b *googleCloudBroker) NewSubscriber(consumerGroup string, offsetReset OffsetReset) (message.Subscriber, error) {
+	return googlecloud.NewSubscriber(
+		googlecloud.SubscriberConfig{
+			ProjectID:                b.projectID,
+			GenerateSubscriptionName: googlecloud.TopicSubscriptionNameWithSuffix("_" + consumerGroup),
+			SubscriptionConfig: pubsub.SubscriptionConfig{
+				EnableMessageOrdering: true,
+			},
+		},
+		b.logger,
+	)
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// HandlerFlags select command and event handlers registered by the instance, so the app can be scaled
+// by running instances with a part of handlers, e.g. payments-only or reporting-only ones.
+//
+// Handlers are selected with names or patterns like bookings_projection_*.
+type HandlerFlags struct {
+	// Enabled handlers are registered, all handlers are registered when it's empty.
+	Enabled []string
+	// Disabled handlers are not registered, even if they are enabled.
+	Disabled []string
+}
+
+func parseHandlerPatterns(s string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func (f HandlerFlags) Validate() error {
+	var errs []error
+	for _, pattern := range slices.Concat(f.Enabled, f.Disabled) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid handler pattern %q: %w", pattern, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f HandlerFlags) IsEnabled(handlerName string) bool {
+	if len(f.Enabled) > 0 && !matchesAnyPattern(f.Enabled, handlerName) {
+		return false
+	}
+	return !matchesAnyPattern(f.Disabled, handlerName)
+}
+
+// CheckPatterns returns errors for patterns which don't match any of the handlers, e.g. misspelled names.
+func (f HandlerFlags) CheckPatterns(handlerNames []string) error {
+	var errs []error
+	check := func(setting string, patterns []string) {
+		for _, pattern := range patterns {
+			if !slices.ContainsFunc(handlerNames, func(name string) bool { return matchesAnyPattern([]string{pattern}, name) }) {
+				errs = append(errs, fmt.Errorf("%s: %q doesn't match any handler", setting, pattern))
+			}
+		}
+	}
+	check("HANDLERS_ENABLED", f.Enabled)
+	check("HANDLERS_DISABLED", f.Disabled)
+	return errors.Join(errs...)
+}
+
+// enabledHandlers returns handlers enabled by the flags.
+func enabledHandlers[H interface{ HandlerName() string }](handlers []H, flags HandlerFlags) []H {
+	return slices.DeleteFunc(slices.Clone(handlers), func(handler H) bool {
+		return !flags.IsEnabled(handler.HandlerName())
+	})
+}
+
+func handlerNames[H interface{ HandlerName() string }](handlers []H) []string {
+	names := make([]string, 0, len(handlers))
+	for _, handler := range handlers {
+		names = append(names, handler.HandlerName())
+	}
+	return names
+}
+
+func matchesAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
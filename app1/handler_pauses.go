@@ -0,0 +1,284 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+var ErrHandlerNotFound = errors.New("handler not found")
+
+type HandlerPauseResponse struct {
+	Handler string `json:"handler"`
+	Paused  bool   `json:"paused"`
+}
+
+// HandlerPauses pauses and resumes subscribers of single handlers while the app runs.
+//
+// Paused handler's subscriber is closed, so messages are not consumed and pile up in the broker
+// until the handler is resumed with a new subscriber of the same consumer group.
+type HandlerPauses struct {
+	lock        sync.Mutex
+	subscribers map[string]*pausableSubscriber
+}
+
+func NewHandlerPauses() *HandlerPauses {
+	return &HandlerPauses{
+		subscribers: map[string]*pausableSubscriber{},
+	}
+}
+
+// Subscriber returns the handler's subscriber, which can be paused. newSubscriber is called again on every resume.
+func (p *HandlerPauses) Subscriber(handlerName string, newSubscriber func() (message.Subscriber, error)) (message.Subscriber, error) {
+	subscriber, err := newSubscriber()
+	if err != nil {
+		return nil, err
+	}
+
+	pausable := &pausableSubscriber{
+		handlerName:   handlerName,
+		newSubscriber: newSubscriber,
+		subscriber:    subscriber,
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.subscribers[handlerName] = pausable
+
+	return pausable, nil
+}
+
+func (p *HandlerPauses) Pause(ctx context.Context, handlerName string) error {
+	subscriber, err := p.subscriber(handlerName)
+	if err != nil {
+		return err
+	}
+
+	return subscriber.pause(ctx)
+}
+
+func (p *HandlerPauses) Resume(ctx context.Context, handlerName string) error {
+	subscriber, err := p.subscriber(handlerName)
+	if err != nil {
+		return err
+	}
+
+	return subscriber.resume(ctx)
+}
+
+func (p *HandlerPauses) subscriber(handlerName string) (*pausableSubscriber, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	subscriber, ok := p.subscribers[handlerName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrHandlerNotFound, handlerName)
+	}
+	return subscriber, nil
+}
+
+func (p *HandlerPauses) PauseHandler(writer http.ResponseWriter, request *http.Request) {
+	p.handle(writer, request, true)
+}
+
+func (p *HandlerPauses) ResumeHandler(writer http.ResponseWriter, request *http.Request) {
+	p.handle(writer, request, false)
+}
+
+func (p *HandlerPauses) handle(writer http.ResponseWriter, request *http.Request, pause bool) {
+	handlerName := request.PathValue("name")
+
+	var err error
+	if pause {
+		err = p.Pause(request.Context(), handlerName)
+	} else {
+		err = p.Resume(request.Context(), handlerName)
+	}
+	if errors.Is(err, ErrHandlerNotFound) {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Handler not found",
+			Status: http.StatusNotFound,
+			Detail: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		slog.With("err", err, "handler", handlerName).ErrorContext(request.Context(), "Failed to pause or resume handler")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, HandlerPauseResponse{
+		Handler: handlerName,
+		Paused:  pause,
+	})
+}
+
+// pausableSubscriber forwards messages of the underlying subscriber to a channel which stays open
+// while the underlying subscriber is closed on pause and replaced on resume.
+type pausableSubscriber struct {
+	handlerName   string
+	newSubscriber func() (message.Subscriber, error)
+
+	lock       sync.Mutex
+	subscriber message.Subscriber
+	paused     bool
+	closed     bool
+
+	ctx        context.Context
+	topic      string
+	out        chan *message.Message
+	cancel     context.CancelFunc
+	forwarding sync.WaitGroup
+	closeOut   sync.Once
+}
+
+func (s *pausableSubscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.out != nil {
+		return nil, errors.New("pausable subscriber can subscribe only once")
+	}
+
+	s.ctx = ctx
+	s.topic = topic
+	s.out = make(chan *message.Message)
+
+	if err := s.subscribe(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.stop()
+	}()
+
+	return s.out, nil
+}
+
+// subscribe subscribes with the current subscriber, s.lock must be held.
+func (s *pausableSubscriber) subscribe() error {
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	messages, err := s.subscriber.Subscribe(ctx, s.topic)
+	if err != nil {
+		cancel()
+		return err
+	}
+	s.cancel = cancel
+
+	s.forwarding.Add(1)
+	go func() {
+		defer s.forwarding.Done()
+
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					// The subscription ended without pausing, so the handler is stopped like with any other subscriber.
+					go s.stop()
+					return
+				}
+
+				select {
+				case s.out <- msg:
+				case <-ctx.Done():
+					// Paused while the message was waiting for the handler, it's redelivered after resume.
+					msg.Nack()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *pausableSubscriber) pause(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.paused || s.closed {
+		return nil
+	}
+	if s.out == nil {
+		return errors.New("handler is not running")
+	}
+
+	s.cancel()
+	s.forwarding.Wait()
+	s.paused = true
+
+	slog.With("handler", s.handlerName, "topic", s.topic).InfoContext(ctx, "Handler paused")
+
+	return s.subscriber.Close()
+}
+
+func (s *pausableSubscriber) resume(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.paused || s.closed {
+		return nil
+	}
+
+	subscriber, err := s.newSubscriber()
+	if err != nil {
+		return fmt.Errorf("could not create subscriber: %w", err)
+	}
+	s.subscriber = subscriber
+
+	if err := s.subscribe(); err != nil {
+		return errors.Join(err, subscriber.Close())
+	}
+	s.paused = false
+
+	slog.With("handler", s.handlerName, "topic", s.topic).InfoContext(ctx, "Handler resumed")
+
+	return nil
+}
+
+// stop stops forwarding and closes the channel, so the router's handler stops.
+func (s *pausableSubscriber) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopForwarding()
+}
+
+// stopForwarding must be called with s.lock held.
+func (s *pausableSubscriber) stopForwarding() {
+	s.closed = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.forwarding.Wait()
+
+	if s.out != nil {
+		s.closeOut.Do(func() {
+			close(s.out)
+		})
+	}
+}
+
+func (s *pausableSubscriber) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopForwarding()
+
+	if s.paused {
+		// Already closed when paused.
+		return nil
+	}
+	return s.subscriber.Close()
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	stdSQL "database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+const (
+	healthStatusOK   = "ok"
+	healthStatusFail = "fail"
+)
+
+// DependencyStatus is the result of a single readiness check.
+type DependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// HealthChecks serves endpoints for Kubernetes liveness and readiness probes.
+type HealthChecks struct {
+	config Config
+	db     *stdSQL.DB
+	broker Broker
+	router *message.Router
+	// projectionCheckpoints are nil in services which don't serve projections.
+	projectionCheckpoints *ProjectionCheckpoints
+}
+
+// HealthzHandler responds as long as the process is able to serve HTTP requests.
+func (h HealthChecks) HealthzHandler(writer http.ResponseWriter, request *http.Request) {
+	server.WriteJSON(request.Context(), writer, http.StatusOK, map[string]string{"status": healthStatusOK})
+}
+
+// ReadyzHandler checks all dependencies in parallel and responds with 503 when any of them isn't ready.
+func (h HealthChecks) ReadyzHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), 5*time.Second)
+	defer cancel()
+
+	checks := map[string]func(ctx context.Context) error{
+		"postgres": h.db.PingContext,
+		"broker": func(ctx context.Context) error {
+			if pinger, ok := unwrapBroker(h.broker).(BrokerPinger); ok {
+				return pinger.Ping(ctx)
+			}
+			return probeBroker(ctx, h.config)
+		},
+		// the router is running once all subscribers are started
+		"router": func(ctx context.Context) error {
+			if !h.router.IsRunning() || h.router.IsClosed() {
+				return errors.New("router is not running")
+			}
+			return nil
+		},
+	}
+	if h.config.DeduplicationStore == "redis" {
+		checks["redis"] = func(ctx context.Context) error {
+			return probeRedis(ctx, h.config.RedisAddr)
+		}
+	}
+	// Stale read models fail the check, so queries are not served from them.
+	// Projections are checked only by the service which serves them.
+	if h.projectionCheckpoints != nil {
+		for name, check := range h.projectionCheckpoints.ReadinessChecks() {
+			checks[name] = check
+		}
+	}
+
+	response := ReadinessResponse{
+		Status:       healthStatusOK,
+		Dependencies: make(map[string]DependencyStatus, len(checks)),
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			status := DependencyStatus{Status: healthStatusOK}
+			if err := check(ctx); err != nil {
+				status = DependencyStatus{Status: healthStatusFail, Error: err.Error()}
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			response.Dependencies[name] = status
+			if status.Status != healthStatusOK {
+				response.Status = healthStatusFail
+			}
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if response.Status != healthStatusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	server.WriteJSON(request.Context(), writer, status, response)
+}
@@ -0,0 +1,471 @@
+package booking
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+var (
+	ErrNotFound         = errors.New("booking not found")
+	ErrAlreadyExists    = errors.New("booking already exists")
+	ErrAlreadyCancelled = errors.New("booking is already cancelled")
+	ErrRefunded         = errors.New("cannot cancel a refunded booking")
+	// ErrInvalidBooking is returned for BookRoom commands which can't be booked however many times they are retried.
+	ErrInvalidBooking = errors.New("invalid booking")
+)
+
+// Booking is an event-sourced aggregate, its state is rebuilt from the events stored in booking_events.
+type Booking struct {
+	id     string
+	roomID string
+	price  contracts.Money
+
+	booked      bool
+	unavailable bool
+	paid        bool
+	cancelled   bool
+	// refunded is true once the payment is refunded in full.
+	refunded bool
+	// refunds are IDs of recorded refunds, including partial ones.
+	refunds map[string]bool
+
+	guestsCount int
+	checkIn     string
+	checkOut    string
+	// percentOff is the promo code's discount, amended prices are discounted by it as well.
+	percentOff int
+	// amendments are IDs of handled amendments, both applied and rejected.
+	amendments map[string]bool
+	// unpaidAmendment is the amendment waiting for its charge, it's reverted if the charge fails.
+	unpaidAmendment *unpaidAmendment
+
+	// version is the number of events the booking was loaded from.
+	version int
+	changes []bookingChange
+}
+
+type bookingChange struct {
+	event any
+
+	// publish is false for events which were already published by someone else
+	// and are only recorded in the booking's stream.
+	publish bool
+}
+
+// unpaidAmendment keeps the stay from before the amendment, so it can be restored.
+type unpaidAmendment struct {
+	AmendmentID string          `json:"amendment_id"`
+	GuestsCount int             `json:"guests_count"`
+	CheckIn     string          `json:"check_in"`
+	CheckOut    string          `json:"check_out"`
+	Price       contracts.Money `json:"price"`
+}
+
+func newBooking(id string) *Booking {
+	return &Booking{id: id, refunds: map[string]bool{}, amendments: map[string]bool{}}
+}
+
+// bookingSnapshotSchemaVersion is increased when bookingSnapshot gets state which older snapshots can't be restored without,
+// older snapshots are ignored and the booking is rebuilt from its events. Version 2 added the stay with amendments.
+const bookingSnapshotSchemaVersion = 2
+
+// bookingSnapshot is the state of the booking stored in booking_snapshots.
+type bookingSnapshot struct {
+	SchemaVersion int `json:"schema_version"`
+
+	RoomID      string          `json:"room_id"`
+	Price       contracts.Money `json:"price"`
+	Booked      bool            `json:"booked"`
+	Unavailable bool            `json:"unavailable"`
+	Paid        bool            `json:"paid"`
+	Cancelled   bool            `json:"cancelled"`
+	Refunded    bool            `json:"refunded"`
+	// Refunds were added with partial refunds, snapshots without them have at most one full refund.
+	Refunds []string `json:"refunds,omitempty"`
+
+	GuestsCount     int              `json:"guests_count,omitempty"`
+	CheckIn         string           `json:"check_in,omitempty"`
+	CheckOut        string           `json:"check_out,omitempty"`
+	PercentOff      int              `json:"percent_off,omitempty"`
+	Amendments      []string         `json:"amendments,omitempty"`
+	UnpaidAmendment *unpaidAmendment `json:"unpaid_amendment,omitempty"`
+}
+
+func (b *Booking) snapshot() bookingSnapshot {
+	return bookingSnapshot{
+		SchemaVersion: bookingSnapshotSchemaVersion,
+
+		RoomID:      b.roomID,
+		Price:       b.price,
+		Booked:      b.booked,
+		Unavailable: b.unavailable,
+		Paid:        b.paid,
+		Cancelled:   b.cancelled,
+		Refunded:    b.refunded,
+		Refunds:     slices.Sorted(maps.Keys(b.refunds)),
+
+		GuestsCount:     b.guestsCount,
+		CheckIn:         b.checkIn,
+		CheckOut:        b.checkOut,
+		PercentOff:      b.percentOff,
+		Amendments:      slices.Sorted(maps.Keys(b.amendments)),
+		UnpaidAmendment: b.unpaidAmendment,
+	}
+}
+
+func (b *Booking) restore(snapshot bookingSnapshot, version int) {
+	b.roomID = snapshot.RoomID
+	b.price = snapshot.Price
+	b.booked = snapshot.Booked
+	b.unavailable = snapshot.Unavailable
+	b.paid = snapshot.Paid
+	b.cancelled = snapshot.Cancelled
+	b.refunded = snapshot.Refunded
+	for _, refundID := range snapshot.Refunds {
+		b.refunds[refundID] = true
+	}
+	if snapshot.Refunded && len(snapshot.Refunds) == 0 {
+		b.refunds[b.id] = true
+	}
+	b.guestsCount = snapshot.GuestsCount
+	b.checkIn = snapshot.CheckIn
+	b.checkOut = snapshot.CheckOut
+	b.percentOff = snapshot.PercentOff
+	for _, amendmentID := range snapshot.Amendments {
+		b.amendments[amendmentID] = true
+	}
+	b.unpaidAmendment = snapshot.UnpaidAmendment
+	b.version = version
+}
+
+// Book books the room for the price if reserveRoom manages to reserve it for the stay, otherwise RoomUnavailable is raised.
+// The price is discounted with promoCode if it's not nil. Details of the registered guest are copied to RoomBooked,
+// guest is empty for guests who didn't register.
+func (b *Booking) Book(cmd contracts.BookRoom, price contracts.Money, guest Guest, promoCode *PromoCode, reserveRoom func() (bool, error)) error {
+	if b.booked || b.unavailable {
+		return ErrAlreadyExists
+	}
+	if cmd.RoomID == "" {
+		return fmt.Errorf("%w: room_id is required", ErrInvalidBooking)
+	}
+	if cmd.GuestsCount <= 0 {
+		return fmt.Errorf("%w: guests_count must be positive, got %d", ErrInvalidBooking, cmd.GuestsCount)
+	}
+
+	available, err := reserveRoom()
+	if err != nil {
+		return err
+	}
+	if !available {
+		b.raise(contracts.RoomUnavailable{
+			BookingID: b.id,
+			RoomID:    cmd.RoomID,
+			CheckIn:   cmd.CheckIn,
+			CheckOut:  cmd.CheckOut,
+		})
+		return nil
+	}
+
+	var discount contracts.DiscountApplied
+	if promoCode != nil {
+		discount = contracts.DiscountApplied{
+			BookingID:     b.id,
+			PromoCode:     promoCode.Code,
+			PercentOff:    promoCode.PercentOff,
+			OriginalPrice: price,
+			Discount:      price.Percent(promoCode.PercentOff),
+		}
+		price = price.Sub(discount.Discount)
+	}
+
+	b.raise(contracts.RoomBooked{
+		BookingID:   b.id,
+		RoomID:      cmd.RoomID,
+		GuestsCount: cmd.GuestsCount,
+		Price:       price,
+		CheckIn:     cmd.CheckIn,
+		CheckOut:    cmd.CheckOut,
+		GuestID:     cmd.GuestID,
+		GuestName:   guest.Name,
+		GuestEmail:  guest.Email,
+	})
+	if promoCode != nil {
+		b.raise(discount)
+	}
+
+	return nil
+}
+
+func (b *Booking) Cancel() error {
+	if !b.booked {
+		return ErrNotFound
+	}
+	if b.cancelled {
+		return ErrAlreadyCancelled
+	}
+	if b.refunded {
+		// the money was already returned, cancelling would refund it again
+		return ErrRefunded
+	}
+
+	b.raise(contracts.BookingCancelled{
+		BookingID: b.id,
+		RoomID:    b.roomID,
+		Price:     b.price,
+	})
+
+	return nil
+}
+
+// Amend changes the guests count or dates of the paid booking before the check-in and raises BookingAmended
+// with the difference to the price paid so far. The new price comes from price and is discounted
+// by the booking's promo code. moveReservation is called only when the dates change.
+//
+// AmendmentRejected is raised if the booking can't be amended or the room is not available for the new dates.
+// Redelivered amendments are ignored.
+func (b *Booking) Amend(
+	cmd contracts.AmendBooking,
+	today string,
+	price func(stay contracts.BookRoom) (contracts.Money, error),
+	moveReservation func(checkIn string, checkOut string) (bool, error),
+) error {
+	if !b.booked {
+		return ErrNotFound
+	}
+	if b.amendments[cmd.AmendmentID] {
+		return nil
+	}
+
+	reject := func(reason string) error {
+		b.raise(contracts.AmendmentRejected{
+			BookingID:   b.id,
+			AmendmentID: cmd.AmendmentID,
+			Reason:      reason,
+		})
+		return nil
+	}
+
+	switch {
+	case b.cancelled:
+		return reject("booking is cancelled")
+	case b.refunded:
+		return reject("booking is refunded")
+	case !b.paid:
+		return reject("booking is not paid yet")
+	case b.checkIn == "":
+		return reject("stay of the booking is not known")
+	case b.unpaidAmendment != nil:
+		return reject("previous amendment is not paid yet")
+	case b.checkIn <= today:
+		return reject("booking can only be amended before the check-in")
+	}
+
+	stay := contracts.BookRoom{
+		BookingID:   b.id,
+		RoomID:      b.roomID,
+		GuestsCount: cmp.Or(cmd.GuestsCount, b.guestsCount),
+		CheckIn:     cmp.Or(cmd.CheckIn, b.checkIn),
+		CheckOut:    cmp.Or(cmd.CheckOut, b.checkOut),
+		Currency:    b.price.Currency,
+	}
+
+	switch {
+	case stay.CheckIn < today:
+		return reject("check_in can't be in the past")
+	case stay.CheckOut <= stay.CheckIn:
+		return reject("check_out must be after check_in")
+	case stay.GuestsCount == b.guestsCount && stay.CheckIn == b.checkIn && stay.CheckOut == b.checkOut:
+		return reject("nothing to amend")
+	}
+
+	newPrice, err := price(stay)
+	if err != nil {
+		return err
+	}
+	newPrice = newPrice.Sub(newPrice.Percent(b.percentOff))
+
+	if stay.CheckIn != b.checkIn || stay.CheckOut != b.checkOut {
+		available, err := moveReservation(stay.CheckIn, stay.CheckOut)
+		if err != nil {
+			return err
+		}
+		if !available {
+			return reject(fmt.Sprintf("room is not available from %s to %s", stay.CheckIn, stay.CheckOut))
+		}
+	}
+
+	b.raise(contracts.BookingAmended{
+		BookingID:   b.id,
+		AmendmentID: cmd.AmendmentID,
+		RoomID:      b.roomID,
+		GuestsCount: stay.GuestsCount,
+		CheckIn:     stay.CheckIn,
+		CheckOut:    stay.CheckOut,
+		Price:       newPrice,
+		Difference:  newPrice.Sub(b.price),
+	})
+
+	return nil
+}
+
+// RevertAmendment restores the stay from before the amendment whose charge failed.
+// If the room was booked by someone else for the previous dates in the meantime, the booking is cancelled instead.
+// Amendments which were paid or already reverted are ignored.
+func (b *Booking) RevertAmendment(
+	cmd contracts.RevertAmendment,
+	moveReservation func(checkIn string, checkOut string) (bool, error),
+	releaseRoom func() error,
+) error {
+	if !b.booked {
+		return ErrNotFound
+	}
+	if b.unpaidAmendment == nil || b.unpaidAmendment.AmendmentID != cmd.AmendmentID {
+		return nil
+	}
+
+	previous := *b.unpaidAmendment
+
+	if !b.cancelled && (previous.CheckIn != b.checkIn || previous.CheckOut != b.checkOut) {
+		available, err := moveReservation(previous.CheckIn, previous.CheckOut)
+		if err != nil {
+			return err
+		}
+		if !available {
+			if err := b.Cancel(); err != nil {
+				return err
+			}
+			return releaseRoom()
+		}
+	}
+
+	b.raise(contracts.AmendmentReverted{
+		BookingID:   b.id,
+		AmendmentID: cmd.AmendmentID,
+		RoomID:      b.roomID,
+		GuestsCount: previous.GuestsCount,
+		CheckIn:     previous.CheckIn,
+		CheckOut:    previous.CheckOut,
+		Price:       previous.Price,
+		Reason:      cmd.Reason,
+	})
+
+	return nil
+}
+
+// RecordAmendmentPaymentTaken adds the amendment's charge to the booking's history.
+func (b *Booking) RecordAmendmentPaymentTaken(event contracts.AmendmentPaymentTaken) error {
+	if !b.booked {
+		return ErrNotFound
+	}
+	if b.unpaidAmendment == nil || b.unpaidAmendment.AmendmentID != event.AmendmentID {
+		return nil
+	}
+
+	b.record(event)
+
+	return nil
+}
+
+// RecordPaymentTaken adds the payment to the booking's history. Redelivered payments are ignored.
+func (b *Booking) RecordPaymentTaken(event contracts.PaymentTaken) error {
+	if !b.booked {
+		return ErrNotFound
+	}
+	if b.paid {
+		return nil
+	}
+
+	b.record(event)
+
+	return nil
+}
+
+// RecordPaymentRefunded adds the refund to the booking's history. Redelivered refunds are ignored.
+func (b *Booking) RecordPaymentRefunded(event contracts.PaymentRefunded) error {
+	if !b.booked {
+		return ErrNotFound
+	}
+	if b.refunds[refundID(event)] {
+		return nil
+	}
+
+	b.record(event)
+
+	return nil
+}
+
+// raise applies the new event and publishes it when the booking is saved.
+func (b *Booking) raise(event any) {
+	b.apply(event)
+	b.changes = append(b.changes, bookingChange{event: event, publish: true})
+}
+
+// record applies the event which was already published and only stores it when the booking is saved.
+func (b *Booking) record(event any) {
+	b.apply(event)
+	b.changes = append(b.changes, bookingChange{event: event, publish: false})
+}
+
+func (b *Booking) apply(event any) {
+	switch event := event.(type) {
+	case contracts.RoomBooked:
+		b.booked = true
+		b.roomID = event.RoomID
+		b.price = event.Price
+		b.guestsCount = event.GuestsCount
+		b.checkIn = event.CheckIn
+		b.checkOut = event.CheckOut
+	case contracts.DiscountApplied:
+		b.percentOff = event.PercentOff
+	case contracts.RoomUnavailable:
+		b.unavailable = true
+	case contracts.BookingCancelled:
+		b.cancelled = true
+	case contracts.PaymentTaken:
+		b.paid = true
+	case contracts.PaymentRefunded:
+		b.refunds[refundID(event)] = true
+		// partially refunded bookings can still be cancelled, which refunds the rest
+		if event.Remaining.Amount <= 0 {
+			b.refunded = true
+		}
+	case contracts.BookingAmended:
+		b.amendments[event.AmendmentID] = true
+		if event.Difference.Amount > 0 {
+			b.unpaidAmendment = &unpaidAmendment{
+				AmendmentID: event.AmendmentID,
+				GuestsCount: b.guestsCount,
+				CheckIn:     b.checkIn,
+				CheckOut:    b.checkOut,
+				Price:       b.price,
+			}
+		}
+		b.guestsCount = event.GuestsCount
+		b.checkIn = event.CheckIn
+		b.checkOut = event.CheckOut
+		b.price = event.Price
+	case contracts.AmendmentRejected:
+		b.amendments[event.AmendmentID] = true
+	case contracts.AmendmentPaymentTaken:
+		b.unpaidAmendment = nil
+	case contracts.AmendmentReverted:
+		b.unpaidAmendment = nil
+		b.guestsCount = event.GuestsCount
+		b.checkIn = event.CheckIn
+		b.checkOut = event.CheckOut
+		b.price = event.Price
+	}
+}
+
+// refundID returns the ID of the refund, refunds published before partial refunds were supported don't have it.
+func refundID(event contracts.PaymentRefunded) string {
+	if event.RefundID == "" {
+		return event.BookingID
+	}
+	return event.RefundID
+}
@@ -0,0 +1,126 @@
+package booking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+type AmendBookingRequest struct {
+	// GuestsCount, CheckIn and CheckOut are optional, only provided ones are changed.
+	// CheckIn and CheckOut must be provided together.
+	GuestsCount *int   `json:"guests_count"`
+	CheckIn     string `json:"check_in"`
+	CheckOut    string `json:"check_out"`
+}
+
+type AmendBookingResponse struct {
+	BookingID   string `json:"booking_id"`
+	AmendmentID string `json:"amendment_id"`
+}
+
+// AmendHandler sends AmendBooking, which is validated against the booking when it's handled.
+// The outcome is published as BookingAmended or AmendmentRejected.
+func (h RoomBookingHandler) AmendHandler(writer http.ResponseWriter, request *http.Request) {
+	bookingID := request.PathValue("id")
+
+	var req AmendBookingRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Malformed request body",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid request",
+			Status: http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+
+	cmd := contracts.AmendBooking{
+		BookingID:   bookingID,
+		AmendmentID: uuid.NewString(),
+		CheckIn:     req.CheckIn,
+		CheckOut:    req.CheckOut,
+	}
+	if req.GuestsCount != nil {
+		cmd.GuestsCount = *req.GuestsCount
+	}
+
+	slog.With("booking_id", bookingID, "amendment_id", cmd.AmendmentID).InfoContext(request.Context(), "Amending booking")
+
+	if err := h.commandBus.Send(request.Context(), cmd); err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to send amend booking command")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusAccepted, AmendBookingResponse{
+		BookingID:   bookingID,
+		AmendmentID: cmd.AmendmentID,
+	})
+}
+
+func (h BookRoomHandler) AmendBooking(ctx context.Context, cmd *contracts.AmendBooking) error {
+	today := time.Now().UTC().Format(time.DateOnly)
+
+	err := h.bookings.Update(ctx, cmd.BookingID, func(tx outbox.Tx, booking *Booking) error {
+		return booking.Amend(
+			*cmd,
+			today,
+			func(stay contracts.BookRoom) (contracts.Money, error) {
+				return h.pricing.Price(ctx, stay)
+			},
+			func(checkIn string, checkOut string) (bool, error) {
+				return h.reservations.Move(ctx, tx, cmd.BookingID, booking.roomID, checkIn, checkOut)
+			},
+		)
+	})
+	if errors.Is(err, ErrNotFound) {
+		slog.With("booking_id", cmd.BookingID).WarnContext(ctx, "Booking to amend not found")
+		return nil
+	}
+
+	return err
+}
+
+func (h BookRoomHandler) RevertAmendment(ctx context.Context, cmd *contracts.RevertAmendment) error {
+	err := h.bookings.Update(ctx, cmd.BookingID, func(tx outbox.Tx, booking *Booking) error {
+		return booking.RevertAmendment(
+			*cmd,
+			func(checkIn string, checkOut string) (bool, error) {
+				return h.reservations.Move(ctx, tx, cmd.BookingID, booking.roomID, checkIn, checkOut)
+			},
+			func() error {
+				return h.reservations.Release(ctx, tx, cmd.BookingID)
+			},
+		)
+	})
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrRefunded) {
+		slog.With("booking_id", cmd.BookingID, "reason", err).WarnContext(ctx, "Amendment can't be reverted")
+		return nil
+	}
+
+	return err
+}
+
+// OnAmendmentPaymentTaken records the charge in the booking's history, so the amendment is not reverted anymore.
+func (h BookRoomHandler) OnAmendmentPaymentTaken(ctx context.Context, event *contracts.AmendmentPaymentTaken) error {
+	return h.bookings.Update(ctx, event.BookingID, func(_ outbox.Tx, booking *Booking) error {
+		return booking.RecordAmendmentPaymentTaken(*event)
+	})
+}
@@ -0,0 +1,58 @@
+package booking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+// baseCurrency is the currency of room prices, bookings in other currencies are converted from it.
+const baseCurrency = contracts.BaseCurrency
+
+var ErrUnsupportedCurrency = errors.New("unsupported currency")
+
+// CurrencyConverter converts money to other currencies.
+type CurrencyConverter interface {
+	// Convert returns ErrUnsupportedCurrency if money can't be converted to currency.
+	Convert(ctx context.Context, money contracts.Money, currency string) (contracts.Money, error)
+}
+
+// FixedRatesCurrencyConverter converts money with exchange rates configured at startup.
+type FixedRatesCurrencyConverter struct {
+	// rates are units of the currency per one unit of baseCurrency.
+	rates map[string]float64
+}
+
+func NewFixedRatesCurrencyConverter(rates map[string]float64) FixedRatesCurrencyConverter {
+	withBase := map[string]float64{baseCurrency: 1}
+	for currency, rate := range rates {
+		withBase[currency] = rate
+	}
+
+	return FixedRatesCurrencyConverter{rates: withBase}
+}
+
+func (c FixedRatesCurrencyConverter) Convert(ctx context.Context, money contracts.Money, currency string) (contracts.Money, error) {
+	if money.Currency == currency {
+		return money, nil
+	}
+
+	fromRate, ok := c.rates[money.Currency]
+	if !ok {
+		return contracts.Money{}, fmt.Errorf("%w: %s", ErrUnsupportedCurrency, money.Currency)
+	}
+	toRate, ok := c.rates[currency]
+	if !ok {
+		return contracts.Money{}, fmt.Errorf("%w: %s", ErrUnsupportedCurrency, currency)
+	}
+
+	major := float64(money.Amount) / math.Pow10(contracts.CurrencyExponent(money.Currency)) / fromRate * toRate
+
+	return contracts.Money{
+		Amount:   int(math.Round(major * math.Pow10(contracts.CurrencyExponent(currency)))),
+		Currency: currency,
+	}, nil
+}
@@ -0,0 +1,224 @@
+package booking
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+type Guest struct {
+	GuestID string `json:"guest_id"`
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+}
+
+type RegisterGuestRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+func (r RegisterGuestRequest) Validate() []server.FieldError {
+	var errs []server.FieldError
+
+	if strings.TrimSpace(r.Name) == "" {
+		errs = append(errs, server.FieldError{Field: "name", Reason: "is required"})
+	} else if len(r.Name) > 255 {
+		errs = append(errs, server.FieldError{Field: "name", Reason: "must be at most 255 characters long"})
+	}
+
+	if _, err := mail.ParseAddress(r.Email); err != nil {
+		errs = append(errs, server.FieldError{Field: "email", Reason: "must be a valid email address"})
+	}
+
+	return errs
+}
+
+var ErrGuestAlreadyRegistered = errors.New("guest with this email is already registered")
+
+// Guests registers guests in the guests table, every email can be registered once.
+//
+// Guests' details are copied to RoomBooked when they book a room, so consumers of bookings
+// don't need to look them up.
+type Guests struct {
+	outbox outbox.Outbox
+	db     *sql.DB
+}
+
+func NewGuests(outbox outbox.Outbox, db *sql.DB) Guests {
+	return Guests{
+		outbox: outbox,
+		db:     db,
+	}
+}
+
+func (g Guests) Register(ctx context.Context, name string, email string) (Guest, error) {
+	guest := Guest{
+		GuestID: uuid.NewString(),
+		Name:    name,
+		Email:   email,
+	}
+
+	err := g.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		result, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO guests (guest_id, name, email) VALUES ($1, $2, $3) ON CONFLICT (email) DO NOTHING`,
+			guest.GuestID, guest.Name, guest.Email,
+		)
+		if err != nil {
+			return err
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if inserted == 0 {
+			return ErrGuestAlreadyRegistered
+		}
+
+		return tx.EventBus.Publish(ctx, contracts.GuestRegistered{
+			GuestID: guest.GuestID,
+			Name:    guest.Name,
+			Email:   guest.Email,
+		})
+	})
+
+	return guest, err
+}
+
+// Guest returns the registered guest, sql.ErrNoRows if there is none.
+func (g Guests) Guest(ctx context.Context, guestID string) (Guest, error) {
+	guest := Guest{GuestID: guestID}
+	err := g.db.QueryRowContext(
+		ctx,
+		`SELECT name, email FROM guests WHERE guest_id = $1`,
+		guestID,
+	).Scan(&guest.Name, &guest.Email)
+
+	return guest, err
+}
+
+// guest returns the registered guest who books the room. Guest IDs which were not registered are only used
+// for loyalty points, an empty Guest is returned for them.
+func (h BookRoomHandler) guest(ctx context.Context, guestID string) (Guest, error) {
+	if guestID == "" {
+		return Guest{}, nil
+	}
+
+	guest, err := h.guests.Guest(ctx, guestID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Guest{}, nil
+	}
+	if err != nil {
+		return Guest{}, fmt.Errorf("could not get guest: %w", err)
+	}
+
+	return guest, nil
+}
+
+func (g Guests) RegisterHandler(writer http.ResponseWriter, request *http.Request) {
+	var req RegisterGuestRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Malformed request body",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid request",
+			Status: http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+
+	guest, err := g.Register(request.Context(), strings.TrimSpace(req.Name), req.Email)
+	if errors.Is(err, ErrGuestAlreadyRegistered) {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Guest already registered",
+			Status: http.StatusConflict,
+			Detail: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to register guest")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	slog.With("guest_id", guest.GuestID).InfoContext(request.Context(), "Guest registered")
+
+	server.WriteJSON(request.Context(), writer, http.StatusCreated, guest)
+}
+
+func (g Guests) GetHandler(writer http.ResponseWriter, request *http.Request) {
+	guest, err := g.Guest(request.Context(), request.PathValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to get guest")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, guest)
+}
+
+// ForgetGuest deletes the guest's key, so personal data in events can't be decrypted anymore,
+// and the guest's registration. GuestForgotten lets consumers delete their copies of the guest's data.
+func (g Guests) ForgetGuest(ctx context.Context, cmd *contracts.ForgetGuest) error {
+	return g.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		_, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO guest_keys (guest_id, key, forgotten_at) VALUES ($1, NULL, NOW())
+			ON CONFLICT (guest_id) DO UPDATE SET key = NULL, forgotten_at = COALESCE(guest_keys.forgotten_at, NOW())`,
+			cmd.GuestID,
+		)
+		if err != nil {
+			return fmt.Errorf("could not delete guest key: %w", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM guests WHERE guest_id = $1`, cmd.GuestID); err != nil {
+			return fmt.Errorf("could not delete guest: %w", err)
+		}
+
+		slog.With("guest_id", cmd.GuestID).InfoContext(ctx, "Guest forgotten")
+
+		return tx.EventBus.Publish(ctx, contracts.GuestForgotten{
+			GuestID: cmd.GuestID,
+		})
+	})
+}
+
+// ForgetGuestHandler sends ForgetGuest, the guest's data is erased asynchronously.
+func (h RoomBookingHandler) ForgetGuestHandler(writer http.ResponseWriter, request *http.Request) {
+	guestID := request.PathValue("id")
+
+	err := h.commandBus.Send(request.Context(), contracts.ForgetGuest{
+		GuestID: guestID,
+	})
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to send forget guest command")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,106 @@
+package booking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+)
+
+type BookRoomHandler struct {
+	bookings     Repository
+	reservations RoomReservations
+	pricing      Pricing
+	promoCodes   PromoCodes
+	guests       Guests
+}
+
+func NewBookRoomHandler(bookings Repository, pricing Pricing, promoCodes PromoCodes, guests Guests) BookRoomHandler {
+	return BookRoomHandler{
+		bookings:   bookings,
+		pricing:    pricing,
+		promoCodes: promoCodes,
+		guests:     guests,
+	}
+}
+
+func (h BookRoomHandler) Handler(ctx context.Context, cmd *contracts.BookRoom) error {
+	price, err := h.pricing.Price(ctx, *cmd)
+	if err != nil {
+		return fmt.Errorf("could not price booking: %w", err)
+	}
+
+	guest, err := h.guest(ctx, cmd.GuestID)
+	if err != nil {
+		return err
+	}
+
+	err = h.bookings.Update(ctx, cmd.BookingID, func(tx outbox.Tx, booking *Booking) error {
+		promoCode, err := h.redeemPromoCode(ctx, tx, cmd)
+		if err != nil {
+			return err
+		}
+
+		return booking.Book(*cmd, price, guest, promoCode, func() (bool, error) {
+			return h.reservations.Reserve(ctx, tx, cmd.BookingID, cmd.RoomID, cmd.CheckIn, cmd.CheckOut)
+		})
+	})
+	if errors.Is(err, ErrAlreadyExists) {
+		slog.With("booking_id", cmd.BookingID).WarnContext(ctx, "Booking already exists")
+		return nil
+	}
+
+	return err
+}
+
+// redeemPromoCode validates and redeems the booking's promo code, nil is returned if there is none.
+// The code could expire or get used up after the booking was requested, then the room is booked at full price.
+func (h BookRoomHandler) redeemPromoCode(ctx context.Context, tx outbox.Tx, cmd *contracts.BookRoom) (*PromoCode, error) {
+	if cmd.PromoCode == "" {
+		return nil, nil
+	}
+
+	promoCode, err := h.promoCodes.Redeem(ctx, tx, cmd.PromoCode, cmd.BookingID)
+	if errors.Is(err, ErrPromoCodeInvalid) {
+		slog.With("booking_id", cmd.BookingID, "promo_code", cmd.PromoCode).WarnContext(ctx, "Promo code can't be redeemed anymore")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not redeem promo code: %w", err)
+	}
+
+	return &promoCode, nil
+}
+
+func (h BookRoomHandler) CancelBooking(ctx context.Context, cmd *contracts.CancelBooking) error {
+	err := h.bookings.Update(ctx, cmd.BookingID, func(tx outbox.Tx, booking *Booking) error {
+		if err := booking.Cancel(); err != nil {
+			return err
+		}
+
+		return h.reservations.Release(ctx, tx, cmd.BookingID)
+	})
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrAlreadyCancelled) || errors.Is(err, ErrRefunded) {
+		slog.With("booking_id", cmd.BookingID, "reason", err).WarnContext(ctx, "Booking can't be cancelled")
+		return nil
+	}
+
+	return err
+}
+
+// OnPaymentTaken records the payment in the booking's history.
+func (h BookRoomHandler) OnPaymentTaken(ctx context.Context, event *contracts.PaymentTaken) error {
+	return h.bookings.Update(ctx, event.BookingID, func(_ outbox.Tx, booking *Booking) error {
+		return booking.RecordPaymentTaken(*event)
+	})
+}
+
+// OnPaymentRefunded records the refund in the booking's history, so a fully refunded booking can't be cancelled anymore.
+func (h BookRoomHandler) OnPaymentRefunded(ctx context.Context, event *contracts.PaymentRefunded) error {
+	return h.bookings.Update(ctx, event.BookingID, func(_ outbox.Tx, booking *Booking) error {
+		return booking.RecordPaymentRefunded(*event)
+	})
+}
@@ -0,0 +1,314 @@
+package booking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/components/requestreply"
+	"github.com/google/uuid"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+type BookRoomRequest struct {
+	RoomID      string `json:"room_id"`
+	GuestsCount int    `json:"guests_count"`
+
+	// CheckIn and CheckOut are dates in the YYYY-MM-DD format.
+	// When not provided, the room is booked for one night starting today.
+	CheckIn  string `json:"check_in"`
+	CheckOut string `json:"check_out"`
+
+	// Email is optional, guests who provide it are notified about the booking.
+	Email string `json:"email"`
+
+	// Currency is the ISO 4217 currency of the price, USD by default.
+	Currency string `json:"currency"`
+
+	// PromoCode is optional, it discounts the price.
+	PromoCode string `json:"promo_code"`
+
+	// GuestID is optional, guests who provide it collect loyalty points.
+	GuestID string `json:"guest_id"`
+}
+
+// Contacts stores emails guests gave when booking, so they can be notified.
+type Contacts interface {
+	Save(ctx context.Context, bookingID string, email string) error
+}
+
+type RoomBookingHandler struct {
+	commandBus      *cqrs.CommandBus
+	idempotencyKeys IdempotencyKeys
+	contacts        Contacts
+	currencies      CurrencyConverter
+	promoCodes      PromoCodes
+
+	// responseStatus is returned when the booking is accepted, 202 Accepted by default
+	// as the booking is processed asynchronously.
+	responseStatus int
+
+	// replies are used by POST /book?sync=true to wait for the payment outcome.
+	replies requestreply.Backend[Status]
+}
+
+func NewRoomBookingHandler(
+	commandBus *cqrs.CommandBus,
+	idempotencyKeys IdempotencyKeys,
+	contacts Contacts,
+	currencies CurrencyConverter,
+	promoCodes PromoCodes,
+	responseStatus int,
+	replies requestreply.Backend[Status],
+) RoomBookingHandler {
+	return RoomBookingHandler{
+		commandBus:      commandBus,
+		idempotencyKeys: idempotencyKeys,
+		contacts:        contacts,
+		currencies:      currencies,
+		promoCodes:      promoCodes,
+		responseStatus:  responseStatus,
+		replies:         replies,
+	}
+}
+
+type BookRoomResponse struct {
+	BookingID string `json:"booking_id"`
+	Status    Status `json:"status"`
+}
+
+func (h RoomBookingHandler) Handler(writer http.ResponseWriter, request *http.Request) {
+	b, err := io.ReadAll(request.Body)
+	if err != nil {
+		slog.With("err", err).Error("Failed to read request body")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req := BookRoomRequest{}
+	err = json.Unmarshal(b, &req)
+	if err != nil {
+		slog.With("err", err).Error("Failed to unmarshal request")
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Malformed request body",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		slog.With("errors", errs).InfoContext(request.Context(), "Invalid book room request")
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid request",
+			Status: http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+
+	currency := req.Currency
+	if currency == "" {
+		currency = baseCurrency
+	}
+
+	// The price is calculated by BookRoomHandler, only the currency is checked here.
+	_, err = h.currencies.Convert(request.Context(), contracts.Money{Currency: baseCurrency}, currency)
+	if errors.Is(err, ErrUnsupportedCurrency) {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid request",
+			Status: http.StatusBadRequest,
+			Errors: []server.FieldError{{Field: "currency", Reason: "is not supported"}},
+		})
+		return
+	}
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to check currency")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if req.PromoCode != "" {
+		_, err := h.promoCodes.Check(request.Context(), req.PromoCode)
+		if errors.Is(err, ErrPromoCodeInvalid) {
+			server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+				Title:  "Invalid request",
+				Status: http.StatusBadRequest,
+				Errors: []server.FieldError{{Field: "promo_code", Reason: "is unknown, expired or used up"}},
+			})
+			return
+		}
+		if err != nil {
+			slog.With("err", err).ErrorContext(request.Context(), "Failed to check promo code")
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	bookingID := uuid.NewString()
+
+	idempotencyKey := request.Header.Get(idempotencyKeyHeader)
+	if idempotencyKey != "" {
+		storedBookingID, replay, err := h.idempotencyKeys.Reserve(request.Context(), idempotencyKey, bookingID)
+		if err != nil {
+			slog.With("err", err).ErrorContext(request.Context(), "Failed to reserve idempotency key")
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if replay {
+			slog.With("booking_id", storedBookingID).InfoContext(request.Context(), "Replaying booking request")
+			server.WriteJSON(request.Context(), writer, h.responseStatus, BookRoomResponse{
+				BookingID: storedBookingID,
+				Status:    StatusPending,
+			})
+			return
+		}
+	}
+
+	sync := request.URL.Query().Get("sync") == "true"
+
+	slog.With("req", req, "booking_id", bookingID, "sync", sync).InfoContext(request.Context(), "Booking room")
+
+	checkIn, checkOut := req.StayDates(time.Now())
+
+	cmd := contracts.BookRoom{
+		BookingID:   bookingID,
+		RoomID:      req.RoomID,
+		GuestsCount: req.GuestsCount,
+		CheckIn:     checkIn,
+		CheckOut:    checkOut,
+		Currency:    currency,
+		PromoCode:   req.PromoCode,
+		GuestID:     req.GuestID,
+	}
+
+	status, err := h.book(request.Context(), cmd, req.Email, sync)
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to book room")
+
+		if idempotencyKey != "" {
+			if err := h.idempotencyKeys.Release(request.Context(), idempotencyKey); err != nil {
+				slog.With("err", err).ErrorContext(request.Context(), "Failed to release idempotency key")
+			}
+		}
+
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if status == StatusUnavailable {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Room unavailable",
+			Status: http.StatusConflict,
+			Detail: fmt.Sprintf("room %s is already booked between %s and %s", cmd.RoomID, cmd.CheckIn, cmd.CheckOut),
+		})
+		return
+	}
+
+	responseStatus := h.responseStatus
+	if status != StatusPending {
+		responseStatus = http.StatusOK
+	}
+
+	server.WriteJSON(request.Context(), writer, responseStatus, BookRoomResponse{
+		BookingID: bookingID,
+		Status:    status,
+	})
+}
+
+// book stores the guest's contact and sends the BookRoom command, waiting for the payment outcome if sync is set.
+func (h RoomBookingHandler) book(ctx context.Context, cmd contracts.BookRoom, email string, sync bool) (Status, error) {
+	if email != "" {
+		if err := h.contacts.Save(ctx, cmd.BookingID, email); err != nil {
+			return "", fmt.Errorf("could not save guest's contact: %w", err)
+		}
+	}
+
+	if sync {
+		return waitForBooking(ctx, h.commandBus, h.replies, cmd)
+	}
+
+	return StatusPending, h.commandBus.Send(ctx, cmd)
+}
+
+func (h RoomBookingHandler) CancelHandler(writer http.ResponseWriter, request *http.Request) {
+	bookingID := request.PathValue("id")
+
+	slog.With("booking_id", bookingID).InfoContext(request.Context(), "Cancelling booking")
+
+	err := h.commandBus.Send(request.Context(), contracts.CancelBooking{
+		BookingID: bookingID,
+	})
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to send cancel booking command")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+type RefundRequest struct {
+	// Amount is optional, everything which wasn't refunded yet is refunded without it.
+	Amount *contracts.Money `json:"amount"`
+}
+
+type RefundResponse struct {
+	BookingID string `json:"booking_id"`
+	RefundID  string `json:"refund_id"`
+}
+
+// RefundHandler sends RefundPayment, which is validated against the payment when it's handled.
+// The outcome is published as PaymentRefunded or RefundRejected.
+func (h RoomBookingHandler) RefundHandler(writer http.ResponseWriter, request *http.Request) {
+	bookingID := request.PathValue("id")
+
+	var req RefundRequest
+	err := json.NewDecoder(request.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Malformed request body",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if errs := req.Validate(); len(errs) > 0 {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid request",
+			Status: http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+
+	cmd := contracts.RefundPayment{
+		BookingID: bookingID,
+		RefundID:  uuid.NewString(),
+	}
+	if req.Amount != nil {
+		cmd.Amount = *req.Amount
+	}
+
+	slog.With("booking_id", bookingID, "refund_id", cmd.RefundID, "amount", cmd.Amount).InfoContext(request.Context(), "Refunding booking")
+
+	if err := h.commandBus.Send(request.Context(), cmd); err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to send refund payment command")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusAccepted, RefundResponse{
+		BookingID: bookingID,
+		RefundID:  cmd.RefundID,
+	})
+}
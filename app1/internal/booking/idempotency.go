@@ -0,0 +1,63 @@
+package booking
+
+import (
+	"context"
+	stdSQL "database/sql"
+	"errors"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyKeys remembers which booking was created for the client's Idempotency-Key,
+// so retried requests return the same booking instead of creating a new one.
+type IdempotencyKeys struct {
+	db  *stdSQL.DB
+	ttl time.Duration
+}
+
+func NewIdempotencyKeys(db *stdSQL.DB, ttl time.Duration) IdempotencyKeys {
+	return IdempotencyKeys{
+		db:  db,
+		ttl: ttl,
+	}
+}
+
+// Reserve stores bookingID for key, unless the key was already used within the TTL.
+// It returns the booking ID stored for the key and true if the request is a replay.
+func (k IdempotencyKeys) Reserve(ctx context.Context, key string, bookingID string) (string, bool, error) {
+	var storedBookingID string
+
+	// Expired keys are overwritten, so they can be reused.
+	err := k.db.QueryRowContext(
+		ctx,
+		`INSERT INTO idempotency_keys (idempotency_key, booking_id) VALUES ($1, $2)
+		ON CONFLICT (idempotency_key) DO UPDATE SET booking_id = EXCLUDED.booking_id, created_at = NOW()
+		WHERE idempotency_keys.created_at < NOW() - make_interval(secs => $3)
+		RETURNING booking_id`,
+		key, bookingID, k.ttl.Seconds(),
+	).Scan(&storedBookingID)
+	if err == nil {
+		return storedBookingID, false, nil
+	}
+	if !errors.Is(err, stdSQL.ErrNoRows) {
+		return "", false, err
+	}
+
+	err = k.db.QueryRowContext(
+		ctx,
+		`SELECT booking_id FROM idempotency_keys WHERE idempotency_key = $1`,
+		key,
+	).Scan(&storedBookingID)
+	if err != nil {
+		return "", false, err
+	}
+
+	return storedBookingID, true, nil
+}
+
+// Release removes the key, so the client can retry a request which failed.
+func (k IdempotencyKeys) Release(ctx context.Context, key string) error {
+	_, err := k.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE idempotency_key = $1`, key)
+	return err
+}
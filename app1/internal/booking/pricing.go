@@ -0,0 +1,150 @@
+package booking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+// PricingRules define prices of rooms per guest and night in baseCurrency.
+type PricingRules struct {
+	// BaseRate is the rate of rooms without a rate in RoomRates.
+	BaseRate  contracts.Money
+	RoomRates map[string]contracts.Money
+
+	// Seasons multiply rates of nights within them, the first matching season is used.
+	Seasons []Season
+
+	// WeekendSurcharge is added to rates of Friday and Saturday nights, 0.2 makes them 20% more expensive.
+	WeekendSurcharge float64
+}
+
+// Season is a recurring period of the year between From and To (inclusive) in the MM-DD format.
+// Seasons can span the new year, e.g. from 12-20 to 01-05.
+type Season struct {
+	From       string
+	To         string
+	Multiplier float64
+}
+
+func (s Season) contains(night time.Time) bool {
+	day := night.Format("01-02")
+	if s.From <= s.To {
+		return s.From <= day && day <= s.To
+	}
+
+	return day >= s.From || day <= s.To
+}
+
+func (r PricingRules) Validate() error {
+	var errs []error
+
+	if r.BaseRate.Amount <= 0 {
+		errs = append(errs, errors.New("PRICING_BASE_RATE must be positive"))
+	}
+	for roomID, rate := range r.RoomRates {
+		if rate.Amount <= 0 {
+			errs = append(errs, fmt.Errorf("PRICING_ROOM_RATES of %s must be positive", roomID))
+		}
+	}
+	for _, season := range r.Seasons {
+		if !validSeasonDay(season.From) || !validSeasonDay(season.To) {
+			errs = append(errs, fmt.Errorf("PRICING_SEASONS period %s:%s must be in the MM-DD:MM-DD format", season.From, season.To))
+		}
+		if season.Multiplier <= 0 {
+			errs = append(errs, fmt.Errorf("PRICING_SEASONS multiplier of %s:%s must be positive", season.From, season.To))
+		}
+	}
+	if r.WeekendSurcharge < 0 {
+		errs = append(errs, errors.New("PRICING_WEEKEND_SURCHARGE can't be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validSeasonDay(day string) bool {
+	// 2024 is a leap year, so 02-29 is valid
+	_, err := time.Parse("2006-01-02", "2024-"+day)
+	return err == nil && len(day) == len("01-02")
+}
+
+// Pricing calculates prices of bookings with PricingRules and converts them to the booked currency.
+type Pricing struct {
+	rules      PricingRules
+	currencies CurrencyConverter
+}
+
+func NewPricing(rules PricingRules, currencies CurrencyConverter) Pricing {
+	return Pricing{
+		rules:      rules,
+		currencies: currencies,
+	}
+}
+
+// Price returns the price of the booked stay in the currency of cmd.
+// Bookings without stay dates are priced as one night without seasonal and weekend rates.
+func (p Pricing) Price(ctx context.Context, cmd contracts.BookRoom) (contracts.Money, error) {
+	rate, ok := p.rules.RoomRates[cmd.RoomID]
+	if !ok {
+		rate = p.rules.BaseRate
+	}
+
+	total := contracts.Money{Currency: rate.Currency}
+
+	nights, err := StayNights(cmd.CheckIn, cmd.CheckOut)
+	if err != nil {
+		return contracts.Money{}, err
+	}
+	if len(nights) == 0 {
+		total.Amount = rate.Amount * cmd.GuestsCount
+	}
+
+	for _, night := range nights {
+		multiplier := 1.0
+		for _, season := range p.rules.Seasons {
+			if season.contains(night) {
+				multiplier = season.Multiplier
+				break
+			}
+		}
+		if night.Weekday() == time.Friday || night.Weekday() == time.Saturday {
+			multiplier += multiplier * p.rules.WeekendSurcharge
+		}
+
+		total.Amount += int(math.Round(float64(rate.Amount*cmd.GuestsCount) * multiplier))
+	}
+
+	currency := cmd.Currency
+	if currency == "" {
+		currency = baseCurrency
+	}
+
+	return p.currencies.Convert(ctx, total, currency)
+}
+
+// StayNights returns dates of nights between checkIn and checkOut, none if they are not provided.
+func StayNights(checkIn string, checkOut string) ([]time.Time, error) {
+	if checkIn == "" || checkOut == "" {
+		return nil, nil
+	}
+
+	from, err := time.Parse(time.DateOnly, checkIn)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid check_in: %w", ErrInvalidBooking, err)
+	}
+	to, err := time.Parse(time.DateOnly, checkOut)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid check_out: %w", ErrInvalidBooking, err)
+	}
+
+	var nights []time.Time
+	for night := from; night.Before(to); night = night.AddDate(0, 0, 1) {
+		nights = append(nights, night)
+	}
+
+	return nights, nil
+}
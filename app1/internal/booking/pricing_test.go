@@ -0,0 +1,151 @@
+package booking
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+func TestPricing_Price(t *testing.T) {
+	usd := func(amount int) contracts.Money {
+		return contracts.Money{Amount: amount, Currency: baseCurrency}
+	}
+
+	rules := PricingRules{
+		BaseRate: usd(4200),
+		RoomRates: map[string]contracts.Money{
+			"suite": usd(10000),
+		},
+		Seasons: []Season{
+			{From: "07-01", To: "08-31", Multiplier: 1.5},
+			{From: "12-20", To: "01-05", Multiplier: 2},
+			{From: "08-01", To: "08-31", Multiplier: 3},
+		},
+		WeekendSurcharge: 0.25,
+	}
+
+	testCases := []struct {
+		name  string
+		rules PricingRules
+		cmd   contracts.BookRoom
+		want  contracts.Money
+		err   error
+	}{
+		{
+			name:  "one night without stay dates",
+			rules: rules,
+			cmd:   contracts.BookRoom{RoomID: "1", GuestsCount: 2},
+			want:  usd(8400),
+		},
+		{
+			name:  "weekday nights",
+			rules: rules,
+			cmd:   contracts.BookRoom{RoomID: "1", GuestsCount: 1, CheckIn: "2026-10-12", CheckOut: "2026-10-15"},
+			want:  usd(3 * 4200),
+		},
+		{
+			name:  "room rate",
+			rules: rules,
+			cmd:   contracts.BookRoom{RoomID: "suite", GuestsCount: 2, CheckIn: "2026-10-12", CheckOut: "2026-10-13"},
+			want:  usd(20000),
+		},
+		{
+			name:  "friday and saturday nights have weekend surcharge",
+			rules: rules,
+			cmd:   contracts.BookRoom{RoomID: "1", GuestsCount: 1, CheckIn: "2026-10-15", CheckOut: "2026-10-19"},
+			// Thursday, Friday, Saturday and Sunday nights
+			want: usd(4200 + 5250 + 5250 + 4200),
+		},
+		{
+			name:  "first matching season is used",
+			rules: rules,
+			cmd:   contracts.BookRoom{RoomID: "1", GuestsCount: 1, CheckIn: "2026-08-04", CheckOut: "2026-08-05"},
+			want:  usd(6300),
+		},
+		{
+			name:  "season spanning the new year with weekend surcharge",
+			rules: rules,
+			cmd:   contracts.BookRoom{RoomID: "1", GuestsCount: 1, CheckIn: "2026-12-30", CheckOut: "2027-01-03"},
+			// Wednesday and Thursday nights, then Friday and Saturday nights with the surcharge
+			want: usd(8400 + 8400 + 10500 + 10500),
+		},
+		{
+			name:  "converted to the booked currency",
+			rules: rules,
+			cmd:   contracts.BookRoom{RoomID: "1", GuestsCount: 1, CheckIn: "2026-10-12", CheckOut: "2026-10-13", Currency: "EUR"},
+			want:  contracts.Money{Amount: 3864, Currency: "EUR"},
+		},
+		{
+			name:  "unsupported currency",
+			rules: rules,
+			cmd:   contracts.BookRoom{RoomID: "1", GuestsCount: 1, Currency: "CHF"},
+			err:   ErrUnsupportedCurrency,
+		},
+		{
+			name:  "default rules",
+			rules: PricingRules{BaseRate: usd(4200)},
+			cmd:   contracts.BookRoom{RoomID: "1", GuestsCount: 3, CheckIn: "2026-10-16", CheckOut: "2026-10-17"},
+			want:  usd(12600),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pricing := NewPricing(tc.rules, NewFixedRatesCurrencyConverter(map[string]float64{"EUR": 0.92}))
+
+			price, err := pricing.Price(context.Background(), tc.cmd)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expected error %v, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if price != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, price)
+			}
+		})
+	}
+}
+
+func TestPricingRules_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rules   PricingRules
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			rules: PricingRules{BaseRate: contracts.Money{Amount: 4200}, Seasons: []Season{{From: "02-29", To: "03-01", Multiplier: 1.1}}},
+		},
+		{
+			name:    "base rate not positive",
+			rules:   PricingRules{},
+			wantErr: true,
+		},
+		{
+			name:    "invalid season day",
+			rules:   PricingRules{BaseRate: contracts.Money{Amount: 4200}, Seasons: []Season{{From: "13-01", To: "01-05", Multiplier: 2}}},
+			wantErr: true,
+		},
+		{
+			name:    "negative weekend surcharge",
+			rules:   PricingRules{BaseRate: contracts.Money{Amount: 4200}, WeekendSurcharge: -0.1},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rules.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected error: %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package booking
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/messages"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusPaid      Status = "paid"
+	StatusConfirmed Status = "confirmed"
+	StatusFailed    Status = "failed"
+	StatusExpired   Status = "expired"
+	StatusRefunding Status = "refunding"
+	StatusRefunded  Status = "refunded"
+	StatusCancelled Status = "cancelled"
+
+	// StatusUnavailable is the status of bookings rejected because the room was already booked.
+	StatusUnavailable Status = "unavailable"
+)
+
+// ProcessManager drives the booking from RoomBooked to BookingConfirmed, BookingFailed or BookingExpired.
+// Payments taken for bookings which can't be confirmed anymore are compensated with RefundPayment.
+// Price differences of amendments are charged or refunded, amendments which can't be charged are reverted.
+//
+// The state is stored in the booking_processes table and updated in the same transaction
+// in which the resulting events are stored in the outbox.
+type ProcessManager struct {
+	outbox       outbox.Outbox
+	reservations RoomReservations
+
+	// expiration is how long the booking waits for the payment before it expires.
+	expiration time.Duration
+}
+
+func NewProcessManager(outbox outbox.Outbox, expiration time.Duration) ProcessManager {
+	return ProcessManager{
+		outbox:     outbox,
+		expiration: expiration,
+	}
+}
+
+// checkInHour is when rooms are ready for guests on the check-in day, in UTC.
+const checkInHour = 15 * time.Hour
+
+// checkInReminderAdvance is how long before the check-in the guest is reminded about it.
+const checkInReminderAdvance = 24 * time.Hour
+
+func (m ProcessManager) OnRoomBooked(ctx context.Context, event *contracts.RoomBooked) error {
+	return m.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		status, err := m.loadStatus(ctx, tx, event.BookingID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`UPDATE booking_processes SET check_in = NULLIF($1, '')::date WHERE booking_id = $2`,
+			event.CheckIn, event.BookingID,
+		)
+		if err != nil {
+			return fmt.Errorf("could not store check-in date: %w", err)
+		}
+
+		if status == StatusConfirmed {
+			// the payment was processed before RoomBooked, so the reminder wasn't scheduled yet
+			return m.scheduleCheckInReminder(ctx, tx, event.BookingID)
+		}
+		if status != StatusPending {
+			return nil
+		}
+
+		return messages.DelayedCommandBus{CommandBus: tx.CommandBus}.SendAfter(ctx, contracts.ExpireBooking{
+			BookingID: event.BookingID,
+		}, m.expiration)
+	})
+}
+
+// ExpireBooking expires the booking if the payment wasn't taken in time, releasing the room.
+func (m ProcessManager) ExpireBooking(ctx context.Context, cmd *contracts.ExpireBooking) error {
+	return m.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		status, err := m.loadStatus(ctx, tx, cmd.BookingID)
+		if err != nil {
+			return err
+		}
+		if status != StatusPending {
+			return nil
+		}
+
+		slog.With("booking_id", cmd.BookingID).InfoContext(ctx, "Payment not received in time, expiring booking")
+
+		if err := m.updateStatus(ctx, tx, cmd.BookingID, StatusExpired); err != nil {
+			return err
+		}
+		if err := m.reservations.Release(ctx, tx, cmd.BookingID); err != nil {
+			return err
+		}
+
+		return tx.EventBus.Publish(ctx, contracts.BookingExpired{
+			BookingID: cmd.BookingID,
+		})
+	})
+}
+
+func (m ProcessManager) OnPaymentTaken(ctx context.Context, event *contracts.PaymentTaken) error {
+	return m.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		status, err := m.loadStatus(ctx, tx, event.BookingID)
+		if err != nil {
+			return err
+		}
+
+		switch status {
+		case StatusPending:
+		case StatusFailed, StatusExpired, StatusCancelled:
+			// the booking failed, expired or was cancelled before the payment arrived, so the money needs to be returned
+			return m.compensate(ctx, tx, event.BookingID, event.Price)
+		default:
+			slog.With("booking_id", event.BookingID, "status", status).WarnContext(ctx, "Ignoring payment for not pending booking")
+			return nil
+		}
+
+		if err := m.updateStatus(ctx, tx, event.BookingID, StatusPaid); err != nil {
+			return err
+		}
+
+		return m.confirm(ctx, tx, event.BookingID)
+	})
+}
+
+func (m ProcessManager) OnPaymentFailed(ctx context.Context, event *contracts.PaymentFailed) error {
+	return m.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		status, err := m.loadStatus(ctx, tx, event.BookingID)
+		if err != nil {
+			return err
+		}
+
+		if status != StatusPending {
+			slog.With("booking_id", event.BookingID, "status", status).WarnContext(ctx, "Ignoring payment failure for not pending booking")
+			return nil
+		}
+
+		return m.fail(ctx, tx, event.BookingID, event.Reason)
+	})
+}
+
+// OnPaymentRefunded marks the booking as refunded once its payment is refunded in full.
+func (m ProcessManager) OnPaymentRefunded(ctx context.Context, event *contracts.PaymentRefunded) error {
+	if event.Remaining.Amount > 0 {
+		return nil
+	}
+
+	return m.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		return m.updateStatus(ctx, tx, event.BookingID, StatusRefunded)
+	})
+}
+
+// OnBookingCancelled only tracks the status, payments are refunded by payments.Handler on cancellation.
+// Payments which were in flight when the booking was cancelled are compensated by OnPaymentTaken,
+// both use the booking's ID as the refund's ID, so the payment is refunded only once.
+func (m ProcessManager) OnBookingCancelled(ctx context.Context, event *contracts.BookingCancelled) error {
+	return m.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		if _, err := m.loadStatus(ctx, tx, event.BookingID); err != nil {
+			return err
+		}
+
+		return m.updateStatus(ctx, tx, event.BookingID, StatusCancelled)
+	})
+}
+
+// OnBookingAmended settles the amendment's price difference and moves the check-in reminder to the new date.
+// Charges and refunds are idempotent for the amendment, so redelivered events don't settle it twice.
+func (m ProcessManager) OnBookingAmended(ctx context.Context, event *contracts.BookingAmended) error {
+	return m.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		if _, err := m.loadStatus(ctx, tx, event.BookingID); err != nil {
+			return err
+		}
+
+		if err := m.rescheduleCheckInReminder(ctx, tx, event.BookingID, event.CheckIn); err != nil {
+			return err
+		}
+
+		switch {
+		case event.Difference.Amount > 0:
+			return tx.CommandBus.Send(ctx, contracts.ChargeAmendment{
+				BookingID:   event.BookingID,
+				AmendmentID: event.AmendmentID,
+				Amount:      event.Difference,
+			})
+		case event.Difference.Amount < 0:
+			return tx.CommandBus.Send(ctx, contracts.RefundPayment{
+				BookingID: event.BookingID,
+				RefundID:  event.AmendmentID,
+				Amount:    contracts.Money{Amount: -event.Difference.Amount, Currency: event.Difference.Currency},
+			})
+		default:
+			return nil
+		}
+	})
+}
+
+// OnAmendmentPaymentTaken returns the amendment's charge if the booking was cancelled while it was taken.
+func (m ProcessManager) OnAmendmentPaymentTaken(ctx context.Context, event *contracts.AmendmentPaymentTaken) error {
+	return m.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		status, err := m.loadStatus(ctx, tx, event.BookingID)
+		if err != nil {
+			return err
+		}
+
+		switch status {
+		case StatusCancelled, StatusRefunding, StatusRefunded:
+			slog.With("booking_id", event.BookingID, "amendment_id", event.AmendmentID).InfoContext(ctx, "Compensating amendment payment")
+
+			return tx.CommandBus.Send(ctx, contracts.RefundPayment{
+				BookingID: event.BookingID,
+				RefundID:  event.AmendmentID,
+				Amount:    event.Amount,
+			})
+		default:
+			return nil
+		}
+	})
+}
+
+// OnAmendmentPaymentFailed reverts the amendment which the guest didn't pay for.
+func (m ProcessManager) OnAmendmentPaymentFailed(ctx context.Context, event *contracts.AmendmentPaymentFailed) error {
+	return m.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		return tx.CommandBus.Send(ctx, contracts.RevertAmendment{
+			BookingID:   event.BookingID,
+			AmendmentID: event.AmendmentID,
+			Reason:      event.Reason,
+		})
+	})
+}
+
+func (m ProcessManager) OnAmendmentReverted(ctx context.Context, event *contracts.AmendmentReverted) error {
+	return m.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		if _, err := m.loadStatus(ctx, tx, event.BookingID); err != nil {
+			return err
+		}
+
+		return m.rescheduleCheckInReminder(ctx, tx, event.BookingID, event.CheckIn)
+	})
+}
+
+func (m ProcessManager) confirm(ctx context.Context, tx outbox.Tx, bookingID string) error {
+	if err := m.updateStatus(ctx, tx, bookingID, StatusConfirmed); err != nil {
+		return err
+	}
+
+	err := tx.EventBus.Publish(ctx, contracts.BookingConfirmed{
+		BookingID: bookingID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.scheduleCheckInReminder(ctx, tx, bookingID)
+}
+
+// scheduleCheckInReminder publishes CheckInReminder checkInReminderAdvance before the check-in.
+// Bookings made less than that before the check-in are reminded right away.
+// It does nothing when the check-in date is not known yet, RoomBooked schedules the reminder then.
+func (m ProcessManager) scheduleCheckInReminder(ctx context.Context, tx outbox.Tx, bookingID string) error {
+	var checkIn sql.NullTime
+	err := tx.QueryRowContext(
+		ctx,
+		`SELECT check_in FROM booking_processes WHERE booking_id = $1`,
+		bookingID,
+	).Scan(&checkIn)
+	if err != nil {
+		return fmt.Errorf("could not load check-in date: %w", err)
+	}
+	if !checkIn.Valid {
+		return nil
+	}
+
+	checkInAt := checkIn.Time.Add(checkInHour)
+	if time.Now().After(checkInAt) {
+		return nil
+	}
+
+	return messages.DelayedEventBus{EventBus: tx.EventBus}.PublishAfter(ctx, contracts.CheckInReminder{
+		BookingID: bookingID,
+		CheckIn:   checkIn.Time.Format(time.DateOnly),
+	}, max(time.Until(checkInAt.Add(-checkInReminderAdvance)), 0))
+}
+
+// rescheduleCheckInReminder schedules the reminder for the new check-in date of a confirmed booking.
+// Reminders scheduled for the previous date are skipped by notifications.Handler.
+func (m ProcessManager) rescheduleCheckInReminder(ctx context.Context, tx outbox.Tx, bookingID string, checkIn string) error {
+	var status Status
+	err := tx.QueryRowContext(
+		ctx,
+		`UPDATE booking_processes SET check_in = $1::date, updated_at = NOW()
+		WHERE booking_id = $2 AND check_in IS DISTINCT FROM $1::date
+		RETURNING status`,
+		checkIn, bookingID,
+	).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the check-in date didn't change
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not store check-in date: %w", err)
+	}
+	if status != StatusConfirmed {
+		return nil
+	}
+
+	return m.scheduleCheckInReminder(ctx, tx, bookingID)
+}
+
+func (m ProcessManager) fail(ctx context.Context, tx outbox.Tx, bookingID string, reason string) error {
+	if err := m.updateStatus(ctx, tx, bookingID, StatusFailed); err != nil {
+		return err
+	}
+
+	// the room is not taken by failed bookings
+	if err := m.reservations.Release(ctx, tx, bookingID); err != nil {
+		return err
+	}
+
+	return tx.EventBus.Publish(ctx, contracts.BookingFailed{
+		BookingID: bookingID,
+		Reason:    reason,
+	})
+}
+
+func (m ProcessManager) compensate(ctx context.Context, tx outbox.Tx, bookingID string, amount contracts.Money) error {
+	slog.With("booking_id", bookingID, "amount", amount).InfoContext(ctx, "Compensating payment")
+
+	if err := m.updateStatus(ctx, tx, bookingID, StatusRefunding); err != nil {
+		return err
+	}
+
+	return tx.CommandBus.Send(ctx, contracts.RefundPayment{
+		BookingID: bookingID,
+		Amount:    amount,
+	})
+}
+
+// loadStatus returns the current status of the booking and locks it until tx ends.
+// Events can arrive in any order, so the process is started by whichever event comes first.
+func (m ProcessManager) loadStatus(ctx context.Context, tx outbox.Tx, bookingID string) (Status, error) {
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO booking_processes (booking_id, status) VALUES ($1, $2) ON CONFLICT (booking_id) DO NOTHING`,
+		bookingID, StatusPending,
+	)
+	if err != nil {
+		return "", fmt.Errorf("could not start booking process: %w", err)
+	}
+
+	var status Status
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT status FROM booking_processes WHERE booking_id = $1 FOR UPDATE`,
+		bookingID,
+	).Scan(&status)
+	if err != nil {
+		return "", fmt.Errorf("could not load booking process: %w", err)
+	}
+
+	return status, nil
+}
+
+func (m ProcessManager) updateStatus(ctx context.Context, tx outbox.Tx, bookingID string, status Status) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`UPDATE booking_processes SET status = $1, updated_at = NOW() WHERE booking_id = $2`,
+		status, bookingID,
+	)
+	if err != nil {
+		return fmt.Errorf("could not update booking process status to %s: %w", status, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package booking
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+var ErrPromoCodeInvalid = errors.New("promo code is unknown, expired or used up")
+
+type PromoCode struct {
+	Code       string `json:"code"`
+	PercentOff int    `json:"percent_off"`
+	// MaxUses limits how many bookings can use the code, 0 means no limit.
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (c PromoCode) Validate() []server.FieldError {
+	var errs []server.FieldError
+
+	if strings.TrimSpace(c.Code) == "" {
+		errs = append(errs, server.FieldError{Field: "code", Reason: "is required"})
+	}
+	if c.PercentOff <= 0 || c.PercentOff > 100 {
+		errs = append(errs, server.FieldError{Field: "percent_off", Reason: "must be between 1 and 100"})
+	}
+	if c.MaxUses < 0 {
+		errs = append(errs, server.FieldError{Field: "max_uses", Reason: "can't be negative"})
+	}
+
+	return errs
+}
+
+// PromoCodes stores promo codes and which bookings redeemed them in the promo_codes
+// and promo_code_redemptions tables.
+type PromoCodes struct {
+	db *sql.DB
+}
+
+func NewPromoCodes(db *sql.DB) PromoCodes {
+	return PromoCodes{db: db}
+}
+
+// Check returns the promo code if it can still be redeemed.
+// It doesn't reserve a use, so the code may be used up before the booking is made.
+func (p PromoCodes) Check(ctx context.Context, code string) (PromoCode, error) {
+	promoCode, err := p.scan(p.db.QueryRowContext(
+		ctx,
+		`SELECT code, percent_off, max_uses, uses, expires_at FROM promo_codes
+		WHERE code = $1 AND (max_uses = 0 OR uses < max_uses) AND (expires_at IS NULL OR expires_at > NOW())`,
+		code,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return PromoCode{}, ErrPromoCodeInvalid
+	}
+
+	return promoCode, err
+}
+
+// Redeem uses the promo code for the booking within tx.
+// Uses are counted atomically, so concurrent bookings can't exceed the code's limit.
+func (p PromoCodes) Redeem(ctx context.Context, tx outbox.Tx, code string, bookingID string) (PromoCode, error) {
+	promoCode, err := p.scan(tx.QueryRowContext(
+		ctx,
+		`UPDATE promo_codes SET uses = uses + 1
+		WHERE code = $1 AND (max_uses = 0 OR uses < max_uses) AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING code, percent_off, max_uses, uses, expires_at`,
+		code,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return PromoCode{}, ErrPromoCodeInvalid
+	}
+	if err != nil {
+		return PromoCode{}, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO promo_code_redemptions (booking_id, code) VALUES ($1, $2)`,
+		bookingID, code,
+	)
+	if err != nil {
+		return PromoCode{}, err
+	}
+
+	return promoCode, nil
+}
+
+// Release gives back the use of the promo code redeemed by the booking which wasn't made.
+// Releasing a booking without a redemption does nothing, so redelivered events are safe.
+func (p PromoCodes) Release(ctx context.Context, bookingID string) error {
+	_, err := p.db.ExecContext(
+		ctx,
+		`WITH released AS (
+			DELETE FROM promo_code_redemptions WHERE booking_id = $1 RETURNING code
+		)
+		UPDATE promo_codes SET uses = uses - 1 WHERE code IN (SELECT code FROM released)`,
+		bookingID,
+	)
+	return err
+}
+
+func (p PromoCodes) OnRoomUnavailable(ctx context.Context, event *contracts.RoomUnavailable) error {
+	return p.Release(ctx, event.BookingID)
+}
+
+func (p PromoCodes) OnPaymentFailed(ctx context.Context, event *contracts.PaymentFailed) error {
+	return p.Release(ctx, event.BookingID)
+}
+
+func (p PromoCodes) OnBookingExpired(ctx context.Context, event *contracts.BookingExpired) error {
+	return p.Release(ctx, event.BookingID)
+}
+
+func (p PromoCodes) ListHandler(writer http.ResponseWriter, request *http.Request) {
+	rows, err := p.db.QueryContext(
+		request.Context(),
+		`SELECT code, percent_off, max_uses, uses, expires_at FROM promo_codes ORDER BY code`,
+	)
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to list promo codes")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	promoCodes := []PromoCode{}
+	for rows.Next() {
+		promoCode, err := p.scan(rows)
+		if err != nil {
+			slog.With("err", err).ErrorContext(request.Context(), "Failed to list promo codes")
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		promoCodes = append(promoCodes, promoCode)
+	}
+	if err := rows.Err(); err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to list promo codes")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, promoCodes)
+}
+
+// CreateHandler creates the promo code or replaces its discount, limit and expiry, keeping its uses.
+func (p PromoCodes) CreateHandler(writer http.ResponseWriter, request *http.Request) {
+	var promoCode PromoCode
+	if err := json.NewDecoder(request.Body).Decode(&promoCode); err != nil {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Malformed request body",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if errs := promoCode.Validate(); len(errs) > 0 {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid request",
+			Status: http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+
+	promoCode, err := p.scan(p.db.QueryRowContext(
+		request.Context(),
+		`INSERT INTO promo_codes (code, percent_off, max_uses, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (code) DO UPDATE SET
+			percent_off = EXCLUDED.percent_off,
+			max_uses = EXCLUDED.max_uses,
+			expires_at = EXCLUDED.expires_at
+		RETURNING code, percent_off, max_uses, uses, expires_at`,
+		promoCode.Code, promoCode.PercentOff, promoCode.MaxUses, promoCode.ExpiresAt,
+	))
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to save promo code")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, promoCode)
+}
+
+func (p PromoCodes) scan(row interface{ Scan(dest ...any) error }) (PromoCode, error) {
+	var promoCode PromoCode
+	var expiresAt sql.NullTime
+
+	err := row.Scan(&promoCode.Code, &promoCode.PercentOff, &promoCode.MaxUses, &promoCode.Uses, &expiresAt)
+	if expiresAt.Valid {
+		promoCode.ExpiresAt = &expiresAt.Time
+	}
+
+	return promoCode, err
+}
@@ -0,0 +1,284 @@
+package booking
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+type ReadModel struct {
+	BookingID   string          `json:"booking_id"`
+	RoomID      string          `json:"room_id"`
+	GuestsCount int             `json:"guests_count"`
+	Price       contracts.Money `json:"price"`
+	CheckIn     string          `json:"check_in"`
+	CheckOut    string          `json:"check_out"`
+	GuestID     string          `json:"guest_id"`
+	Status      Status          `json:"status"`
+}
+
+// ReadModelTable is the table with bookings' read models queried by the API.
+const ReadModelTable = "bookings_read_model"
+
+// Projection builds the bookings_read_model table from events.
+//
+// Events may arrive in any order, e.g. when events of different topics are consumed in parallel or replayed,
+// so every handler upserts the row. The stay and the status are changed only by events which occurred after
+// the ones which changed them last, tracked in stay_updated_at and status_updated_at.
+type Projection struct {
+	db    *sql.DB
+	table string
+}
+
+func NewProjection(db *sql.DB) Projection {
+	return Projection{db: db, table: ReadModelTable}
+}
+
+// WithTable returns the projection building another table with the same schema, e.g. when it's rebuilt.
+func (p Projection) WithTable(table string) Projection {
+	p.table = table
+	return p
+}
+
+func (p Projection) OnRoomBooked(ctx context.Context, event *contracts.RoomBooked) error {
+	occurredAt := eventOccurredAt(ctx)
+
+	// The booking may have been amended before RoomBooked is handled, then the amended stay is kept.
+	_, err := p.db.ExecContext(
+		ctx,
+		`INSERT INTO `+p.table+` AS b (booking_id, room_id, guests_count, price, currency, check_in, check_out, guest_id, status, stay_updated_at, status_updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $10)
+		ON CONFLICT (booking_id) DO UPDATE SET
+			room_id = EXCLUDED.room_id,
+			guest_id = EXCLUDED.guest_id,
+			guests_count = CASE WHEN b.stay_updated_at < EXCLUDED.stay_updated_at THEN EXCLUDED.guests_count ELSE b.guests_count END,
+			price = CASE WHEN b.stay_updated_at < EXCLUDED.stay_updated_at THEN EXCLUDED.price ELSE b.price END,
+			currency = CASE WHEN b.stay_updated_at < EXCLUDED.stay_updated_at THEN EXCLUDED.currency ELSE b.currency END,
+			check_in = CASE WHEN b.stay_updated_at < EXCLUDED.stay_updated_at THEN EXCLUDED.check_in ELSE b.check_in END,
+			check_out = CASE WHEN b.stay_updated_at < EXCLUDED.stay_updated_at THEN EXCLUDED.check_out ELSE b.check_out END,
+			stay_updated_at = GREATEST(b.stay_updated_at, EXCLUDED.stay_updated_at)`,
+		event.BookingID, event.RoomID, event.GuestsCount, event.Price.Amount, event.Price.Currency, event.CheckIn, event.CheckOut, event.GuestID, StatusPending, occurredAt,
+	)
+	return err
+}
+
+func (p Projection) OnRoomUnavailable(ctx context.Context, event *contracts.RoomUnavailable) error {
+	_, err := p.db.ExecContext(
+		ctx,
+		`INSERT INTO `+p.table+` AS b (booking_id, room_id, price, currency, status, status_updated_at) VALUES ($1, $2, 0, '', $3, $4)
+		ON CONFLICT (booking_id) DO UPDATE SET status = EXCLUDED.status, status_updated_at = EXCLUDED.status_updated_at
+		WHERE b.status_updated_at < EXCLUDED.status_updated_at`,
+		event.BookingID, event.RoomID, StatusUnavailable, eventOccurredAt(ctx),
+	)
+	return err
+}
+
+func (p Projection) OnPaymentTaken(ctx context.Context, event *contracts.PaymentTaken) error {
+	_, err := p.db.ExecContext(
+		ctx,
+		`INSERT INTO `+p.table+` AS b (booking_id, room_id, price, currency, status, status_updated_at) VALUES ($1, $2, $3, $4, $5, $7)
+		ON CONFLICT (booking_id) DO UPDATE SET status = EXCLUDED.status, status_updated_at = EXCLUDED.status_updated_at
+		WHERE b.status = $6 AND b.status_updated_at < EXCLUDED.status_updated_at`,
+		event.BookingID, event.RoomID, event.Price.Amount, event.Price.Currency, StatusPaid, StatusPending, eventOccurredAt(ctx),
+	)
+	return err
+}
+
+func (p Projection) OnBookingCancelled(ctx context.Context, event *contracts.BookingCancelled) error {
+	_, err := p.db.ExecContext(
+		ctx,
+		`INSERT INTO `+p.table+` AS b (booking_id, room_id, price, currency, status, status_updated_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (booking_id) DO UPDATE SET status = EXCLUDED.status, status_updated_at = EXCLUDED.status_updated_at
+		WHERE b.status_updated_at < EXCLUDED.status_updated_at`,
+		event.BookingID, event.RoomID, event.Price.Amount, event.Price.Currency, StatusCancelled, eventOccurredAt(ctx),
+	)
+	return err
+}
+
+func (p Projection) OnPaymentFailed(ctx context.Context, event *contracts.PaymentFailed) error {
+	_, err := p.db.ExecContext(
+		ctx,
+		`INSERT INTO `+p.table+` AS b (booking_id, room_id, price, currency, status, status_updated_at) VALUES ($1, '', 0, '', $2, $4)
+		ON CONFLICT (booking_id) DO UPDATE SET status = EXCLUDED.status, status_updated_at = EXCLUDED.status_updated_at
+		WHERE b.status = $3 AND b.status_updated_at < EXCLUDED.status_updated_at`,
+		event.BookingID, StatusFailed, StatusPending, eventOccurredAt(ctx),
+	)
+	return err
+}
+
+func (p Projection) OnBookingExpired(ctx context.Context, event *contracts.BookingExpired) error {
+	_, err := p.db.ExecContext(
+		ctx,
+		`INSERT INTO `+p.table+` AS b (booking_id, room_id, price, currency, status, status_updated_at) VALUES ($1, '', 0, '', $2, $4)
+		ON CONFLICT (booking_id) DO UPDATE SET status = EXCLUDED.status, status_updated_at = EXCLUDED.status_updated_at
+		WHERE b.status = $3 AND b.status_updated_at < EXCLUDED.status_updated_at`,
+		event.BookingID, StatusExpired, StatusPending, eventOccurredAt(ctx),
+	)
+	return err
+}
+
+func (p Projection) OnBookingAmended(ctx context.Context, event *contracts.BookingAmended) error {
+	return p.updateStay(ctx, event.BookingID, event.GuestsCount, event.CheckIn, event.CheckOut, event.Price)
+}
+
+func (p Projection) OnAmendmentReverted(ctx context.Context, event *contracts.AmendmentReverted) error {
+	return p.updateStay(ctx, event.BookingID, event.GuestsCount, event.CheckIn, event.CheckOut, event.Price)
+}
+
+// updateStay updates the booking's stay after it was amended, unless a later amendment was applied already.
+// The row is inserted when the amendment is handled before RoomBooked, which keeps the amended stay.
+func (p Projection) updateStay(ctx context.Context, bookingID string, guestsCount int, checkIn string, checkOut string, price contracts.Money) error {
+	_, err := p.db.ExecContext(
+		ctx,
+		`INSERT INTO `+p.table+` AS b (booking_id, room_id, guests_count, check_in, check_out, price, currency, status, stay_updated_at)
+		VALUES ($1, '', $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (booking_id) DO UPDATE SET
+			guests_count = EXCLUDED.guests_count,
+			check_in = EXCLUDED.check_in,
+			check_out = EXCLUDED.check_out,
+			price = EXCLUDED.price,
+			currency = EXCLUDED.currency,
+			stay_updated_at = EXCLUDED.stay_updated_at
+		WHERE b.stay_updated_at < EXCLUDED.stay_updated_at`,
+		bookingID, guestsCount, checkIn, checkOut, price.Amount, price.Currency, StatusPending, eventOccurredAt(ctx),
+	)
+	return err
+}
+
+// eventOccurredAt returns when the handled event occurred, or now when it's unknown.
+func eventOccurredAt(ctx context.Context) time.Time {
+	if msg := cqrs.OriginalMessageFromCtx(ctx); msg != nil {
+		if occurredAt, err := time.Parse(time.RFC3339Nano, msg.Metadata.Get(contracts.OccurredAtMetadataKey)); err == nil {
+			return occurredAt
+		}
+	}
+
+	return time.Now()
+}
+
+func (p Projection) GetBooking(ctx context.Context, bookingID string) (ReadModel, error) {
+	var booking ReadModel
+
+	err := p.db.QueryRowContext(
+		ctx,
+		`SELECT booking_id, room_id, guests_count, price, currency, check_in, check_out, guest_id, status FROM `+p.table+` WHERE booking_id = $1`,
+		bookingID,
+	).Scan(&booking.BookingID, &booking.RoomID, &booking.GuestsCount, &booking.Price.Amount, &booking.Price.Currency, &booking.CheckIn, &booking.CheckOut, &booking.GuestID, &booking.Status)
+
+	return booking, err
+}
+
+const bookingsPageSize = 20
+
+type ListFilter struct {
+	RoomID  string
+	GuestID string
+	Status  Status
+	Page    int
+}
+
+func (p Projection) ListBookings(ctx context.Context, filter ListFilter) ([]ReadModel, error) {
+	query := `SELECT booking_id, room_id, guests_count, price, currency, check_in, check_out, guest_id, status FROM ` + p.table + ` WHERE true`
+	var args []any
+
+	if filter.RoomID != "" {
+		args = append(args, filter.RoomID)
+		query += fmt.Sprintf(" AND room_id = $%d", len(args))
+	}
+	if filter.GuestID != "" {
+		args = append(args, filter.GuestID)
+		query += fmt.Sprintf(" AND guest_id = $%d", len(args))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		query += fmt.Sprintf(" AND status = $%d", len(args))
+	}
+
+	args = append(args, bookingsPageSize, (filter.Page-1)*bookingsPageSize)
+	query += fmt.Sprintf(" ORDER BY booking_id LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookings := []ReadModel{}
+	for rows.Next() {
+		var booking ReadModel
+		if err := rows.Scan(&booking.BookingID, &booking.RoomID, &booking.GuestsCount, &booking.Price.Amount, &booking.Price.Currency, &booking.CheckIn, &booking.CheckOut, &booking.GuestID, &booking.Status); err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, booking)
+	}
+
+	return bookings, rows.Err()
+}
+
+type ListResponse struct {
+	Bookings []ReadModel `json:"bookings"`
+	Page     int         `json:"page"`
+}
+
+func (p Projection) ListHandler(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+
+	filter := ListFilter{
+		RoomID:  query.Get("room_id"),
+		GuestID: query.Get("guest_id"),
+		Status:  Status(query.Get("status")),
+		Page:    1,
+	}
+
+	if page := query.Get("page"); page != "" {
+		var err error
+		filter.Page, err = strconv.Atoi(page)
+		if err != nil || filter.Page < 1 {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	bookings, err := p.ListBookings(request.Context(), filter)
+	if err != nil {
+		slog.With("err", err).Error("Failed to list bookings")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(writer).Encode(ListResponse{
+		Bookings: bookings,
+		Page:     filter.Page,
+	})
+	if err != nil {
+		slog.With("err", err).Error("Failed to write bookings")
+	}
+}
+
+func (p Projection) GetHandler(writer http.ResponseWriter, request *http.Request) {
+	booking, err := p.GetBooking(request.Context(), request.PathValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.With("err", err).Error("Failed to get booking")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(booking); err != nil {
+		slog.With("err", err).Error("Failed to write booking")
+	}
+}
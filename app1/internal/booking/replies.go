@@ -0,0 +1,70 @@
+package booking
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/components/requestreply"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+// Replies replies to POST /book requests waiting for the payment outcome.
+// Events without the operation ID were not requested synchronously and are ignored.
+type Replies struct {
+	backend requestreply.Backend[Status]
+}
+
+func NewReplies(backend requestreply.Backend[Status]) Replies {
+	return Replies{backend: backend}
+}
+
+func (r Replies) OnPaymentTaken(ctx context.Context, event *contracts.PaymentTaken) error {
+	return r.reply(ctx, event, StatusPaid)
+}
+
+func (r Replies) OnPaymentFailed(ctx context.Context, event *contracts.PaymentFailed) error {
+	return r.reply(ctx, event, StatusFailed)
+}
+
+func (r Replies) OnRoomUnavailable(ctx context.Context, event *contracts.RoomUnavailable) error {
+	return r.reply(ctx, event, StatusUnavailable)
+}
+
+func (r Replies) reply(ctx context.Context, event any, status Status) error {
+	msg := cqrs.OriginalMessageFromCtx(ctx)
+	if msg == nil || msg.Metadata.Get(requestreply.OperationIDMetadataKey) == "" {
+		return nil
+	}
+
+	return r.backend.OnCommandProcessed(ctx, requestreply.BackendOnCommandProcessedParams[Status]{
+		Command:        event,
+		CommandMessage: msg,
+		HandlerResult:  status,
+	})
+}
+
+// waitForBooking sends the BookRoom command and waits until the payment is taken or fails,
+// or the room turns out to be unavailable.
+// The booking is still pending if there is no outcome within BOOKING_SYNC_TIMEOUT.
+func waitForBooking(
+	ctx context.Context,
+	commandBus *cqrs.CommandBus,
+	backend requestreply.Backend[Status],
+	cmd contracts.BookRoom,
+) (Status, error) {
+	reply, err := requestreply.SendWithReply[Status](ctx, commandBus, backend, cmd)
+	if err != nil {
+		return "", err
+	}
+
+	var timeoutErr requestreply.ReplyTimeoutError
+	if errors.As(reply.Error, &timeoutErr) {
+		return StatusPending, nil
+	}
+	if reply.Error != nil {
+		return "", reply.Error
+	}
+
+	return reply.HandlerResult, nil
+}
@@ -0,0 +1,260 @@
+package booking
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/lib/pq"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+)
+
+// ErrConcurrentModification is returned when the booking's stream was appended to
+// after the booking was loaded.
+var ErrConcurrentModification = errors.New("booking was modified concurrently")
+
+// PersonalData encrypts personal data of events before they are stored.
+type PersonalData interface {
+	Encrypt(ctx context.Context, event any) (any, error)
+}
+
+// Repository stores bookings as streams of events in the booking_events table.
+//
+// New events are published with the outbox in the same transaction in which they are stored.
+type Repository struct {
+	outbox outbox.Outbox
+
+	// maxAttempts is how many times Update reloads the booking and calls updateFn again
+	// when the booking was modified concurrently.
+	maxAttempts int
+
+	// snapshotInterval is every how many events the booking's state is stored in booking_snapshots,
+	// so loading it doesn't need to apply all events. Zero disables snapshots.
+	snapshotInterval int
+
+	// personalData encrypts personal data of stored events, as it does for published ones.
+	personalData PersonalData
+}
+
+func NewRepository(outbox outbox.Outbox, maxAttempts int, snapshotInterval int, personalData PersonalData) Repository {
+	return Repository{
+		outbox:           outbox,
+		maxAttempts:      maxAttempts,
+		snapshotInterval: snapshotInterval,
+		personalData:     personalData,
+	}
+}
+
+// Update loads the booking, calls updateFn and stores the events it produced.
+// updateFn can use tx to change other tables in the same transaction.
+//
+// Events are appended with the version the booking was loaded at. If another command appended to the stream
+// in the meantime, the booking is reloaded and updateFn is called again, up to maxAttempts times.
+func (r Repository) Update(ctx context.Context, bookingID string, updateFn func(tx outbox.Tx, booking *Booking) error) error {
+	for attempt := 1; ; attempt++ {
+		err := r.outbox.InTx(ctx, func(tx outbox.Tx) error {
+			booking, err := r.load(ctx, tx, bookingID)
+			if err != nil {
+				return err
+			}
+
+			if err := updateFn(tx, booking); err != nil {
+				return err
+			}
+
+			return r.save(ctx, tx, booking)
+		})
+		if !errors.Is(err, ErrConcurrentModification) || attempt >= r.maxAttempts {
+			return err
+		}
+
+		slog.With("booking_id", bookingID, "attempt", attempt).InfoContext(ctx, "Booking modified concurrently, retrying")
+	}
+}
+
+// load restores the booking from the latest snapshot and applies only the events stored after it.
+func (r Repository) load(ctx context.Context, tx outbox.Tx, bookingID string) (*Booking, error) {
+	booking := newBooking(bookingID)
+
+	var snapshotVersion int
+	var state []byte
+	err := tx.QueryRowContext(
+		ctx,
+		`SELECT version, state FROM booking_snapshots WHERE booking_id = $1`,
+		bookingID,
+	).Scan(&snapshotVersion, &state)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("could not load booking snapshot: %w", err)
+	}
+	if err == nil {
+		var snapshot bookingSnapshot
+		if err := json.Unmarshal(state, &snapshot); err != nil {
+			return nil, fmt.Errorf("could not unmarshal booking snapshot: %w", err)
+		}
+		if snapshot.SchemaVersion == bookingSnapshotSchemaVersion {
+			booking.restore(snapshot, snapshotVersion)
+		}
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT event_name, payload FROM booking_events WHERE booking_id = $1 AND version > $2 ORDER BY version`,
+		bookingID, booking.version,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not load booking events: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var payload []byte
+		if err := rows.Scan(&name, &payload); err != nil {
+			return nil, err
+		}
+
+		event, err := unmarshalBookingEvent(name, payload)
+		if err != nil {
+			return nil, fmt.Errorf("could not unmarshal booking event %d: %w", booking.version+1, err)
+		}
+
+		booking.apply(event)
+		booking.version++
+	}
+
+	return booking, rows.Err()
+}
+
+// save appends the booking's changes after the version it was loaded at.
+// The primary key on (booking_id, version) makes the append fail if the expected version was already taken.
+func (r Repository) save(ctx context.Context, tx outbox.Tx, booking *Booking) error {
+	for i, change := range booking.changes {
+		stored, err := r.personalData.Encrypt(ctx, change.event)
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO booking_events (booking_id, version, event_name, payload) VALUES ($1, $2, $3, $4)`,
+			booking.id, booking.version+i+1, cqrs.StructName(change.event), payload,
+		)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+			return fmt.Errorf("%w: expected version %d", ErrConcurrentModification, booking.version+i)
+		}
+		if err != nil {
+			return fmt.Errorf("could not store booking event: %w", err)
+		}
+
+		if !change.publish {
+			continue
+		}
+		if err := tx.EventBus.Publish(ctx, change.event); err != nil {
+			return err
+		}
+	}
+
+	previousVersion := booking.version
+	booking.version += len(booking.changes)
+	booking.changes = nil
+
+	if r.snapshotInterval > 0 && booking.version/r.snapshotInterval > previousVersion/r.snapshotInterval {
+		return r.saveSnapshot(ctx, tx, booking)
+	}
+
+	return nil
+}
+
+func (r Repository) saveSnapshot(ctx context.Context, tx outbox.Tx, booking *Booking) error {
+	state, err := json.Marshal(booking.snapshot())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO booking_snapshots (booking_id, version, state) VALUES ($1, $2, $3)
+		ON CONFLICT (booking_id) DO UPDATE SET version = EXCLUDED.version, state = EXCLUDED.state, created_at = NOW()
+		WHERE booking_snapshots.version < EXCLUDED.version
+		OR booking_snapshots.state->'schema_version' IS DISTINCT FROM EXCLUDED.state->'schema_version'`,
+		booking.id, booking.version, state,
+	)
+	if err != nil {
+		return fmt.Errorf("could not store booking snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func unmarshalBookingEvent(name string, payload []byte) (any, error) {
+	if field, ok := legacyPriceFields[name]; ok {
+		var err error
+		payload, err = upcastStoredLegacyPrice(payload, field)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch name {
+	case "RoomBooked":
+		return unmarshalJSON[contracts.RoomBooked](payload)
+	case "RoomUnavailable":
+		return unmarshalJSON[contracts.RoomUnavailable](payload)
+	case "BookingCancelled":
+		return unmarshalJSON[contracts.BookingCancelled](payload)
+	case "PaymentTaken":
+		return unmarshalJSON[contracts.PaymentTaken](payload)
+	case "PaymentRefunded":
+		return unmarshalJSON[contracts.PaymentRefunded](payload)
+	case "DiscountApplied":
+		return unmarshalJSON[contracts.DiscountApplied](payload)
+	case "BookingAmended":
+		return unmarshalJSON[contracts.BookingAmended](payload)
+	case "AmendmentRejected":
+		return unmarshalJSON[contracts.AmendmentRejected](payload)
+	case "AmendmentPaymentTaken":
+		return unmarshalJSON[contracts.AmendmentPaymentTaken](payload)
+	case "AmendmentReverted":
+		return unmarshalJSON[contracts.AmendmentReverted](payload)
+	default:
+		return nil, fmt.Errorf("unknown booking event %s", name)
+	}
+}
+
+// legacyPriceFields are fields of stored events which were whole US dollars before Money was introduced.
+var legacyPriceFields = map[string]string{
+	"RoomBooked":       "price",
+	"BookingCancelled": "price",
+	"PaymentTaken":     "price",
+	"PaymentRefunded":  "amount",
+}
+
+func upcastStoredLegacyPrice(payload []byte, field string) ([]byte, error) {
+	var fields map[string]any
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields[field].(float64); !ok {
+		return payload, nil
+	}
+
+	contracts.UpcastLegacyPrice(fields, field)
+
+	return json.Marshal(fields)
+}
+
+func unmarshalJSON[T any](payload []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(payload, &v)
+	return v, err
+}
@@ -0,0 +1,108 @@
+package booking
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+)
+
+// RoomReservations prevents double-booking by reserving every night of the stay in the room_nights table.
+// The primary key on (room_id, night) doesn't allow two bookings of the same room to overlap.
+type RoomReservations struct{}
+
+// Reserve reserves nights from checkIn until checkOut (exclusive) for the booking.
+// It returns false and reserves nothing if any night is already taken by another booking.
+// Bookings without stay dates don't reserve any nights.
+func (r RoomReservations) Reserve(
+	ctx context.Context,
+	tx outbox.Tx,
+	bookingID string,
+	roomID string,
+	checkIn string,
+	checkOut string,
+) (bool, error) {
+	if checkIn == "" || checkOut == "" {
+		return true, nil
+	}
+
+	// Concurrent bookings of the same night wait for each other, so only one of them gets it.
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO room_nights (room_id, night, booking_id)
+		SELECT $1, night, $2 FROM generate_series($3::date, $4::date - 1, '1 day') AS night
+		ON CONFLICT (room_id, night) DO NOTHING`,
+		roomID, bookingID, checkIn, checkOut,
+	)
+	if err != nil {
+		return false, fmt.Errorf("could not reserve room: %w", err)
+	}
+
+	var taken bool
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (
+			SELECT 1 FROM room_nights
+			WHERE room_id = $1 AND night >= $2::date AND night < $3::date AND booking_id <> $4
+		)`,
+		roomID, checkIn, checkOut, bookingID,
+	).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("could not check room availability: %w", err)
+	}
+
+	if taken {
+		return false, r.Release(ctx, tx, bookingID)
+	}
+
+	return true, nil
+}
+
+// Release frees nights reserved for the booking, so the room can be booked again.
+func (r RoomReservations) Release(ctx context.Context, tx outbox.Tx, bookingID string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM room_nights WHERE booking_id = $1`, bookingID)
+	if err != nil {
+		return fmt.Errorf("could not release room: %w", err)
+	}
+
+	return nil
+}
+
+// Move reserves nights from checkIn until checkOut for the booking instead of the nights it has reserved.
+// It returns false and keeps the reserved nights if any new night is already taken by another booking.
+func (r RoomReservations) Move(
+	ctx context.Context,
+	tx outbox.Tx,
+	bookingID string,
+	roomID string,
+	checkIn string,
+	checkOut string,
+) (bool, error) {
+	// Reserve releases all nights of the booking when the room is not available,
+	// the savepoint brings the previous nights back.
+	if _, err := tx.ExecContext(ctx, `SAVEPOINT move_reservation`); err != nil {
+		return false, fmt.Errorf("could not move reservation: %w", err)
+	}
+
+	if err := r.Release(ctx, tx, bookingID); err != nil {
+		return false, err
+	}
+
+	available, err := r.Reserve(ctx, tx, bookingID, roomID, checkIn, checkOut)
+	if err != nil {
+		return false, err
+	}
+
+	if !available {
+		if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT move_reservation`); err != nil {
+			return false, fmt.Errorf("could not restore reservation: %w", err)
+		}
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `RELEASE SAVEPOINT move_reservation`); err != nil {
+		return false, fmt.Errorf("could not move reservation: %w", err)
+	}
+
+	return true, nil
+}
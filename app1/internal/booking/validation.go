@@ -0,0 +1,109 @@
+package booking
+
+import (
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+func (r BookRoomRequest) Validate() []server.FieldError {
+	var errs []server.FieldError
+
+	if strings.TrimSpace(r.RoomID) == "" {
+		errs = append(errs, server.FieldError{Field: "room_id", Reason: "is required"})
+	}
+
+	if r.GuestsCount <= 0 {
+		errs = append(errs, server.FieldError{Field: "guests_count", Reason: "must be positive"})
+	}
+
+	checkIn, checkInErr := time.Parse(time.DateOnly, r.CheckIn)
+	if r.CheckIn != "" && checkInErr != nil {
+		errs = append(errs, server.FieldError{Field: "check_in", Reason: "must be a date in the YYYY-MM-DD format"})
+	}
+
+	checkOut, checkOutErr := time.Parse(time.DateOnly, r.CheckOut)
+	if r.CheckOut != "" && checkOutErr != nil {
+		errs = append(errs, server.FieldError{Field: "check_out", Reason: "must be a date in the YYYY-MM-DD format"})
+	}
+
+	if (r.CheckIn == "") != (r.CheckOut == "") {
+		errs = append(errs, server.FieldError{Field: "check_out", Reason: "check_in and check_out must be provided together"})
+	} else if checkInErr == nil && checkOutErr == nil && !checkOut.After(checkIn) {
+		errs = append(errs, server.FieldError{Field: "check_out", Reason: "must be after check_in"})
+	}
+
+	if r.Currency != "" && !contracts.IsCurrencyCode(r.Currency) {
+		errs = append(errs, server.FieldError{Field: "currency", Reason: "must be an ISO 4217 currency code"})
+	}
+
+	if len(r.GuestID) > 255 {
+		errs = append(errs, server.FieldError{Field: "guest_id", Reason: "must be at most 255 characters long"})
+	}
+
+	if r.Email != "" {
+		if _, err := mail.ParseAddress(r.Email); err != nil {
+			errs = append(errs, server.FieldError{Field: "email", Reason: "must be a valid email address"})
+		}
+	}
+
+	return errs
+}
+
+// StayDates returns the requested check-in and check-out dates, one night from now by default.
+func (r BookRoomRequest) StayDates(now time.Time) (string, string) {
+	if r.CheckIn != "" {
+		return r.CheckIn, r.CheckOut
+	}
+
+	return now.Format(time.DateOnly), now.AddDate(0, 0, 1).Format(time.DateOnly)
+}
+
+func (r RefundRequest) Validate() []server.FieldError {
+	var errs []server.FieldError
+
+	if r.Amount == nil {
+		return nil
+	}
+	if r.Amount.Amount <= 0 {
+		errs = append(errs, server.FieldError{Field: "amount.amount", Reason: "must be positive"})
+	}
+	if !contracts.IsCurrencyCode(r.Amount.Currency) {
+		errs = append(errs, server.FieldError{Field: "amount.currency", Reason: "must be an ISO 4217 currency code"})
+	}
+
+	return errs
+}
+
+func (r AmendBookingRequest) Validate() []server.FieldError {
+	var errs []server.FieldError
+
+	if r.GuestsCount == nil && r.CheckIn == "" && r.CheckOut == "" {
+		return []server.FieldError{{Field: "guests_count", Reason: "guests_count or check_in and check_out must be provided"}}
+	}
+
+	if r.GuestsCount != nil && *r.GuestsCount <= 0 {
+		errs = append(errs, server.FieldError{Field: "guests_count", Reason: "must be positive"})
+	}
+
+	checkIn, checkInErr := time.Parse(time.DateOnly, r.CheckIn)
+	if r.CheckIn != "" && checkInErr != nil {
+		errs = append(errs, server.FieldError{Field: "check_in", Reason: "must be a date in the YYYY-MM-DD format"})
+	}
+
+	checkOut, checkOutErr := time.Parse(time.DateOnly, r.CheckOut)
+	if r.CheckOut != "" && checkOutErr != nil {
+		errs = append(errs, server.FieldError{Field: "check_out", Reason: "must be a date in the YYYY-MM-DD format"})
+	}
+
+	if (r.CheckIn == "") != (r.CheckOut == "") {
+		errs = append(errs, server.FieldError{Field: "check_out", Reason: "check_in and check_out must be provided together"})
+	} else if checkInErr == nil && checkOutErr == nil && !checkOut.After(checkIn) {
+		errs = append(errs, server.FieldError{Field: "check_out", Reason: "must be after check_in"})
+	}
+
+	return errs
+}
@@ -0,0 +1,124 @@
+// Package clock lets components wait and read the time through Clock,
+// so tests can control time with Fake instead of sleeping.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	// After sends the time on the returned channel once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the system clock.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Fake is a clock which moves only when Advance is called.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	changed chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now:     now,
+		changed: make(chan struct{}),
+	}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+
+	f.timers = append(f.timers, fakeTimer{at: f.now.Add(d), c: c})
+	f.notify()
+
+	return c
+}
+
+// Advance moves the clock by d and fires timers which are due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+
+	pending := f.timers[:0]
+	for _, timer := range f.timers {
+		if timer.at.After(f.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- f.now
+	}
+	f.timers = pending
+	f.notify()
+}
+
+// Timers returns the number of timers waiting for the clock to advance.
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.timers)
+}
+
+// WaitForTimers blocks until at least n timers are waiting, so the clock is advanced only after
+// the code under test started waiting. It returns false if that doesn't happen within timeout.
+func (f *Fake) WaitForTimers(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+
+	for {
+		f.mu.Lock()
+		waiting := len(f.timers)
+		changed := f.changed
+		f.mu.Unlock()
+
+		if waiting >= n {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// notify wakes up WaitForTimers, it must be called with mu locked.
+func (f *Fake) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
@@ -0,0 +1,29 @@
+package messages
+
+import (
+	"context"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/components/delay"
+)
+
+// DelayedEventBus publishes events which are delivered after a delay.
+type DelayedEventBus struct {
+	*cqrs.EventBus
+}
+
+// PublishAfter publishes the event, which reaches the broker once after has passed.
+func (b DelayedEventBus) PublishAfter(ctx context.Context, event any, after time.Duration) error {
+	return b.Publish(delay.WithContext(ctx, delay.For(after)), event)
+}
+
+// DelayedCommandBus sends commands which are delivered after a delay.
+type DelayedCommandBus struct {
+	*cqrs.CommandBus
+}
+
+// SendAfter sends the command, which reaches the broker once after has passed.
+func (b DelayedCommandBus) SendAfter(ctx context.Context, command any, after time.Duration) error {
+	return b.Send(delay.WithContext(ctx, delay.For(after)), command)
+}
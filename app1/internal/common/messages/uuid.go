@@ -0,0 +1,20 @@
+package messages
+
+import (
+	"context"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+type uuidKey struct{}
+
+// ContextWithUUID makes the event published with ctx use the UUID instead of a random one.
+func ContextWithUUID(ctx context.Context, messageUUID string) context.Context {
+	return context.WithValue(ctx, uuidKey{}, messageUUID)
+}
+
+func SetUUIDFromContext(ctx context.Context, msg *message.Message) {
+	if messageUUID, ok := ctx.Value(uuidKey{}).(string); ok {
+		msg.UUID = messageUUID
+	}
+}
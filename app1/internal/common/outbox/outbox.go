@@ -0,0 +1,156 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ThreeDotsLabs/watermill"
+	watermillSQL "github.com/ThreeDotsLabs/watermill-sql/v3/pkg/sql"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/components/delay"
+	"github.com/ThreeDotsLabs/watermill/components/forwarder"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const outboxTopic = "outbox"
+
+// Outbox runs database transactions in which published events and sent commands are stored
+// in the outbox table, so they reach the broker only if the transaction is committed.
+type Outbox struct {
+	db               *sql.DB
+	eventBusConfig   cqrs.EventBusConfig
+	commandBusConfig cqrs.CommandBusConfig
+	logger           watermill.LoggerAdapter
+
+	// decoratePublisher decorates the publisher storing messages in the outbox table, e.g. with tracing.
+	decoratePublisher func(message.Publisher) message.Publisher
+}
+
+func New(
+	db *sql.DB,
+	eventBusConfig cqrs.EventBusConfig,
+	commandBusConfig cqrs.CommandBusConfig,
+	logger watermill.LoggerAdapter,
+	decoratePublisher func(message.Publisher) message.Publisher,
+) Outbox {
+	return Outbox{
+		db:                db,
+		eventBusConfig:    eventBusConfig,
+		commandBusConfig:  commandBusConfig,
+		logger:            logger,
+		decoratePublisher: decoratePublisher,
+	}
+}
+
+type Tx struct {
+	*sql.Tx
+
+	EventBus   *cqrs.EventBus
+	CommandBus *cqrs.CommandBus
+}
+
+func (o Outbox) InTx(ctx context.Context, fn func(tx Tx) error) (err error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	publisher, err := o.newPublisher(tx)
+	if err != nil {
+		return err
+	}
+
+	eventBus, err := cqrs.NewEventBusWithConfig(publisher, o.eventBusConfig)
+	if err != nil {
+		return err
+	}
+
+	commandBus, err := cqrs.NewCommandBusWithConfig(publisher, o.commandBusConfig)
+	if err != nil {
+		return err
+	}
+
+	err = fn(Tx{
+		Tx:         tx,
+		EventBus:   eventBus,
+		CommandBus: commandBus,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// newPublisher returns a Publisher which stores messages in the outbox table within tx.
+// Messages are published to the real broker by the forwarder once tx is committed.
+func (o Outbox) newPublisher(tx *sql.Tx) (message.Publisher, error) {
+	sqlPublisher, err := watermillSQL.NewPublisher(
+		tx,
+		watermillSQL.PublisherConfig{
+			SchemaAdapter: watermillSQL.DefaultPostgreSQLSchema{},
+		},
+		o.logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delays set with delay.WithContext are stored in the metadata before the message is wrapped by the forwarder,
+	// so the forwarder publishes it to DelayedDelivery.
+	delayedPublisher, err := delay.NewPublisher(
+		forwarder.NewPublisher(sqlPublisher, forwarder.PublisherConfig{
+			ForwarderTopic: outboxTopic,
+		}),
+		delay.PublisherConfig{
+			AllowNoDelay: true,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.decoratePublisher == nil {
+		return delayedPublisher, nil
+	}
+
+	return o.decoratePublisher(delayedPublisher), nil
+}
+
+// AddForwarder adds to router a handler that reads messages stored in the outbox table
+// and publishes them to publisher.
+func AddForwarder(
+	router *message.Router,
+	db *sql.DB,
+	publisher message.Publisher,
+	logger watermill.LoggerAdapter,
+) error {
+	subscriber, err := watermillSQL.NewSubscriber(
+		db,
+		watermillSQL.SubscriberConfig{
+			SchemaAdapter:    watermillSQL.DefaultPostgreSQLSchema{},
+			OffsetsAdapter:   watermillSQL.DefaultPostgreSQLOffsetsAdapter{},
+			InitializeSchema: true,
+		},
+		logger,
+	)
+	if err != nil {
+		return err
+	}
+
+	// the outbox table needs to exist before the first booking is stored
+	if err := subscriber.SubscribeInitialize(outboxTopic); err != nil {
+		return err
+	}
+
+	_, err = forwarder.NewForwarder(subscriber, publisher, logger, forwarder.Config{
+		ForwarderTopic: outboxTopic,
+		Router:         router,
+	})
+	return err
+}
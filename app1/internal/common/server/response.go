@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ProblemDetails is an RFC 9457 error response.
+type ProblemDetails struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+func WriteJSON(ctx context.Context, writer http.ResponseWriter, status int, v any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	if err := json.NewEncoder(writer).Encode(v); err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Failed to write response")
+	}
+}
+
+func WriteProblem(ctx context.Context, writer http.ResponseWriter, problem ProblemDetails) {
+	if problem.Type == "" {
+		problem.Type = "about:blank"
+	}
+
+	writer.Header().Set("Content-Type", "application/problem+json")
+	writer.WriteHeader(problem.Status)
+
+	if err := json.NewEncoder(writer).Encode(problem); err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Failed to write problem response")
+	}
+}
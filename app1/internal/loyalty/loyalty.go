@@ -0,0 +1,138 @@
+package loyalty
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/booking"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+type PointsResponse struct {
+	GuestID string `json:"guest_id"`
+	Points  int    `json:"points"`
+}
+
+// Loyalty accrues points of guests for their paid bookings, pointsPerUSD for every whole US dollar of the price.
+//
+// Guests of bookings are taken from RoomBooked and stored in loyalty_bookings,
+// as PaymentTaken doesn't have them. Balances are stored in loyalty_balances.
+type Loyalty struct {
+	outbox     outbox.Outbox
+	db         *sql.DB
+	currencies booking.CurrencyConverter
+
+	pointsPerUSD int
+}
+
+func NewLoyalty(outbox outbox.Outbox, db *sql.DB, currencies booking.CurrencyConverter, pointsPerUSD int) Loyalty {
+	return Loyalty{
+		outbox:       outbox,
+		db:           db,
+		currencies:   currencies,
+		pointsPerUSD: pointsPerUSD,
+	}
+}
+
+func (l Loyalty) OnRoomBooked(ctx context.Context, event *contracts.RoomBooked) error {
+	_, err := l.db.ExecContext(
+		ctx,
+		`INSERT INTO loyalty_bookings (booking_id, guest_id) VALUES ($1, $2) ON CONFLICT (booking_id) DO NOTHING`,
+		event.BookingID, event.GuestID,
+	)
+	return err
+}
+
+// OnPaymentTaken accrues points of the booking's guest once, even if the event is redelivered.
+func (l Loyalty) OnPaymentTaken(ctx context.Context, event *contracts.PaymentTaken) error {
+	price, err := l.currencies.Convert(ctx, event.Price, contracts.BaseCurrency)
+	if err != nil {
+		return err
+	}
+	points := int(math.Floor(float64(price.Amount)/math.Pow10(contracts.CurrencyExponent(contracts.BaseCurrency)))) * l.pointsPerUSD
+
+	return l.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		var guestID string
+		err := tx.QueryRowContext(ctx, `SELECT guest_id FROM loyalty_bookings WHERE booking_id = $1`, event.BookingID).Scan(&guestID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// RoomBooked is handled by another handler, so it may not be handled yet; the message is retried.
+			return fmt.Errorf("RoomBooked of booking %s was not handled yet", event.BookingID)
+		}
+		if err != nil {
+			return err
+		}
+		if guestID == "" || points <= 0 {
+			return nil
+		}
+
+		result, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO loyalty_points (booking_id, guest_id, points) VALUES ($1, $2, $3) ON CONFLICT (booking_id) DO NOTHING`,
+			event.BookingID, guestID, points,
+		)
+		if err != nil {
+			return err
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if inserted == 0 {
+			// points of the booking were already earned
+			return nil
+		}
+
+		var balance int
+		err = tx.QueryRowContext(
+			ctx,
+			`INSERT INTO loyalty_balances (guest_id, points) VALUES ($1, $2)
+			ON CONFLICT (guest_id) DO UPDATE SET points = loyalty_balances.points + EXCLUDED.points, updated_at = NOW()
+			RETURNING points`,
+			guestID, points,
+		).Scan(&balance)
+		if err != nil {
+			return err
+		}
+
+		return tx.EventBus.Publish(ctx, contracts.LoyaltyPointsEarned{
+			GuestID:   guestID,
+			BookingID: event.BookingID,
+			Points:    points,
+			Balance:   balance,
+		})
+	})
+}
+
+// Points returns the guest's balance, 0 for guests who haven't earned any points.
+func (l Loyalty) Points(ctx context.Context, guestID string) (int, error) {
+	var points int
+	err := l.db.QueryRowContext(ctx, `SELECT points FROM loyalty_balances WHERE guest_id = $1`, guestID).Scan(&points)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+
+	return points, err
+}
+
+func (l Loyalty) PointsHandler(writer http.ResponseWriter, request *http.Request) {
+	guestID := request.PathValue("id")
+
+	points, err := l.Points(request.Context(), guestID)
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to get loyalty points")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, PointsResponse{
+		GuestID: guestID,
+		Points:  points,
+	})
+}
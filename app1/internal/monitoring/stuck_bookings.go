@@ -0,0 +1,248 @@
+package monitoring
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/clock"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+// StuckBooking is a booking which payment had no outcome within the SLA.
+type StuckBooking struct {
+	BookingID string    `json:"booking_id"`
+	RoomID    string    `json:"room_id"`
+	BookedAt  time.Time `json:"booked_at"`
+	// DetectedAt is when BookingStuck was published, it's nil until the next check.
+	DetectedAt      *time.Time `json:"detected_at"`
+	StuckForSeconds float64    `json:"stuck_for_seconds"`
+}
+
+// StuckBookings is a watchdog detecting bookings with RoomBooked, but without PaymentTaken or PaymentFailed
+// within the SLA, e.g. because payments handlers are failing or paused, or an event was lost.
+//
+// Bookings are tracked in the booking_payment_watch table. Every interval, bookings stuck for longer than the SLA
+// are marked as detected and BookingStuck is published with the outbox in the same transaction, so it's published
+// once per booking even when many instances run the watchdog. Resolved bookings are deleted after retention.
+type StuckBookings struct {
+	outbox    outbox.Outbox
+	db        *sql.DB
+	clock     clock.Clock
+	sla       time.Duration
+	interval  time.Duration
+	retention time.Duration
+
+	stuckGauge    prometheus.Gauge
+	detectedTotal prometheus.Counter
+}
+
+func NewStuckBookings(
+	outbox outbox.Outbox,
+	db *sql.DB,
+	clock clock.Clock,
+	sla time.Duration,
+	interval time.Duration,
+	retention time.Duration,
+	registry *prometheus.Registry,
+) (*StuckBookings, error) {
+	s := &StuckBookings{
+		outbox:    outbox,
+		db:        db,
+		clock:     clock,
+		sla:       sla,
+		interval:  interval,
+		retention: retention,
+		stuckGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "stuck_bookings",
+			Help: "Number of bookings which payment had no outcome within the SLA.",
+		}),
+		detectedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stuck_bookings_detected_total",
+			Help: "Number of bookings for which BookingStuck was published.",
+		}),
+	}
+
+	if err := registry.Register(s.stuckGauge); err != nil {
+		return nil, err
+	}
+	if err := registry.Register(s.detectedTotal); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// OnRoomBooked starts watching the booking's payment from the time the room was booked.
+func (s *StuckBookings) OnRoomBooked(ctx context.Context, event *contracts.RoomBooked) error {
+	bookedAt := s.clock.Now()
+	if msg := cqrs.OriginalMessageFromCtx(ctx); msg != nil {
+		if occurredAt, err := time.Parse(time.RFC3339Nano, msg.Metadata.Get(contracts.OccurredAtMetadataKey)); err == nil {
+			bookedAt = occurredAt
+		}
+	}
+
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO booking_payment_watch (booking_id, room_id, booked_at) VALUES ($1, $2, $3)
+		ON CONFLICT (booking_id) DO UPDATE SET room_id = EXCLUDED.room_id, booked_at = EXCLUDED.booked_at`,
+		event.BookingID, event.RoomID, bookedAt,
+	)
+	return err
+}
+
+func (s *StuckBookings) OnPaymentTaken(ctx context.Context, event *contracts.PaymentTaken) error {
+	return s.resolve(ctx, event.BookingID)
+}
+
+func (s *StuckBookings) OnPaymentFailed(ctx context.Context, event *contracts.PaymentFailed) error {
+	return s.resolve(ctx, event.BookingID)
+}
+
+// resolve stops watching the booking's payment. The outcome may be handled before RoomBooked,
+// so the booking is inserted as resolved then.
+func (s *StuckBookings) resolve(ctx context.Context, bookingID string) error {
+	now := s.clock.Now()
+
+	_, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO booking_payment_watch (booking_id, room_id, booked_at, resolved_at) VALUES ($1, '', $2, $2)
+		ON CONFLICT (booking_id) DO UPDATE SET resolved_at = EXCLUDED.resolved_at
+		WHERE booking_payment_watch.resolved_at IS NULL`,
+		bookingID, now,
+	)
+	return err
+}
+
+// Run checks for stuck bookings every interval until ctx is cancelled.
+func (s *StuckBookings) Run(ctx context.Context) error {
+	for {
+		if err := s.check(ctx); err != nil {
+			slog.With("err", err).ErrorContext(ctx, "Failed to check stuck bookings")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.clock.After(s.interval):
+		}
+	}
+}
+
+func (s *StuckBookings) check(ctx context.Context) error {
+	now := s.clock.Now()
+
+	var detected []contracts.BookingStuck
+	err := s.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		// Bookings locked by another instance are published by it.
+		rows, err := tx.QueryContext(
+			ctx,
+			`SELECT booking_id, room_id, booked_at FROM booking_payment_watch
+			WHERE resolved_at IS NULL AND detected_at IS NULL AND booked_at < $1
+			ORDER BY booked_at
+			FOR UPDATE SKIP LOCKED`,
+			now.Add(-s.sla),
+		)
+		if err != nil {
+			return err
+		}
+
+		detected = nil
+		for rows.Next() {
+			event := contracts.BookingStuck{DetectedAt: now}
+			if err := rows.Scan(&event.BookingID, &event.RoomID, &event.BookedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			detected = append(detected, event)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, event := range detected {
+			_, err := tx.ExecContext(ctx, `UPDATE booking_payment_watch SET detected_at = $1 WHERE booking_id = $2`, now, event.BookingID)
+			if err != nil {
+				return err
+			}
+
+			slog.With("booking_id", event.BookingID, "booked_at", event.BookedAt).WarnContext(ctx, "Booking is stuck")
+
+			if err := tx.EventBus.Publish(ctx, event); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.detectedTotal.Add(float64(len(detected)))
+
+	var stuck int
+	err = s.db.QueryRowContext(
+		ctx,
+		`SELECT COUNT(*) FROM booking_payment_watch WHERE resolved_at IS NULL AND booked_at < $1`,
+		now.Add(-s.sla),
+	).Scan(&stuck)
+	if err != nil {
+		return err
+	}
+	s.stuckGauge.Set(float64(stuck))
+
+	// Resolved bookings are kept for a while, so RoomBooked handled after the payment's outcome still finds them resolved.
+	_, err = s.db.ExecContext(
+		ctx,
+		`DELETE FROM booking_payment_watch WHERE resolved_at < $1`,
+		now.Add(-s.retention),
+	)
+	return err
+}
+
+// List returns bookings stuck for longer than the SLA, the longest stuck first.
+func (s *StuckBookings) List(ctx context.Context) ([]StuckBooking, error) {
+	now := s.clock.Now()
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT booking_id, room_id, booked_at, detected_at FROM booking_payment_watch
+		WHERE resolved_at IS NULL AND booked_at < $1
+		ORDER BY booked_at`,
+		now.Add(-s.sla),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookings := []StuckBooking{}
+	for rows.Next() {
+		var booking StuckBooking
+		if err := rows.Scan(&booking.BookingID, &booking.RoomID, &booking.BookedAt, &booking.DetectedAt); err != nil {
+			return nil, err
+		}
+		booking.StuckForSeconds = now.Sub(booking.BookedAt).Seconds()
+		bookings = append(bookings, booking)
+	}
+
+	return bookings, rows.Err()
+}
+
+func (s *StuckBookings) ListHandler(writer http.ResponseWriter, request *http.Request) {
+	bookings, err := s.List(request.Context())
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to list stuck bookings")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, bookings)
+}
@@ -0,0 +1,148 @@
+package notifications
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/roblaszczak/watermill-livecoding/internal/common/logs"
+)
+
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// EmailSender sends emails to guests.
+type EmailSender interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// smtpTimeout bounds sending an email when ctx has no earlier deadline,
+// so a hanging SMTP server doesn't block the handler.
+const smtpTimeout = 30 * time.Second
+
+// SMTPEmailSender sends emails with the SMTP server at addr.
+// PLAIN authentication is used when the username is set.
+type SMTPEmailSender struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func NewSMTPEmailSender(addr string, from string, username string, password string) SMTPEmailSender {
+	return SMTPEmailSender{
+		addr:     addr,
+		from:     from,
+		username: username,
+		password: password,
+	}
+}
+
+func (s SMTPEmailSender) Send(ctx context.Context, email Email) error {
+	host, _, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP address: %w", err)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + s.from,
+		"To: " + email.To,
+		"Subject: " + email.Subject,
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		email.Body,
+	}, "\r\n")
+
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("could not connect to SMTP server: %w", err)
+	}
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return errors.Join(err, conn.Close())
+	}
+	// Unblocks the conversation with the server when ctx is cancelled before the deadline.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return errors.Join(fmt.Errorf("could not send email: %w", err), conn.Close())
+	}
+	defer client.Close()
+
+	if err := s.send(client, host, email.To, msg); err != nil {
+		return fmt.Errorf("could not send email: %w", err)
+	}
+
+	return nil
+}
+
+// send works like smtp.SendMail with an already connected client.
+func (s SMTPEmailSender) send(client *smtp.Client, host string, to string, msg string) error {
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.username, s.password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(s.from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// LogEmailSender only logs emails, it's used when no SMTP server is configured.
+// The recipient is redacted and the body is not logged, as they contain guests' personal data.
+type LogEmailSender struct{}
+
+func (LogEmailSender) Send(ctx context.Context, email Email) error {
+	logs.FromContext(ctx).
+		With("to", redactEmailAddress(email.To), "subject", email.Subject, "body_length", len(email.Body)).
+		InfoContext(ctx, "Sending email")
+
+	return nil
+}
+
+// redactEmailAddress keeps only the first letter of the address' local part and the domain, e.g. j***@example.com.
+func redactEmailAddress(address string) string {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || local == "" {
+		return "***"
+	}
+
+	return local[:1] + "***@" + domain
+}
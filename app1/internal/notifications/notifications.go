@@ -0,0 +1,187 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"log/slog"
+	"text/template"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/booking"
+)
+
+// emailTemplates define the "subject" and "body" templates of every email.
+//
+//go:embed templates/*.tmpl
+var emailTemplates embed.FS
+
+// GuestContacts stores how to contact guests of bookings.
+// Emails given when booking are not part of events, so personal data doesn't end up in the brokers.
+// Only emails of registered guests are carried by RoomBooked.
+type GuestContacts struct {
+	db *sql.DB
+}
+
+func NewGuestContacts(db *sql.DB) GuestContacts {
+	return GuestContacts{db: db}
+}
+
+func (c GuestContacts) Save(ctx context.Context, bookingID string, email string) error {
+	_, err := c.db.ExecContext(
+		ctx,
+		`INSERT INTO booking_contacts (booking_id, email) VALUES ($1, $2) ON CONFLICT (booking_id) DO NOTHING`,
+		bookingID, email,
+	)
+	return err
+}
+
+// Email returns the guest's email, or an empty string if the guest didn't provide it.
+func (c GuestContacts) Email(ctx context.Context, bookingID string) (string, error) {
+	var email string
+	err := c.db.QueryRowContext(
+		ctx,
+		`SELECT email FROM booking_contacts WHERE booking_id = $1`,
+		bookingID,
+	).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return email, err
+}
+
+// DeleteGuest deletes contacts of the guest's bookings.
+func (c GuestContacts) DeleteGuest(ctx context.Context, guestID string) error {
+	_, err := c.db.ExecContext(
+		ctx,
+		`DELETE FROM booking_contacts WHERE booking_id IN (SELECT booking_id FROM bookings_read_model WHERE guest_id = $1)`,
+		guestID,
+	)
+	return err
+}
+
+// Handler emails guests about their bookings.
+// Booking details are taken from the bookings read model.
+type Handler struct {
+	bookings booking.Projection
+	contacts GuestContacts
+	sender   EmailSender
+}
+
+func NewHandler(bookings booking.Projection, contacts GuestContacts, sender EmailSender) Handler {
+	return Handler{
+		bookings: bookings,
+		contacts: contacts,
+		sender:   sender,
+	}
+}
+
+// OnRoomBooked stores the email of the registered guest carried by the event, so it doesn't have to be looked up.
+// The email given when booking takes precedence.
+func (h Handler) OnRoomBooked(ctx context.Context, event *contracts.RoomBooked) error {
+	if event.GuestEmail == "" {
+		return nil
+	}
+
+	return h.contacts.Save(ctx, event.BookingID, event.GuestEmail)
+}
+
+// OnGuestForgotten deletes emails of the forgotten guest, so they are not notified anymore.
+func (h Handler) OnGuestForgotten(ctx context.Context, event *contracts.GuestForgotten) error {
+	return h.contacts.DeleteGuest(ctx, event.GuestID)
+}
+
+func (h Handler) OnBookingConfirmed(ctx context.Context, event *contracts.BookingConfirmed) error {
+	return h.notify(ctx, event.BookingID, "booking_confirmed.tmpl", func(readModel booking.ReadModel) any {
+		return readModel
+	})
+}
+
+func (h Handler) OnPaymentFailed(ctx context.Context, event *contracts.PaymentFailed) error {
+	return h.notify(ctx, event.BookingID, "payment_failed.tmpl", func(readModel booking.ReadModel) any {
+		return struct {
+			booking.ReadModel
+			Reason string
+		}{readModel, event.Reason}
+	})
+}
+
+func (h Handler) OnCheckInReminder(ctx context.Context, event *contracts.CheckInReminder) error {
+	return h.notify(ctx, event.BookingID, "check_in_reminder.tmpl", func(readModel booking.ReadModel) any {
+		if readModel.Status == booking.StatusCancelled {
+			// the reminder was scheduled before the booking was cancelled
+			return nil
+		}
+		if readModel.CheckIn != event.CheckIn {
+			// the reminder was scheduled before the booking was amended
+			return nil
+		}
+		return readModel
+	})
+}
+
+// notify renders the template with data returned by templateData and emails it to the guest.
+// Nothing is sent if the guest didn't provide an email or templateData returns nil.
+func (h Handler) notify(
+	ctx context.Context,
+	bookingID string,
+	templateName string,
+	templateData func(readModel booking.ReadModel) any,
+) error {
+	to, err := h.contacts.Email(ctx, bookingID)
+	if err != nil {
+		return fmt.Errorf("could not get guest's email: %w", err)
+	}
+	if to == "" {
+		return nil
+	}
+
+	readModel, err := h.bookings.GetBooking(ctx, bookingID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the read model may not be updated yet
+		return fmt.Errorf("booking %s not found in the read model", bookingID)
+	}
+	if err != nil {
+		return err
+	}
+
+	data := templateData(readModel)
+	if data == nil {
+		return nil
+	}
+
+	email, err := renderEmail(templateName, data)
+	if err != nil {
+		return err
+	}
+	email.To = to
+
+	slog.With("booking_id", bookingID, "template", templateName).InfoContext(ctx, "Notifying guest")
+
+	return h.sender.Send(ctx, email)
+}
+
+func renderEmail(templateName string, data any) (Email, error) {
+	// every file defines the same template names, so they are parsed separately
+	tmpl, err := template.ParseFS(emailTemplates, "templates/"+templateName)
+	if err != nil {
+		return Email{}, fmt.Errorf("could not parse email template %s: %w", templateName, err)
+	}
+
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Email{}, fmt.Errorf("could not render subject of %s: %w", templateName, err)
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return Email{}, fmt.Errorf("could not render body of %s: %w", templateName, err)
+	}
+
+	return Email{
+		Subject: subject.String(),
+		Body:    body.String(),
+	}, nil
+}
@@ -0,0 +1,234 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/roblaszczak/watermill-livecoding/internal/common/clock"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+type ChaosErrorType string
+
+const (
+	ChaosErrorProviderError     ChaosErrorType = "provider_error"
+	ChaosErrorCardDeclined      ChaosErrorType = "card_declined"
+	ChaosErrorInsufficientFunds ChaosErrorType = "insufficient_funds"
+	// ChaosErrorTimeout never answers: calls block until their context is done and callbacks are not sent.
+	ChaosErrorTimeout ChaosErrorType = "timeout"
+)
+
+var chaosErrorMessages = map[ChaosErrorType]string{
+	ChaosErrorProviderError:     "payments provider internal error",
+	ChaosErrorCardDeclined:      "card declined",
+	ChaosErrorInsufficientFunds: "insufficient funds",
+	ChaosErrorTimeout:           "payments provider timed out",
+}
+
+const (
+	LatencyDistributionFixed       = "fixed"
+	LatencyDistributionUniform     = "uniform"
+	LatencyDistributionExponential = "exponential"
+)
+
+// ChaosSettings configure failures injected by the fake payments provider.
+type ChaosSettings struct {
+	// FailureRate is the probability (0-1) that a payment fails with one of ErrorTypes, picked at random.
+	FailureRate float64          `json:"failure_rate"`
+	ErrorTypes  []ChaosErrorType `json:"error_types"`
+
+	// LatencyRate is the probability (0-1) that a payment is delayed.
+	// The delay is LatencyMin with the fixed distribution, between LatencyMin and LatencyMax with the uniform one,
+	// and mostly close to LatencyMin with a long tail up to LatencyMax with the exponential one.
+	LatencyRate         float64       `json:"latency_rate"`
+	LatencyDistribution string        `json:"latency_distribution"`
+	LatencyMin          chaosDuration `json:"latency_min"`
+	LatencyMax          chaosDuration `json:"latency_max"`
+
+	// Seed makes injected failures repeatable, 0 seeds them randomly.
+	Seed int64 `json:"seed"`
+}
+
+func (s ChaosSettings) Validate() []server.FieldError {
+	var errs []server.FieldError
+
+	if s.FailureRate < 0 || s.FailureRate > 1 {
+		errs = append(errs, server.FieldError{Field: "failure_rate", Reason: "must be between 0 and 1"})
+	}
+	if s.FailureRate > 0 && len(s.ErrorTypes) == 0 {
+		errs = append(errs, server.FieldError{Field: "error_types", Reason: "is required when failure_rate is set"})
+	}
+	for _, errorType := range s.ErrorTypes {
+		if _, ok := chaosErrorMessages[errorType]; !ok {
+			errs = append(errs, server.FieldError{Field: "error_types", Reason: "unknown error type " + string(errorType)})
+		}
+	}
+	if s.LatencyRate < 0 || s.LatencyRate > 1 {
+		errs = append(errs, server.FieldError{Field: "latency_rate", Reason: "must be between 0 and 1"})
+	}
+	if !slices.Contains([]string{LatencyDistributionFixed, LatencyDistributionUniform, LatencyDistributionExponential}, s.LatencyDistribution) {
+		errs = append(errs, server.FieldError{Field: "latency_distribution", Reason: "must be fixed, uniform or exponential"})
+	}
+	if s.LatencyMin < 0 {
+		errs = append(errs, server.FieldError{Field: "latency_min", Reason: "can't be negative"})
+	}
+	if s.LatencyMax < s.LatencyMin {
+		errs = append(errs, server.FieldError{Field: "latency_max", Reason: "can't be lower than latency_min"})
+	}
+
+	return errs
+}
+
+// chaosDuration is a time.Duration written as "3s" in JSON.
+type chaosDuration time.Duration
+
+func (d chaosDuration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *chaosDuration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	*d = chaosDuration(parsed)
+	return err
+}
+
+// Chaos injects latency and errors into the fake payments provider.
+// Settings can be changed at runtime with the admin endpoints.
+type Chaos struct {
+	mu       sync.Mutex
+	settings ChaosSettings
+	rand     *rand.Rand
+
+	// clock is used to wait for the injected latency.
+	clock clock.Clock
+}
+
+func NewChaos(settings ChaosSettings, clock clock.Clock) *Chaos {
+	c := &Chaos{clock: clock}
+	c.setSettings(settings)
+	return c
+}
+
+func (c *Chaos) Settings() ChaosSettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.settings
+}
+
+func (c *Chaos) SetSettings(settings ChaosSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setSettings(settings)
+}
+
+// setSettings resets the random source, so the same seed gives the same failures after every change.
+func (c *Chaos) setSettings(settings ChaosSettings) {
+	seed := settings.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	c.settings = settings
+	c.rand = rand.New(rand.NewSource(seed))
+}
+
+// Draw returns the latency and error (empty if none) injected into the next payment.
+func (c *Chaos) Draw() (time.Duration, ChaosErrorType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.settings
+
+	var latency time.Duration
+	if c.rand.Float64() < s.LatencyRate {
+		latency = c.latency()
+	}
+
+	var errorType ChaosErrorType
+	if c.rand.Float64() < s.FailureRate {
+		errorType = s.ErrorTypes[c.rand.Intn(len(s.ErrorTypes))]
+	}
+
+	return latency, errorType
+}
+
+func (c *Chaos) latency() time.Duration {
+	base := time.Duration(c.settings.LatencyMin)
+	spread := time.Duration(c.settings.LatencyMax) - base
+
+	switch c.settings.LatencyDistribution {
+	case LatencyDistributionUniform:
+		return base + time.Duration(c.rand.Int63n(int64(spread)+1))
+	case LatencyDistributionExponential:
+		return base + min(time.Duration(c.rand.ExpFloat64()*float64(spread)/4), spread)
+	default:
+		return base
+	}
+}
+
+// Inject waits for the drawn latency and returns the drawn error.
+func (c *Chaos) Inject(ctx context.Context) error {
+	latency, errorType := c.Draw()
+
+	select {
+	case <-c.clock.After(latency):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if errorType == ChaosErrorTimeout {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if errorType != "" {
+		return errors.New(chaosErrorMessages[errorType])
+	}
+
+	return nil
+}
+
+func (c *Chaos) GetHandler(writer http.ResponseWriter, request *http.Request) {
+	c.writeSettings(writer, request)
+}
+
+func (c *Chaos) UpdateHandler(writer http.ResponseWriter, request *http.Request) {
+	var settings ChaosSettings
+	if err := json.NewDecoder(request.Body).Decode(&settings); err != nil {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Malformed request body",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if errs := settings.Validate(); len(errs) > 0 {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid request",
+			Status: http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+
+	c.SetSettings(settings)
+	slog.With("settings", settings).InfoContext(request.Context(), "Payments chaos settings updated")
+
+	c.writeSettings(writer, request)
+}
+
+func (c *Chaos) writeSettings(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(c.Settings()); err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to write chaos settings")
+	}
+}
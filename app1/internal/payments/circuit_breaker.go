@@ -0,0 +1,69 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/clock"
+	"github.com/sony/gobreaker"
+)
+
+// NewCircuitBreaker returns a circuit breaker which stops calling the payments provider
+// after consecutiveFailures failures for openDuration, and then lets a single probe request through.
+// gobreaker measures openDuration on the wall clock, the clock only sets OpenUntil of PaymentsDegraded,
+// so tests with a fake clock need a short openDuration to see the breaker close.
+func NewCircuitBreaker(
+	consecutiveFailures uint32,
+	openDuration time.Duration,
+	eventBus *cqrs.EventBus,
+	registry *prometheus.Registry,
+	clock clock.Clock,
+) (*gobreaker.CircuitBreaker, error) {
+	openGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "payments_circuit_breaker_open",
+		Help: "1 if the payments circuit breaker is open, 0 otherwise.",
+	})
+	if err := registry.Register(openGauge); err != nil {
+		return nil, err
+	}
+
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        "payments",
+		MaxRequests: 1,
+		Timeout:     openDuration,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= consecutiveFailures
+		},
+		IsSuccessful: func(err error) bool {
+			// Cancelled handlers are not the provider's fault.
+			return err == nil || errors.Is(err, context.Canceled)
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			slog.With("from", from.String(), "to", to.String()).Warn("Payments circuit breaker state changed")
+
+			if to != gobreaker.StateOpen {
+				openGauge.Set(0)
+				return
+			}
+
+			openGauge.Set(1)
+
+			event := contracts.PaymentsDegraded{
+				Reason:    "payments provider keeps failing",
+				OpenUntil: clock.Now().Add(openDuration),
+			}
+
+			// OnStateChange is called with the breaker locked, so publishing must not block it.
+			go func() {
+				if err := eventBus.Publish(context.Background(), event); err != nil {
+					slog.With("err", err).Error("Failed to publish PaymentsDegraded")
+				}
+			}()
+		},
+	}), nil
+}
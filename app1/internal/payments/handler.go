@@ -0,0 +1,277 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/clock"
+	"github.com/sony/gobreaker"
+)
+
+type Handler struct {
+	paymentsProvider Provider
+	payments         Records
+	breaker          *gobreaker.CircuitBreaker
+	eventBus         *cqrs.EventBus
+
+	maxAttempts   int
+	retryInterval time.Duration
+	// clock is used to wait between retries.
+	clock clock.Clock
+
+	// waitForWebhook makes the handler only initiate payments, their outcome is published
+	// by WebhookHandler when the provider calls back.
+	waitForWebhook bool
+}
+
+func NewHandler(
+	paymentsProvider Provider,
+	payments Records,
+	breaker *gobreaker.CircuitBreaker,
+	eventBus *cqrs.EventBus,
+	maxAttempts int,
+	retryInterval time.Duration,
+	clock clock.Clock,
+	waitForWebhook bool,
+) Handler {
+	return Handler{
+		paymentsProvider: paymentsProvider,
+		payments:         payments,
+		breaker:          breaker,
+		eventBus:         eventBus,
+		maxAttempts:      maxAttempts,
+		retryInterval:    retryInterval,
+		clock:            clock,
+		waitForWebhook:   waitForWebhook,
+	}
+}
+
+func (p Handler) OnRoomBooked(ctx context.Context, rb *contracts.RoomBooked) (err error) {
+	record, started, err := p.payments.Start(ctx, rb.BookingID, rb.Price)
+	if err != nil {
+		return fmt.Errorf("could not start payment: %w", err)
+	}
+	if !started {
+		return p.replayPayment(ctx, rb, record)
+	}
+
+	if err := p.takePayment(ctx, rb); err != nil {
+		if ctx.Err() != nil {
+			// The outcome is unknown, so the payment stays pending.
+			return err
+		}
+
+		slog.With("err", err, "booking_id", rb.BookingID).ErrorContext(ctx, "Failed to take payment")
+
+		if err := p.payments.Finish(ctx, rb.BookingID, StatusFailed, err.Error()); err != nil {
+			return fmt.Errorf("could not record failed payment: %w", err)
+		}
+
+		return p.eventBus.Publish(ctx, contracts.PaymentFailed{
+			BookingID: rb.BookingID,
+			Reason:    err.Error(),
+		})
+	}
+
+	if p.waitForWebhook {
+		return p.payments.Finish(ctx, rb.BookingID, StatusInitiated, "")
+	}
+
+	if err := p.payments.Finish(ctx, rb.BookingID, StatusTaken, ""); err != nil {
+		return fmt.Errorf("could not record taken payment: %w", err)
+	}
+
+	return p.eventBus.Publish(ctx, contracts.PaymentTaken{
+		BookingID: rb.BookingID,
+		RoomID:    rb.RoomID,
+		Price:     rb.Price,
+	})
+}
+
+// replayPayment publishes the outcome of the already started payment again instead of calling the provider.
+func (p Handler) replayPayment(ctx context.Context, rb *contracts.RoomBooked, record Record) error {
+	logger := slog.With("booking_id", rb.BookingID, "payment_status", record.Status)
+
+	switch record.Status {
+	case StatusTaken:
+		logger.InfoContext(ctx, "Payment already taken, not charging again")
+
+		return p.eventBus.Publish(ctx, contracts.PaymentTaken{
+			BookingID: rb.BookingID,
+			RoomID:    rb.RoomID,
+			Price:     record.Amount,
+		})
+	case StatusFailed:
+		logger.InfoContext(ctx, "Payment already failed")
+
+		return p.eventBus.Publish(ctx, contracts.PaymentFailed{
+			BookingID: rb.BookingID,
+			Reason:    record.Reason,
+		})
+	case StatusInitiated:
+		logger.InfoContext(ctx, "Payment already initiated, waiting for the provider's callback")
+		return nil
+	default:
+		// The guest may have been charged, retrying the payment could charge them twice.
+		return fmt.Errorf("payment of booking %s is in progress or was interrupted and has to be reconciled with the provider", rb.BookingID)
+	}
+}
+
+// takePayment retries the payment with exponential backoff, so PaymentFailed is published
+// only when the provider keeps failing. With waitForWebhook, the payment is only initiated.
+func (p Handler) takePayment(ctx context.Context, rb *contracts.RoomBooked) error {
+	return p.retry(ctx, rb.BookingID, func() error {
+		if p.waitForWebhook {
+			return p.paymentsProvider.(AsyncProvider).InitiatePayment(ctx, rb.BookingID, rb.RoomID, rb.Price)
+		}
+		return p.paymentsProvider.TakePayment(ctx, rb.BookingID, rb.BookingID, rb.Price)
+	})
+}
+
+// retry calls the provider through the circuit breaker until it succeeds or maxAttempts are used up.
+func (p Handler) retry(ctx context.Context, bookingID string, call func() error) error {
+	interval := p.retryInterval
+
+	for attempt := 1; ; attempt++ {
+		_, err := p.breaker.Execute(func() (any, error) {
+			return nil, call()
+		})
+		if err == nil || attempt >= p.maxAttempts {
+			return err
+		}
+		if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+			// There is no point in waiting for the provider, it's failing for everyone.
+			return err
+		}
+
+		slog.With("err", err, "booking_id", bookingID, "attempt", attempt).WarnContext(ctx, "Payment failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.clock.After(interval):
+		}
+
+		interval *= 2
+	}
+}
+
+func (p Handler) RefundPayment(ctx context.Context, cmd *contracts.RefundPayment) error {
+	return p.refund(ctx, cmd.BookingID, cmd.RefundID, cmd.Amount)
+}
+
+// OnBookingCancelled refunds what is left of the payment after partial refunds.
+func (p Handler) OnBookingCancelled(ctx context.Context, event *contracts.BookingCancelled) error {
+	return p.refund(ctx, event.BookingID, "", contracts.Money{})
+}
+
+// refund validates the refund against the recorded payment before refunding it with the provider.
+// Full refunds use the booking's ID as refundID, so the payment can be refunded in full only once.
+func (p Handler) refund(ctx context.Context, bookingID string, refundID string, amount contracts.Money) error {
+	if refundID == "" {
+		refundID = bookingID
+	}
+
+	refund, err := p.payments.Refund(ctx, bookingID, refundID, amount)
+	var rejected RefundRejectedError
+	if errors.As(err, &rejected) {
+		slog.With("booking_id", bookingID, "refund_id", refundID, "reason", rejected.Reason).WarnContext(ctx, "Refund rejected")
+
+		return p.eventBus.Publish(ctx, contracts.RefundRejected{
+			BookingID: bookingID,
+			RefundID:  refundID,
+			Amount:    amount,
+			Reason:    rejected.Reason,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("could not record refund: %w", err)
+	}
+
+	if err := p.paymentsProvider.Refund(ctx, bookingID, refundID, refund.Amount); err != nil {
+		return err
+	}
+
+	return p.eventBus.Publish(ctx, contracts.PaymentRefunded{
+		BookingID: bookingID,
+		RefundID:  refundID,
+		Amount:    refund.Amount,
+		Remaining: refund.Remaining,
+	})
+}
+
+// ChargeAmendment takes the amendment's payment right away, also when the booking's payment was taken with webhooks.
+// The charge is recorded before calling the provider, so a redelivered command doesn't charge the guest again.
+func (p Handler) ChargeAmendment(ctx context.Context, cmd *contracts.ChargeAmendment) error {
+	charge, started, err := p.payments.StartCharge(ctx, cmd.BookingID, cmd.AmendmentID, cmd.Amount)
+	if err != nil {
+		return fmt.Errorf("could not start amendment charge: %w", err)
+	}
+	if !started {
+		return p.replayCharge(ctx, cmd, charge)
+	}
+
+	err = p.retry(ctx, cmd.BookingID, func() error {
+		return p.paymentsProvider.TakePayment(ctx, cmd.BookingID, cmd.AmendmentID, cmd.Amount)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			// The outcome is unknown, so the charge stays pending.
+			return err
+		}
+
+		slog.With("err", err, "booking_id", cmd.BookingID, "amendment_id", cmd.AmendmentID).ErrorContext(ctx, "Failed to charge amendment")
+
+		if err := p.payments.FinishCharge(ctx, cmd.AmendmentID, StatusFailed, err.Error()); err != nil {
+			return fmt.Errorf("could not record failed amendment charge: %w", err)
+		}
+
+		return p.eventBus.Publish(ctx, contracts.AmendmentPaymentFailed{
+			BookingID:   cmd.BookingID,
+			AmendmentID: cmd.AmendmentID,
+			Reason:      err.Error(),
+		})
+	}
+
+	if err := p.payments.FinishCharge(ctx, cmd.AmendmentID, StatusTaken, ""); err != nil {
+		return fmt.Errorf("could not record amendment charge: %w", err)
+	}
+
+	return p.eventBus.Publish(ctx, contracts.AmendmentPaymentTaken{
+		BookingID:   cmd.BookingID,
+		AmendmentID: cmd.AmendmentID,
+		Amount:      cmd.Amount,
+	})
+}
+
+// replayCharge publishes the outcome of the already started charge again instead of calling the provider.
+func (p Handler) replayCharge(ctx context.Context, cmd *contracts.ChargeAmendment, charge Charge) error {
+	logger := slog.With("booking_id", cmd.BookingID, "amendment_id", cmd.AmendmentID, "charge_status", charge.Status)
+
+	switch charge.Status {
+	case StatusTaken:
+		logger.InfoContext(ctx, "Amendment already charged, not charging again")
+
+		return p.eventBus.Publish(ctx, contracts.AmendmentPaymentTaken{
+			BookingID:   cmd.BookingID,
+			AmendmentID: cmd.AmendmentID,
+			Amount:      charge.Amount,
+		})
+	case StatusFailed:
+		logger.InfoContext(ctx, "Amendment charge already failed")
+
+		return p.eventBus.Publish(ctx, contracts.AmendmentPaymentFailed{
+			BookingID:   cmd.BookingID,
+			AmendmentID: cmd.AmendmentID,
+			Reason:      charge.Reason,
+		})
+	default:
+		// The guest may have been charged, retrying the charge could charge them twice.
+		return fmt.Errorf("charge of amendment %s is in progress or was interrupted and has to be reconciled with the provider", cmd.AmendmentID)
+	}
+}
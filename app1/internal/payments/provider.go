@@ -0,0 +1,64 @@
+package payments
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/clock"
+)
+
+// Provider takes and refunds payments of bookings.
+// Calls are retried, so implementations should be idempotent for the payment and the refund.
+type Provider interface {
+	// TakePayment charges amount for the booking. The booking's payment uses its ID as paymentID,
+	// further charges, like ones of amendments, have their own paymentIDs.
+	TakePayment(ctx context.Context, bookingID string, paymentID string, amount contracts.Money) error
+	// Refund refunds amount of the booking's payment, which can be refunded in parts with different refundIDs.
+	Refund(ctx context.Context, bookingID string, refundID string, amount contracts.Money) error
+}
+
+// AsyncProvider can only initiate payments, their outcome is sent to POST /webhooks/payments.
+type AsyncProvider interface {
+	InitiatePayment(ctx context.Context, bookingID string, roomID string, amount contracts.Money) error
+}
+
+// FakeProvider is a flaky payments provider for demos.
+// How slow it is and how often it fails is configured by chaos.
+type FakeProvider struct {
+	chaos *Chaos
+	clock clock.Clock
+
+	// callbackURL and callbackSecret are used to send outcomes of initiated payments.
+	callbackURL    string
+	callbackSecret string
+}
+
+func NewFakeProvider(chaos *Chaos, clock clock.Clock, callbackURL string, callbackSecret string) FakeProvider {
+	return FakeProvider{
+		chaos:          chaos,
+		clock:          clock,
+		callbackURL:    callbackURL,
+		callbackSecret: callbackSecret,
+	}
+}
+
+func (p FakeProvider) TakePayment(ctx context.Context, bookingID string, paymentID string, amount contracts.Money) error {
+	logger := slog.With("amount", amount, "booking_id", bookingID, "payment_id", paymentID)
+
+	logger.InfoContext(ctx, "Taking payment")
+
+	if err := p.chaos.Inject(ctx); err != nil {
+		return err
+	}
+
+	logger.InfoContext(ctx, "Payment taken")
+
+	return nil
+}
+
+func (p FakeProvider) Refund(ctx context.Context, bookingID string, refundID string, amount contracts.Money) error {
+	slog.With("amount", amount, "booking_id", bookingID, "refund_id", refundID).InfoContext(ctx, "Refunding payment")
+
+	return nil
+}
@@ -0,0 +1,448 @@
+package payments
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+type Status string
+
+const (
+	// StatusPending means the provider was called, but the outcome is not known yet.
+	// The provider may have charged the guest if the call was interrupted.
+	StatusPending Status = "pending"
+	// StatusInitiated means the payment was initiated and the provider will call back with the outcome.
+	StatusInitiated Status = "initiated"
+	StatusTaken     Status = "taken"
+	StatusFailed    Status = "failed"
+)
+
+type Record struct {
+	BookingID string
+	Amount    contracts.Money
+	Status    Status
+	Reason    string
+}
+
+// Refund is a refund of the booking's payment.
+type Refund struct {
+	RefundID string
+	Amount   contracts.Money
+	// Remaining is the amount of the payment which is left after this and earlier refunds.
+	Remaining contracts.Money
+}
+
+// Charge is a charge added after the booking's payment, like for an amendment.
+type Charge struct {
+	ChargeID  string
+	BookingID string
+	Amount    contracts.Money
+	Status    Status
+	Reason    string
+}
+
+// RefundRejectedError is returned when the refund doesn't match what was paid for the booking.
+type RefundRejectedError struct {
+	Reason string
+}
+
+func (e RefundRejectedError) Error() string {
+	return "refund rejected: " + e.Reason
+}
+
+// Records remember payments of bookings, so Handler never charges the same booking twice,
+// even when RoomBooked is delivered again after the deduplication window.
+type Records interface {
+	// Start records the pending payment of the booking.
+	// If the payment was already started, the existing record is returned and started is false.
+	Start(ctx context.Context, bookingID string, amount contracts.Money) (record Record, started bool, err error)
+	// Finish records the outcome of the payment.
+	Finish(ctx context.Context, bookingID string, status Status, reason string) error
+	// Refund records the refund of amount, a zero amount refunds everything which wasn't refunded yet.
+	// RefundRejectedError is returned if the payment wasn't taken or amount exceeds what is left of it.
+	// Refunding with the same refundID again returns the recorded refund.
+	Refund(ctx context.Context, bookingID string, refundID string, amount contracts.Money) (Refund, error)
+	// StartCharge records the pending charge added after the payment, like for an amendment.
+	// If the charge was already started, the existing charge is returned and started is false.
+	StartCharge(ctx context.Context, bookingID string, chargeID string, amount contracts.Money) (charge Charge, started bool, err error)
+	// FinishCharge records the outcome of the charge. The taken charge is added to the payment once,
+	// so it can be refunded as well.
+	FinishCharge(ctx context.Context, chargeID string, status Status, reason string) error
+}
+
+// validateRefund returns the amount to refund from the taken payment of which refunded was already refunded.
+func validateRefund(payment Record, refunded int, amount contracts.Money) (contracts.Money, error) {
+	if payment.Status != StatusTaken {
+		return contracts.Money{}, RefundRejectedError{Reason: "payment of the booking was not taken"}
+	}
+
+	remaining := payment.Amount.Amount - refunded
+	if amount == (contracts.Money{}) {
+		amount = contracts.Money{Amount: remaining, Currency: payment.Amount.Currency}
+		if remaining <= 0 {
+			return contracts.Money{}, RefundRejectedError{Reason: "payment was already refunded"}
+		}
+	}
+
+	if amount.Currency != payment.Amount.Currency {
+		return contracts.Money{}, RefundRejectedError{Reason: fmt.Sprintf("currency must be %s, as the payment", payment.Amount.Currency)}
+	}
+	if amount.Amount <= 0 {
+		return contracts.Money{}, RefundRejectedError{Reason: "amount must be positive"}
+	}
+	if amount.Amount > remaining {
+		return contracts.Money{}, RefundRejectedError{Reason: fmt.Sprintf(
+			"amount %s exceeds %s left of the payment",
+			amount, contracts.Money{Amount: remaining, Currency: payment.Amount.Currency},
+		)}
+	}
+
+	return amount, nil
+}
+
+// MemoryRecords keeps payment records in memory, so they are lost on restart.
+type MemoryRecords struct {
+	mu      sync.Mutex
+	records map[string]Record
+	// refunds are refunded amounts by refund ID, by booking ID
+	refunds map[string]map[string]contracts.Money
+	// charges are charges by charge ID
+	charges map[string]Charge
+}
+
+func NewMemoryRecords() *MemoryRecords {
+	return &MemoryRecords{
+		records: map[string]Record{},
+		refunds: map[string]map[string]contracts.Money{},
+		charges: map[string]Charge{},
+	}
+}
+
+func (r *MemoryRecords) Start(ctx context.Context, bookingID string, amount contracts.Money) (Record, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if record, ok := r.records[bookingID]; ok {
+		return record, false, nil
+	}
+
+	record := Record{
+		BookingID: bookingID,
+		Amount:    amount,
+		Status:    StatusPending,
+	}
+	r.records[bookingID] = record
+
+	return record, true, nil
+}
+
+func (r *MemoryRecords) Finish(ctx context.Context, bookingID string, status Status, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record := r.records[bookingID]
+	record.BookingID = bookingID
+	record.Status = status
+	record.Reason = reason
+	r.records[bookingID] = record
+
+	return nil
+}
+
+func (r *MemoryRecords) Refund(ctx context.Context, bookingID string, refundID string, amount contracts.Money) (Refund, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.records[bookingID]
+	if !ok {
+		return Refund{}, RefundRejectedError{Reason: "no payment is recorded for the booking"}
+	}
+
+	refunded := 0
+	for _, refund := range r.refunds[bookingID] {
+		refunded += refund.Amount
+	}
+
+	if existing, ok := r.refunds[bookingID][refundID]; ok {
+		return Refund{RefundID: refundID, Amount: existing, Remaining: record.Amount.Sub(contracts.Money{Amount: refunded})}, nil
+	}
+
+	amount, err := validateRefund(record, refunded, amount)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	if r.refunds[bookingID] == nil {
+		r.refunds[bookingID] = map[string]contracts.Money{}
+	}
+	r.refunds[bookingID][refundID] = amount
+
+	return Refund{
+		RefundID:  refundID,
+		Amount:    amount,
+		Remaining: record.Amount.Sub(contracts.Money{Amount: refunded + amount.Amount}),
+	}, nil
+}
+
+func (r *MemoryRecords) StartCharge(ctx context.Context, bookingID string, chargeID string, amount contracts.Money) (Charge, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if charge, ok := r.charges[chargeID]; ok {
+		return charge, false, nil
+	}
+
+	charge := Charge{
+		ChargeID:  chargeID,
+		BookingID: bookingID,
+		Amount:    amount,
+		Status:    StatusPending,
+	}
+	r.charges[chargeID] = charge
+
+	return charge, true, nil
+}
+
+func (r *MemoryRecords) FinishCharge(ctx context.Context, chargeID string, status Status, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	charge, ok := r.charges[chargeID]
+	if !ok {
+		return fmt.Errorf("charge %s is not recorded", chargeID)
+	}
+	if charge.Status == StatusTaken {
+		return nil
+	}
+
+	if status == StatusTaken {
+		record, ok := r.records[charge.BookingID]
+		if !ok {
+			return fmt.Errorf("no payment is recorded for booking %s", charge.BookingID)
+		}
+		record.Amount.Amount += charge.Amount.Amount
+		r.records[charge.BookingID] = record
+	}
+
+	charge.Status = status
+	charge.Reason = reason
+	r.charges[chargeID] = charge
+
+	return nil
+}
+
+// PostgresRecords keeps payment records in the payment_records table, refunds in payment_refunds
+// and charges added after the payment in payment_charges.
+type PostgresRecords struct {
+	db *sql.DB
+}
+
+func NewPostgresRecords(db *sql.DB) PostgresRecords {
+	return PostgresRecords{db: db}
+}
+
+func (r PostgresRecords) Start(ctx context.Context, bookingID string, amount contracts.Money) (Record, bool, error) {
+	record := Record{
+		BookingID: bookingID,
+		Amount:    amount,
+		Status:    StatusPending,
+	}
+
+	var inserted string
+	err := r.db.QueryRowContext(
+		ctx,
+		`INSERT INTO payment_records (booking_id, amount, currency, status) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (booking_id) DO NOTHING
+		RETURNING booking_id`,
+		bookingID, amount.Amount, amount.Currency, StatusPending,
+	).Scan(&inserted)
+	if err == nil {
+		return record, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Record{}, false, err
+	}
+
+	err = r.db.QueryRowContext(
+		ctx,
+		`SELECT amount, currency, status, reason FROM payment_records WHERE booking_id = $1`,
+		bookingID,
+	).Scan(&record.Amount.Amount, &record.Amount.Currency, &record.Status, &record.Reason)
+
+	return record, false, err
+}
+
+func (r PostgresRecords) Finish(ctx context.Context, bookingID string, status Status, reason string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		`INSERT INTO payment_records (booking_id, amount, currency, status, reason) VALUES ($1, 0, '', $2, $3)
+		ON CONFLICT (booking_id) DO UPDATE SET status = EXCLUDED.status, reason = EXCLUDED.reason, updated_at = NOW()`,
+		bookingID, status, reason,
+	)
+	return err
+}
+
+func (r PostgresRecords) Refund(ctx context.Context, bookingID string, refundID string, amount contracts.Money) (refund Refund, err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Refund{}, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// the payment is locked, so concurrent refunds can't exceed it
+	record := Record{BookingID: bookingID}
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT amount, currency, status FROM payment_records WHERE booking_id = $1 FOR UPDATE`,
+		bookingID,
+	).Scan(&record.Amount.Amount, &record.Amount.Currency, &record.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Refund{}, RefundRejectedError{Reason: "no payment is recorded for the booking"}
+	}
+	if err != nil {
+		return Refund{}, err
+	}
+
+	var refunded int
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT COALESCE(SUM(amount), 0) FROM payment_refunds WHERE booking_id = $1`,
+		bookingID,
+	).Scan(&refunded)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	var existing contracts.Money
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT amount, currency FROM payment_refunds WHERE refund_id = $1`,
+		refundID,
+	).Scan(&existing.Amount, &existing.Currency)
+	if err == nil {
+		return Refund{RefundID: refundID, Amount: existing, Remaining: record.Amount.Sub(contracts.Money{Amount: refunded})}, tx.Commit()
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Refund{}, err
+	}
+
+	amount, err = validateRefund(record, refunded, amount)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO payment_refunds (refund_id, booking_id, amount, currency) VALUES ($1, $2, $3, $4)`,
+		refundID, bookingID, amount.Amount, amount.Currency,
+	)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	return Refund{
+		RefundID:  refundID,
+		Amount:    amount,
+		Remaining: record.Amount.Sub(contracts.Money{Amount: refunded + amount.Amount}),
+	}, tx.Commit()
+}
+
+func (r PostgresRecords) StartCharge(ctx context.Context, bookingID string, chargeID string, amount contracts.Money) (Charge, bool, error) {
+	charge := Charge{
+		ChargeID:  chargeID,
+		BookingID: bookingID,
+		Amount:    amount,
+		Status:    StatusPending,
+	}
+
+	var inserted string
+	err := r.db.QueryRowContext(
+		ctx,
+		`INSERT INTO payment_charges (charge_id, booking_id, amount, currency, status) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (charge_id) DO NOTHING
+		RETURNING charge_id`,
+		chargeID, bookingID, amount.Amount, amount.Currency, StatusPending,
+	).Scan(&inserted)
+	if err == nil {
+		return charge, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Charge{}, false, err
+	}
+
+	err = r.db.QueryRowContext(
+		ctx,
+		`SELECT booking_id, amount, currency, status, reason FROM payment_charges WHERE charge_id = $1`,
+		chargeID,
+	).Scan(&charge.BookingID, &charge.Amount.Amount, &charge.Amount.Currency, &charge.Status, &charge.Reason)
+
+	return charge, false, err
+}
+
+func (r PostgresRecords) FinishCharge(ctx context.Context, chargeID string, status Status, reason string) (err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// the charge is locked, so it's added to the payment only once
+	charge := Charge{ChargeID: chargeID}
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT booking_id, amount, currency, status FROM payment_charges WHERE charge_id = $1 FOR UPDATE`,
+		chargeID,
+	).Scan(&charge.BookingID, &charge.Amount.Amount, &charge.Amount.Currency, &charge.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("charge %s is not recorded", chargeID)
+	}
+	if err != nil {
+		return err
+	}
+	if charge.Status == StatusTaken {
+		return tx.Commit()
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE payment_charges SET status = $1, reason = $2, updated_at = NOW() WHERE charge_id = $3`,
+		status, reason, chargeID,
+	)
+	if err != nil {
+		return err
+	}
+	if status != StatusTaken {
+		return tx.Commit()
+	}
+
+	result, err := tx.ExecContext(
+		ctx,
+		`UPDATE payment_records SET amount = amount + $1, updated_at = NOW() WHERE booking_id = $2 AND currency = $3`,
+		charge.Amount.Amount, charge.BookingID, charge.Amount.Currency,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("no payment in %s is recorded for booking %s", charge.Amount.Currency, charge.BookingID)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,143 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+)
+
+const stripeAPIURL = "https://api.stripe.com"
+
+// StripeProvider takes payments with Stripe PaymentIntents.
+//
+// Requests are sent with idempotency keys derived from IDs of payments and refunds,
+// so retried calls don't charge or refund the guest twice.
+type StripeProvider struct {
+	url           string
+	secretKey     string
+	paymentMethod string
+	httpClient    *http.Client
+}
+
+func NewStripeProvider(secretKey string, paymentMethod string) StripeProvider {
+	return StripeProvider{
+		url:           stripeAPIURL,
+		secretKey:     secretKey,
+		paymentMethod: paymentMethod,
+		httpClient:    http.DefaultClient,
+	}
+}
+
+func (p StripeProvider) TakePayment(ctx context.Context, bookingID string, paymentID string, amount contracts.Money) error {
+	logger := slog.With("amount", amount, "booking_id", bookingID, "payment_id", paymentID)
+
+	logger.InfoContext(ctx, "Taking payment with Stripe")
+
+	var resp struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	err := p.call(ctx, http.MethodPost, "/v1/payment_intents", "take-payment-"+paymentID, url.Values{
+		"amount":                             {strconv.Itoa(amount.Amount)},
+		"currency":                           {strings.ToLower(amount.Currency)},
+		"payment_method":                     {p.paymentMethod},
+		"confirm":                            {"true"},
+		"metadata[booking_id]":               {bookingID},
+		"metadata[payment_id]":               {paymentID},
+		"automatic_payment_methods[enabled]": {"true"},
+		"automatic_payment_methods[allow_redirects]": {"never"},
+	}, &resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.Status != "succeeded" {
+		return fmt.Errorf("payment intent %s has status %s", resp.ID, resp.Status)
+	}
+
+	logger.With("payment_intent_id", resp.ID).InfoContext(ctx, "Payment taken with Stripe")
+
+	return nil
+}
+
+func (p StripeProvider) Refund(ctx context.Context, bookingID string, refundID string, amount contracts.Money) error {
+	logger := slog.With("amount", amount, "booking_id", bookingID, "refund_id", refundID)
+
+	var search struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	query := url.Values{"query": {fmt.Sprintf("metadata['booking_id']:'%s'", bookingID)}}
+	if err := p.call(ctx, http.MethodGet, "/v1/payment_intents/search?"+query.Encode(), "", nil, &search); err != nil {
+		return err
+	}
+	if len(search.Data) == 0 {
+		return fmt.Errorf("no Stripe payment intent found for booking %s", bookingID)
+	}
+
+	logger = logger.With("payment_intent_id", search.Data[0].ID)
+	logger.InfoContext(ctx, "Refunding payment with Stripe")
+
+	var refund struct {
+		ID string `json:"id"`
+	}
+	err := p.call(ctx, http.MethodPost, "/v1/refunds", "refund-"+refundID, url.Values{
+		"payment_intent": {search.Data[0].ID},
+		"amount":         {strconv.Itoa(amount.Amount)},
+	}, &refund)
+	if err != nil {
+		return err
+	}
+
+	logger.With("refund_id", refund.ID).InfoContext(ctx, "Payment refunded with Stripe")
+
+	return nil
+}
+
+func (p StripeProvider) call(
+	ctx context.Context,
+	method string,
+	path string,
+	idempotencyKey string,
+	form url.Values,
+	resp any,
+) error {
+	req, err := http.NewRequestWithContext(ctx, method, p.url+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.secretKey)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	httpResp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.NewDecoder(httpResp.Body).Decode(&errResp)
+
+		return fmt.Errorf("stripe returned %d: %s", httpResp.StatusCode, errResp.Error.Message)
+	}
+
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
@@ -0,0 +1,215 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/google/uuid"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/messages"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+const (
+	paymentsTimestampHeader = "X-Payments-Timestamp"
+	paymentsSignatureHeader = "X-Payments-Signature"
+
+	paymentSucceeded = "payment.succeeded"
+	paymentFailed    = "payment.failed"
+)
+
+// ProviderCallback is sent by the payments provider when the initiated payment is finished.
+type ProviderCallback struct {
+	// ID is the same when the provider retries the callback.
+	ID            string            `json:"id"`
+	Type          string            `json:"type"`
+	BookingID     string            `json:"booking_id"`
+	Amount        int               `json:"amount"`
+	Currency      string            `json:"currency"`
+	FailureReason string            `json:"failure_reason,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+// WebhookHandler translates the payments provider's callbacks into PaymentTaken and PaymentFailed.
+//
+// Callbacks are signed like our outbound webhooks: the X-Payments-Signature header is
+// sha256=<hex HMAC-SHA256 of "<X-Payments-Timestamp>.<body>">.
+type WebhookHandler struct {
+	eventBus *cqrs.EventBus
+	payments Records
+	secret   string
+
+	// maxClockSkew is how old the callback can be, so captured callbacks can't be replayed later.
+	maxClockSkew time.Duration
+}
+
+func NewWebhookHandler(eventBus *cqrs.EventBus, payments Records, secret string, maxClockSkew time.Duration) WebhookHandler {
+	return WebhookHandler{
+		eventBus:     eventBus,
+		payments:     payments,
+		secret:       secret,
+		maxClockSkew: maxClockSkew,
+	}
+}
+
+func (h WebhookHandler) Handler(writer http.ResponseWriter, request *http.Request) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := h.verify(request.Header, body); err != nil {
+		slog.With("err", err).WarnContext(request.Context(), "Rejected payments provider callback")
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var callback ProviderCallback
+	if err := json.Unmarshal(body, &callback); err != nil || callback.ID == "" || callback.BookingID == "" {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Malformed callback",
+			Status: http.StatusBadRequest,
+		})
+		return
+	}
+
+	var event any
+	var status Status
+	switch callback.Type {
+	case paymentSucceeded:
+		status = StatusTaken
+		event = contracts.PaymentTaken{
+			BookingID: callback.BookingID,
+			RoomID:    callback.Metadata["room_id"],
+			Price:     contracts.Money{Amount: callback.Amount, Currency: callback.Currency},
+		}
+	case paymentFailed:
+		status = StatusFailed
+		event = contracts.PaymentFailed{
+			BookingID: callback.BookingID,
+			Reason:    callback.FailureReason,
+		}
+	default:
+		// the provider may send callbacks we are not interested in
+		slog.With("type", callback.Type).InfoContext(request.Context(), "Ignoring payments provider callback")
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := h.payments.Finish(request.Context(), callback.BookingID, status, callback.FailureReason); err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to record payment outcome")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Retried callbacks get the same message UUID, so they are deduplicated by handlers.
+	ctx := messages.ContextWithUUID(request.Context(), uuid.NewSHA1(uuid.NameSpaceURL, []byte("payments:"+callback.ID)).String())
+
+	if err := h.eventBus.Publish(ctx, event); err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Failed to publish payment outcome")
+		// the provider retries the callback
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (h WebhookHandler) verify(header http.Header, body []byte) error {
+	timestamp := header.Get(paymentsTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", paymentsTimestampHeader)
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > h.maxClockSkew || age < -h.maxClockSkew {
+		return fmt.Errorf("callback timestamp is %s off", age)
+	}
+
+	signature, ok := strings.CutPrefix(header.Get(paymentsSignatureHeader), "sha256=")
+	if !ok {
+		return fmt.Errorf("invalid %s header", paymentsSignatureHeader)
+	}
+	if !hmac.Equal([]byte(signature), []byte(server.SignWebhook(h.secret, timestamp, body))) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+// InitiatePayment starts the payment, its outcome is sent later to the callback URL.
+//
+// The provider is simulated: the callback's delay and failure are drawn from chaos,
+// and the callback is not sent at all on timeouts.
+func (p FakeProvider) InitiatePayment(ctx context.Context, bookingID string, roomID string, amount contracts.Money) error {
+	logger := slog.With("amount", amount, "booking_id", bookingID)
+	logger.InfoContext(ctx, "Initiating payment")
+
+	latency, errorType := p.chaos.Draw()
+	if errorType == ChaosErrorTimeout {
+		logger.InfoContext(ctx, "Payment callback won't be sent")
+		return nil
+	}
+
+	callback := ProviderCallback{
+		ID:        uuid.NewString(),
+		Type:      paymentSucceeded,
+		BookingID: bookingID,
+		Amount:    amount.Amount,
+		Currency:  amount.Currency,
+		Metadata:  map[string]string{"room_id": roomID},
+	}
+	if errorType != "" {
+		callback.Type = paymentFailed
+		callback.FailureReason = chaosErrorMessages[errorType]
+	}
+
+	go func() {
+		<-p.clock.After(latency)
+
+		if err := p.sendCallback(callback); err != nil {
+			logger.With("err", err).Error("Failed to send payment callback")
+		}
+	}()
+
+	return nil
+}
+
+func (p FakeProvider) sendCallback(callback ProviderCallback) error {
+	body, err := json.Marshal(callback)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, p.callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(paymentsTimestampHeader, timestamp)
+	req.Header.Set(paymentsSignatureHeader, "sha256="+server.SignWebhook(p.callbackSecret, timestamp, body))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
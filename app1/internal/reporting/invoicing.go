@@ -0,0 +1,247 @@
+package reporting
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/booking"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+//go:embed templates/invoice.html
+var invoiceTemplate string
+
+var invoiceHTML = template.Must(template.New("invoice").Parse(invoiceTemplate))
+
+type InvoiceLine struct {
+	Description string          `json:"description"`
+	Amount      contracts.Money `json:"amount"`
+}
+
+// Invoice of a paid booking. Prices include tax, so Net and Tax add up to Total.
+type Invoice struct {
+	Number    string          `json:"number"`
+	BookingID string          `json:"booking_id"`
+	Lines     []InvoiceLine   `json:"lines"`
+	Net       contracts.Money `json:"net"`
+	TaxRate   float64         `json:"tax_rate"`
+	Tax       contracts.Money `json:"tax"`
+	Total     contracts.Money `json:"total"`
+	IssuedAt  time.Time       `json:"issued_at"`
+}
+
+func (i Invoice) TaxRatePercent() string {
+	return strconv.FormatFloat(i.TaxRate*100, 'f', -1, 64)
+}
+
+// Invoicing issues invoices of paid bookings and stores them with their HTML in the invoices table.
+// Booking details are taken from the bookings read model.
+//
+// Invoices are numbered INV-<year>-<number> without gaps, numbers are counted per year in invoice_numbers.
+type Invoicing struct {
+	outbox   outbox.Outbox
+	db       *sql.DB
+	bookings booking.Projection
+
+	taxRate float64
+}
+
+func NewInvoicing(outbox outbox.Outbox, db *sql.DB, bookings booking.Projection, taxRate float64) Invoicing {
+	return Invoicing{
+		outbox:   outbox,
+		db:       db,
+		bookings: bookings,
+		taxRate:  taxRate,
+	}
+}
+
+// OnPaymentTaken issues the booking's invoice, once even if the event is redelivered.
+func (i Invoicing) OnPaymentTaken(ctx context.Context, event *contracts.PaymentTaken) error {
+	if _, err := i.Invoice(ctx, event.BookingID); !errors.Is(err, sql.ErrNoRows) {
+		// already issued
+		return err
+	}
+
+	readModel, err := i.bookings.GetBooking(ctx, event.BookingID)
+	if errors.Is(err, sql.ErrNoRows) || readModel.GuestsCount == 0 {
+		// the read model may not be updated with RoomBooked yet
+		return fmt.Errorf("booking %s not found in the read model", event.BookingID)
+	}
+	if err != nil {
+		return err
+	}
+
+	lines, err := i.lines(ctx, readModel, event.Price)
+	if err != nil {
+		return err
+	}
+
+	issuedAt := time.Now().UTC()
+	tax := contracts.Money{
+		Amount:   int(math.Round(float64(event.Price.Amount) * i.taxRate / (1 + i.taxRate))),
+		Currency: event.Price.Currency,
+	}
+	invoice := Invoice{
+		BookingID: event.BookingID,
+		Lines:     lines,
+		Net:       event.Price.Sub(tax),
+		TaxRate:   i.taxRate,
+		Tax:       tax,
+		Total:     event.Price,
+		IssuedAt:  issuedAt,
+	}
+
+	return i.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		var number int
+		err := tx.QueryRowContext(
+			ctx,
+			`INSERT INTO invoice_numbers (year, last_number) VALUES ($1, 1)
+			ON CONFLICT (year) DO UPDATE SET last_number = invoice_numbers.last_number + 1
+			RETURNING last_number`,
+			issuedAt.Year(),
+		).Scan(&number)
+		if err != nil {
+			return fmt.Errorf("could not get invoice number: %w", err)
+		}
+		invoice.Number = fmt.Sprintf("INV-%d-%06d", issuedAt.Year(), number)
+
+		var html bytes.Buffer
+		if err := invoiceHTML.Execute(&html, invoice); err != nil {
+			return fmt.Errorf("could not render invoice: %w", err)
+		}
+
+		data, err := json.Marshal(invoice)
+		if err != nil {
+			return err
+		}
+
+		// If the invoice was issued concurrently, the primary key fails the transaction
+		// and the number is not used. The message is retried and finds the issued invoice.
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO invoices (booking_id, number, invoice, html) VALUES ($1, $2, $3, $4)`,
+			invoice.BookingID, invoice.Number, data, html.String(),
+		)
+		if err != nil {
+			return err
+		}
+
+		slog.With("booking_id", invoice.BookingID, "number", invoice.Number).InfoContext(ctx, "Issued invoice")
+
+		return tx.EventBus.Publish(ctx, contracts.InvoiceIssued{
+			Number:    invoice.Number,
+			BookingID: invoice.BookingID,
+			Total:     invoice.Total,
+			Tax:       invoice.Tax,
+			IssuedAt:  invoice.IssuedAt,
+		})
+	})
+}
+
+// lines itemizes the stay and the promo code's discount, which add up to paid.
+func (i Invoicing) lines(ctx context.Context, readModel booking.ReadModel, paid contracts.Money) ([]InvoiceLine, error) {
+	nights, err := booking.StayNights(readModel.CheckIn, readModel.CheckOut)
+	if err != nil {
+		return nil, err
+	}
+
+	stay := InvoiceLine{
+		Description: fmt.Sprintf(
+			"Room %s, %d night(s) from %s to %s, %d guest(s)",
+			readModel.RoomID, max(len(nights), 1), readModel.CheckIn, readModel.CheckOut, readModel.GuestsCount,
+		),
+		Amount: paid,
+	}
+
+	var discount contracts.DiscountApplied
+	var payload []byte
+	err = i.db.QueryRowContext(
+		ctx,
+		`SELECT payload FROM booking_events WHERE booking_id = $1 AND event_name = 'DiscountApplied'`,
+		readModel.BookingID,
+	).Scan(&payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return []InvoiceLine{stay}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(payload, &discount); err != nil {
+		return nil, err
+	}
+	if discount.Discount.Currency != paid.Currency {
+		return []InvoiceLine{stay}, nil
+	}
+
+	stay.Amount = contracts.Money{Amount: paid.Amount + discount.Discount.Amount, Currency: paid.Currency}
+
+	return []InvoiceLine{
+		stay,
+		{
+			Description: fmt.Sprintf("Promo code %s (%d%% off)", discount.PromoCode, discount.PercentOff),
+			Amount:      contracts.Money{Amount: -discount.Discount.Amount, Currency: paid.Currency},
+		},
+	}, nil
+}
+
+// Invoice returns the booking's invoice, sql.ErrNoRows if it wasn't issued yet.
+func (i Invoicing) Invoice(ctx context.Context, bookingID string) (Invoice, error) {
+	var invoice Invoice
+	var data []byte
+
+	err := i.db.QueryRowContext(ctx, `SELECT invoice FROM invoices WHERE booking_id = $1`, bookingID).Scan(&data)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	return invoice, json.Unmarshal(data, &invoice)
+}
+
+// Handler returns the booking's invoice as HTML, or as JSON with ?format=json.
+func (i Invoicing) Handler(writer http.ResponseWriter, request *http.Request) {
+	bookingID := request.PathValue("id")
+
+	if request.URL.Query().Get("format") == "json" {
+		invoice, err := i.Invoice(request.Context(), bookingID)
+		if errors.Is(err, sql.ErrNoRows) {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.With("err", err).ErrorContext(request.Context(), "Failed to get invoice")
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		server.WriteJSON(request.Context(), writer, http.StatusOK, invoice)
+		return
+	}
+
+	var html string
+	err := i.db.QueryRowContext(request.Context(), `SELECT html FROM invoices WHERE booking_id = $1`, bookingID).Scan(&html)
+	if errors.Is(err, sql.ErrNoRows) {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to get invoice")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = writer.Write([]byte(html))
+}
@@ -0,0 +1,18 @@
+package reporting
+
+import (
+	"context"
+
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/logs"
+)
+
+// PromoCodesReport reports discounts given with promo codes.
+type PromoCodesReport struct{}
+
+func (r PromoCodesReport) OnDiscountApplied(ctx context.Context, event *contracts.DiscountApplied) error {
+	logs.FromContext(ctx).
+		With("booking_id", event.BookingID, "promo_code", event.PromoCode, "discount", event.Discount.String()).
+		InfoContext(ctx, "Reporting discount applied")
+	return nil
+}
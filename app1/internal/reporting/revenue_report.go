@@ -0,0 +1,200 @@
+package reporting
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/logs"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+const revenueReportDefaultDays = 30
+
+func NewDailyReportRequested(scheduledAt time.Time) any {
+	return contracts.DailyReportRequested{
+		Day:         scheduledAt.UTC().AddDate(0, 0, -1).Format(time.DateOnly),
+		RequestedAt: scheduledAt,
+	}
+}
+
+type DailyRevenue struct {
+	Day      string          `json:"day"`
+	RoomID   string          `json:"room_id"`
+	Revenue  contracts.Money `json:"revenue"`
+	Payments int             `json:"payments"`
+}
+
+type RevenueReportResponse struct {
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Revenue []DailyRevenue `json:"revenue"`
+}
+
+// RevenueReport aggregates taken payments into daily revenue per room and currency in the daily_revenue table.
+//
+// Payments are also stored one by one in revenue_payments, so redelivered events are not counted twice.
+type RevenueReport struct {
+	db *sql.DB
+}
+
+func NewRevenueReport(db *sql.DB) RevenueReport {
+	return RevenueReport{db: db}
+}
+
+func (r RevenueReport) OnPaymentTaken(ctx context.Context, event *contracts.PaymentTaken) error {
+	// Revenue is reported for the day the payment was taken, not when the event was handled.
+	takenAt := time.Now()
+	if msg := cqrs.OriginalMessageFromCtx(ctx); msg != nil {
+		if occurredAt, err := time.Parse(time.RFC3339Nano, msg.Metadata.Get(contracts.OccurredAtMetadataKey)); err == nil {
+			takenAt = occurredAt
+		}
+	}
+
+	_, err := r.db.ExecContext(
+		ctx,
+		`WITH payment AS (
+			INSERT INTO revenue_payments (booking_id, day, room_id, currency, amount) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (booking_id) DO NOTHING
+			RETURNING day, room_id, currency, amount
+		)
+		INSERT INTO daily_revenue (day, room_id, currency, revenue, payments)
+		SELECT day, room_id, currency, amount, 1 FROM payment
+		ON CONFLICT (day, room_id, currency) DO UPDATE SET
+			revenue = daily_revenue.revenue + EXCLUDED.revenue,
+			payments = daily_revenue.payments + 1`,
+		event.BookingID, takenAt.UTC().Format(time.DateOnly), event.RoomID, event.Price.Currency, event.Price.Amount,
+	)
+	return err
+}
+
+// OnDailyReportRequested reports the day's total revenue in every currency.
+func (r RevenueReport) OnDailyReportRequested(ctx context.Context, event *contracts.DailyReportRequested) error {
+	revenue, err := r.DailyRevenue(ctx, event.Day, event.Day)
+	if err != nil {
+		return err
+	}
+
+	totals := map[string]DailyRevenue{}
+	for _, row := range revenue {
+		total := totals[row.Revenue.Currency]
+		total.Revenue.Currency = row.Revenue.Currency
+		total.Revenue.Amount += row.Revenue.Amount
+		total.Payments += row.Payments
+		totals[row.Revenue.Currency] = total
+	}
+
+	if len(totals) == 0 {
+		logs.FromContext(ctx).With("day", event.Day).InfoContext(ctx, "Daily revenue report: no payments")
+		return nil
+	}
+	for _, total := range totals {
+		logs.FromContext(ctx).
+			With("day", event.Day, "revenue", total.Revenue.String(), "payments", total.Payments).
+			InfoContext(ctx, "Daily revenue report")
+	}
+
+	return nil
+}
+
+// DailyRevenue returns revenue of days between from and to (inclusive).
+func (r RevenueReport) DailyRevenue(ctx context.Context, from string, to string) ([]DailyRevenue, error) {
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT to_char(day, 'YYYY-MM-DD'), room_id, currency, revenue, payments FROM daily_revenue
+		WHERE day >= $1::date AND day <= $2::date
+		ORDER BY day, room_id, currency`,
+		from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revenue := []DailyRevenue{}
+	for rows.Next() {
+		var row DailyRevenue
+		if err := rows.Scan(&row.Day, &row.RoomID, &row.Revenue.Currency, &row.Revenue.Amount, &row.Payments); err != nil {
+			return nil, err
+		}
+		revenue = append(revenue, row)
+	}
+
+	return revenue, rows.Err()
+}
+
+// Handler returns the revenue report as JSON, or as CSV with ?format=csv.
+// The report covers the last 30 days unless from and to (YYYY-MM-DD) are provided.
+func (r RevenueReport) Handler(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+
+	now := time.Now().UTC()
+	from := query.Get("from")
+	if from == "" {
+		from = now.AddDate(0, 0, -revenueReportDefaultDays).Format(time.DateOnly)
+	}
+	to := query.Get("to")
+	if to == "" {
+		to = now.Format(time.DateOnly)
+	}
+
+	var errs []server.FieldError
+	fromDate, err := time.Parse(time.DateOnly, from)
+	if err != nil {
+		errs = append(errs, server.FieldError{Field: "from", Reason: "must be a date in the YYYY-MM-DD format"})
+	}
+	toDate, err := time.Parse(time.DateOnly, to)
+	if err != nil {
+		errs = append(errs, server.FieldError{Field: "to", Reason: "must be a date in the YYYY-MM-DD format"})
+	} else if toDate.Before(fromDate) {
+		errs = append(errs, server.FieldError{Field: "to", Reason: "can't be before from"})
+	}
+	if len(errs) > 0 {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid request",
+			Status: http.StatusBadRequest,
+			Errors: errs,
+		})
+		return
+	}
+
+	revenue, err := r.DailyRevenue(request.Context(), from, to)
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to get revenue report")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if query.Get("format") == "csv" {
+		r.writeCSV(writer, request, from, to, revenue)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, RevenueReportResponse{
+		From:    from,
+		To:      to,
+		Revenue: revenue,
+	})
+}
+
+func (r RevenueReport) writeCSV(writer http.ResponseWriter, request *http.Request, from string, to string, revenue []DailyRevenue) {
+	writer.Header().Set("Content-Type", "text/csv")
+	writer.Header().Set("Content-Disposition", `attachment; filename="revenue_`+from+`_`+to+`.csv"`)
+
+	csvWriter := csv.NewWriter(writer)
+	_ = csvWriter.Write([]string{"day", "room_id", "currency", "revenue", "payments"})
+	for _, row := range revenue {
+		_ = csvWriter.Write([]string{row.Day, row.RoomID, row.Revenue.Currency, row.Revenue.Decimal(), strconv.Itoa(row.Payments)})
+	}
+	csvWriter.Flush()
+
+	if err := csvWriter.Error(); err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to write revenue report")
+	}
+}
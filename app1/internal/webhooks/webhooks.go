@@ -0,0 +1,502 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/google/uuid"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+const (
+	idHeader        = "X-Webhook-ID"
+	eventHeader     = "X-Webhook-Event"
+	timestampHeader = "X-Webhook-Timestamp"
+	signatureHeader = "X-Webhook-Signature"
+)
+
+// Subscription is a callback URL which receives events of one type.
+type Subscription struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	EventName string `json:"event_name"`
+	// Secret signs the payloads, it's returned only when the subscription is created.
+	Secret  string `json:"secret,omitempty"`
+	Enabled bool   `json:"enabled"`
+
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+	LastSuccessAt       *time.Time `json:"last_success_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+type SubscriptionRequest struct {
+	URL       string `json:"url"`
+	EventName string `json:"event_name"`
+	// Enabled is used only when the subscription is updated, new subscriptions are enabled.
+	Enabled *bool `json:"enabled"`
+}
+
+func (r SubscriptionRequest) Validate(eventNames []string) []server.FieldError {
+	var errs []server.FieldError
+
+	if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, server.FieldError{Field: "url", Reason: "must be an absolute http or https URL"})
+	}
+	if !slices.Contains(eventNames, r.EventName) {
+		errs = append(errs, server.FieldError{Field: "event_name", Reason: fmt.Sprintf("must be one of %v", eventNames)})
+	}
+
+	return errs
+}
+
+// Subscriptions stores webhook subscriptions in the webhook_subscriptions table.
+type Subscriptions struct {
+	db *sql.DB
+
+	// eventNames are events which can be subscribed to.
+	eventNames []string
+}
+
+func NewSubscriptions(db *sql.DB, eventNames []string) Subscriptions {
+	return Subscriptions{
+		db:         db,
+		eventNames: eventNames,
+	}
+}
+
+const subscriptionColumns = `id, url, event_name, enabled, consecutive_failures, last_error, last_failure_at, last_success_at, created_at`
+
+func scanSubscription(row interface{ Scan(dest ...any) error }) (Subscription, error) {
+	var s Subscription
+	var lastFailureAt, lastSuccessAt sql.NullTime
+
+	err := row.Scan(
+		&s.ID,
+		&s.URL,
+		&s.EventName,
+		&s.Enabled,
+		&s.ConsecutiveFailures,
+		&s.LastError,
+		&lastFailureAt,
+		&lastSuccessAt,
+		&s.CreatedAt,
+	)
+	if lastFailureAt.Valid {
+		s.LastFailureAt = &lastFailureAt.Time
+	}
+	if lastSuccessAt.Valid {
+		s.LastSuccessAt = &lastSuccessAt.Time
+	}
+
+	return s, err
+}
+
+func (w Subscriptions) List(ctx context.Context) ([]Subscription, error) {
+	rows, err := w.db.QueryContext(ctx, `SELECT `+subscriptionColumns+` FROM webhook_subscriptions ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []Subscription{}
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+func (w Subscriptions) Get(ctx context.Context, id string) (Subscription, error) {
+	return scanSubscription(w.db.QueryRowContext(
+		ctx,
+		`SELECT `+subscriptionColumns+` FROM webhook_subscriptions WHERE id = $1`,
+		id,
+	))
+}
+
+func (w Subscriptions) Create(ctx context.Context, req SubscriptionRequest) (Subscription, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Subscription{}, err
+	}
+
+	s, err := scanSubscription(w.db.QueryRowContext(
+		ctx,
+		`INSERT INTO webhook_subscriptions (id, url, event_name, secret) VALUES ($1, $2, $3, $4)
+		RETURNING `+subscriptionColumns,
+		uuid.NewString(), req.URL, req.EventName, hex.EncodeToString(secret),
+	))
+	s.Secret = hex.EncodeToString(secret)
+
+	return s, err
+}
+
+// Update changes the subscription. Enabling it again resets the failures.
+func (w Subscriptions) Update(ctx context.Context, id string, req SubscriptionRequest) (Subscription, error) {
+	enabled := true
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+
+	return scanSubscription(w.db.QueryRowContext(
+		ctx,
+		`UPDATE webhook_subscriptions SET
+			url = $2,
+			event_name = $3,
+			consecutive_failures = CASE WHEN $4 AND NOT enabled THEN 0 ELSE consecutive_failures END,
+			enabled = $4
+		WHERE id = $1
+		RETURNING `+subscriptionColumns,
+		id, req.URL, req.EventName, enabled,
+	))
+}
+
+func (w Subscriptions) Delete(ctx context.Context, id string) error {
+	result, err := w.db.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// forEvent returns enabled subscriptions of the event together with their secrets.
+func (w Subscriptions) forEvent(ctx context.Context, eventName string) ([]Subscription, error) {
+	rows, err := w.db.QueryContext(
+		ctx,
+		`SELECT id, url, secret FROM webhook_subscriptions WHERE event_name = $1 AND enabled`,
+		eventName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []Subscription
+	for rows.Next() {
+		s := Subscription{EventName: eventName, Enabled: true}
+		if err := rows.Scan(&s.ID, &s.URL, &s.Secret); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions, rows.Err()
+}
+
+func (w Subscriptions) recordSuccess(ctx context.Context, id string) error {
+	_, err := w.db.ExecContext(
+		ctx,
+		`UPDATE webhook_subscriptions SET consecutive_failures = 0, last_success_at = NOW() WHERE id = $1`,
+		id,
+	)
+	return err
+}
+
+// recordFailure counts the failed delivery and disables the subscription after disableAfter failures in a row.
+func (w Subscriptions) recordFailure(ctx context.Context, id string, deliveryErr error, disableAfter int) error {
+	_, err := w.db.ExecContext(
+		ctx,
+		`UPDATE webhook_subscriptions SET
+			consecutive_failures = consecutive_failures + 1,
+			last_error = $2,
+			last_failure_at = NOW(),
+			enabled = enabled AND consecutive_failures + 1 < $3
+		WHERE id = $1`,
+		id, deliveryErr.Error(), disableAfter,
+	)
+	return err
+}
+
+func (w Subscriptions) ListHandler(writer http.ResponseWriter, request *http.Request) {
+	subscriptions, err := w.List(request.Context())
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to list webhook subscriptions")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, subscriptions)
+}
+
+func (w Subscriptions) GetHandler(writer http.ResponseWriter, request *http.Request) {
+	subscription, err := w.Get(request.Context(), request.PathValue("id"))
+	w.writeSubscription(writer, request, http.StatusOK, subscription, err)
+}
+
+func (w Subscriptions) CreateHandler(writer http.ResponseWriter, request *http.Request) {
+	req, ok := w.readRequest(writer, request)
+	if !ok {
+		return
+	}
+
+	subscription, err := w.Create(request.Context(), req)
+	w.writeSubscription(writer, request, http.StatusCreated, subscription, err)
+}
+
+func (w Subscriptions) UpdateHandler(writer http.ResponseWriter, request *http.Request) {
+	req, ok := w.readRequest(writer, request)
+	if !ok {
+		return
+	}
+
+	subscription, err := w.Update(request.Context(), request.PathValue("id"), req)
+	w.writeSubscription(writer, request, http.StatusOK, subscription, err)
+}
+
+func (w Subscriptions) DeleteHandler(writer http.ResponseWriter, request *http.Request) {
+	err := w.Delete(request.Context(), request.PathValue("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to delete webhook subscription")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (w Subscriptions) readRequest(writer http.ResponseWriter, request *http.Request) (SubscriptionRequest, bool) {
+	var req SubscriptionRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Malformed request body",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return req, false
+	}
+
+	if errs := req.Validate(w.eventNames); len(errs) > 0 {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Invalid request",
+			Status: http.StatusBadRequest,
+			Errors: errs,
+		})
+		return req, false
+	}
+
+	return req, true
+}
+
+func (w Subscriptions) writeSubscription(
+	writer http.ResponseWriter,
+	request *http.Request,
+	status int,
+	subscription Subscription,
+	err error,
+) {
+	if errors.Is(err, sql.ErrNoRows) {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to store webhook subscription")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, status, subscription)
+}
+
+// Payload is POSTed to subscribers.
+type Payload struct {
+	ID         string          `json:"id"`
+	Event      string          `json:"event"`
+	OccurredAt string          `json:"occurred_at,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Dispatcher POSTs events to their webhook subscriptions.
+//
+// Payloads are signed with the subscription's secret: the X-Webhook-Signature header is
+// sha256=<hex HMAC-SHA256 of "<X-Webhook-Timestamp>.<body>">.
+// Every subscription is retried separately, so one failing endpoint doesn't delay nor duplicate deliveries to others.
+type Dispatcher struct {
+	subscriptions Subscriptions
+	marshaler     cqrs.CommandEventMarshaler
+	httpClient    *http.Client
+
+	maxAttempts   int
+	retryInterval time.Duration
+	// disableAfter is how many failed deliveries in a row disable the subscription.
+	disableAfter int
+}
+
+func NewDispatcher(
+	subscriptions Subscriptions,
+	marshaler cqrs.CommandEventMarshaler,
+	httpClient *http.Client,
+	maxAttempts int,
+	retryInterval time.Duration,
+	disableAfter int,
+) Dispatcher {
+	return Dispatcher{
+		subscriptions: subscriptions,
+		marshaler:     marshaler,
+		httpClient:    httpClient,
+		maxAttempts:   maxAttempts,
+		retryInterval: retryInterval,
+		disableAfter:  disableAfter,
+	}
+}
+
+// Handler returns a handler dispatching events of eventType.
+func (d Dispatcher) Handler(eventType reflect.Type) message.NoPublishHandlerFunc {
+	return func(msg *message.Message) error {
+		ctx := msg.Context()
+		name := d.marshaler.NameFromMessage(msg)
+
+		subscriptions, err := d.subscriptions.forEvent(ctx, name)
+		if err != nil {
+			return fmt.Errorf("could not get webhook subscriptions: %w", err)
+		}
+		if len(subscriptions) == 0 {
+			return nil
+		}
+
+		event := reflect.New(eventType).Interface()
+		if err := d.marshaler.Unmarshal(msg, event); err != nil {
+			return err
+		}
+
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		body, err := json.Marshal(Payload{
+			ID:         msg.UUID,
+			Event:      name,
+			OccurredAt: msg.Metadata.Get(contracts.OccurredAtMetadataKey),
+			Payload:    payload,
+		})
+		if err != nil {
+			return err
+		}
+
+		wg := sync.WaitGroup{}
+		errs := make([]error, len(subscriptions))
+		for i, subscription := range subscriptions {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = d.dispatch(ctx, subscription, msg.UUID, name, body)
+			}()
+		}
+		wg.Wait()
+
+		return errors.Join(errs...)
+	}
+}
+
+// dispatch delivers the event to the subscription and records the outcome.
+// Failed deliveries are only recorded, the returned error means the outcome couldn't be stored.
+func (d Dispatcher) dispatch(
+	ctx context.Context,
+	subscription Subscription,
+	messageUUID string,
+	name string,
+	body []byte,
+) error {
+	logger := slog.With("webhook_subscription_id", subscription.ID, "event", name)
+
+	if err := d.deliver(ctx, subscription, messageUUID, name, body); err != nil {
+		logger.With("err", err).WarnContext(ctx, "Failed to deliver webhook")
+		return d.subscriptions.recordFailure(ctx, subscription.ID, err, d.disableAfter)
+	}
+
+	return d.subscriptions.recordSuccess(ctx, subscription.ID)
+}
+
+// deliver POSTs the body, retrying with exponential backoff up to maxAttempts times.
+func (d Dispatcher) deliver(
+	ctx context.Context,
+	subscription Subscription,
+	messageUUID string,
+	name string,
+	body []byte,
+) error {
+	interval := d.retryInterval
+
+	for attempt := 1; ; attempt++ {
+		err := d.post(ctx, subscription, messageUUID, name, body)
+		if err == nil || attempt >= d.maxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+	}
+}
+
+func (d Dispatcher) post(
+	ctx context.Context,
+	subscription Subscription,
+	messageUUID string,
+	name string,
+	body []byte,
+) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idHeader, messageUUID)
+	req.Header.Set(eventHeader, name)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, "sha256="+server.SignWebhook(subscription.Secret, timestamp, body))
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
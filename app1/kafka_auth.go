@@ -0,0 +1,137 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/IBM/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// KafkaAuth configures TLS and SASL authentication of Kafka clients, e.g. for Confluent Cloud or MSK.
+type KafkaAuth struct {
+	TLS                   bool
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSInsecureSkipVerify bool
+
+	// SASLMechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, SASL is disabled when empty.
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+}
+
+func (a KafkaAuth) Validate() error {
+	var errs []error
+
+	if (a.TLSCertFile == "") != (a.TLSKeyFile == "") {
+		errs = append(errs, errors.New("KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together"))
+	}
+
+	switch a.SASLMechanism {
+	case "":
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		if a.SASLUsername == "" || a.SASLPassword == "" {
+			errs = append(errs, errors.New("KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD are required by KAFKA_SASL_MECHANISM"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf(
+			"unknown KAFKA_SASL_MECHANISM %q, expected PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512",
+			a.SASLMechanism,
+		))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Apply overrides TLS and SASL settings of saramaConfig.
+func (a KafkaAuth) Apply(saramaConfig *sarama.Config) error {
+	if a.TLS {
+		tlsConfig, err := a.tlsConfig()
+		if err != nil {
+			return err
+		}
+
+		saramaConfig.Net.TLS.Enable = true
+		saramaConfig.Net.TLS.Config = tlsConfig
+	}
+
+	if a.SASLMechanism == "" {
+		return nil
+	}
+
+	saramaConfig.Net.SASL.Enable = true
+	saramaConfig.Net.SASL.Mechanism = sarama.SASLMechanism(a.SASLMechanism)
+	saramaConfig.Net.SASL.User = a.SASLUsername
+	saramaConfig.Net.SASL.Password = a.SASLPassword
+
+	switch a.SASLMechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: scram.SHA256}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: scram.SHA512}
+		}
+	}
+
+	return nil
+}
+
+func (a KafkaAuth) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: a.TLSInsecureSkipVerify,
+	}
+
+	if a.TLSCAFile != "" {
+		ca, err := os.ReadFile(a.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read KAFKA_TLS_CA_FILE: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("KAFKA_TLS_CA_FILE doesn't contain any PEM certificates")
+		}
+	}
+
+	if a.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(a.TLSCertFile, a.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load Kafka client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// scramClient implements sarama.SCRAMClient with github.com/xdg-go/scram.
+type scramClient struct {
+	*scram.ClientConversation
+	hashGenerator scram.HashGeneratorFcn
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+
+	c.ClientConversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// KafkaProducerSettings tune the Kafka producer.
+//
+// Every Publish waits for the acknowledgement, so batching only helps when many messages are published in parallel.
+type KafkaProducerSettings struct {
+	Compression sarama.CompressionCodec
+	// BatchSize is the number of bytes that triggers sending a batch, 0 sends every message immediately.
+	BatchSize int
+	// Linger is how long messages wait for the batch to fill up.
+	Linger      time.Duration
+	Acks        sarama.RequiredAcks
+	MaxInFlight int
+}
+
+// Apply overrides producer settings of saramaConfig.
+func (s KafkaProducerSettings) Apply(saramaConfig *sarama.Config) {
+	saramaConfig.Producer.Compression = s.Compression
+	if s.Compression == sarama.CompressionZSTD && !saramaConfig.Version.IsAtLeast(sarama.V2_1_0_0) {
+		// zstd is supported since Kafka 2.1
+		saramaConfig.Version = sarama.V2_1_0_0
+	}
+
+	saramaConfig.Producer.Flush.Bytes = s.BatchSize
+	saramaConfig.Producer.Flush.Frequency = s.Linger
+	saramaConfig.Producer.RequiredAcks = s.Acks
+	saramaConfig.Net.MaxOpenRequests = s.MaxInFlight
+}
+
+// parseAcks parses acks the same way as the acks setting of the Kafka producer: all, 1 or 0.
+func parseAcks(s string) (sarama.RequiredAcks, error) {
+	switch s {
+	case "all", "-1":
+		return sarama.WaitForAll, nil
+	case "1":
+		return sarama.WaitForLocal, nil
+	case "0":
+		return sarama.NoResponse, nil
+	default:
+		return 0, fmt.Errorf("unknown acks %q, expected all, 1 or 0", s)
+	}
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Lifecycle runs the app's components until ctx is cancelled or any of them stops.
+//
+// Components are started one by one in the order in which they were added and stopped in the reverse order,
+// waiting for each to return. For example, the router is started before the HTTP server,
+// so commands sent by HTTP handlers are handled, and the HTTP server stops sending commands before the router is closed.
+type Lifecycle struct {
+	components []lifecycleComponent
+}
+
+type lifecycleComponent struct {
+	name  string
+	run   func(ctx context.Context) error
+	ready func() chan struct{}
+}
+
+// Add registers a component. run must block until ctx is cancelled and return once the component is stopped.
+func (l *Lifecycle) Add(name string, run func(ctx context.Context) error) {
+	l.components = append(l.components, lifecycleComponent{name: name, run: run})
+}
+
+// AddWithReady registers a component like Add, components added after it are started once ready is closed.
+func (l *Lifecycle) AddWithReady(name string, run func(ctx context.Context) error, ready func() chan struct{}) {
+	l.components = append(l.components, lifecycleComponent{name: name, run: run, ready: ready})
+}
+
+func (l *Lifecycle) Run(ctx context.Context) error {
+	g := errgroup.Group{}
+	stopped := make(chan struct{}, len(l.components))
+
+	var cancels []context.CancelFunc
+	var done []chan struct{}
+
+	for _, component := range l.components {
+		componentCtx, cancel := context.WithCancel(context.Background())
+		componentDone := make(chan struct{})
+		cancels = append(cancels, cancel)
+		done = append(done, componentDone)
+
+		g.Go(func() error {
+			defer close(componentDone)
+			defer func() { stopped <- struct{}{} }()
+
+			slog.With("component", component.name).Info("Starting component")
+
+			if err := component.run(componentCtx); err != nil {
+				return fmt.Errorf("%s: %w", component.name, err)
+			}
+
+			return nil
+		})
+
+		if component.ready == nil {
+			continue
+		}
+
+		select {
+		case <-component.ready():
+			continue
+		case <-ctx.Done():
+		case <-componentDone:
+			slog.With("component", component.name).Warn("Component stopped before it was ready, shutting down")
+		}
+		break
+	}
+
+	if len(cancels) == len(l.components) {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+			slog.Warn("Component stopped unexpectedly, shutting down")
+		}
+	}
+
+	for i := len(cancels) - 1; i >= 0; i-- {
+		slog.With("component", l.components[i].name).Info("Stopping component")
+
+		cancels[i]()
+		<-done[i]
+	}
+
+	return g.Wait()
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+type LogLevelsRequest struct {
+	// Level and WatermillInfoLevel are optional, only provided ones are changed.
+	Level              *slog.Level `json:"level"`
+	WatermillInfoLevel *slog.Level `json:"watermill_info_level"`
+}
+
+type LogLevelsResponse struct {
+	Level              slog.Level `json:"level"`
+	WatermillInfoLevel slog.Level `json:"watermill_info_level"`
+}
+
+// LogLevels are levels of logs which can be changed while the app runs.
+type LogLevels struct {
+	// app is the minimal level of logged records.
+	app *slog.LevelVar
+	// watermillInfo is the level Watermill's info logs are logged at.
+	// They are logged at debug by default, because Watermill logs every subscription and handler at info.
+	watermillInfo *slog.LevelVar
+
+	configured slog.Level
+}
+
+func NewLogLevels(configured slog.Level) LogLevels {
+	levels := LogLevels{
+		app:           &slog.LevelVar{},
+		watermillInfo: &slog.LevelVar{},
+		configured:    configured,
+	}
+	levels.app.Set(configured)
+	levels.watermillInfo.Set(slog.LevelDebug)
+
+	return levels
+}
+
+// WatermillHandler logs Watermill's info records at the current watermillInfo level.
+func (l LogLevels) WatermillHandler(handler slog.Handler) slog.Handler {
+	return watermillLevelHandler{Handler: handler, infoLevel: l.watermillInfo}
+}
+
+// ToggleDebugOnSIGHUP switches between debug and the configured level on every SIGHUP until ctx is done.
+func (l LogLevels) ToggleDebugOnSIGHUP(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-signals:
+				level := slog.LevelDebug
+				if l.app.Level() == slog.LevelDebug {
+					level = l.configured
+				}
+				l.app.Set(level)
+
+				slog.With("level", level).Info("Log level changed on SIGHUP")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (l LogLevels) response() LogLevelsResponse {
+	return LogLevelsResponse{
+		Level:              l.app.Level(),
+		WatermillInfoLevel: l.watermillInfo.Level(),
+	}
+}
+
+func (l LogLevels) GetHandler(writer http.ResponseWriter, request *http.Request) {
+	server.WriteJSON(request.Context(), writer, http.StatusOK, l.response())
+}
+
+func (l LogLevels) UpdateHandler(writer http.ResponseWriter, request *http.Request) {
+	var req LogLevelsRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		server.WriteProblem(request.Context(), writer, server.ProblemDetails{
+			Title:  "Malformed request body",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	if req.Level != nil {
+		l.app.Set(*req.Level)
+	}
+	if req.WatermillInfoLevel != nil {
+		l.watermillInfo.Set(*req.WatermillInfoLevel)
+	}
+
+	resp := l.response()
+	slog.With("level", resp.Level, "watermill_info_level", resp.WatermillInfoLevel).InfoContext(request.Context(), "Log levels changed")
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, resp)
+}
+
+// watermillLevelHandler changes the level of info records to infoLevel.
+type watermillLevelHandler struct {
+	slog.Handler
+	infoLevel *slog.LevelVar
+}
+
+func (h watermillLevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.Handler.Enabled(ctx, h.level(level))
+}
+
+func (h watermillLevelHandler) Handle(ctx context.Context, record slog.Record) error {
+	record.Level = h.level(record.Level)
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h watermillLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return watermillLevelHandler{Handler: h.Handler.WithAttrs(attrs), infoLevel: h.infoLevel}
+}
+
+func (h watermillLevelHandler) WithGroup(name string) slog.Handler {
+	return watermillLevelHandler{Handler: h.Handler.WithGroup(name), infoLevel: h.infoLevel}
+}
+
+func (h watermillLevelHandler) level(level slog.Level) slog.Level {
+	if level == slog.LevelInfo {
+		return h.infoLevel.Level()
+	}
+	return level
+}
@@ -0,0 +1,27 @@
+package app
+
+import (
+	"log/slog"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/logs"
+)
+
+// loggingRouterMiddleware passes to the handler's context a logger with the message UUID, topic,
+// handler name and correlation ID, so logs of handlers can be matched with messages.
+func loggingRouterMiddleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		logger := slog.With(
+			"message_uuid", msg.UUID,
+			"topic", message.SubscribeTopicFromCtx(msg.Context()),
+			"handler", message.HandlerNameFromCtx(msg.Context()),
+		)
+		if correlationID := correlationIDFromContext(msg.Context()); correlationID != "" {
+			logger = logger.With(correlationIDLogKey, correlationID)
+		}
+
+		msg.SetContext(logs.ContextWithLogger(msg.Context(), logger))
+
+		return h(msg)
+	}
+}
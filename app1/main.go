@@ -1,248 +1,467 @@
-package main
+package app
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/ThreeDotsLabs/watermill"
-	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
 	"github.com/ThreeDotsLabs/watermill/components/cqrs"
-	"github.com/ThreeDotsLabs/watermill/message"
-	"github.com/google/uuid"
 	"github.com/lmittmann/tint"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+	"github.com/roblaszczak/watermill-livecoding/internal/reporting"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
-type BookRoomRequest struct {
-	RoomID      string `json:"room_id"`
-	GuestsCount int    `json:"guests_count"`
-}
+// Run runs the service until it receives SIGINT or SIGTERM.
+func Run(service Service) {
+	config, err := LoadConfig(service)
+	if err != nil {
+		panic(fmt.Errorf("invalid config: %w", err))
+	}
 
-type RoomBookingHandler struct {
-	payments PaymentsProvider
+	logLevels := NewLogLevels(config.LogLevel)
 
-	eventBus *cqrs.EventBus
-}
+	slog.SetDefault(slog.New(correlationIDLogHandler{
+		Handler: tint.NewHandler(os.Stderr, &tint.Options{
+			Level:      logLevels.app,
+			TimeFormat: time.Kitchen,
+		}),
+	}))
 
-type RoomBooked struct {
-	BookingID   string `json:"booking_id"`
-	RoomID      string `json:"room_id"`
-	GuestsCount int    `json:"guests_count"`
-	Price       int    `json:"price"`
-}
+	watermillLogger := watermill.NewSlogLogger(
+		slog.New(logLevels.WatermillHandler(slog.Default().Handler())).With("watermill", true),
+	)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	logLevels.ToggleDebugOnSIGHUP(ctx)
 
-func (h RoomBookingHandler) Handler(writer http.ResponseWriter, request *http.Request) {
-	b, err := io.ReadAll(request.Body)
+	app, err := NewApp(NewContainer(ctx, config, watermillLogger), logLevels)
 	if err != nil {
-		slog.With("err", err).Error("Failed to read request body")
-		writer.WriteHeader(http.StatusBadRequest)
-		return
+		panic(err)
 	}
+	defer func() {
+		if err := app.Close(); err != nil {
+			slog.With("err", err).Warn("Failed to close app")
+		}
+	}()
 
-	req := BookRoomRequest{}
-	err = json.Unmarshal(b, &req)
-	if err != nil {
-		slog.With("err", err).Error("Failed to unmarshal request")
-		writer.WriteHeader(http.StatusBadRequest)
-		return
+	if err := app.Run(ctx); err != nil {
+		slog.With("err", err).Error("App stopped with error")
 	}
+}
 
-	slog.With("req", req).Info("Booking room")
+// NewApp wires handlers, HTTP routes and background components of the app built by the container.
+// Components are started with Run, the container is closed with the app.
+func NewApp(c *Container, logLevels LogLevels) (_ *App, err error) {
+	app := &App{container: c}
+	defer func() {
+		if err != nil {
+			_ = app.Close()
+		}
+	}()
 
-	bookingID := uuid.NewString()
-	roomPrice := 42 * req.GuestsCount
+	config := c.Config()
 
-	rb := RoomBooked{
-		BookingID:   bookingID,
-		RoomID:      req.RoomID,
-		GuestsCount: req.GuestsCount,
-		Price:       roomPrice,
+	if _, err := c.TracerProvider(); err != nil {
+		return nil, err
 	}
 
-	err = h.eventBus.Publish(request.Context(), rb)
+	db, err := c.DB()
 	if err != nil {
-		slog.With("err", err).Error("Failed to publish room booked event")
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-}
-
-type PaymentsProvider struct{}
-
-func (p PaymentsProvider) TakePayment(bookingID string, amount int) error {
-	logger := slog.With("amount", amount, "booking_id", bookingID)
-
-	logger.Info("Taking payment")
-
-	// this is not the best payment provider...
-	if rand.Int31n(2) == 0 {
-		time.Sleep(time.Second * 3)
+	broker, err := c.Broker()
+	if err != nil {
+		return nil, err
 	}
-	if rand.Int31n(3) == 0 {
-		return errors.New("random error")
+	publisher, err := c.Publisher()
+	if err != nil {
+		return nil, err
+	}
+	marshaler, err := c.Marshaler()
+	if err != nil {
+		return nil, err
 	}
 
-	logger.Info("Payment taken")
-
-	return nil
-}
-
-type PaymentsHandler struct {
-	paymentsProvider PaymentsProvider
-	eventBus         *cqrs.EventBus
-}
-
-type PaymentTaken struct {
-	BookingID string `json:"booking_id"`
-	RoomID    string `json:"room_id"`
-	Price     int    `json:"price"`
-}
+	slog.Info("Starting app")
 
-func (p PaymentsHandler) Handler(ctx context.Context, rb *RoomBooked) (err error) {
-	if err := p.paymentsProvider.TakePayment(rb.BookingID, rb.Price); err != nil {
-		return err
+	router, err := c.Router()
+	if err != nil {
+		return nil, err
 	}
 
-	return p.eventBus.Publish(ctx, PaymentTaken{
-		BookingID: rb.BookingID,
-		RoomID:    rb.RoomID,
-		Price:     rb.Price,
-	})
-}
-
-func main() {
-	slog.SetDefault(slog.New(
-		tint.NewHandler(os.Stderr, &tint.Options{
-			Level:      slog.LevelInfo,
-			TimeFormat: time.Kitchen,
-		}),
-	))
+	if config.RunsComponent(ComponentOutboxForwarder) {
+		err = outbox.AddForwarder(router, db, publisher, c.watermillLogger)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	watermillLogger := watermill.NewSlogLoggerWithLevelMapping(
-		slog.With("watermill", true),
-		map[slog.Level]slog.Level{
-			slog.LevelInfo: slog.LevelDebug,
-		},
-	)
+	commandProcessor, err := c.CommandProcessor()
+	if err != nil {
+		return nil, err
+	}
+	eventProcessor, err := c.EventProcessor()
+	if err != nil {
+		return nil, err
+	}
 
-	publisher, err := kafka.NewPublisher(
-		kafka.PublisherConfig{
-			Brokers:   []string{"kafka:9092"},
-			Marshaler: kafka.DefaultMarshaler{},
-		},
-		watermillLogger,
-	)
+	h, err := c.RoomBookingHandler()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	bookRoomHandler, err := c.BookRoomHandler()
+	if err != nil {
+		return nil, err
+	}
+	bookingProcessManager, err := c.BookingProcessManager()
+	if err != nil {
+		return nil, err
+	}
+	bookingsProjection, err := c.BookingsProjection()
+	if err != nil {
+		return nil, err
+	}
+	bookingReplies, err := c.BookingReplies()
+	if err != nil {
+		return nil, err
+	}
+	guests, err := c.Guests()
+	if err != nil {
+		return nil, err
+	}
+	promoCodes, err := c.PromoCodes()
+	if err != nil {
+		return nil, err
+	}
+	paymentsHandler, err := c.PaymentsHandler()
+	if err != nil {
+		return nil, err
+	}
+	paymentsWebhookHandler, err := c.PaymentsWebhookHandler()
+	if err != nil {
+		return nil, err
+	}
+	revenueReport, err := c.RevenueReport()
+	if err != nil {
+		return nil, err
+	}
+	invoicing, err := c.Invoicing()
+	if err != nil {
+		return nil, err
+	}
+	loyalty, err := c.Loyalty()
+	if err != nil {
+		return nil, err
+	}
+	stuckBookings, err := c.StuckBookings()
+	if err != nil {
+		return nil, err
+	}
+	notificationsHandler, err := c.NotificationsHandler()
+	if err != nil {
+		return nil, err
+	}
+	eventsStream, err := c.EventsStream()
+	if err != nil {
+		return nil, err
+	}
+	audit, err := c.Audit()
+	if err != nil {
+		return nil, err
+	}
+	deadLetterStore, err := c.DeadLetterStore()
+	if err != nil {
+		return nil, err
+	}
+	quarantine, err := c.Quarantine()
+	if err != nil {
+		return nil, err
+	}
+	delayedDelivery, err := c.DelayedDelivery()
+	if err != nil {
+		return nil, err
+	}
+	transactionalOutbox, err := c.Outbox()
+	if err != nil {
+		return nil, err
 	}
 
-	slog.Info("Starting app")
+	topology := c.Topology()
+	mux := http.NewServeMux()
+
+	commandHandlers := []cqrs.CommandHandler{
+		cqrs.NewCommandHandler("book_room", bookRoomHandler.Handler),
+		cqrs.NewCommandHandler("cancel_booking", bookRoomHandler.CancelBooking),
+		cqrs.NewCommandHandler("refund_payment", paymentsHandler.RefundPayment),
+		cqrs.NewCommandHandler("expire_booking", bookingProcessManager.ExpireBooking),
+		cqrs.NewCommandHandler("amend_booking", bookRoomHandler.AmendBooking),
+		cqrs.NewCommandHandler("revert_amendment", bookRoomHandler.RevertAmendment),
+		cqrs.NewCommandHandler("charge_amendment", paymentsHandler.ChargeAmendment),
+		cqrs.NewCommandHandler("forget_guest", guests.ForgetGuest),
+	}
+	allHandlerNames := handlerNames(commandHandlers)
+	commandHandlers = enabledHandlers(commandHandlers, config.Handlers)
 
-	router := message.NewDefaultRouter(watermillLogger)
+	err = commandProcessor.AddHandlers(commandHandlers...)
+	if err != nil {
+		return nil, err
+	}
+	topology.AddCommandHandlers(commandHandlers)
+
+	eventHandlers := []cqrs.EventHandler{
+		cqrs.NewEventHandler("payments", paymentsHandler.OnRoomBooked),
+		cqrs.NewEventHandler("payments_booking_cancelled", paymentsHandler.OnBookingCancelled),
+		cqrs.NewEventHandler("booking_payment_taken", bookRoomHandler.OnPaymentTaken),
+		cqrs.NewEventHandler("booking_payment_refunded", bookRoomHandler.OnPaymentRefunded),
+		cqrs.NewEventHandler("booking_amendment_payment_taken", bookRoomHandler.OnAmendmentPaymentTaken),
+		cqrs.NewEventHandler("booking_process_manager_room_booked", bookingProcessManager.OnRoomBooked),
+		cqrs.NewEventHandler("booking_process_manager_payment_taken", bookingProcessManager.OnPaymentTaken),
+		cqrs.NewEventHandler("booking_process_manager_payment_refunded", bookingProcessManager.OnPaymentRefunded),
+		cqrs.NewEventHandler("booking_process_manager_booking_cancelled", bookingProcessManager.OnBookingCancelled),
+		cqrs.NewEventHandler("booking_process_manager_payment_failed", bookingProcessManager.OnPaymentFailed),
+		cqrs.NewEventHandler("booking_process_manager_booking_amended", bookingProcessManager.OnBookingAmended),
+		cqrs.NewEventHandler("booking_process_manager_amendment_payment_taken", bookingProcessManager.OnAmendmentPaymentTaken),
+		cqrs.NewEventHandler("booking_process_manager_amendment_payment_failed", bookingProcessManager.OnAmendmentPaymentFailed),
+		cqrs.NewEventHandler("booking_process_manager_amendment_reverted", bookingProcessManager.OnAmendmentReverted),
+		cqrs.NewEventHandler("booking_replies_payment_taken", bookingReplies.OnPaymentTaken),
+		cqrs.NewEventHandler("booking_replies_payment_failed", bookingReplies.OnPaymentFailed),
+		cqrs.NewEventHandler("booking_replies_room_unavailable", bookingReplies.OnRoomUnavailable),
+		cqrs.NewEventHandler("notifications_room_booked", notificationsHandler.OnRoomBooked),
+		cqrs.NewEventHandler("notifications_booking_confirmed", notificationsHandler.OnBookingConfirmed),
+		cqrs.NewEventHandler("notifications_payment_failed", notificationsHandler.OnPaymentFailed),
+		cqrs.NewEventHandler("notifications_check_in_reminder", notificationsHandler.OnCheckInReminder),
+		cqrs.NewEventHandler("notifications_guest_forgotten", notificationsHandler.OnGuestForgotten),
+		cqrs.NewEventHandler("promo_codes_room_unavailable", promoCodes.OnRoomUnavailable),
+		cqrs.NewEventHandler("promo_codes_payment_failed", promoCodes.OnPaymentFailed),
+		cqrs.NewEventHandler("promo_codes_booking_expired", promoCodes.OnBookingExpired),
+		cqrs.NewEventHandler("promo_codes_report", reporting.PromoCodesReport{}.OnDiscountApplied),
+		cqrs.NewEventHandler("revenue_report_payment_taken", revenueReport.OnPaymentTaken),
+		cqrs.NewEventHandler("invoicing_payment_taken", invoicing.OnPaymentTaken),
+		cqrs.NewEventHandler("loyalty_room_booked", loyalty.OnRoomBooked),
+		cqrs.NewEventHandler("loyalty_payment_taken", loyalty.OnPaymentTaken),
+		cqrs.NewEventHandler("stuck_bookings_room_booked", stuckBookings.OnRoomBooked),
+		cqrs.NewEventHandler("stuck_bookings_payment_taken", stuckBookings.OnPaymentTaken),
+		cqrs.NewEventHandler("stuck_bookings_payment_failed", stuckBookings.OnPaymentFailed),
+		cqrs.NewEventHandler("revenue_report_daily_report_requested", revenueReport.OnDailyReportRequested),
+	}
+	eventHandlers = append(eventHandlers, bookingsProjectionHandlers(bookingsProjection)...)
+
+	slackAlerts := c.SlackAlerts()
+	if config.SlackWebhookURL != "" {
+		eventHandlers = append(
+			eventHandlers,
+			cqrs.NewEventHandler("slack_alerts_payment_failed", slackAlerts.OnPaymentFailed),
+			cqrs.NewEventHandler("slack_alerts_booking_stuck", slackAlerts.OnBookingStuck),
+		)
+	}
 
-	marshaler := cqrs.JSONMarshaler{
-		GenerateName: cqrs.StructName,
+	allHandlerNames = append(allHandlerNames, handlerNames(eventHandlers)...)
+	if err := config.Handlers.CheckPatterns(allHandlerNames); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
 	}
+	eventHandlers = enabledHandlers(eventHandlers, config.Handlers)
 
-	eventBus, err := cqrs.NewEventBusWithConfig(publisher, cqrs.EventBusConfig{
-		GeneratePublishTopic: func(params cqrs.GenerateEventPublishTopicParams) (string, error) {
-			return params.EventName, nil
-		},
-		Marshaler: marshaler,
-		Logger:    watermillLogger,
-	})
+	err = eventProcessor.AddHandlers(eventHandlers...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	topology.AddEventHandlers(eventHandlers)
 
-	eventProcessor, err := cqrs.NewEventProcessorWithConfig(router, cqrs.EventProcessorConfig{
-		GenerateSubscribeTopic: func(params cqrs.EventProcessorGenerateSubscribeTopicParams) (string, error) {
-			return params.EventName, nil
-		},
-		SubscriberConstructor: func(params cqrs.EventProcessorSubscriberConstructorParams) (message.Subscriber, error) {
-			return kafka.NewSubscriber(
-				kafka.SubscriberConfig{
-					Brokers:       []string{"kafka:9092"},
-					ConsumerGroup: params.HandlerName,
-					Unmarshaler:   kafka.DefaultMarshaler{},
-				},
-				watermillLogger,
-			)
-		},
-		Marshaler: marshaler,
-		Logger:    watermillLogger,
-	})
+	webhookSubscriptions, err := c.WebhookSubscriptions()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	h := RoomBookingHandler{
-		payments: PaymentsProvider{},
-		eventBus: eventBus,
+	webhookDispatcher, err := c.WebhookDispatcher()
+	if err != nil {
+		return nil, err
 	}
 
-	paymentsHandler := PaymentsHandler{
-		eventBus: eventBus,
+	err = addWebhookDispatcherHandlers(router, webhookDispatcher, marshaler, broker, config)
+	if err != nil {
+		return nil, err
 	}
 
-	err = eventProcessor.AddHandlers(
-		cqrs.NewEventHandler("payments", paymentsHandler.Handler),
-		cqrs.NewEventHandler("payments_report", func(ctx context.Context, event *PaymentTaken) error {
-			fmt.Printf("Reporting payment taken: %#v\n", event)
-			return nil
-		}),
-		cqrs.NewEventHandler("payments_report_v2", func(ctx context.Context, event *PaymentTaken) error {
-			fmt.Printf("Reporting payment taken (v2): %#v\n", event)
-			return nil
-		}),
-	)
+	err = addReplayHandlers(router, topology, broker, config)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	http.HandleFunc("POST /book", h.Handler)
+	if config.SlackWebhookURL != "" {
+		// Added after all other handlers, so dead letters of each of them are alerted about.
+		err = addDeadLetterAlertHandlers(router, slackAlerts, broker, config)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	var consumerLagExporter *ConsumerLagExporter
+	if config.Broker == "kafka" && config.RunsComponent(ComponentConsumerLag) {
+		consumerLagExporter, err = c.ConsumerLagExporter()
+		if err != nil {
+			return nil, err
+		}
 
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, os.Kill)
-		<-c
-		cancel()
-	}()
+		for _, handler := range commandHandlers {
+			topic := marshaler.Name(handler.NewCommand())
+			consumerLagExporter.Watch(handler.HandlerName(), topic, consumerGroupName(config, handler.HandlerName()))
+		}
+		for _, handler := range eventHandlers {
+			topic := marshaler.Name(handler.NewEvent())
+			consumerLagExporter.Watch(handler.HandlerName(), topic, consumerGroupName(config, handler.HandlerName()))
+		}
 
-	go func() {
-		err := router.Run(context.Background())
+		mux.HandleFunc("GET /debug/lag", consumerLagExporter.Handler)
+	}
+
+	if provisioner, ok := unwrapBroker(broker).(TopicProvisioner); ok && config.ProvisionTopics {
+		// Topics are created with the configured settings instead of the broker's auto-create defaults.
+		if err := provisioner.ProvisionTopics(appTopics(router, topology)); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.RunsComponent(ComponentBookingsAPI) {
+		mux.HandleFunc("POST /book", h.Handler)
+		mux.HandleFunc("DELETE /bookings/{id}", h.CancelHandler)
+		mux.HandleFunc("POST /bookings/{id}/refund", h.RefundHandler)
+		mux.HandleFunc("PATCH /bookings/{id}", h.AmendHandler)
+		mux.HandleFunc("GET /bookings", bookingsProjection.ListHandler)
+		mux.HandleFunc("GET /bookings/{id}", bookingsProjection.GetHandler)
+		mux.HandleFunc("GET /bookings/{id}/events", eventsStream.BookingEventsHandler)
+		mux.HandleFunc("GET /bookings/{id}/audit", audit.BookingHandler)
+		mux.HandleFunc("GET /bookings/{id}/timeline", BookingTimeline{db: db}.Handler)
+		mux.HandleFunc("POST /guests", guests.RegisterHandler)
+		mux.HandleFunc("GET /guests/{id}", guests.GetHandler)
+		mux.HandleFunc("DELETE /guests/{id}", h.ForgetGuestHandler)
+		mux.HandleFunc("GET /guests/{id}/points", loyalty.PointsHandler)
+		mux.HandleFunc("GET /ws", eventsStream.WebSocketHandler)
+
+		mux.HandleFunc("GET /webhooks", webhookSubscriptions.ListHandler)
+		mux.HandleFunc("POST /webhooks", webhookSubscriptions.CreateHandler)
+		mux.HandleFunc("GET /webhooks/{id}", webhookSubscriptions.GetHandler)
+		mux.HandleFunc("PUT /webhooks/{id}", webhookSubscriptions.UpdateHandler)
+		mux.HandleFunc("DELETE /webhooks/{id}", webhookSubscriptions.DeleteHandler)
+
+		mux.HandleFunc("GET /admin/promo-codes", promoCodes.ListHandler)
+		mux.HandleFunc("POST /admin/promo-codes", promoCodes.CreateHandler)
+	}
+	if config.RunsComponent(ComponentPaymentsAPI) {
+		if config.PaymentsWebhookSecret != "" {
+			mux.HandleFunc("POST /webhooks/payments", paymentsWebhookHandler.Handler)
+		}
+		mux.HandleFunc("GET /admin/chaos/payments", c.PaymentsChaos().GetHandler)
+		mux.HandleFunc("PUT /admin/chaos/payments", c.PaymentsChaos().UpdateHandler)
+	}
+	if config.RunsComponent(ComponentReportingAPI) {
+		mux.HandleFunc("GET /bookings/{id}/invoice", invoicing.Handler)
+		mux.HandleFunc("GET /reports/revenue", revenueReport.Handler)
+	}
+	mux.HandleFunc("GET /asyncapi.json", NewAsyncAPIDocument(commandHandlers, eventHandlers).Handler)
+
+	healthChecks := HealthChecks{
+		config: config,
+		db:     db,
+		broker: broker,
+		router: router,
+	}
+	if config.RunsComponent(ComponentProjectionCheckpoints) {
+		projectionCheckpoints, err := c.ProjectionCheckpoints()
 		if err != nil {
-			slog.With("err", err).Error("Failed to start watermill router")
+			return nil, err
 		}
-	}()
+		healthChecks.projectionCheckpoints = projectionCheckpoints
 
-	runHTTP(ctx)
+		mux.HandleFunc("GET /admin/projections", projectionCheckpoints.Handler)
+	}
+	if config.RunsComponent(ComponentStuckBookings) {
+		mux.HandleFunc("GET /admin/stuck-bookings", stuckBookings.ListHandler)
+	}
 
-	err = router.Close()
-	if err != nil {
-		slog.With("err", err).Warn("Failed to close Watermill router")
+	mux.HandleFunc("GET /healthz", healthChecks.HealthzHandler)
+	mux.HandleFunc("GET /readyz", healthChecks.ReadyzHandler)
+
+	deadLettersAdmin := DeadLettersAdmin{
+		store:     deadLetterStore,
+		publisher: publisher,
+	}
+	mux.HandleFunc("GET /admin/dlq/{handler}", deadLettersAdmin.ListHandler)
+	mux.HandleFunc("POST /admin/dlq/{handler}/replay", deadLettersAdmin.ReplayHandler)
+	mux.HandleFunc("GET /admin/quarantine", quarantine.ListHandler)
+	mux.HandleFunc("GET /admin/quarantine/{id}/payload", quarantine.PayloadHandler)
+	mux.HandleFunc("DELETE /admin/quarantine/{id}", quarantine.DeleteHandler)
+	mux.HandleFunc("GET /admin/topology", topology.Handler)
+	mux.HandleFunc("GET /admin/loglevel", logLevels.GetHandler)
+	mux.HandleFunc("PUT /admin/loglevel", logLevels.UpdateHandler)
+	mux.HandleFunc("POST /admin/handlers/{name}/pause", c.HandlerPauses().PauseHandler)
+	mux.HandleFunc("POST /admin/handlers/{name}/resume", c.HandlerPauses().ResumeHandler)
+
+	// The router is started first and stopped last, so handlers are subscribed before
+	// the HTTP server accepts requests and no new commands are sent while the router is closing.
+	app.lifecycle.AddWithReady("router", router.Run, router.Running)
+	if config.RunsComponent(ComponentDelayedDelivery) {
+		app.lifecycle.Add("delayed_delivery", delayedDelivery.Run)
+	}
+	if config.RunsComponent(ComponentScheduler) {
+		app.lifecycle.Add("scheduler", Scheduler{
+			outbox: transactionalOutbox,
+			jobs: []ScheduledJob{
+				{Name: "daily_report", Schedule: config.DailyReportSchedule, Event: reporting.NewDailyReportRequested},
+			},
+		}.Run)
+	}
+	if consumerLagExporter != nil {
+		app.lifecycle.Add("consumer_lag", consumerLagExporter.Run)
+	}
+	if healthChecks.projectionCheckpoints != nil {
+		app.lifecycle.Add("projection_checkpoints", healthChecks.projectionCheckpoints.Run)
 	}
+	if config.RunsComponent(ComponentStuckBookings) {
+		app.lifecycle.Add("stuck_bookings", stuckBookings.Run)
+	}
+	app.httpHandler = otelhttp.NewHandler(correlationIDHTTPMiddleware(mux), "http")
+	app.lifecycle.Add("http", func(ctx context.Context) error {
+		return runHTTP(ctx, config.HTTPAddr, app.httpHandler, config.HTTPShutdownTimeout)
+	})
+
+	return app, nil
 }
 
-func runHTTP(ctx context.Context) {
+func runHTTP(ctx context.Context, addr string, handler http.Handler, shutdownTimeout time.Duration) error {
 	slog.Info("Running HTTP server")
-	server := &http.Server{Addr: ":8080", Handler: http.DefaultServeMux}
+	server := &http.Server{Addr: addr, Handler: handler}
+
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-ctx.Done()
-		_ = server.Close()
+
+		slog.Info("Shutting down HTTP server")
+
+		// Shutdown stops accepting new connections and waits for in-flight requests.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.With("err", err).Warn("HTTP server didn't shut down in time, closing connections")
+			_ = server.Close()
+		}
 	}()
 
 	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-		panic(err)
+		return err
 	}
+
+	<-shutdownDone
+
+	return nil
 }
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-nats/v2/pkg/nats"
+	"github.com/ThreeDotsLabs/watermill/message"
+	nc "github.com/nats-io/nats.go"
+)
+
+// natsBroker uses NATS JetStream.
+//
+// Every topic is stored in a stream with the same name, created on the first publish or subscribe.
+// Consumer groups are durable queue groups, so the stream keeps the position of the group between restarts.
+type natsBroker struct {
+	url       string
+	publisher *nats.Publisher
+	logger    watermill.LoggerAdapter
+}
+
+func newNATSBroker(url string, logger watermill.LoggerAdapter) (*natsBroker, error) {
+	publisher, err := nats.NewPublisher(
+		nats.PublisherConfig{
+			URL:         url,
+			NatsOptions: []nc.Option{nc.RetryOnFailedConnect(true)},
+			Marshaler:   &nats.NATSMarshaler{},
+			JetStream: nats.JetStreamConfig{
+				AutoProvision: true,
+				TrackMsgId:    true,
+			},
+		},
+		logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsBroker{
+		url:       url,
+		publisher: publisher,
+		logger:    logger,
+	}, nil
+}
+
+func (b *natsBroker) Publisher() message.Publisher {
+	return b.publisher
+}
+
+func (b *natsBroker) NewSubscriber(consumerGroup string, offsetReset OffsetReset) (message.Subscriber, error) {
+	deliverPolicy := nc.DeliverNew()
+	if offsetReset == OffsetResetEarliest {
+		deliverPolicy = nc.DeliverAll()
+	}
+
+	return nats.NewSubscriber(
+		nats.SubscriberConfig{
+			URL:              b.url,
+			NatsOptions:      []nc.Option{nc.RetryOnFailedConnect(true)},
+			QueueGroupPrefix: consumerGroup,
+			Unmarshaler:      &nats.NATSMarshaler{},
+			JetStream: nats.JetStreamConfig{
+				AutoProvision:    true,
+				DurablePrefix:    consumerGroup,
+				SubscribeOptions: []nc.SubOpt{deliverPolicy, nc.AckExplicit()},
+			},
+		},
+		b.logger,
+	)
+}
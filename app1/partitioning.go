@@ -0,0 +1,68 @@
+package app
+
+import (
+	"reflect"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const (
+	partitionKeyMetadataKey = "partition_key"
+	bookingIDMetadataKey    = "booking_id"
+)
+
+// partitionKey returns the key deciding to which Kafka partition the message goes.
+// Messages with the same key are kept in order.
+//
+// RoomBooked and PaymentTaken are keyed by RoomID, so bookings of the same room are processed in order.
+// Other messages of a booking are keyed by its BookingID.
+func partitionKey(v any) string {
+	switch v := v.(type) {
+	case RoomBooked:
+		return v.RoomID
+	case *RoomBooked:
+		return v.RoomID
+	case PaymentTaken:
+		return v.RoomID
+	case *PaymentTaken:
+		return v.RoomID
+	}
+
+	return bookingIDOf(v)
+}
+
+// bookingIDOf returns the BookingID field of the command or event, or an empty string if it has none.
+func bookingIDOf(v any) string {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() != reflect.Struct {
+		return ""
+	}
+
+	field := value.FieldByName("BookingID")
+	if !field.IsValid() || field.Kind() != reflect.String {
+		return ""
+	}
+
+	return field.String()
+}
+
+// setPartitionKeyMetadata sets the partition key and the booking ID, so messages can be found
+// by booking without unmarshaling the payload.
+func setPartitionKeyMetadata(v any, msg *message.Message) {
+	if key := partitionKey(v); key != "" {
+		msg.Metadata.Set(partitionKeyMetadataKey, key)
+	}
+	if bookingID := bookingIDOf(v); bookingID != "" {
+		msg.Metadata.Set(bookingIDMetadataKey, bookingID)
+	}
+}
+
+// generatePartitionKey is used by the Kafka publisher.
+// Messages without the partition key are spread randomly over partitions.
+func generatePartitionKey(topic string, msg *message.Message) (string, error) {
+	if key := msg.Metadata.Get(partitionKeyMetadataKey); key != "" {
+		return key, nil
+	}
+
+	return msg.UUID, nil
+}
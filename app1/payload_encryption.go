@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// encryptionKeyIDMetadataKey is the ID of the key the payload was encrypted with, it's not set for plaintext payloads.
+const encryptionKeyIDMetadataKey = "encryption_key_id"
+
+var ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+
+// PayloadKeys provides keys of payload encryption. Keys are looked up by their IDs,
+// so payloads encrypted with old keys can be decrypted after the current key is rotated.
+//
+// StaticPayloadKeys are configured with environment variables, a KMS can implement it as well.
+type PayloadKeys interface {
+	// CurrentKey returns the key new payloads are encrypted with.
+	CurrentKey(ctx context.Context) (keyID string, key []byte, err error)
+	// Key returns the key with the ID, ErrUnknownEncryptionKey if there is none.
+	Key(ctx context.Context, keyID string) ([]byte, error)
+}
+
+// StaticPayloadKeys are AES keys by their IDs. Payloads are not encrypted when currentKeyID is empty,
+// but payloads encrypted before are still decrypted.
+type StaticPayloadKeys struct {
+	currentKeyID string
+	keys         map[string][]byte
+}
+
+func (k StaticPayloadKeys) CurrentKey(ctx context.Context) (string, []byte, error) {
+	if k.currentKeyID == "" {
+		return "", nil, nil
+	}
+
+	key, err := k.Key(ctx, k.currentKeyID)
+	return k.currentKeyID, key, err
+}
+
+func (k StaticPayloadKeys) Key(ctx context.Context, keyID string) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEncryptionKey, keyID)
+	}
+	return key, nil
+}
+
+// encryptingMarshaler encrypts whole payloads of commands and events with AES-GCM after marshaling them
+// and decrypts them before unmarshaling. Payloads without encryptionKeyIDMetadataKey are unmarshaled as they are,
+// so encryption can be enabled while plaintext messages are still consumed.
+type encryptingMarshaler struct {
+	cqrs.CommandEventMarshaler
+
+	keys PayloadKeys
+}
+
+func (m encryptingMarshaler) Marshal(v any) (*message.Message, error) {
+	msg, err := m.CommandEventMarshaler.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, key, err := m.keys.CurrentKey(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not get encryption key: %w", err)
+	}
+	if keyID == "" {
+		return msg, nil
+	}
+
+	msg.Payload, err = sealAESGCM(key, msg.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt payload: %w", err)
+	}
+	msg.Metadata.Set(encryptionKeyIDMetadataKey, keyID)
+
+	return msg, nil
+}
+
+func (m encryptingMarshaler) Unmarshal(msg *message.Message, v any) error {
+	keyID := msg.Metadata.Get(encryptionKeyIDMetadataKey)
+	if keyID == "" {
+		return m.CommandEventMarshaler.Unmarshal(msg, v)
+	}
+
+	key, err := m.keys.Key(msg.Context(), keyID)
+	if err != nil {
+		return fmt.Errorf("could not get encryption key: %w", err)
+	}
+
+	payload, err := openAESGCM(key, msg.Payload)
+	if err != nil {
+		return fmt.Errorf("could not decrypt payload with key %s: %w", keyID, err)
+	}
+
+	// The original message is not modified, so it's retried or dead-lettered as it was received.
+	decrypted := msg.Copy()
+	decrypted.Payload = payload
+	delete(decrypted.Metadata, encryptionKeyIDMetadataKey)
+
+	return m.CommandEventMarshaler.Unmarshal(decrypted, v)
+}
+
+// parseEncryptionKeys parses comma-separated id=key entries, keys are base64-encoded AES keys.
+func parseEncryptionKeys(s string) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+	if s == "" {
+		return keys, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		keyID, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, errors.New("invalid entry, expected id=key")
+		}
+		keyID = strings.TrimSpace(keyID)
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", keyID, err)
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("invalid key %s: must be 16, 24 or 32 bytes long, got %d", keyID, len(key))
+		}
+
+		keys[keyID] = key
+	}
+
+	return keys, nil
+}
+
+// sealAESGCM encrypts plaintext with a random nonce, which is prepended to the result.
+func sealAESGCM(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openAESGCM(key []byte, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,29 @@
+package app
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/roblaszczak/watermill-livecoding/internal/common/clock"
+	"github.com/roblaszczak/watermill-livecoding/internal/payments"
+)
+
+func newPaymentsProvider(config Config, chaos *payments.Chaos, clock clock.Clock) payments.Provider {
+	switch config.PaymentsProvider {
+	case "stripe":
+		return payments.NewStripeProvider(config.StripeSecretKey, config.StripePaymentMethod)
+	default:
+		return payments.NewFakeProvider(chaos, clock, config.PaymentsCallbackURL, config.PaymentsWebhookSecret)
+	}
+}
+
+func newPaymentRecords(config Config, db *sql.DB) (payments.Records, error) {
+	switch config.PaymentRecordsStore {
+	case "memory":
+		return payments.NewMemoryRecords(), nil
+	case "postgres":
+		return payments.NewPostgresRecords(db), nil
+	default:
+		return nil, fmt.Errorf("unknown payment records store: %s", config.PaymentRecordsStore)
+	}
+}
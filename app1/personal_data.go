@@ -0,0 +1,236 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// encryptedPrefix marks encrypted values of personal data fields, values without it were stored before encryption.
+const encryptedPrefix = "pii:"
+
+// personalDataEvent is implemented by events carrying personal data of a guest.
+type personalDataEvent interface {
+	// PersonalData returns the guest whose data the event carries and the fields with it.
+	PersonalData() (guestID string, fields []*string)
+}
+
+var ErrGuestForgotten = errors.New("guest was forgotten")
+
+// GuestKeys stores encryption keys of guests' personal data in the guest_keys table, one key per guest.
+// Keys of forgotten guests are deleted, but the guests are remembered, so no new key is created for them.
+type GuestKeys struct {
+	db *sql.DB
+}
+
+// Key returns the guest's key, creating it for guests who don't have one yet.
+// ErrGuestForgotten is returned for forgotten guests.
+func (k GuestKeys) Key(ctx context.Context, guestID string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	_, err := k.db.ExecContext(
+		ctx,
+		`INSERT INTO guest_keys (guest_id, key) VALUES ($1, $2) ON CONFLICT (guest_id) DO NOTHING`,
+		guestID, key,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create guest key: %w", err)
+	}
+
+	key, err = k.ExistingKey(ctx, guestID)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrGuestForgotten
+	}
+
+	return key, nil
+}
+
+// ExistingKey returns the guest's key, nil if the guest has none or was forgotten.
+func (k GuestKeys) ExistingKey(ctx context.Context, guestID string) ([]byte, error) {
+	var key []byte
+	err := k.db.QueryRowContext(ctx, `SELECT key FROM guest_keys WHERE guest_id = $1`, guestID).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get guest key: %w", err)
+	}
+
+	return key, nil
+}
+
+// PersonalDataEncryption encrypts personal data in events with AES-GCM and keys of the guests it belongs to.
+//
+// Events are immutable, so personal data can't be deleted from published and stored events.
+// Instead, the guest's key is deleted when the guest is forgotten and the data can't be decrypted anymore (crypto-shredding).
+type PersonalDataEncryption struct {
+	keys GuestKeys
+}
+
+// Encrypt returns a copy of the event with encrypted personal data, events without it are returned as they are.
+// Personal data of forgotten guests is not stored at all.
+func (e PersonalDataEncryption) Encrypt(ctx context.Context, event any) (any, error) {
+	encrypted, ok := copyPersonalDataEvent(event)
+	if !ok {
+		return event, nil
+	}
+
+	guestID, fields := encrypted.PersonalData()
+	if guestID == "" || !hasPersonalData(fields) {
+		return event, nil
+	}
+
+	key, err := e.keys.Key(ctx, guestID)
+	if errors.Is(err, ErrGuestForgotten) {
+		for _, field := range fields {
+			*field = ""
+		}
+		return encrypted, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		if *field == "" || strings.HasPrefix(*field, encryptedPrefix) {
+			continue
+		}
+		if *field, err = encrypt(key, *field); err != nil {
+			return nil, err
+		}
+	}
+
+	return encrypted, nil
+}
+
+// Decrypt decrypts personal data of the event in place. Personal data of forgotten guests is cleared.
+func (e PersonalDataEncryption) Decrypt(ctx context.Context, event any) error {
+	personal, ok := event.(personalDataEvent)
+	if !ok {
+		return nil
+	}
+
+	guestID, fields := personal.PersonalData()
+	if !hasEncrypted(fields) {
+		return nil
+	}
+
+	key, err := e.keys.ExistingKey(ctx, guestID)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		if !strings.HasPrefix(*field, encryptedPrefix) {
+			continue
+		}
+		if key == nil {
+			*field = ""
+			continue
+		}
+		if *field, err = decrypt(key, *field); err != nil {
+			return fmt.Errorf("could not decrypt personal data of guest %s: %w", guestID, err)
+		}
+	}
+
+	return nil
+}
+
+// copyPersonalDataEvent copies the event, so encrypting it doesn't change the event passed to the event bus.
+func copyPersonalDataEvent(event any) (personalDataEvent, bool) {
+	value := reflect.ValueOf(event)
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil, false
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	copied := reflect.New(value.Type())
+	copied.Elem().Set(value)
+
+	personal, ok := copied.Interface().(personalDataEvent)
+	return personal, ok
+}
+
+func hasPersonalData(fields []*string) bool {
+	for _, field := range fields {
+		if *field != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasEncrypted(fields []*string) bool {
+	for _, field := range fields {
+		if strings.HasPrefix(*field, encryptedPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func encrypt(key []byte, plaintext string) (string, error) {
+	sealed, err := sealAESGCM(key, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decrypt(key []byte, value string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := openAESGCM(key, sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// personalDataMarshaler encrypts personal data of events before marshaling them and decrypts it after unmarshaling.
+type personalDataMarshaler struct {
+	cqrs.CommandEventMarshaler
+
+	encryption PersonalDataEncryption
+}
+
+func (m personalDataMarshaler) Marshal(v any) (*message.Message, error) {
+	encrypted, err := m.encryption.Encrypt(context.Background(), v)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.CommandEventMarshaler.Marshal(encrypted)
+}
+
+func (m personalDataMarshaler) Unmarshal(msg *message.Message, v any) error {
+	if err := m.CommandEventMarshaler.Unmarshal(msg, v); err != nil {
+		return err
+	}
+
+	return m.encryption.Decrypt(msg.Context(), v)
+}
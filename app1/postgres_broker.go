@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	stdSQL "database/sql"
+	"errors"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	watermillSQL "github.com/ThreeDotsLabs/watermill-sql/v3/pkg/sql"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// postgresBroker keeps messages in Postgres, so the app can run without a broker.
+//
+// Every topic is stored in the watermill_<topic> table, the same way as the outbox,
+// and offsets of consumer groups are stored in watermill_offsets_<topic>.
+// Tables are created on the first publish or subscribe.
+type postgresBroker struct {
+	db        *stdSQL.DB
+	publisher *watermillSQL.Publisher
+	logger    watermill.LoggerAdapter
+}
+
+func newPostgresBroker(db *stdSQL.DB, logger watermill.LoggerAdapter) (*postgresBroker, error) {
+	publisher, err := watermillSQL.NewPublisher(
+		db,
+		watermillSQL.PublisherConfig{
+			SchemaAdapter:        watermillSQL.DefaultPostgreSQLSchema{},
+			AutoInitializeSchema: true,
+		},
+		logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &postgresBroker{
+		db:        db,
+		publisher: publisher,
+		logger:    logger,
+	}, nil
+}
+
+func (b *postgresBroker) Publisher() message.Publisher {
+	return b.publisher
+}
+
+func (b *postgresBroker) NewSubscriber(consumerGroup string, offsetReset OffsetReset) (message.Subscriber, error) {
+	var offsetsAdapter watermillSQL.OffsetsAdapter = watermillSQL.DefaultPostgreSQLOffsetsAdapter{}
+	if offsetReset == OffsetResetLatest {
+		offsetsAdapter = latestOffsetsAdapter{}
+	}
+
+	return watermillSQL.NewSubscriber(
+		b.db,
+		watermillSQL.SubscriberConfig{
+			ConsumerGroup:    consumerGroup,
+			SchemaAdapter:    watermillSQL.DefaultPostgreSQLSchema{},
+			OffsetsAdapter:   offsetsAdapter,
+			InitializeSchema: true,
+			PollInterval:     100 * time.Millisecond,
+		},
+		b.logger,
+	)
+}
+
+// DeleteConsumerGroup deletes offsets of the consumer group in every topic.
+func (b *postgresBroker) DeleteConsumerGroup(ctx context.Context, consumerGroup string, topics []string) error {
+	offsetsAdapter := watermillSQL.DefaultPostgreSQLOffsetsAdapter{}
+
+	var errs []error
+	for _, topic := range topics {
+		_, err := b.db.ExecContext(ctx, `DELETE FROM `+offsetsAdapter.MessagesOffsetsTable(topic)+` WHERE consumer_group = $1`, consumerGroup)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// latestOffsetsAdapter starts new consumer groups after the last message stored in the topic.
+//
+// DefaultPostgreSQLOffsetsAdapter starts them from the first message.
+type latestOffsetsAdapter struct {
+	watermillSQL.DefaultPostgreSQLOffsetsAdapter
+}
+
+func (a latestOffsetsAdapter) BeforeSubscribingQueries(topic string, consumerGroup string) []watermillSQL.Query {
+	messagesTable := watermillSQL.DefaultPostgreSQLSchema{}.MessagesTable(topic)
+
+	return []watermillSQL.Query{
+		{
+			Query: `INSERT INTO ` + a.MessagesOffsetsTable(topic) + ` (consumer_group, offset_acked, last_processed_transaction_id)
+				SELECT $1, COALESCE(last."offset", 0), COALESCE(last.transaction_id, '0')
+				FROM (SELECT 1) AS one
+				LEFT JOIN (
+					SELECT "offset", transaction_id FROM ` + messagesTable + `
+					ORDER BY transaction_id DESC, "offset" DESC LIMIT 1
+				) AS last ON true
+				ON CONFLICT DO NOTHING`,
+			Args: []any{consumerGroup},
+		},
+	}
+}
@@ -0,0 +1,360 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/roblaszczak/watermill-livecoding/contracts"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/clock"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+// ProjectionCheckpoint is the position of the last event processed by a projection's handler in a partition.
+type ProjectionCheckpoint struct {
+	Projection string `json:"projection"`
+	Handler    string `json:"handler"`
+	Topic      string `json:"topic"`
+	Partition  int32  `json:"partition"`
+	// Offset is -1 with brokers without offsets.
+	Offset int64 `json:"offset"`
+	// EventTime is when the last processed event was published.
+	EventTime time.Time `json:"event_time"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Lag is the number of events published to the partition after the checkpoint, -1 when it's unknown.
+	Lag int64 `json:"lag"`
+}
+
+type checkpointKey struct {
+	handler   string
+	topic     string
+	partition int32
+}
+
+// ProjectionStatus is how stale the projection's read model is.
+type ProjectionStatus struct {
+	Projection string `json:"projection"`
+	// Staleness is for how long any of the projection's handlers has been behind the newest events,
+	// but not longer than the age of the last event it processed.
+	Staleness   time.Duration          `json:"-"`
+	Checkpoints []ProjectionCheckpoint `json:"checkpoints"`
+	CheckedAt   time.Time              `json:"checked_at"`
+}
+
+// ProjectionCheckpoints records checkpoints of projections' handlers in the projection_checkpoints table,
+// and compares them with the newest offsets every interval to detect stale read models.
+//
+// Staleness is exported as the projection_staleness_seconds gauge and checked by /readyz,
+// so instances don't serve queries from read models which are too stale.
+type ProjectionCheckpoints struct {
+	db *sql.DB
+	// reader gets the newest offsets, it's nil with brokers which don't keep messages.
+	reader       TopicReader
+	clock        clock.Clock
+	interval     time.Duration
+	maxStaleness time.Duration
+
+	offsetGauge    *prometheus.GaugeVec
+	lagGauge       *prometheus.GaugeVec
+	timestampGauge *prometheus.GaugeVec
+	stalenessGauge *prometheus.GaugeVec
+
+	lock     sync.RWMutex
+	statuses map[string]ProjectionStatus
+	// behindSince is when checkpoints were first seen behind the newest offsets, it's used only by poll.
+	behindSince map[checkpointKey]time.Time
+}
+
+func NewProjectionCheckpoints(
+	db *sql.DB,
+	reader TopicReader,
+	clock clock.Clock,
+	interval time.Duration,
+	maxStaleness time.Duration,
+	registry *prometheus.Registry,
+) (*ProjectionCheckpoints, error) {
+	checkpointLabels := []string{"projection", "handler", "topic", "partition"}
+
+	c := &ProjectionCheckpoints{
+		db:           db,
+		reader:       reader,
+		clock:        clock,
+		interval:     interval,
+		maxStaleness: maxStaleness,
+		offsetGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "projection_checkpoint_offset",
+			Help: "Offset of the last event processed by the projection's handler in the partition.",
+		}, checkpointLabels),
+		lagGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "projection_checkpoint_lag",
+			Help: "Number of events in the partition not processed by the projection's handler yet.",
+		}, checkpointLabels),
+		timestampGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "projection_checkpoint_timestamp_seconds",
+			Help: "Time when the last event processed by the projection's handler in the partition was published.",
+		}, checkpointLabels),
+		stalenessGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "projection_staleness_seconds",
+			Help: "For how long the projection has been behind the newest events.",
+		}, []string{"projection"}),
+		statuses:    map[string]ProjectionStatus{},
+		behindSince: map[checkpointKey]time.Time{},
+	}
+
+	for _, gauge := range []*prometheus.GaugeVec{c.offsetGauge, c.lagGauge, c.timestampGauge, c.stalenessGauge} {
+		if err := registry.Register(gauge); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// handlerProjection returns the projection of the handler, handlers of projections are prefixed with their names.
+func handlerProjection(handler string) (string, bool) {
+	for projection := range projectionTables {
+		if strings.HasPrefix(handler, projection+"_") {
+			return projection, true
+		}
+	}
+	return "", false
+}
+
+// Middleware records the checkpoint after a projection's handler processed an event successfully.
+func (c *ProjectionCheckpoints) Middleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		produced, err := h(msg)
+		if err != nil {
+			return produced, err
+		}
+
+		handler := configuredHandlerName(msg.Context())
+		projection, ok := handlerProjection(handler)
+		if !ok {
+			return produced, nil
+		}
+
+		if err := c.save(msg.Context(), projection, handler, msg); err != nil {
+			// The event was processed, the checkpoint is saved with the next one.
+			slog.With("err", err, "handler", handler).WarnContext(msg.Context(), "Failed to save projection checkpoint")
+		}
+
+		return produced, nil
+	}
+}
+
+func (c *ProjectionCheckpoints) save(ctx context.Context, projection string, handler string, msg *message.Message) error {
+	partition, _ := kafka.MessagePartitionFromCtx(ctx)
+	offset, ok := kafka.MessagePartitionOffsetFromCtx(ctx)
+	if !ok {
+		offset = -1
+	}
+
+	eventTime, ok := kafka.MessageTimestampFromCtx(ctx)
+	if !ok {
+		var err error
+		eventTime, err = time.Parse(time.RFC3339Nano, msg.Metadata.Get(contracts.OccurredAtMetadataKey))
+		if err != nil {
+			eventTime = c.clock.Now()
+		}
+	}
+
+	// Checkpoints only move forward, also when an older event is retried after a newer one was processed.
+	_, err := c.db.ExecContext(
+		ctx,
+		`INSERT INTO projection_checkpoints (handler, topic, partition, projection, message_offset, event_time, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (handler, topic, partition) DO UPDATE SET
+			message_offset = EXCLUDED.message_offset,
+			event_time = EXCLUDED.event_time,
+			updated_at = EXCLUDED.updated_at
+		WHERE projection_checkpoints.message_offset <= EXCLUDED.message_offset`,
+		handler, message.SubscribeTopicFromCtx(ctx), partition, projection, offset, eventTime, c.clock.Now(),
+	)
+	return err
+}
+
+// Run polls staleness of projections every interval until ctx is cancelled.
+func (c *ProjectionCheckpoints) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *ProjectionCheckpoints) poll(ctx context.Context) {
+	checkpoints, err := c.load(ctx)
+	if err != nil {
+		slog.With("err", err).WarnContext(ctx, "Failed to load projection checkpoints")
+		return
+	}
+
+	now := c.clock.Now()
+	newestOffsets := map[string]map[int32]int64{}
+
+	statuses := map[string]ProjectionStatus{}
+	for projection := range projectionTables {
+		statuses[projection] = ProjectionStatus{Projection: projection, CheckedAt: now}
+	}
+
+	for _, checkpoint := range checkpoints {
+		checkpoint.Lag = c.lag(ctx, checkpoint, newestOffsets)
+
+		key := checkpointKey{handler: checkpoint.Handler, topic: checkpoint.Topic, partition: checkpoint.Partition}
+		var staleness time.Duration
+		if checkpoint.Lag > 0 {
+			since, ok := c.behindSince[key]
+			if !ok {
+				since = now
+				c.behindSince[key] = now
+			}
+			if checkpoint.EventTime.After(since) {
+				since = checkpoint.EventTime
+			}
+			staleness = now.Sub(since)
+		} else {
+			delete(c.behindSince, key)
+		}
+
+		status := statuses[checkpoint.Projection]
+		status.Staleness = max(status.Staleness, staleness)
+		status.Checkpoints = append(status.Checkpoints, checkpoint)
+		statuses[checkpoint.Projection] = status
+
+		labels := []string{checkpoint.Projection, checkpoint.Handler, checkpoint.Topic, strconv.Itoa(int(checkpoint.Partition))}
+		c.offsetGauge.WithLabelValues(labels...).Set(float64(checkpoint.Offset))
+		c.lagGauge.WithLabelValues(labels...).Set(float64(checkpoint.Lag))
+		c.timestampGauge.WithLabelValues(labels...).Set(float64(checkpoint.EventTime.Unix()))
+	}
+
+	for projection, status := range statuses {
+		c.stalenessGauge.WithLabelValues(projection).Set(status.Staleness.Seconds())
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.statuses = statuses
+}
+
+func (c *ProjectionCheckpoints) load(ctx context.Context) ([]ProjectionCheckpoint, error) {
+	rows, err := c.db.QueryContext(
+		ctx,
+		`SELECT projection, handler, topic, partition, message_offset, event_time, updated_at
+		FROM projection_checkpoints ORDER BY projection, handler, topic, partition`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkpoints []ProjectionCheckpoint
+	for rows.Next() {
+		var checkpoint ProjectionCheckpoint
+		err := rows.Scan(
+			&checkpoint.Projection,
+			&checkpoint.Handler,
+			&checkpoint.Topic,
+			&checkpoint.Partition,
+			&checkpoint.Offset,
+			&checkpoint.EventTime,
+			&checkpoint.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	return checkpoints, rows.Err()
+}
+
+// lag compares the checkpoint with the newest offset of its partition, newest offsets are fetched once per topic.
+func (c *ProjectionCheckpoints) lag(ctx context.Context, checkpoint ProjectionCheckpoint, newestOffsets map[string]map[int32]int64) int64 {
+	if c.reader == nil || checkpoint.Offset < 0 {
+		return -1
+	}
+
+	if _, ok := newestOffsets[checkpoint.Topic]; !ok {
+		newestOffsets[checkpoint.Topic] = map[int32]int64{}
+
+		ranges, err := c.reader.PartitionRanges(checkpoint.Topic, ReadPosition{})
+		if err != nil {
+			slog.With("err", err, "topic", checkpoint.Topic).WarnContext(ctx, "Failed to get newest offsets")
+		}
+		for _, partitionRange := range ranges {
+			newestOffsets[checkpoint.Topic][partitionRange.Partition] = partitionRange.To
+		}
+	}
+
+	newest, ok := newestOffsets[checkpoint.Topic][checkpoint.Partition]
+	if !ok {
+		return -1
+	}
+
+	return max(newest-checkpoint.Offset-1, 0)
+}
+
+// ReadinessChecks fail when a projection is more stale than maxStaleness, there are none when it's 0.
+func (c *ProjectionCheckpoints) ReadinessChecks() map[string]func(ctx context.Context) error {
+	checks := map[string]func(ctx context.Context) error{}
+	if c.maxStaleness == 0 {
+		return checks
+	}
+
+	for projection := range projectionTables {
+		checks["projection_"+projection] = func(ctx context.Context) error {
+			c.lock.RLock()
+			defer c.lock.RUnlock()
+
+			if staleness := c.statuses[projection].Staleness; staleness > c.maxStaleness {
+				return fmt.Errorf("%s is behind the newest events for %s", projection, staleness.Round(time.Second))
+			}
+			return nil
+		}
+	}
+
+	return checks
+}
+
+type projectionStatusResponse struct {
+	ProjectionStatus
+	StalenessSeconds float64 `json:"staleness_seconds"`
+}
+
+// Handler responds with statuses of all projections from the last poll.
+func (c *ProjectionCheckpoints) Handler(writer http.ResponseWriter, request *http.Request) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	response := make([]projectionStatusResponse, 0, len(c.statuses))
+	for _, status := range c.statuses {
+		response = append(response, projectionStatusResponse{
+			ProjectionStatus: status,
+			StalenessSeconds: status.Staleness.Seconds(),
+		})
+	}
+	slices.SortFunc(response, func(a, b projectionStatusResponse) int {
+		return strings.Compare(a.Projection, b.Projection)
+	})
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, response)
+}
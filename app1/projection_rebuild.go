@@ -0,0 +1,422 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/lib/pq"
+)
+
+// rebuildCatchUpThreshold is the number of events the rebuild may be behind the newest ones when the live table
+// is locked and swapped. Events published while the table is locked are handled before the swap.
+const rebuildCatchUpThreshold = 100
+
+// rebuildPollInterval is how often the rebuild compares handled events with the newest ones and reports progress.
+const rebuildPollInterval = time.Second
+
+// rebuildSwapPollInterval is how often the rebuild checks if the last events were handled while the table is locked.
+const rebuildSwapPollInterval = 10 * time.Millisecond
+
+// RebuildProgress is reported by ProjectionRebuild every second.
+type RebuildProgress struct {
+	Projection string `json:"projection"`
+	// Phase is replaying, swapping or done.
+	Phase    string `json:"phase"`
+	Replayed int64  `json:"replayed"`
+	// Total is the number of events to replay known so far, it grows while events are published.
+	Total int64 `json:"total"`
+}
+
+// ProjectionRebuild rebuilds a projection's table from scratch.
+//
+// The projection's handlers, building a shadow table, are run with their own consumer groups reset to the earliest
+// offset, while the running projection keeps updating the live table. When the shadow table has caught up,
+// the live table is locked, the last events are handled and the tables are swapped in one transaction,
+// so queries never see a partially rebuilt table. Queries and handlers waiting for the lock continue with
+// the rebuilt table, because Postgres resolves table names again after acquiring the lock.
+//
+// Handlers consume topics in parallel, so the projection must not depend on the order of events from different
+// topics, e.g. bookings_projection applies only events which occurred after the ones applied before.
+type ProjectionRebuild struct {
+	db        *sql.DB
+	broker    Broker
+	reader    TopicReader
+	marshaler cqrs.CommandEventMarshaler
+	config    Config
+	logger    watermill.LoggerAdapter
+
+	projection  string
+	table       string
+	shadowTable string
+	// handlers are the projection's handlers building the shadow table, named like the ones building the live table.
+	handlers []cqrs.EventHandler
+
+	// RateLimit is the maximum number of events replayed per second, 0 disables the limit.
+	RateLimit int
+	// OnProgress is called with the rebuild's progress, e.g. to print it.
+	OnProgress func(RebuildProgress)
+}
+
+// Run rebuilds the projection. The shadow table is dropped if the rebuild fails or ctx is cancelled,
+// so the rebuild can be started again.
+func (r ProjectionRebuild) Run(ctx context.Context) (err error) {
+	// The shadow table is not dropped if it exists, because it means that another rebuild is running.
+	_, err = r.db.ExecContext(ctx, `CREATE TABLE `+r.shadowTable+` (LIKE `+r.table+` INCLUDING ALL)`)
+	if err != nil {
+		return fmt.Errorf("could not create %s, another rebuild of %s may be running: %w", r.shadowTable, r.projection, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if _, dropErr := r.db.ExecContext(context.WithoutCancel(ctx), `DROP TABLE IF EXISTS `+r.shadowTable); dropErr != nil {
+			slog.With("err", dropErr, "table", r.shadowTable).ErrorContext(ctx, "Failed to drop shadow table")
+		}
+	}()
+
+	// Offsets committed by a previous rebuild are deleted, so the consumer groups start from the earliest offset.
+	if err := r.deleteConsumerGroups(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err := r.deleteConsumerGroups(context.WithoutCancel(ctx)); err != nil {
+			slog.With("err", err, "projection", r.projection).WarnContext(ctx, "Failed to delete rebuild consumer groups")
+		}
+	}()
+
+	positions := newRebuildPositions()
+	router, err := r.newRouter(positions)
+	if err != nil {
+		return err
+	}
+
+	var routerErr error
+	routerDone := make(chan struct{})
+	go func() {
+		defer close(routerDone)
+		routerErr = router.Run(ctx)
+	}()
+	// The router is closed before the consumer groups are deleted, because their subscribers have to be closed first.
+	defer func() {
+		if err := router.Close(); err != nil {
+			slog.With("err", err).WarnContext(ctx, "Failed to close rebuild router")
+		}
+		<-routerDone
+	}()
+
+	select {
+	case <-router.Running():
+	case <-routerDone:
+		return routerErr
+	}
+
+	progress := RebuildProgress{Projection: r.projection, Phase: "replaying"}
+	if err := r.catchUp(ctx, positions, &progress); err != nil {
+		return err
+	}
+
+	progress.Phase = "swapping"
+	r.report(progress)
+	if err := r.swap(ctx, positions, &progress); err != nil {
+		return err
+	}
+
+	progress.Phase = "done"
+	r.report(progress)
+
+	return nil
+}
+
+// rebuildHandlerName is the name of the handler building the shadow table, it's also the name of its consumer group.
+func rebuildHandlerName(handler cqrs.EventHandler) string {
+	return handler.HandlerName() + "_rebuild"
+}
+
+// consumerGroup returns the consumer group of the rebuild's handler. Every handler has its own consumer group
+// regardless of CONSUMER_GROUP_STRATEGY, so the groups of different projections can be reset independently.
+func (r ProjectionRebuild) consumerGroup(handler cqrs.EventHandler) string {
+	return r.config.ConsumerGroupPrefix + rebuildHandlerName(handler)
+}
+
+func (r ProjectionRebuild) topic(handler cqrs.EventHandler) string {
+	return r.marshaler.Name(handler.NewEvent())
+}
+
+func (r ProjectionRebuild) deleteConsumerGroups(ctx context.Context) error {
+	deleter, ok := unwrapBroker(r.broker).(ConsumerGroupDeleter)
+	if !ok {
+		return fmt.Errorf("broker %s can't reset consumer groups", r.config.Broker)
+	}
+
+	for _, handler := range r.handlers {
+		err := deleter.DeleteConsumerGroup(ctx, r.consumerGroup(handler), []string{r.topic(handler)})
+		if err != nil && !errors.Is(err, sarama.ErrGroupIDNotFound) {
+			return fmt.Errorf("could not reset consumer group %s: %w", r.consumerGroup(handler), err)
+		}
+	}
+
+	return nil
+}
+
+// newRouter returns the router running the projection's handlers, which record positions of handled events.
+func (r ProjectionRebuild) newRouter(positions *rebuildPositions) (*message.Router, error) {
+	router, err := message.NewRouter(message.RouterConfig{
+		CloseTimeout: r.config.RouterCloseTimeout,
+	}, r.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.RateLimit > 0 {
+		// The throttle is shared by all handlers, so it limits events replayed by all of them.
+		router.AddMiddleware(middleware.NewThrottle(int64(r.RateLimit), time.Second).Middleware)
+	}
+
+	for _, handler := range r.handlers {
+		subscriber, err := r.broker.NewSubscriber(r.consumerGroup(handler), OffsetResetEarliest)
+		if err != nil {
+			return nil, err
+		}
+
+		target := ReplayToEventHandlers(r.marshaler, []cqrs.EventHandler{handler})
+		router.AddNoPublisherHandler(rebuildHandlerName(handler), r.topic(handler), subscriber, func(msg *message.Message) error {
+			if err := target(msg.Context(), msg); err != nil {
+				positions.fail(fmt.Errorf("could not replay message %s: %w", msg.UUID, err))
+				return err
+			}
+
+			positions.handled(handler.HandlerName(), msg)
+			return nil
+		})
+	}
+
+	return router, nil
+}
+
+// catchUp waits until the rebuild is less than rebuildCatchUpThreshold events behind the newest ones.
+func (r ProjectionRebuild) catchUp(ctx context.Context, positions *rebuildPositions, progress *RebuildProgress) error {
+	ticker := time.NewTicker(rebuildPollInterval)
+	defer ticker.Stop()
+
+	for {
+		ranges, err := r.newestRanges()
+		if err != nil {
+			return err
+		}
+
+		behind := r.behind(positions, ranges, progress)
+		r.report(*progress)
+		if behind < rebuildCatchUpThreshold {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-positions.failed:
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// newestRanges returns ranges of all events in topics of the projection's handlers, by topics.
+func (r ProjectionRebuild) newestRanges() (map[string][]PartitionRange, error) {
+	ranges := map[string][]PartitionRange{}
+
+	for _, handler := range r.handlers {
+		topic := r.topic(handler)
+		if _, ok := ranges[topic]; ok {
+			continue
+		}
+
+		topicRanges, err := r.reader.PartitionRanges(topic, ReadPosition{})
+		if err != nil {
+			return nil, err
+		}
+		ranges[topic] = topicRanges
+	}
+
+	return ranges, nil
+}
+
+// behind returns the number of events in the ranges which the handlers haven't handled yet, and updates progress.
+func (r ProjectionRebuild) behind(positions *rebuildPositions, ranges map[string][]PartitionRange, progress *RebuildProgress) int64 {
+	positions.lock.Lock()
+	defer positions.lock.Unlock()
+
+	var behind int64
+	for _, handler := range r.handlers {
+		for _, partitionRange := range ranges[r.topic(handler)] {
+			position, ok := positions.positions[handler.HandlerName()][partitionRange.Partition]
+			if !ok {
+				behind += partitionRange.Count()
+				continue
+			}
+			behind += max(partitionRange.To-position.offset-1, 0)
+		}
+	}
+
+	progress.Replayed = positions.count
+	progress.Total = positions.count + behind
+
+	return behind
+}
+
+// swap locks the live table, waits until the last events are handled and replaces the live table with the shadow table.
+func (r ProjectionRebuild) swap(ctx context.Context, positions *rebuildPositions, progress *RebuildProgress) (err error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// The projection's handlers wait for the lock, so no events are applied only to the live table.
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE `+r.table+` IN ACCESS EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+
+	ranges, err := r.newestRanges()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(rebuildSwapPollInterval)
+	defer ticker.Stop()
+
+	for r.behind(positions, ranges, progress) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-positions.failed:
+			return err
+		case <-ticker.C:
+		}
+	}
+
+	if err := r.reconcileCheckpoints(ctx, tx, positions); err != nil {
+		return err
+	}
+
+	oldTable := r.table + "_old"
+	statements := []string{
+		`ALTER TABLE ` + r.table + ` RENAME TO ` + oldTable,
+		`ALTER TABLE ` + r.shadowTable + ` RENAME TO ` + r.table,
+		`DROP TABLE ` + oldTable,
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// reconcileCheckpoints moves checkpoints of the projection's handlers to the last events handled by the rebuild,
+// because the rebuilt table has all of them, and deletes checkpoints of handlers which the projection no longer has.
+// The live handlers handle these events again after the swap, but checkpoints don't move back.
+func (r ProjectionRebuild) reconcileCheckpoints(ctx context.Context, tx *sql.Tx, positions *rebuildPositions) error {
+	positions.lock.Lock()
+	defer positions.lock.Unlock()
+
+	now := time.Now()
+	var handlerNames []string
+
+	for _, handler := range r.handlers {
+		handlerNames = append(handlerNames, handler.HandlerName())
+
+		for partition, position := range positions.positions[handler.HandlerName()] {
+			_, err := tx.ExecContext(
+				ctx,
+				`INSERT INTO projection_checkpoints (handler, topic, partition, projection, message_offset, event_time, updated_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)
+				ON CONFLICT (handler, topic, partition) DO UPDATE SET
+					message_offset = EXCLUDED.message_offset,
+					event_time = EXCLUDED.event_time,
+					updated_at = EXCLUDED.updated_at
+				WHERE projection_checkpoints.message_offset < EXCLUDED.message_offset`,
+				handler.HandlerName(), r.topic(handler), partition, r.projection, position.offset, position.eventTime, now,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := tx.ExecContext(
+		ctx,
+		`DELETE FROM projection_checkpoints WHERE projection = $1 AND NOT handler = ANY($2)`,
+		r.projection, pq.Array(handlerNames),
+	)
+	return err
+}
+
+func (r ProjectionRebuild) report(progress RebuildProgress) {
+	if r.OnProgress != nil {
+		r.OnProgress(progress)
+	}
+}
+
+// rebuildPosition is the last event handled by a rebuild's handler in a partition.
+type rebuildPosition struct {
+	offset    int64
+	eventTime time.Time
+}
+
+// rebuildPositions are positions of the rebuild's handlers, by names of the projection's handlers and partitions.
+type rebuildPositions struct {
+	lock      sync.Mutex
+	positions map[string]map[int32]rebuildPosition
+	count     int64
+
+	// failed receives the first error of a handler, the rebuild fails instead of retrying it forever.
+	failed chan error
+}
+
+func newRebuildPositions() *rebuildPositions {
+	return &rebuildPositions{
+		positions: map[string]map[int32]rebuildPosition{},
+		failed:    make(chan error, 1),
+	}
+}
+
+func (p *rebuildPositions) handled(handler string, msg *message.Message) {
+	partition, _ := kafka.MessagePartitionFromCtx(msg.Context())
+	offset, _ := kafka.MessagePartitionOffsetFromCtx(msg.Context())
+	eventTime, _ := kafka.MessageTimestampFromCtx(msg.Context())
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.positions[handler] == nil {
+		p.positions[handler] = map[int32]rebuildPosition{}
+	}
+	// Redelivered events don't move the position back.
+	if position, ok := p.positions[handler][partition]; !ok || position.offset < offset {
+		p.positions[handler][partition] = rebuildPosition{offset: offset, eventTime: eventTime}
+	}
+	p.count++
+}
+
+func (p *rebuildPositions) fail(err error) {
+	select {
+	case p.failed <- err:
+	default:
+	}
+}
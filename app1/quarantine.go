@@ -0,0 +1,193 @@
+package app
+
+import (
+	"context"
+	stdSQL "database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+// UnmarshalError is returned by handlers when the message payload can't be unmarshaled.
+type UnmarshalError struct {
+	Err error
+}
+
+func (e UnmarshalError) Error() string {
+	return fmt.Sprintf("cannot unmarshal message: %s", e.Err)
+}
+
+func (e UnmarshalError) Unwrap() error {
+	return e.Err
+}
+
+// quarantiningMarshaler marks unmarshaling errors, so corrupted messages can be quarantined
+// instead of being retried.
+type quarantiningMarshaler struct {
+	cqrs.CommandEventMarshaler
+}
+
+func (m quarantiningMarshaler) Unmarshal(msg *message.Message, v any) error {
+	if err := m.CommandEventMarshaler.Unmarshal(msg, v); err != nil {
+		return UnmarshalError{Err: err}
+	}
+
+	return nil
+}
+
+// QuarantinedMessage is a message which couldn't be unmarshaled at all.
+type QuarantinedMessage struct {
+	ID          int64             `json:"id"`
+	MessageUUID string            `json:"message_uuid"`
+	Handler     string            `json:"handler"`
+	Topic       string            `json:"topic"`
+	Error       string            `json:"error"`
+	Metadata    map[string]string `json:"metadata"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// Quarantine keeps raw payloads of messages which can't be unmarshaled.
+// Retrying them makes no sense, as they will never be unmarshaled successfully.
+type Quarantine struct {
+	db *stdSQL.DB
+}
+
+// Middleware quarantines messages which failed with UnmarshalError and acks them.
+func (q Quarantine) Middleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		events, err := h(msg)
+
+		var unmarshalErr UnmarshalError
+		if !errors.As(err, &unmarshalErr) {
+			return events, err
+		}
+
+		if storeErr := q.store(msg.Context(), msg, unmarshalErr); storeErr != nil {
+			return nil, errors.Join(err, fmt.Errorf("cannot quarantine message: %w", storeErr))
+		}
+
+		slog.With("err", err, "message_uuid", msg.UUID).WarnContext(msg.Context(), "Message quarantined")
+
+		return nil, nil
+	}
+}
+
+func (q Quarantine) store(ctx context.Context, msg *message.Message, unmarshalErr UnmarshalError) error {
+	metadata, err := json.Marshal(msg.Metadata)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.db.ExecContext(
+		ctx,
+		`INSERT INTO quarantined_messages (message_uuid, handler, topic, error, metadata, payload)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		msg.UUID,
+		message.HandlerNameFromCtx(ctx),
+		message.SubscribeTopicFromCtx(ctx),
+		unmarshalErr.Err.Error(),
+		metadata,
+		[]byte(msg.Payload),
+	)
+
+	return err
+}
+
+func (q Quarantine) ListHandler(writer http.ResponseWriter, request *http.Request) {
+	rows, err := q.db.QueryContext(
+		request.Context(),
+		`SELECT id, message_uuid, handler, topic, error, metadata, created_at FROM quarantined_messages ORDER BY id`,
+	)
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to list quarantined messages")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	messages := []QuarantinedMessage{}
+	for rows.Next() {
+		var msg QuarantinedMessage
+		var metadata []byte
+
+		err := rows.Scan(&msg.ID, &msg.MessageUUID, &msg.Handler, &msg.Topic, &msg.Error, &metadata, &msg.CreatedAt)
+		if err == nil {
+			err = json.Unmarshal(metadata, &msg.Metadata)
+		}
+		if err != nil {
+			slog.With("err", err).ErrorContext(request.Context(), "Failed to read quarantined message")
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to list quarantined messages")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	server.WriteJSON(request.Context(), writer, http.StatusOK, messages)
+}
+
+// PayloadHandler downloads the raw payload of the quarantined message.
+func (q Quarantine) PayloadHandler(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var messageUUID string
+	var payload []byte
+
+	err = q.db.QueryRowContext(
+		request.Context(),
+		`SELECT message_uuid, payload FROM quarantined_messages WHERE id = $1`,
+		id,
+	).Scan(&messageUUID, &payload)
+	if errors.Is(err, stdSQL.ErrNoRows) {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to get quarantined message")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.bin"`, messageUUID))
+	_, _ = writer.Write(payload)
+}
+
+func (q Quarantine) DeleteHandler(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	result, err := q.db.ExecContext(request.Context(), `DELETE FROM quarantined_messages WHERE id = $1`, id)
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to delete quarantined message")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
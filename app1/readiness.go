@@ -0,0 +1,124 @@
+package app
+
+import (
+	"context"
+	stdSQL "database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/cenkalti/backoff/v4"
+	nc "github.com/nats-io/nats.go"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
+)
+
+// waitUntilReady calls check with exponential backoff until it succeeds, maxWait passes or ctx is cancelled.
+func waitUntilReady(ctx context.Context, dependency string, maxWait time.Duration, check func(ctx context.Context) error) error {
+	logger := slog.With("dependency", dependency)
+
+	expBackoff := backoff.NewExponentialBackOff()
+	expBackoff.InitialInterval = 500 * time.Millisecond
+	expBackoff.MaxInterval = 10 * time.Second
+	expBackoff.MaxElapsedTime = maxWait
+
+	err := backoff.RetryNotify(
+		func() error {
+			return check(ctx)
+		},
+		backoff.WithContext(expBackoff, ctx),
+		func(err error, next time.Duration) {
+			logger.With("err", err, "retry_in", next).InfoContext(ctx, "Waiting for dependency")
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("%s is not ready after %s: %w", dependency, maxWait, err)
+	}
+
+	logger.InfoContext(ctx, "Dependency is ready")
+	return nil
+}
+
+// probeBroker checks if the configured broker accepts connections, it doesn't take longer than ctx allows.
+func probeBroker(ctx context.Context, config Config) error {
+	timeout := probeTimeout(ctx)
+
+	switch config.Broker {
+	case "kafka":
+		saramaConfig := newProbeSaramaConfig(timeout)
+		if err := config.KafkaAuth.Apply(saramaConfig); err != nil {
+			return backoff.Permanent(err)
+		}
+
+		client, err := sarama.NewClient(config.KafkaBrokers, saramaConfig)
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	case "nats":
+		conn, err := nc.Connect(config.NATSURL, nc.Timeout(timeout), nc.NoReconnect())
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	case "amqp":
+		conn, err := amqp091.DialConfig(config.AMQPURL, amqp091.Config{
+			Dial: func(network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				// Bounds the AMQP handshake, amqp091 clears the deadline once the connection is open.
+				if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+					return nil, errors.Join(err, conn.Close())
+				}
+				return conn, nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "redis":
+		return probeRedis(ctx, config.RedisAddr)
+	default:
+		// Postgres is checked separately, Google Cloud Pub/Sub and GoChannel don't need to be checked.
+		return nil
+	}
+}
+
+// probeTimeout returns the time left until ctx's deadline, probes without a deadline time out after 5s.
+func probeTimeout(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 5 * time.Second
+	}
+	return max(time.Until(deadline), time.Millisecond)
+}
+
+func newProbeSaramaConfig(timeout time.Duration) *sarama.Config {
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Net.DialTimeout = timeout
+	saramaConfig.Net.ReadTimeout = timeout
+	saramaConfig.Net.WriteTimeout = timeout
+	saramaConfig.Metadata.Retry.Max = 0
+	return saramaConfig
+}
+
+func probePostgres(ctx context.Context, dsn string) error {
+	db, err := stdSQL.Open("postgres", dsn)
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+
+	return errors.Join(db.PingContext(ctx), db.Close())
+}
+
+func probeRedis(ctx context.Context, addr string) error {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	return errors.Join(client.Ping(ctx).Err(), client.Close())
+}
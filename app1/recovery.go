@@ -0,0 +1,30 @@
+package app
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// recoveryRouterMiddleware converts panics in handlers to errors, so a single bad message
+// doesn't take down the consumer and goes through the retry and dead letter queue instead.
+func recoveryRouterMiddleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) (events []*message.Message, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.With(
+					"panic", r,
+					"message_uuid", msg.UUID,
+					"handler", message.HandlerNameFromCtx(msg.Context()),
+					"stacktrace", string(debug.Stack()),
+				).ErrorContext(msg.Context(), "Recovered from panic in handler")
+
+				err = fmt.Errorf("handler panicked: %v", r)
+			}
+		}()
+
+		return h(msg)
+	}
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisBroker uses Redis Streams.
+//
+// Every topic is a stream with the same name and every consumer group is a Redis consumer group of the stream.
+// Publishers and subscribers close their Redis client on Close, so each of them gets its own client.
+type redisBroker struct {
+	addr      string
+	publisher *redisstream.Publisher
+	logger    watermill.LoggerAdapter
+}
+
+func newRedisBroker(addr string, logger watermill.LoggerAdapter) (*redisBroker, error) {
+	publisher, err := redisstream.NewPublisher(
+		redisstream.PublisherConfig{
+			Client: redis.NewClient(&redis.Options{Addr: addr}),
+		},
+		logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisBroker{
+		addr:      addr,
+		publisher: publisher,
+		logger:    logger,
+	}, nil
+}
+
+func (b *redisBroker) Publisher() message.Publisher {
+	return b.publisher
+}
+
+func (b *redisBroker) NewSubscriber(consumerGroup string, offsetReset OffsetReset) (message.Subscriber, error) {
+	oldestID := "$"
+	if offsetReset == OffsetResetEarliest {
+		oldestID = "0"
+	}
+
+	return redisstream.NewSubscriber(
+		redisstream.SubscriberConfig{
+			Client:        redis.NewClient(&redis.Options{Addr: b.addr}),
+			ConsumerGroup: consumerGroup,
+			OldestId:      oldestID,
+		},
+		b.logger,
+	)
+}
+
+// DeleteConsumerGroup destroys the consumer group of every topic's stream.
+func (b *redisBroker) DeleteConsumerGroup(ctx context.Context, consumerGroup string, topics []string) error {
+	client := redis.NewClient(&redis.Options{Addr: b.addr})
+	defer client.Close()
+
+	var errs []error
+	for _, topic := range topics {
+		if err := client.XGroupDestroy(ctx, topic, consumerGroup).Err(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,346 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const (
+	// replayHandlerMetadataKey is the name of the handler a message replayed to the topic it was published to
+	// is handled by. Messages are replayed to replay topics now, but older replays are kept by the topic.
+	replayHandlerMetadataKey = "replay_handler"
+	// replayedMessageUUIDMetadataKey is the UUID of the message which was replayed.
+	replayedMessageUUIDMetadataKey = "replayed_message_uuid"
+)
+
+// TopicReader is implemented by brokers which keep messages after they are consumed, so they can be replayed.
+type TopicReader interface {
+	// PartitionRanges returns offsets of the topic's messages from the position up to the last published one.
+	PartitionRanges(topic string, from ReadPosition) ([]PartitionRange, error)
+	// ReadPartitions passes messages in the ranges to handle, one partition after another.
+	ReadPartitions(ctx context.Context, topic string, ranges []PartitionRange, handle func(msg *message.Message) error) error
+}
+
+// ReadPosition is where reading of a topic starts.
+type ReadPosition struct {
+	// Offset is the offset in every partition, it's used when Time is zero.
+	Offset int64
+	// Time starts reading at the first message published at or after it.
+	Time time.Time
+}
+
+// PartitionRange are offsets of messages read from a partition.
+type PartitionRange struct {
+	Partition int32 `json:"partition"`
+	From      int64 `json:"from"`
+	// To is the offset after the last read message.
+	To int64 `json:"to"`
+}
+
+func (r PartitionRange) Count() int64 {
+	return max(r.To-r.From, 0)
+}
+
+// ReplayTarget handles replayed messages.
+type ReplayTarget func(ctx context.Context, msg *message.Message) error
+
+// Replay passes messages of the topic from the position to the target.
+//
+// Messages published after the replay started are not replayed, so it always ends.
+type Replay struct {
+	Reader TopicReader
+	Topic  string
+	From   ReadPosition
+	// RateLimit is the maximum number of messages replayed per second, 0 disables the limit.
+	RateLimit int
+	Target    ReplayTarget
+}
+
+// Plan returns offsets of messages which would be replayed, e.g. to check them with a dry run.
+func (r Replay) Plan() ([]PartitionRange, error) {
+	return r.Reader.PartitionRanges(r.Topic, r.From)
+}
+
+// Run replays messages until all are replayed or ctx is cancelled, it returns the number of replayed messages.
+func (r Replay) Run(ctx context.Context) (replayed int, err error) {
+	ranges, err := r.Plan()
+	if err != nil {
+		return 0, err
+	}
+
+	return r.RunRanges(ctx, ranges)
+}
+
+// RunRanges replays messages in the ranges instead of the planned ones, e.g. to replay messages published
+// after the previous replay.
+func (r Replay) RunRanges(ctx context.Context, ranges []PartitionRange) (replayed int, err error) {
+	var limit <-chan time.Time
+	if r.RateLimit > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(r.RateLimit))
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+
+	err = r.Reader.ReadPartitions(ctx, r.Topic, ranges, func(msg *message.Message) error {
+		if limit != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-limit:
+			}
+		}
+
+		if err := r.Target(ctx, msg); err != nil {
+			return fmt.Errorf("could not replay message %s: %w", msg.UUID, err)
+		}
+		replayed++
+
+		return nil
+	})
+
+	return replayed, err
+}
+
+// ReplayToHandler publishes replayed messages to the handler's replay topic, which only the handler subscribes to,
+// so other handlers and consumers of the topic don't receive them again.
+//
+// Replayed messages get a new UUID, so they are not skipped by the Deduplicator. The handler has to be idempotent.
+func ReplayToHandler(publisher message.Publisher, handlerName string) ReplayTarget {
+	return func(ctx context.Context, msg *message.Message) error {
+		replayed := msg.Copy()
+		replayed.UUID = watermill.NewUUID()
+		replayed.SetContext(ctx)
+		replayed.Metadata.Set(replayedMessageUUIDMetadataKey, msg.UUID)
+
+		return publisher.Publish(replayTopic(handlerName), replayed)
+	}
+}
+
+// replayPrefix prefixes replay topics and names of replay handlers.
+const replayPrefix = "replay_"
+
+// replayTopic is the topic of messages replayed to the handler, it's also the name of the handler handling them.
+func replayTopic(handlerName string) string {
+	return replayPrefix + handlerName
+}
+
+// configuredHandlerName returns the name of the handler processing the message, which middlewares are configured by.
+// Replay handlers are configured like the handlers they replay to, e.g. they are not retried when the handler isn't.
+func configuredHandlerName(ctx context.Context) string {
+	return strings.TrimPrefix(message.HandlerNameFromCtx(ctx), replayPrefix)
+}
+
+// addReplayHandlers subscribes command and event handlers to their replay topics.
+// Replayed messages are handled by the same handler function, and middlewares use configuredHandlerName,
+// so they handle replayed messages like messages of the handler's topic.
+func addReplayHandlers(router *message.Router, topology *Topology, broker Broker, config Config) error {
+	handlerFuncs := router.Handlers()
+
+	for _, handler := range topology.Response().Handlers {
+		handlerFunc, ok := handlerFuncs[handler.Name]
+		if !ok {
+			continue
+		}
+
+		// The replay topic has only replayed messages, so the ones replayed before the handler subscribed aren't skipped.
+		subscriber, err := broker.NewSubscriber(consumerGroupName(config, replayTopic(handler.Name)), OffsetResetEarliest)
+		if err != nil {
+			return err
+		}
+
+		router.AddNoPublisherHandler(replayTopic(handler.Name), replayTopic(handler.Name), subscriber, func(msg *message.Message) error {
+			_, err := handlerFunc(msg)
+			return err
+		})
+	}
+
+	return nil
+}
+
+// ReplayToEventHandlers calls event handlers, e.g. of a projection, with replayed events in this process,
+// without publishing them again. Events which the handlers don't handle are skipped.
+//
+// Like with the event processor, handlers can get the replayed message with cqrs.OriginalMessageFromCtx.
+func ReplayToEventHandlers(marshaler cqrs.CommandEventMarshaler, handlers []cqrs.EventHandler) ReplayTarget {
+	return func(ctx context.Context, msg *message.Message) error {
+		name := marshaler.NameFromMessage(msg)
+		ctx = cqrs.CtxWithOriginalMessage(ctx, msg)
+
+		for _, handler := range handlers {
+			event := handler.NewEvent()
+			if marshaler.Name(event) != name {
+				continue
+			}
+
+			if err := marshaler.Unmarshal(msg, event); err != nil {
+				return err
+			}
+			if err := handler.Handle(ctx, event); err != nil {
+				return fmt.Errorf("handler %s failed: %w", handler.HandlerName(), err)
+			}
+		}
+
+		return nil
+	}
+}
+
+// replayRouterMiddleware makes handlers skip messages which older versions replayed to the topic for another handler.
+func replayRouterMiddleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		handler := msg.Metadata.Get(replayHandlerMetadataKey)
+		if handler != "" && handler != message.HandlerNameFromCtx(msg.Context()) {
+			return nil, nil
+		}
+
+		return h(msg)
+	}
+}
+
+func (b *kafkaBroker) newClient() (sarama.Client, error) {
+	saramaConfig := sarama.NewConfig()
+	if err := b.auth.Apply(saramaConfig); err != nil {
+		return nil, err
+	}
+
+	return sarama.NewClient(b.brokers, saramaConfig)
+}
+
+func (b *kafkaBroker) PartitionRanges(topic string, from ReadPosition) ([]PartitionRange, error) {
+	client, err := b.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("could not get partitions of %s: %w", topic, err)
+	}
+
+	ranges := make([]PartitionRange, 0, len(partitions))
+	for _, partition := range partitions {
+		oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return nil, err
+		}
+		newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, err
+		}
+
+		start := max(from.Offset, oldest)
+		if !from.Time.IsZero() {
+			start, err = client.GetOffset(topic, partition, from.Time.UnixMilli())
+			if err != nil {
+				return nil, err
+			}
+			if start < 0 {
+				// No message was published to the partition after the time.
+				start = newest
+			}
+		}
+
+		ranges = append(ranges, PartitionRange{
+			Partition: partition,
+			From:      min(start, newest),
+			To:        newest,
+		})
+	}
+
+	return ranges, nil
+}
+
+func (b *kafkaBroker) ReadPartitions(
+	ctx context.Context,
+	topic string,
+	ranges []PartitionRange,
+	handle func(msg *message.Message) error,
+) error {
+	client, err := b.newClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	for _, partitionRange := range ranges {
+		if partitionRange.Count() == 0 {
+			continue
+		}
+
+		if err := readPartition(ctx, consumer, topic, partitionRange, handle); err != nil {
+			return fmt.Errorf("could not read partition %d of %s: %w", partitionRange.Partition, topic, err)
+		}
+	}
+
+	return nil
+}
+
+// readPartitionIdleTimeout is how long readPartition waits for a message after the last one before it checks
+// whether the rest of the range has no messages.
+const readPartitionIdleTimeout = 5 * time.Second
+
+func readPartition(
+	ctx context.Context,
+	consumer sarama.Consumer,
+	topic string,
+	partitionRange PartitionRange,
+	handle func(msg *message.Message) error,
+) error {
+	partitionConsumer, err := consumer.ConsumePartition(topic, partitionRange.Partition, partitionRange.From)
+	if err != nil {
+		return err
+	}
+	defer partitionConsumer.Close()
+
+	unmarshaler := kafka.DefaultMarshaler{}
+
+	// Offsets at the end of the range may have no messages (transaction markers, compaction or retention),
+	// so reading also ends when the partition is read up to its high water mark and no message comes.
+	idle := time.NewTicker(readPartitionIdleTimeout)
+	defer idle.Stop()
+	received := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case kafkaMsg, ok := <-partitionConsumer.Messages():
+			if !ok {
+				return fmt.Errorf("partition %d of %s was closed while reading", partitionRange.Partition, topic)
+			}
+			received = true
+
+			msg, err := unmarshaler.Unmarshal(kafkaMsg)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal message at offset %d: %w", kafkaMsg.Offset, err)
+			}
+
+			if err := handle(msg); err != nil {
+				return err
+			}
+
+			if kafkaMsg.Offset+1 >= partitionRange.To {
+				return nil
+			}
+		case <-idle.C:
+			if !received && partitionConsumer.HighWaterMarkOffset() >= partitionRange.To {
+				return nil
+			}
+			received = false
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestReplayHandler_replayed_payments_message_is_not_retried(t *testing.T) {
+	attempts := runTestRouter(
+		t,
+		replayTopic("payments"),
+		DeadLetterQueue{NoRetry: []string{"payments"}},
+		errors.New("payment failed"),
+		message.NewMessage(watermill.NewUUID(), nil),
+	)
+
+	if attempts != 1 {
+		t.Errorf("handler was called %d times, want 1", attempts)
+	}
+}
@@ -0,0 +1,272 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roblaszczak/watermill-livecoding/internal/common/outbox"
+)
+
+// cronDescriptors are shorthands of common cron expressions.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// CronSchedule is a cron expression with minute, hour, day of month, month and day of week fields,
+// for example "0 0 * * *" is every midnight. Fields support *, lists, ranges and steps (e.g. "*/15" or "1-5").
+//
+// Like in cron, when both day of month and day of week are restricted, days matching either of them are used.
+type CronSchedule struct {
+	expr string
+
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+
+	anyDay     bool
+	anyWeekday bool
+}
+
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12},
+	// 7 is Sunday as well as 0
+	{name: "day of week", min: 0, max: 7},
+}
+
+func ParseCronSchedule(expr string) (CronSchedule, error) {
+	fieldsExpr := expr
+	if descriptor, ok := cronDescriptors[expr]; ok {
+		fieldsExpr = descriptor
+	}
+
+	fields := strings.Fields(fieldsExpr)
+	if len(fields) != len(cronFields) {
+		return CronSchedule{}, fmt.Errorf("cron expression %q must have %d fields", expr, len(cronFields))
+	}
+
+	bits := make([]uint64, len(cronFields))
+	for i, field := range cronFields {
+		var err error
+		bits[i], err = parseCronField(fields[i], field)
+		if err != nil {
+			return CronSchedule{}, fmt.Errorf("invalid %s of cron expression %q: %w", field.name, expr, err)
+		}
+	}
+
+	weekdays := bits[4]
+	if weekdays&(1<<7) != 0 {
+		weekdays |= 1
+	}
+
+	schedule := CronSchedule{
+		expr:       expr,
+		minutes:    bits[0],
+		hours:      bits[1],
+		days:       bits[2],
+		months:     bits[3],
+		weekdays:   weekdays,
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return CronSchedule{}, fmt.Errorf("cron expression %q never matches", expr)
+	}
+
+	return schedule, nil
+}
+
+func parseCronField(s string, field cronField) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(s, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepExpr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepExpr)
+			}
+		}
+
+		from, to := field.min, field.max
+		switch {
+		case rangeExpr == "*":
+		case strings.Contains(rangeExpr, "-"):
+			fromExpr, toExpr, _ := strings.Cut(rangeExpr, "-")
+			var err error
+			if from, err = strconv.Atoi(fromExpr); err != nil {
+				return 0, fmt.Errorf("invalid value %q", fromExpr)
+			}
+			if to, err = strconv.Atoi(toExpr); err != nil {
+				return 0, fmt.Errorf("invalid value %q", toExpr)
+			}
+		default:
+			value, err := strconv.Atoi(rangeExpr)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rangeExpr)
+			}
+			from = value
+			if !hasStep {
+				to = value
+			}
+		}
+
+		if from < field.min || to > field.max || from > to {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, field.min, field.max)
+		}
+
+		for value := from; value <= to; value += step {
+			bits |= 1 << value
+		}
+	}
+
+	return bits, nil
+}
+
+func (s CronSchedule) String() string {
+	return s.expr
+}
+
+func (s CronSchedule) matchesDay(t time.Time) bool {
+	day := s.days&(1<<t.Day()) != 0
+	weekday := s.weekdays&(1<<int(t.Weekday())) != 0
+
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+// Next returns the first time matching the schedule after t, in t's location.
+// It returns zero time if the schedule doesn't match within five years, e.g. for February 30th.
+func (s CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case s.months&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hours&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minutes&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// ScheduledJob publishes the event returned by Event at times of Schedule.
+type ScheduledJob struct {
+	Name     string
+	Schedule CronSchedule
+	// Event returns the event published for the run scheduled at scheduledAt.
+	Event func(scheduledAt time.Time) any
+}
+
+// Scheduler publishes events of ScheduledJobs, so time-driven workflows are handled like other events.
+//
+// Runs are recorded in the scheduled_runs table in the same transaction as the event is published with the outbox,
+// so when many instances run the scheduler, each run is published once.
+// Runs missed while no instance was running are not caught up. Schedules are in UTC.
+type Scheduler struct {
+	outbox outbox.Outbox
+	jobs   []ScheduledJob
+}
+
+// Run publishes events of jobs when they are due until ctx is cancelled.
+func (s Scheduler) Run(ctx context.Context) error {
+	if len(s.jobs) == 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	now := time.Now().UTC()
+	next := make([]time.Time, len(s.jobs))
+	for i, job := range s.jobs {
+		next[i] = job.Schedule.Next(now)
+	}
+
+	for {
+		timer := time.NewTimer(time.Until(slices.MinFunc(next, time.Time.Compare)))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		for i, job := range s.jobs {
+			if next[i].After(time.Now()) {
+				continue
+			}
+
+			if err := s.publish(ctx, job, next[i]); err != nil {
+				slog.With("err", err, "job", job.Name, "scheduled_at", next[i]).ErrorContext(ctx, "Failed to publish scheduled event, the run is skipped")
+			}
+
+			next[i] = job.Schedule.Next(next[i])
+		}
+	}
+}
+
+func (s Scheduler) publish(ctx context.Context, job ScheduledJob, scheduledAt time.Time) error {
+	return s.outbox.InTx(ctx, func(tx outbox.Tx) error {
+		result, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO scheduled_runs (job, scheduled_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			job.Name, scheduledAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if inserted == 0 {
+			// published by another instance
+			return nil
+		}
+
+		slog.With("job", job.Name, "scheduled_at", scheduledAt).InfoContext(ctx, "Publishing scheduled event")
+
+		return tx.EventBus.Publish(ctx, job.Event(scheduledAt))
+	})
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"slices"
+)
+
+// Service is a binary built from the app, which runs a part of its handlers.
+// All services share the database and the broker, and commands and events from the contracts package.
+type Service struct {
+	// Name is the default SERVICE_NAME, it's the producer of events and a part of consumer group names.
+	Name string
+	// Handlers are registered by default, HANDLERS_ENABLED and HANDLERS_DISABLED override them.
+	Handlers HandlerFlags
+	// Components are run by the service, all of them are run when it's empty.
+	Components []Component
+}
+
+// Component is a background component or a group of HTTP routes, which is run only by the service owning it,
+// so services sharing the database don't run it more than once.
+type Component string
+
+const (
+	// ComponentOutboxForwarder forwards messages stored in the outbox by all services.
+	ComponentOutboxForwarder Component = "outbox_forwarder"
+	// ComponentDelayedDelivery delivers delayed messages stored by all services.
+	ComponentDelayedDelivery Component = "delayed_delivery"
+	// ComponentScheduler publishes scheduled events, like DailyReportRequested.
+	ComponentScheduler             Component = "scheduler"
+	ComponentStuckBookings         Component = "stuck_bookings"
+	ComponentProjectionCheckpoints Component = "projection_checkpoints"
+	// ComponentConsumerLag exports the consumer lag of the service's handlers.
+	ComponentConsumerLag Component = "consumer_lag"
+
+	ComponentBookingsAPI  Component = "bookings_api"
+	ComponentPaymentsAPI  Component = "payments_api"
+	ComponentReportingAPI Component = "reporting_api"
+)
+
+var (
+	// PaymentsHandlers charge and refund guests.
+	PaymentsHandlers = []string{"payments", "payments_*", "refund_payment", "charge_amendment"}
+	// ReportingHandlers build reports and invoices from events of other services.
+	ReportingHandlers = []string{"revenue_report_*", "invoicing_*", "promo_codes_report"}
+)
+
+var (
+	// MonolithService runs all handlers in one binary.
+	MonolithService = Service{Name: "app1"}
+
+	// BookingsService forwards the outbox and delivers delayed messages of all services, as they share the database.
+	BookingsService = Service{
+		Name:     "bookings",
+		Handlers: HandlerFlags{Disabled: slices.Concat(PaymentsHandlers, ReportingHandlers)},
+		Components: []Component{
+			ComponentOutboxForwarder,
+			ComponentDelayedDelivery,
+			ComponentStuckBookings,
+			ComponentProjectionCheckpoints,
+			ComponentConsumerLag,
+			ComponentBookingsAPI,
+		},
+	}
+	PaymentsService = Service{
+		Name:       "payments",
+		Handlers:   HandlerFlags{Enabled: PaymentsHandlers},
+		Components: []Component{ComponentConsumerLag, ComponentPaymentsAPI},
+	}
+	ReportingService = Service{
+		Name:       "reporting",
+		Handlers:   HandlerFlags{Enabled: ReportingHandlers},
+		Components: []Component{ComponentScheduler, ComponentConsumerLag, ComponentReportingAPI},
+	}
+)
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// SlackAlerts posts alerts about failing payments, stuck bookings and dead letters to a Slack incoming webhook.
+type SlackAlerts struct {
+	webhookURL string
+	httpClient *http.Client
+}
+
+func NewSlackAlerts(webhookURL string) SlackAlerts {
+	return SlackAlerts{
+		webhookURL: webhookURL,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (a SlackAlerts) OnPaymentFailed(ctx context.Context, event *PaymentFailed) error {
+	return a.post(ctx, fmt.Sprintf(
+		":rotating_light: *Payment failed* for booking `%s`\n>%s",
+		event.BookingID, event.Reason,
+	))
+}
+
+func (a SlackAlerts) OnBookingStuck(ctx context.Context, event *BookingStuck) error {
+	return a.post(ctx, fmt.Sprintf(
+		":hourglass: *Booking stuck* `%s`, payment has no outcome since %s",
+		event.BookingID, event.BookedAt.Format(time.RFC3339),
+	))
+}
+
+// OnDeadLetter handles messages from dead letter topics.
+func (a SlackAlerts) OnDeadLetter(msg *message.Message) error {
+	return a.post(msg.Context(), fmt.Sprintf(
+		":skull: *Message moved to the dead letter queue* by `%s` after %s attempts\nTopic: `%s`, message: `%s`, booking: `%s`\n>%s",
+		msg.Metadata.Get(deadLetterHandlerKey),
+		msg.Metadata.Get(deadLetterAttemptsKey),
+		msg.Metadata.Get(deadLetterTopicKey),
+		msg.UUID,
+		msg.Metadata.Get(bookingIDMetadataKey),
+		msg.Metadata.Get(deadLetterReasonKey),
+	))
+}
+
+func (a SlackAlerts) post(ctx context.Context, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not post Slack alert: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not post Slack alert: unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// addDeadLetterAlertHandlers adds handlers alerting about messages moved to dead letter topics
+// of all handlers already added to router.
+func addDeadLetterAlertHandlers(router *message.Router, alerts SlackAlerts, broker Broker, config Config) error {
+	for _, handlerName := range slices.Sorted(maps.Keys(router.Handlers())) {
+		alertHandlerName := "slack_alerts_" + deadLetterTopic(handlerName)
+
+		subscriber, err := newHandlerSubscriber(broker, config, alertHandlerName)
+		if err != nil {
+			return err
+		}
+
+		router.AddNoPublisherHandler(alertHandlerName, deadLetterTopic(handlerName), subscriber, alerts.OnDeadLetter)
+	}
+
+	return nil
+}
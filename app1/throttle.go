@@ -0,0 +1,36 @@
+package app
+
+import (
+	"slices"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+)
+
+// HandlerThrottle limits how many messages per second are processed by Handlers together.
+//
+// Throttled handlers block, so they stop fetching new messages and unprocessed messages wait in Kafka.
+type HandlerThrottle struct {
+	Handlers []string
+	Throttle *middleware.Throttle
+}
+
+func NewHandlerThrottle(handlers []string, perSecond int64) HandlerThrottle {
+	return HandlerThrottle{
+		Handlers: handlers,
+		Throttle: middleware.NewThrottle(perSecond, time.Second),
+	}
+}
+
+func (t HandlerThrottle) Middleware(h message.HandlerFunc) message.HandlerFunc {
+	throttled := t.Throttle.Middleware(h)
+
+	return func(msg *message.Message) ([]*message.Message, error) {
+		if slices.Contains(t.Handlers, configuredHandlerName(msg.Context())) {
+			return throttled(msg)
+		}
+
+		return h(msg)
+	}
+}
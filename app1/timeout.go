@@ -0,0 +1,42 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// HandlerTimeouts limits how long a handler can process a single message, so a hanging
+// dependency can't stall the partition. Expired handlers return an error, so the message is retried.
+type HandlerTimeouts struct {
+	Default    time.Duration
+	PerHandler map[string]time.Duration
+}
+
+func (t HandlerTimeouts) Middleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		timeout := t.Default
+		if handlerTimeout, ok := t.PerHandler[configuredHandlerName(msg.Context())]; ok {
+			timeout = handlerTimeout
+		}
+
+		parent := msg.Context()
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		defer cancel()
+
+		// The context is put back, so middlewares retrying the handler or storing the message after it
+		// don't get the cancelled one.
+		msg.SetContext(ctx)
+		defer msg.SetContext(parent)
+
+		events, err := h(msg)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, errors.Join(fmt.Errorf("handler timed out after %s", timeout), err)
+		}
+
+		return events, err
+	}
+}
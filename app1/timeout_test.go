@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+)
+
+// testDeadLetterStore fails with cancelled contexts, like DeadLetterStore does.
+type testDeadLetterStore struct {
+	lock   sync.Mutex
+	stored []*message.Message
+}
+
+func (s *testDeadLetterStore) Store(ctx context.Context, msg *message.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stored = append(s.stored, msg)
+	return nil
+}
+
+func (s *testDeadLetterStore) Stored() []*message.Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.stored
+}
+
+// runTestRouter runs the router with the dead letter queue and handler timeouts, like Container.Router does,
+// and the handler failing with handlerErr on every attempt. NoRetry and PermanentErrors of dlq are used,
+// the rest is set up by the test. It returns the number of attempts when the message was dead-lettered.
+func runTestRouter(t *testing.T, handlerName string, dlq DeadLetterQueue, handlerErr error, msg *message.Message) int32 {
+	t.Helper()
+
+	logger := watermill.NopLogger{}
+	pubSub := gochannel.NewGoChannel(gochannel.Config{}, logger)
+	t.Cleanup(func() { _ = pubSub.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	deadLetters, err := pubSub.Subscribe(ctx, deadLetterTopic(handlerName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &testDeadLetterStore{}
+	router, err := message.NewRouter(message.RouterConfig{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dlq.Retry = RetrySettings{
+		MaxRetries:      2,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond,
+		Multiplier:      1,
+	}.Middleware(logger)
+	dlq.Publisher = pubSub
+	dlq.Store = store
+	dlq.Logger = logger
+
+	router.AddMiddleware(dlq.Middleware)
+	router.AddMiddleware(HandlerTimeouts{Default: time.Second}.Middleware)
+
+	var attempts atomic.Int32
+	router.AddNoPublisherHandler(handlerName, "test_topic", pubSub, func(msg *message.Message) error {
+		attempts.Add(1)
+		return handlerErr
+	})
+
+	go func() {
+		if err := router.Run(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	<-router.Running()
+
+	if err := pubSub.Publish("test_topic", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case deadLetter := <-deadLetters:
+		deadLetter.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message was not moved to the dead letter queue after %d attempts", attempts.Load())
+	}
+
+	if stored := store.Stored(); len(stored) != 1 {
+		t.Fatalf("stored %d dead letters, want 1", len(stored))
+	}
+
+	return attempts.Load()
+}
+
+func TestHandlerTimeouts_failing_handler_is_retried_and_dead_lettered(t *testing.T) {
+	attempts := runTestRouter(
+		t,
+		"failing_handler",
+		DeadLetterQueue{},
+		errors.New("handler failed"),
+		message.NewMessage(watermill.NewUUID(), nil),
+	)
+
+	if attempts != 3 {
+		t.Errorf("handler was called %d times, want 3", attempts)
+	}
+}
@@ -0,0 +1,153 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// commands are sent by the app, every command has its own topic.
+var commands = []any{
+	BookRoom{},
+	CancelBooking{},
+	RefundPayment{},
+	ExpireBooking{},
+	AmendBooking{},
+	ChargeAmendment{},
+	RevertAmendment{},
+	ForgetGuest{},
+}
+
+// events are published by the app, every event has its own topic.
+var events = []any{
+	AmendmentPaymentFailed{},
+	AmendmentPaymentTaken{},
+	AmendmentRejected{},
+	AmendmentReverted{},
+	BookingAmended{},
+	BookingCancelled{},
+	BookingConfirmed{},
+	BookingExpired{},
+	BookingFailed{},
+	BookingStuck{},
+	CheckInReminder{},
+	DailyReportRequested{},
+	DiscountApplied{},
+	GuestForgotten{},
+	GuestRegistered{},
+	InvoiceIssued{},
+	LoyaltyPointsEarned{},
+	PaymentFailed{},
+	PaymentRefunded{},
+	PaymentTaken{},
+	PaymentsDegraded{},
+	RefundRejected{},
+	RoomBooked{},
+	RoomUnavailable{},
+}
+
+// MessageNames returns sorted names of commands and events of the app, which are also names of their topics.
+func MessageNames() []string {
+	var names []string
+	for _, v := range slices.Concat(commands, events) {
+		names = append(names, cqrs.StructName(v))
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+// IsCommand reports whether name is the name of a command, other messages returned by MessageNames are events.
+func IsCommand(name string) bool {
+	return slices.ContainsFunc(commands, func(v any) bool {
+		return cqrs.StructName(v) == name
+	})
+}
+
+// NewMessage returns a pointer to a new command or event with the name, false if the app has no such message.
+func NewMessage(name string) (any, bool) {
+	for _, v := range slices.Concat(commands, events) {
+		if cqrs.StructName(v) == name {
+			return reflect.New(reflect.TypeOf(v)).Interface(), true
+		}
+	}
+
+	return nil, false
+}
+
+// TopicProvisioner is implemented by brokers which can create topics before they are used.
+type TopicProvisioner interface {
+	ProvisionTopics(topics []string) error
+}
+
+// TopicSettings are used for topics created at startup.
+type TopicSettings struct {
+	Partitions        int32
+	ReplicationFactor int16
+	// Retention is how long messages are kept, 0 keeps them forever.
+	Retention time.Duration
+}
+
+// appTopics returns all topics used by the app: topics of all commands and events, including the ones
+// handlers registered in the topology subscribe to and their replay topics, replies and dead letter topics of router's handlers.
+func appTopics(router *message.Router, topology *Topology) []string {
+	topics := MessageNames()
+	topics = append(topics, bookingRepliesTopic)
+
+	for _, handler := range topology.Response().Handlers {
+		topics = append(topics, handler.Subscribes, replayTopic(handler.Name))
+	}
+
+	for handlerName := range router.Handlers() {
+		topics = append(topics, deadLetterTopic(handlerName))
+	}
+
+	slices.Sort(topics)
+	return slices.Compact(topics)
+}
+
+// ProvisionTopics creates topics which don't exist yet, existing topics are not changed.
+func (b *kafkaBroker) ProvisionTopics(topics []string) error {
+	saramaConfig := sarama.NewConfig()
+	if err := b.auth.Apply(saramaConfig); err != nil {
+		return err
+	}
+
+	admin, err := sarama.NewClusterAdmin(b.brokers, saramaConfig)
+	if err != nil {
+		return fmt.Errorf("could not connect to Kafka: %w", err)
+	}
+	defer admin.Close()
+
+	retention := "-1"
+	if b.topicSettings.Retention > 0 {
+		retention = fmt.Sprint(b.topicSettings.Retention.Milliseconds())
+	}
+
+	for _, topic := range topics {
+		err := admin.CreateTopic(topic, &sarama.TopicDetail{
+			NumPartitions:     b.topicSettings.Partitions,
+			ReplicationFactor: b.topicSettings.ReplicationFactor,
+			ConfigEntries: map[string]*string{
+				"retention.ms": &retention,
+			},
+		}, false)
+		if errors.Is(err, sarama.ErrTopicAlreadyExists) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not create topic %s: %w", topic, err)
+		}
+
+		slog.With("topic", topic).Info("Topic created")
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/roblaszczak/watermill-livecoding/internal/common/server"
+)
+
+// topologyOutsideHandlers is the publisher of messages published outside of handlers, e.g. by HTTP endpoints.
+const topologyOutsideHandlers = "api"
+
+// TopologyHandler is a handler with the topic it subscribes to and topics it published to.
+type TopologyHandler struct {
+	Name          string   `json:"name"`
+	Kind          string   `json:"kind"`
+	Subscribes    string   `json:"subscribes"`
+	ConsumerGroup string   `json:"consumer_group"`
+	Publishes     []string `json:"publishes"`
+}
+
+type TopologyResponse struct {
+	Handlers []TopologyHandler `json:"handlers"`
+	// PublishedOutsideHandlers are topics published to by HTTP endpoints and background jobs.
+	PublishedOutsideHandlers []string `json:"published_outside_handlers"`
+}
+
+// Topology describes which handlers subscribe to which topics and where they publish.
+//
+// Subscriptions are known when handlers are added, but what handlers publish depends on the messages
+// they handle, so it's recorded by the buses while the app runs and is only known for this instance.
+type Topology struct {
+	config Config
+
+	lock      sync.Mutex
+	handlers  []TopologyHandler
+	published map[string]map[string]struct{}
+}
+
+func NewTopology(config Config) *Topology {
+	return &Topology{
+		config:    config,
+		published: map[string]map[string]struct{}{},
+	}
+}
+
+func (t *Topology) AddCommandHandlers(handlers []cqrs.CommandHandler) {
+	for _, handler := range handlers {
+		t.addHandler("command", handler.HandlerName(), handler.NewCommand())
+	}
+}
+
+func (t *Topology) AddEventHandlers(handlers []cqrs.EventHandler) {
+	for _, handler := range handlers {
+		t.addHandler("event", handler.HandlerName(), handler.NewEvent())
+	}
+}
+
+func (t *Topology) addHandler(kind string, handlerName string, v any) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.handlers = append(t.handlers, TopologyHandler{
+		Name:          handlerName,
+		Kind:          kind,
+		Subscribes:    cqrs.StructName(v),
+		ConsumerGroup: consumerGroupName(t.config, handlerName),
+	})
+}
+
+// RecordPublished records that the handler from the context published to the topic.
+func (t *Topology) RecordPublished(ctx context.Context, topic string) {
+	handlerName := message.HandlerNameFromCtx(ctx)
+	if handlerName == "" {
+		handlerName = topologyOutsideHandlers
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.published[handlerName] == nil {
+		t.published[handlerName] = map[string]struct{}{}
+	}
+	t.published[handlerName][topic] = struct{}{}
+}
+
+func (t *Topology) Response() TopologyResponse {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	resp := TopologyResponse{
+		Handlers:                 make([]TopologyHandler, 0, len(t.handlers)),
+		PublishedOutsideHandlers: slices.Sorted(maps.Keys(t.published[topologyOutsideHandlers])),
+	}
+	for _, handler := range t.handlers {
+		handler.Publishes = slices.Sorted(maps.Keys(t.published[handler.Name]))
+		resp.Handlers = append(resp.Handlers, handler)
+	}
+	slices.SortFunc(resp.Handlers, func(a, b TopologyHandler) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return resp
+}
+
+// Handler returns the topology as JSON, or as Graphviz DOT with ?format=dot:
+//
+//	curl localhost:8080/admin/topology?format=dot | dot -Tsvg > topology.svg
+func (t *Topology) Handler(writer http.ResponseWriter, request *http.Request) {
+	resp := t.Response()
+
+	if request.URL.Query().Get("format") != "dot" {
+		server.WriteJSON(request.Context(), writer, http.StatusOK, resp)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "text/vnd.graphviz")
+	_, _ = fmt.Fprint(writer, resp.DOT())
+}
+
+// DOT returns the topology as a Graphviz graph with topics as ellipses and handlers as boxes.
+func (r TopologyResponse) DOT() string {
+	var b strings.Builder
+
+	b.WriteString("digraph topology {\n")
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=ellipse];\n")
+
+	fmt.Fprintf(&b, "\t%q [shape=box, style=dashed];\n", topologyOutsideHandlers)
+	for _, topic := range r.PublishedOutsideHandlers {
+		fmt.Fprintf(&b, "\t%q -> %q;\n", topologyOutsideHandlers, topic)
+	}
+
+	for _, handler := range r.Handlers {
+		fmt.Fprintf(&b, "\t%q [shape=box, tooltip=%q];\n", handler.Name, "consumer group: "+handler.ConsumerGroup)
+		fmt.Fprintf(&b, "\t%q -> %q;\n", handler.Subscribes, handler.Name)
+		for _, topic := range handler.Publishes {
+			fmt.Fprintf(&b, "\t%q -> %q;\n", handler.Name, topic)
+		}
+	}
+
+	b.WriteString("}\n")
+
+	return b.String()
+}
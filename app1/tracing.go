@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"os"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/roblaszczak/watermill-livecoding")
+
+// newTracerProvider configures the global tracer provider exporting spans with OTLP.
+// The exporter is configured with the standard OTEL_EXPORTER_OTLP_* environment variables,
+// tracing is disabled when OTEL_EXPORTER_OTLP_ENDPOINT is not set.
+func newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var opts []sdktrace.TracerProviderOption
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+
+	return tp, nil
+}
+
+// tracingPublisher starts a producer span for every published message
+// and passes the trace context to consumers in the message metadata.
+type tracingPublisher struct {
+	message.Publisher
+}
+
+func (p tracingPublisher) Publish(topic string, messages ...*message.Message) error {
+	spans := make([]trace.Span, 0, len(messages))
+
+	for _, msg := range messages {
+		ctx, span := tracer.Start(
+			msg.Context(),
+			"publish "+topic,
+			trace.WithSpanKind(trace.SpanKindProducer),
+		)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(msg.Metadata))
+
+		spans = append(spans, span)
+	}
+
+	err := p.Publisher.Publish(topic, messages...)
+
+	for _, span := range spans {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+
+	return err
+}
+
+// tracingRouterMiddleware starts a consumer span for every handled message,
+// continuing the trace from the message metadata.
+func tracingRouterMiddleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		ctx := otel.GetTextMapPropagator().Extract(msg.Context(), propagation.MapCarrier(msg.Metadata))
+
+		ctx, span := tracer.Start(
+			ctx,
+			"handle "+message.HandlerNameFromCtx(ctx),
+			trace.WithSpanKind(trace.SpanKindConsumer),
+		)
+		defer span.End()
+
+		msg.SetContext(ctx)
+
+		events, err := h(msg)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		return events, err
+	}
+}
@@ -0,0 +1,35 @@
+package app
+
+import (
+	"reflect"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/roblaszczak/watermill-livecoding/internal/webhooks"
+)
+
+// addWebhookDispatcherHandlers adds a handler dispatching every event of streamedEvents to webhooks.
+func addWebhookDispatcherHandlers(
+	router *message.Router,
+	dispatcher webhooks.Dispatcher,
+	marshaler cqrs.CommandEventMarshaler,
+	broker Broker,
+	config Config,
+) error {
+	for _, event := range streamedEvents {
+		name := marshaler.Name(event)
+		handlerName := "webhooks_" + name
+		if !config.Handlers.IsEnabled(handlerName) {
+			continue
+		}
+
+		subscriber, err := newHandlerSubscriber(broker, config, handlerName)
+		if err != nil {
+			return err
+		}
+
+		router.AddNoPublisherHandler(handlerName, name, subscriber, dispatcher.Handler(reflect.TypeOf(event)))
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	// The live demo page can be served from anywhere.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WebSocketHandler pushes all events as pretty-printed JSON to the connected WebSocket client,
+// so the event flow can be watched live without tailing Kafka.
+func (s EventsStream) WebSocketHandler(writer http.ResponseWriter, request *http.Request) {
+	conn, err := upgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		slog.With("err", err).ErrorContext(request.Context(), "Failed to upgrade WebSocket connection")
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+
+	events, err := s.Subscribe(ctx)
+	if err != nil {
+		slog.With("err", err).ErrorContext(ctx, "Failed to subscribe to events")
+		return
+	}
+
+	// Reading is needed to notice that the client closed the connection.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			b, err := json.MarshalIndent(event, "", "  ")
+			if err != nil {
+				continue
+			}
+
+			if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				return
+			}
+		}
+	}
+}